@@ -0,0 +1,347 @@
+package main
+
+// MIT Licensed - see LICENSE
+
+import (
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/pschlump/json"
+	"github.com/pschlump/uuid"
+)
+
+// AlertRule is one alert on a QR code.  The rules for a code are stored as a JSON array in qr-alert:{id}
+// and the IDs that have rules are kept in the set qr-alert-ids.
+//
+//	threshold - fires once when the total scans reach Threshold.
+//	spike     - fires when the scans in one interval are more than Factor times the baseline (and at least MinScans).
+//	silent    - fires when a code with a baseline of at least MinScans per interval has had no scans for Intervals intervals.
+type AlertRule struct {
+	Kind      string  `json:"kind"`
+	Threshold int64   `json:"threshold,omitempty"`
+	Factor    float64 `json:"factor,omitempty"`
+	MinScans  int64   `json:"min_scans,omitempty"`
+	Intervals int     `json:"intervals,omitempty"`
+	Webhook   string  `json:"webhook"`
+}
+
+// AlertState is what the evaluator remembers about a QR between passes.  It is kept in qr-alert-state:{id}
+// so that a restart does not lose the baseline.
+type AlertState struct {
+	LastCount int64   `json:"last_count"`
+	Baseline  float64 `json:"baseline"` // moving average of scans per interval
+	Samples   int     `json:"samples"`  // number of intervals seen
+	Quiet     int     `json:"quiet"`    // consecutive intervals with no scans
+	Fired     []bool  `json:"fired"`    // per rule, true while the condition is still met so it only fires once
+}
+
+// AlertEvent is the body of an alert webhook.
+type AlertEvent struct {
+	Event    string    `json:"event"`
+	ID       string    `json:"id"`
+	Kind     string    `json:"kind"`
+	Count    int64     `json:"count"`
+	Delta    int64     `json:"delta"`
+	Baseline float64   `json:"baseline"`
+	Msg      string    `json:"msg"`
+	Time     time.Time `json:"time"`
+	Webhook  string    `json:"-"`
+}
+
+// AlertDelivery is one entry in the delivery log, qr-alert-log:{id}.
+type AlertDelivery struct {
+	Event  AlertEvent `json:"event"`
+	URL    string     `json:"url"`
+	Status int        `json:"status"`
+	Tries  int        `json:"tries"`
+	Error  string     `json:"error,omitempty"`
+	Time   time.Time  `json:"time"`
+}
+
+const alertWarmup = 3     // intervals of history needed before spike and silent rules are checked
+const alertAlpha = 0.2    // weight of the newest interval in the baseline
+const alertDfltFactor = 5 // spike factor if none is given
+const alertDfltQuiet = 3  // silent intervals if none is given
+
+// ValidateAlertRules checks the rules and fills in defaults.
+func ValidateAlertRules(rules []AlertRule) error {
+	for ii := range rules {
+		r := &rules[ii]
+		if r.Webhook == "" {
+			return fmt.Errorf("Rule %d: missing webhook", ii)
+		}
+		if err := CheckWebhookURL(r.Webhook); err != nil {
+			return fmt.Errorf("Rule %d: %s", ii, err)
+		}
+		switch r.Kind {
+		case "threshold":
+			if r.Threshold <= 0 {
+				return fmt.Errorf("Rule %d: threshold must be greater than 0", ii)
+			}
+		case "spike":
+			if r.Factor <= 1 {
+				r.Factor = alertDfltFactor
+			}
+			if r.MinScans <= 0 {
+				r.MinScans = 1
+			}
+		case "silent":
+			if r.Intervals <= 0 {
+				r.Intervals = alertDfltQuiet
+			}
+			if r.MinScans <= 0 {
+				r.MinScans = 1
+			}
+		default:
+			return fmt.Errorf("Rule %d: invalid kind %q", ii, r.Kind)
+		}
+	}
+	return nil
+}
+
+// EvalAlerts takes the current scan count for id, updates st and returns the alerts that fire.
+func EvalAlerts(id string, rules []AlertRule, st *AlertState, count int64, now time.Time) (rv []AlertEvent) {
+	if len(st.Fired) != len(rules) {
+		st.Fired = make([]bool, len(rules))
+	}
+	var delta int64
+	if st.Samples > 0 {
+		delta = count - st.LastCount
+		if delta < 0 { // counter was reset
+			delta = 0
+		}
+	}
+	warm := st.Samples >= alertWarmup
+	quiet := 0
+	if st.Samples > 0 && delta == 0 {
+		quiet = st.Quiet + 1
+	}
+
+	fire := func(ii int, cond bool, msg string) {
+		if cond && !st.Fired[ii] {
+			rv = append(rv, AlertEvent{Event: "qr.alert", ID: id, Kind: rules[ii].Kind, Count: count, Delta: delta,
+				Baseline: st.Baseline, Msg: msg, Time: now, Webhook: rules[ii].Webhook})
+		}
+		st.Fired[ii] = cond
+	}
+
+	for ii, r := range rules {
+		switch r.Kind {
+		case "threshold":
+			fire(ii, count >= r.Threshold, fmt.Sprintf("%d scans reached threshold of %d", count, r.Threshold))
+		case "spike":
+			base := st.Baseline
+			if base < 1 {
+				base = 1
+			}
+			fire(ii, warm && delta >= r.MinScans && float64(delta) > r.Factor*base,
+				fmt.Sprintf("%d scans in one interval against a baseline of %.1f", delta, st.Baseline))
+		case "silent":
+			fire(ii, warm && st.Baseline >= float64(r.MinScans) && quiet >= r.Intervals,
+				fmt.Sprintf("no scans for %d intervals against a baseline of %.1f", quiet, st.Baseline))
+		}
+	}
+
+	// The baseline is not moved during a quiet streak so that a silent code is still compared to its normal traffic.
+	if st.Samples > 0 && delta > 0 {
+		if st.Samples == 1 {
+			st.Baseline = float64(delta)
+		} else {
+			st.Baseline = alertAlpha*float64(delta) + (1-alertAlpha)*st.Baseline
+		}
+	}
+	st.Quiet = quiet
+	st.LastCount = count
+	st.Samples++
+	return
+}
+
+// AlertEvaluator checks the alert rules every interval until the workers are stopped.
+func AlertEvaluator(interval time.Duration) {
+	for sleepOrStop(interval) {
+		RunAlertPass(time.Now())
+	}
+}
+
+// RunAlertPass checks every QR that has alert rules against its scan counter and sends any alerts.
+func RunAlertPass(now time.Time) {
+	ids, err := redisClient.Cmd("SMEMBERS", "qr-alert-ids").List()
+	if err != nil {
+		logger.Error("alert pass unable to read qr-alert-ids", "error", err)
+		return
+	}
+	for _, id := range ids {
+		rules, err := GetAlertRules(id)
+		if err != nil || len(rules) == 0 {
+			continue
+		}
+		count, err := redisClient.Cmd("GET", fmt.Sprintf("qr-count:%s", id)).Int64()
+		if err != nil {
+			continue
+		}
+		var st AlertState
+		key := fmt.Sprintf("qr-alert-state:%s", id)
+		if s, err := redisClient.Cmd("GET", key).Str(); err == nil {
+			json.Unmarshal([]byte(s), &st)
+		}
+		events := EvalAlerts(id, rules, &st, count, now)
+		redisClient.Cmd("SET", key, SVar(st))
+		for _, ev := range events {
+			QueueAlert(ev)
+		}
+	}
+}
+
+// QueueAlert puts an alert on the webhook queue, qr-hook-retry:, so that it is retried with the same backoff
+// as the subscriptions and survives a restart.  The delivery carries the URL from the rule in place of a hook ID.
+func QueueAlert(ev AlertEvent) {
+	newUUID, err := uuid.NewV4()
+	if err != nil {
+		logger.Error("unable to queue alert", "alert_id", ev.ID, "error", err)
+		return
+	}
+	now := time.Now().Unix()
+	dl := HookDelivery{
+		DeliveryID: newUUID.String(),
+		URL:        ev.Webhook,
+		Event:      ev.Event,
+		Body:       SVar(ev),
+		Created:    now,
+	}
+	redisClient.Cmd("SET", fmt.Sprintf("qr-hook-dlv:%s", dl.DeliveryID), SVar(dl))
+	redisClient.Cmd("ZADD", "qr-hook-retry:", now, dl.DeliveryID)
+}
+
+// LogAlert records the result of an alert delivery in the delivery log.  It is called when the delivery
+// succeeds or runs out of attempts.
+func LogAlert(dl HookDelivery, now time.Time) {
+	var ev AlertEvent
+	if err := json.Unmarshal([]byte(dl.Body), &ev); err != nil {
+		return
+	}
+	ev.Webhook = dl.URL
+	ad := AlertDelivery{Event: ev, URL: dl.URL, Status: dl.Status, Tries: dl.Attempts, Error: dl.Error, Time: now}
+	key := fmt.Sprintf("qr-alert-log:%s", ev.ID)
+	redisClient.Cmd("LPUSH", key, SVar(ad))
+	redisClient.Cmd("LTRIM", key, 0, gCfg.AlertLogSize-1)
+}
+
+// GetAlertRules returns the alert rules for id.
+func GetAlertRules(id string) (rules []AlertRule, err error) {
+	s, err := redisClient.Cmd("GET", fmt.Sprintf("qr-alert:%s", id)).Str()
+	if err != nil {
+		return nil, err
+	}
+	err = json.Unmarshal([]byte(s), &rules)
+	return
+}
+
+/*
+/api/set-alert?id=ID&rules=[{"kind":"threshold","threshold":1000,"webhook":"https://..."}]
+An empty rules list, [], removes the alerts.
+*/
+func respHandlerSetAlert(www http.ResponseWriter, req *http.Request) {
+	if !CheckAuth(www, req) {
+		return
+	}
+
+	id := GetParam(www, req, "id", "")
+	if id == "" {
+		AnError(www, req, 406, "Missing Parameter")
+		return
+	}
+	sRules := GetParam(www, req, "rules", "")
+	if sRules == "" {
+		AnError(www, req, 406, "Missing Parameter")
+		return
+	}
+
+	var rules []AlertRule
+	if err := json.Unmarshal([]byte(sRules), &rules); err != nil {
+		AnError(www, req, 406, fmt.Sprintf("Invalid rules: %s", err))
+		return
+	}
+	if err := ValidateAlertRules(rules); err != nil {
+		AnError(www, req, 406, err.Error())
+		return
+	}
+
+	if _, err := redisClient.Cmd("GET", fmt.Sprintf("qrr:%s", id)).Str(); err != nil {
+		AnError(www, req, 404, "Not Found")
+		return
+	}
+
+	key := fmt.Sprintf("qr-alert:%s", id)
+	redisClient.Cmd("DEL", fmt.Sprintf("qr-alert-state:%s", id))
+	if len(rules) == 0 {
+		redisClient.Cmd("DEL", key)
+		redisClient.Cmd("SREM", "qr-alert-ids", id)
+	} else {
+		err := redisClient.Cmd("SET", key, SVar(rules)).Err
+		if err != nil {
+			AnError(www, req, 500, "Config Error 9")
+			return
+		}
+		redisClient.Cmd("SADD", "qr-alert-ids", id)
+	}
+
+	www.Header().Set("Content-Type", "application/json; charset=utf-8")
+	fmt.Fprintf(www, `{"status":"success","rules":%s}`+"\n", SVar(rules))
+}
+
+/*
+/api/get-alert?id=ID
+*/
+func respHandlerGetAlert(www http.ResponseWriter, req *http.Request) {
+	if !CheckAuth(www, req) {
+		return
+	}
+
+	id := GetParam(www, req, "id", "")
+	if id == "" {
+		AnError(www, req, 406, "Missing Parameter")
+		return
+	}
+
+	rules, err := GetAlertRules(id)
+	if err != nil {
+		rules = []AlertRule{}
+	}
+
+	www.Header().Set("Content-Type", "application/json; charset=utf-8")
+	fmt.Fprintf(www, `{"status":"success","rules":%s}`+"\n", SVar(rules))
+}
+
+/*
+/api/alert-log?id=ID - the most recent alert deliveries, newest first.
+*/
+func respHandlerAlertLog(www http.ResponseWriter, req *http.Request) {
+	if !CheckAuth(www, req) {
+		return
+	}
+
+	id := GetParam(www, req, "id", "")
+	if id == "" {
+		AnError(www, req, 406, "Missing Parameter")
+		return
+	}
+
+	lst, err := redisClient.Cmd("LRANGE", fmt.Sprintf("qr-alert-log:%s", id), 0, -1).List()
+	if err != nil {
+		AnError(www, req, 500, "Config Error 10")
+		return
+	}
+	log := make([]AlertDelivery, 0, len(lst))
+	for _, s := range lst {
+		var dl AlertDelivery
+		if json.Unmarshal([]byte(s), &dl) == nil {
+			log = append(log, dl)
+		}
+	}
+
+	www.Header().Set("Content-Type", "application/json; charset=utf-8")
+	fmt.Fprintf(www, `{"status":"success","log":%s}`+"\n", SVar(log))
+}
+
+/* vim: set noai ts=4 sw=4: */
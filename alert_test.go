@@ -0,0 +1,137 @@
+package main
+
+// MIT Licensed - see LICENSE
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/pschlump/json"
+)
+
+func TestEvalAlerts(t *testing.T) {
+	rules := []AlertRule{
+		{Kind: "threshold", Threshold: 100, Webhook: "https://93.184.216.34/alert"},
+		{Kind: "spike", Factor: 5, MinScans: 10, Webhook: "https://93.184.216.34/alert"},
+		{Kind: "silent", Intervals: 2, MinScans: 5, Webhook: "https://93.184.216.34/alert"},
+	}
+	tests := []struct {
+		count    int64
+		expected []string
+	}{
+		{0, nil},
+		{10, nil},
+		{20, nil},
+		{30, nil},
+		{40, nil},
+		{140, []string{"threshold", "spike"}},
+		{150, nil},
+		{150, nil},
+		{150, []string{"silent"}},
+		{150, nil},
+		{160, nil},
+	}
+
+	var st AlertState
+	now := time.Now()
+	for ii, test := range tests {
+		got := EvalAlerts("10001", rules, &st, test.count, now)
+		if len(got) != len(test.expected) {
+			t.Errorf("Test %d, expected %v got %s\n", ii, test.expected, SVar(got))
+			continue
+		}
+		for jj, ev := range got {
+			if ev.Kind != test.expected[jj] {
+				t.Errorf("Test %d, expected %s got %s\n", ii, test.expected[jj], ev.Kind)
+			}
+		}
+	}
+}
+
+func TestValidateAlertRules(t *testing.T) {
+	tests := []struct {
+		rule  AlertRule
+		isErr bool
+	}{
+		{AlertRule{Kind: "threshold", Threshold: 100, Webhook: "https://93.184.216.34/alert"}, false},
+		{AlertRule{Kind: "spike", Webhook: "https://93.184.216.34/alert"}, false},
+		{AlertRule{Kind: "threshold", Threshold: 100}, true},
+		{AlertRule{Kind: "threshold", Threshold: 100, Webhook: "x"}, true},
+		{AlertRule{Kind: "threshold", Threshold: 100, Webhook: "http://127.0.0.1:8080/alert"}, true},
+		{AlertRule{Kind: "threshold", Threshold: 0, Webhook: "https://93.184.216.34/alert"}, true},
+		{AlertRule{Kind: "often", Webhook: "https://93.184.216.34/alert"}, true},
+	}
+
+	for ii, test := range tests {
+		if err := ValidateAlertRules([]AlertRule{test.rule}); (err != nil) != test.isErr {
+			t.Errorf("Test %d, expected error %v got %v\n", ii, test.isErr, err)
+		}
+	}
+}
+
+func TestQueueAlert(t *testing.T) {
+	_, done := testRedis(t)
+	defer done()
+	defer func(tries, backoff int, secret string) {
+		gCfg.WebhookTries, gCfg.WebhookBackoff, gCfg.WebhookSecret = tries, backoff, secret
+	}(gCfg.WebhookTries, gCfg.WebhookBackoff, gCfg.WebhookSecret)
+	gCfg.WebhookTries, gCfg.WebhookBackoff, gCfg.WebhookSecret = 3, 10, "secret"
+
+	var status, calls int32 = 503, 0
+	srv := httptest.NewServer(http.HandlerFunc(func(www http.ResponseWriter, req *http.Request) {
+		atomic.AddInt32(&calls, 1)
+		body, _ := ioutil.ReadAll(req.Body)
+		ts, _ := strconv.ParseInt(req.Header.Get("X-QR-Timestamp"), 10, 64)
+		if req.Header.Get("X-QR-Signature") != "sha256="+SignWebhook("secret", ts, body) {
+			t.Errorf("Invalid signature %s\n", req.Header.Get("X-QR-Signature"))
+		}
+		if req.Header.Get("X-QR-Event") != "qr.alert" {
+			t.Errorf("Expected qr.alert got %s\n", req.Header.Get("X-QR-Event"))
+		}
+		www.WriteHeader(int(atomic.LoadInt32(&status)))
+	}))
+	defer srv.Close()
+
+	QueueAlert(AlertEvent{Event: "qr.alert", ID: "10001", Kind: "threshold", Webhook: srv.URL})
+	QueueAlert(AlertEvent{Event: "qr.alert", ID: "10002", Kind: "threshold", Webhook: srv.URL})
+
+	now := time.Now()
+	tests := []struct {
+		at     time.Duration // after now
+		status int32
+		calls  int32
+		retry  int
+		log    int // entries in qr-alert-log:10001
+	}{
+		{at: 0, status: 503, calls: 2, retry: 2, log: 0},
+		{at: 5 * time.Second, status: 503, calls: 2, retry: 2, log: 0},
+		{at: 10 * time.Second, status: 200, calls: 4, retry: 0, log: 1},
+		{at: time.Hour, status: 200, calls: 4, retry: 0, log: 1},
+	}
+	for ii, test := range tests {
+		atomic.StoreInt32(&status, test.status)
+		RunHookQueue(now.Add(test.at))
+
+		retry, _ := redisClient.Cmd("ZCARD", "qr-hook-retry:").Int()
+		lst, _ := redisClient.Cmd("LRANGE", "qr-alert-log:10001", 0, -1).List()
+		if got := atomic.LoadInt32(&calls); got != test.calls || retry != test.retry || len(lst) != test.log {
+			t.Errorf("Test %d, expected calls %d retry %d log %d, got %d %d %d\n", ii, test.calls, test.retry, test.log, got, retry, len(lst))
+		}
+	}
+
+	var ad AlertDelivery
+	lst, _ := redisClient.Cmd("LRANGE", "qr-alert-log:10001", 0, -1).List()
+	if len(lst) == 1 {
+		json.Unmarshal([]byte(lst[0]), &ad)
+	}
+	if ad.Status != 200 || ad.Tries != 2 || ad.URL != srv.URL || ad.Event.ID != "10001" {
+		t.Errorf("Expected a delivery after 2 tries, got %s\n", SVar(ad))
+	}
+}
+
+/* vim: set noai ts=4 sw=4: */
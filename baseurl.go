@@ -0,0 +1,141 @@
+package main
+
+// MIT Licensed - see LICENSE
+
+import (
+	"fmt"
+	"net/url"
+	"path"
+	"strings"
+)
+
+// Public URLs.
+//
+// Every URL this server puts in a QR or hands back as a link is built on a base URL - scheme, host and
+// an optional path prefix - which is gCfg.PublicBaseURL, or http(s)://{host_port} if that is not set.  A
+// path prefix is for a proxy that strips it before passing the request on.  Users can have short domains
+// of their own, in gCfg.UserDomains or registered by an admin (see domain.go), and choose one with
+// domain= when they make a QR.  The base a QR was made with is kept in qr-base:{id} when it is not the
+// default, so re-rendering keeps it.
+
+// BaseURL is the default base URL, with no trailing /.
+func BaseURL() string {
+	if gCfg.PublicBaseURL != "" {
+		return strings.TrimRight(gCfg.PublicBaseURL, "/")
+	}
+	if gCfg.TLSCert != "" {
+		return "https://" + gCfg.HostPort
+	}
+	return "http://" + gCfg.HostPort
+}
+
+// NormalizeBaseURL checks that s is an http or https URL with a host and nothing after the path, and
+// returns it with the scheme and host in lower case and no trailing /.
+func NormalizeBaseURL(s string) (string, error) {
+	u, err := url.Parse(strings.TrimSpace(s))
+	if err != nil {
+		return "", fmt.Errorf("Invalid base URL %q: %s", s, err)
+	}
+	scheme := strings.ToLower(u.Scheme)
+	if scheme != "http" && scheme != "https" {
+		return "", fmt.Errorf("Invalid base URL %q, must be http or https", s)
+	}
+	if u.Host == "" || u.User != nil || u.RawQuery != "" || u.Fragment != "" {
+		return "", fmt.Errorf("Invalid base URL %q, must be a scheme, host and optional path", s)
+	}
+	return scheme + "://" + strings.ToLower(u.Host) + strings.TrimRight(u.EscapedPath(), "/"), nil
+}
+
+// CheckBaseURLs normalizes gCfg.PublicBaseURL and gCfg.UserDomains, it is called once the config is read.
+func CheckBaseURLs() (err error) {
+	if gCfg.PublicBaseURL != "" {
+		if gCfg.PublicBaseURL, err = NormalizeBaseURL(gCfg.PublicBaseURL); err != nil {
+			return
+		}
+	}
+	for user, list := range gCfg.UserDomains {
+		for ii := range list {
+			if list[ii], err = NormalizeBaseURL(list[ii]); err != nil {
+				return fmt.Errorf("user_domains for %s: %s", user, err)
+			}
+		}
+	}
+	return nil
+}
+
+// UserBaseURLs are the base URLs user can make QRs with, the default first.
+func UserBaseURLs(user string) (list []string) {
+	seen := make(map[string]bool)
+	for _, base := range append(append([]string{BaseURL()}, gCfg.UserDomains[user]...), UserDomainURLs(user)...) {
+		if !seen[base] {
+			seen[base] = true
+			list = append(list, base)
+		}
+	}
+	return
+}
+
+// ChooseBaseURL returns the base URL of user's that domain names, by its host or as a whole base URL.
+// "" is the default.
+func ChooseBaseURL(user, domain string) (string, error) {
+	if domain == "" {
+		return BaseURL(), nil
+	}
+	want := strings.ToLower(strings.TrimRight(domain, "/"))
+	for _, base := range UserBaseURLs(user) {
+		if base == want {
+			return base, nil
+		}
+		if u, err := url.Parse(base); err == nil && u.Host == want {
+			return base, nil
+		}
+	}
+	return "", fmt.Errorf("Domain %s is not one of yours", domain)
+}
+
+// QRBaseURL is the base URL the QR id was made with.
+func QRBaseURL(id string) string {
+	if base, err := redisClient.Cmd("GET", fmt.Sprintf("qr-base:%s", id)).Str(); err == nil && base != "" {
+		return base
+	}
+	return BaseURL()
+}
+
+// SetQRBaseURL records the base URL for id, nothing is kept for the default.
+func SetQRBaseURL(id, base string) error {
+	if base == "" || base == BaseURL() {
+		return redisClient.Cmd("DEL", fmt.Sprintf("qr-base:%s", id)).Err
+	}
+	return redisClient.Cmd("SET", fmt.Sprintf("qr-base:%s", id), base).Err
+}
+
+// QRContentAt is the URL encoded in the QR for id when it is made with base.
+func QRContentAt(base, id string) string {
+	return base + "/Q/" + PublicName(id)
+}
+
+// ImageURL is the link to the image of id.
+func ImageURL(id string) string {
+	return BaseURL() + path.Join("/", gCfg.QRUri, id+".png")
+}
+
+// IsOwnHost is true if host, with or without a port, is this server: the default host or a custom domain.
+func IsOwnHost(host string) bool {
+	if IsDefaultHost(host) {
+		return true
+	}
+	_, ok := CustomBaseURL(host)
+	return ok
+}
+
+// IsOwnURL is true if u is on this server and its path ends with suffix, for a target that points back
+// at us such as a landing page.  The base URL may have changed since the target was set.
+func IsOwnURL(u, suffix string) bool {
+	pu, err := url.Parse(u)
+	if err != nil {
+		return false
+	}
+	return strings.HasSuffix(pu.Path, suffix) && IsOwnHost(pu.Host)
+}
+
+/* vim: set noai ts=4 sw=4: */
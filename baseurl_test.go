@@ -0,0 +1,97 @@
+package main
+
+// MIT Licensed - see LICENSE
+
+import (
+	"testing"
+)
+
+func TestNormalizeBaseURL(t *testing.T) {
+	tests := []struct {
+		in       string
+		expected string
+		isErr    bool
+	}{
+		{"https://QR.Example.com/", "https://qr.example.com", false},
+		{"HTTPS://qr.example.com/go/", "https://qr.example.com/go", false},
+		{"http://localhost:8333", "http://localhost:8333", false},
+		{"ftp://qr.example.com", "", true},
+		{"qr.example.com", "", true},
+		{"https://qr.example.com/?a=1", "", true},
+		{"https://bob@qr.example.com", "", true},
+	}
+
+	for ii, test := range tests {
+		got, err := NormalizeBaseURL(test.in)
+		if test.isErr {
+			if err == nil {
+				t.Errorf("Test %d, expected an error for %s\n", ii, test.in)
+			}
+			continue
+		}
+		if err != nil || got != test.expected {
+			t.Errorf("Test %d, expected %s got %s %v\n", ii, test.expected, got, err)
+		}
+	}
+}
+
+func TestChooseBaseURL(t *testing.T) {
+	gCfg.HostPort, gCfg.PublicBaseURL = "localhost:8333", "https://qr.example.com/go"
+	gCfg.UserDomains = map[string][]string{"bob": {"https://go.brand-a.com", "https://brand-b.link"}}
+	defer func() { gCfg.PublicBaseURL, gCfg.UserDomains = "", nil }()
+
+	tests := []struct {
+		user     string
+		domain   string
+		expected string
+		isErr    bool
+	}{
+		{"bob", "", "https://qr.example.com/go", false},
+		{"bob", "go.brand-a.com", "https://go.brand-a.com", false},
+		{"bob", "https://brand-b.link/", "https://brand-b.link", false},
+		{"bob", "qr.example.com", "https://qr.example.com/go", false},
+		{"alice", "go.brand-a.com", "", true},
+		{"bob", "evil.example.com", "", true},
+	}
+
+	for ii, test := range tests {
+		got, err := ChooseBaseURL(test.user, test.domain)
+		if test.isErr {
+			if err == nil {
+				t.Errorf("Test %d, expected an error\n", ii)
+			}
+			continue
+		}
+		if err != nil || got != test.expected {
+			t.Errorf("Test %d, expected %s got %s %v\n", ii, test.expected, got, err)
+		}
+	}
+	if got := QRContentAt(BaseURL(), "10001"); got != "https://qr.example.com/go/Q/10001" {
+		t.Errorf("Expected the QR URL on the base, got %s\n", got)
+	}
+}
+
+func TestIsOwnURL(t *testing.T) {
+	gCfg.HostPort, gCfg.PublicBaseURL = "localhost:8333", "https://qr.example.com"
+	gCfg.UserDomains = map[string][]string{"bob": {"https://go.brand-a.com"}}
+	defer func() { gCfg.PublicBaseURL, gCfg.UserDomains = "", nil }()
+
+	tests := []struct {
+		url      string
+		expected bool
+	}{
+		{"https://qr.example.com/L/10001", true},
+		{"http://localhost:8333/L/10001", true}, // set before public_base_url was
+		{"https://go.brand-a.com/L/10001", true},
+		{"https://qr.example.com/L/10002", false},
+		{"https://other.example.com/L/10001", false},
+	}
+
+	for ii, test := range tests {
+		if got := IsOwnURL(test.url, "/L/10001"); got != test.expected {
+			t.Errorf("Test %d, %s expected %v got %v\n", ii, test.url, test.expected, got)
+		}
+	}
+}
+
+/* vim: set noai ts=4 sw=4: */
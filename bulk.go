@@ -0,0 +1,613 @@
+package main
+
+// MIT Licensed - see LICENSE
+
+import (
+	"archive/zip"
+	"bytes"
+	"encoding/csv"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pschlump/json"
+	"github.com/pschlump/radix.v2/redis"
+)
+
+// Bulk creation.
+//
+// A bulk request is a CSV or JSON list of rows, each with a target url and an optional label and slug.
+// A slug is used as the ID of the QR in place of a number, scoped by host if the QRs are on a custom
+// domain, see ScopedID.  The numbered IDs are allocated in one
+// INCRBY on qr-id:, then the images are made by gCfg.BulkWorkers goroutines.  Requests from the API run
+// as a job, see jobs.go, with the job ID as the bulk_id.  Progress is kept in the hash qr-bulk:{bulk_id}
+// and the manifest in qr-bulk-items:{bulk_id}, both for gCfg.BulkRetain seconds.  Slugs are added to the
+// set qr-slug-ids so they can be found by exports.
+//
+// A slug is claimed before its QR is made by setting qr-slug:{id} to the bulk_id with NX, so two bulk
+// requests with the same slug cannot both make it.  A slug the bulk_id already holds is its own, from
+// before a restart, and is made again.
+
+// BulkRow is one QR to create.
+type BulkRow struct {
+	URL   string `json:"url"`
+	Label string `json:"label,omitempty"`
+	Slug  string `json:"slug,omitempty"`
+}
+
+// BulkItem is a row of the manifest.
+type BulkItem struct {
+	Row     int    `json:"row"`
+	ID      string `json:"id,omitempty"`
+	URL     string `json:"url"`
+	Label   string `json:"label,omitempty"`
+	QRURL   string `json:"qr_url,omitempty"`
+	Encoded string `json:"qr_encoded,omitempty"`
+	Error   string `json:"error,omitempty"`
+}
+
+// BulkStatus is the progress of a bulk request.
+type BulkStatus struct {
+	BulkID   string `json:"bulk_id"`
+	State    string `json:"state"` // queued, running, done or canceled
+	Total    int    `json:"total"`
+	Done     int    `json:"done"`
+	Failed   int    `json:"failed"`
+	User     string `json:"user,omitempty"`
+	Created  int64  `json:"created"`
+	Finished int64  `json:"finished,omitempty"`
+}
+
+var slugRe = regexp.MustCompile(`^[A-Za-z0-9][A-Za-z0-9_-]{3,63}$`)
+var allDigits = regexp.MustCompile(`^[0-9]+$`)
+
+// ParseBulk reads the rows from a CSV or a JSON array.  A CSV may have a header row naming the url, label
+// and slug columns, if not the columns are taken in that order.  If format is "" it is worked out from
+// the data.
+func ParseBulk(data []byte, format string) (rows []BulkRow, err error) {
+	data = bytes.TrimPrefix(data, []byte("\xef\xbb\xbf")) // Excel puts a BOM on CSVs
+	if format == "" {
+		format = "csv"
+		if t := bytes.TrimSpace(data); len(t) > 0 && t[0] == '[' {
+			format = "json"
+		}
+	}
+
+	switch format {
+	case "json":
+		if err = json.Unmarshal(data, &rows); err != nil {
+			return nil, fmt.Errorf("Invalid JSON: %s", err)
+		}
+	case "csv":
+		rdr := csv.NewReader(bytes.NewReader(data))
+		rdr.FieldsPerRecord = -1
+		rdr.TrimLeadingSpace = true
+		recs, err := rdr.ReadAll()
+		if err != nil {
+			return nil, fmt.Errorf("Invalid CSV: %s", err)
+		}
+		col := map[string]int{"url": 0, "label": 1, "slug": 2}
+		if len(recs) > 0 {
+			hdr := make(map[string]int)
+			for ii, h := range recs[0] {
+				hdr[strings.ToLower(strings.TrimSpace(h))] = ii
+			}
+			if _, ok := hdr["url"]; ok {
+				col = map[string]int{"url": -1, "label": -1, "slug": -1}
+				for k := range col {
+					if ii, ok := hdr[k]; ok {
+						col[k] = ii
+					}
+				}
+				recs = recs[1:]
+			}
+		}
+		get := func(rec []string, k string) string {
+			if ii := col[k]; ii >= 0 && ii < len(rec) {
+				return strings.TrimSpace(rec[ii])
+			}
+			return ""
+		}
+		for _, rec := range recs {
+			if len(rec) == 1 && strings.TrimSpace(rec[0]) == "" {
+				continue
+			}
+			rows = append(rows, BulkRow{URL: get(rec, "url"), Label: get(rec, "label"), Slug: get(rec, "slug")})
+		}
+	default:
+		return nil, fmt.Errorf("Invalid format %q", format)
+	}
+
+	if len(rows) == 0 {
+		return nil, fmt.Errorf("No rows")
+	}
+	if gCfg.BulkMaxRows > 0 && len(rows) > gCfg.BulkMaxRows {
+		return nil, fmt.Errorf("Too many rows, %d, the limit is %d", len(rows), gCfg.BulkMaxRows)
+	}
+	return rows, nil
+}
+
+// ValidateBulk validates and normalizes the URLs and checks the slugs.  Slugs may not be all digits, so
+// they can never be the same as a numbered ID.
+func ValidateBulk(rows []BulkRow, vv *Validator) {
+	seen := make(map[string]int)
+	for ii := range rows {
+		vv.URL(fmt.Sprintf("rows[%d].url", ii), &rows[ii].URL)
+		slug := rows[ii].Slug
+		if slug == "" {
+			continue
+		}
+		field := fmt.Sprintf("rows[%d].slug", ii)
+		if !slugRe.MatchString(slug) || allDigits.MatchString(slug) {
+			vv.Add(field, "invalid_slug", slug, "Slug must be 4 to 64 letters, digits, - or _ and not all digits")
+		} else if jj, dup := seen[slug]; dup {
+			vv.Add(field, "duplicate_slug", slug, fmt.Sprintf("Slug is also used in row %d", jj))
+		}
+		seen[slug] = ii
+	}
+}
+
+// StartBulk records a new bulk request.  If bid is "" a new ID is made.
+func StartBulk(bid string, total int, user string) (string, error) {
+	if bid == "" {
+		var err error
+		if bid, err = NewJobID(); err != nil {
+			return "", err
+		}
+	}
+	key := fmt.Sprintf("qr-bulk:%s", bid)
+	err := redisClient.Cmd("HMSET", key, "bulk_id", bid, "state", "queued", "total", total, "done", 0, "failed", 0,
+		"user", user, "created", time.Now().Unix()).Err
+	if err != nil {
+		return "", err
+	}
+	redisClient.Cmd("EXPIRE", key, gCfg.BulkRetain)
+	return bid, nil
+}
+
+// RunBulk creates the QRs for rows and returns the manifest.  progress, if not nil, is called as each
+// row is finished, if it returns false the rows that are left are not created.  RunBulk can be run again
+// with the same bid after a restart, the IDs allocated the first time are used again and the rows that
+// were finished, kept in the hash qr-bulk-made:{bid}, are not made a second time.
+func RunBulk(bid string, rows []BulkRow, user, base string, progress func(done, failed int) bool) (items []BulkItem) {
+	items = make([]BulkItem, len(rows))
+	key := fmt.Sprintf("qr-bulk:%s", bid)
+	mkey := fmt.Sprintf("qr-bulk-made:%s", bid)
+	redisClient.Cmd("HMSET", key, "state", "running", "done", 0, "failed", 0)
+
+	nNumbered := 0
+	for ii, row := range rows {
+		items[ii] = BulkItem{Row: ii, URL: row.URL, Label: row.Label}
+		if row.Slug == "" {
+			nNumbered++
+		} else {
+			items[ii].ID = ScopedID(baseHost(base), row.Slug)
+		}
+	}
+	if nNumbered > 0 {
+		next, err := redisClient.Cmd("HGET", key, "first_id").Int()
+		if err != nil {
+			var last int
+			if last, err = redisClient.Cmd("INCRBY", "qr-id:", nNumbered).Int(); err == nil {
+				next = last - nNumbered + 1
+				redisClient.Cmd("HSET", key, "first_id", next)
+			}
+		}
+		for ii := range items {
+			if rows[ii].Slug != "" {
+				continue
+			}
+			if err != nil {
+				items[ii].Error = "Config Error 1"
+				continue
+			}
+			items[ii].ID = fmt.Sprintf("%d", next)
+			next++
+		}
+	}
+	made, _ := redisClient.Cmd("HGETALL", mkey).Map()
+
+	var lock sync.Mutex
+	done, failed, stop := 0, 0, false
+	work := make(chan int)
+	var wg sync.WaitGroup
+	nWorkers := gCfg.BulkWorkers
+	if nWorkers < 1 {
+		nWorkers = 1
+	}
+	for w := 0; w < nWorkers; w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for ii := range work {
+				it := &items[ii]
+				lock.Lock()
+				stopped := stop
+				lock.Unlock()
+				if stopped {
+					it.Error = "Canceled"
+					continue
+				}
+				if s, ok := made[strconv.Itoa(ii)]; ok && json.Unmarshal([]byte(s), it) == nil {
+					// made before a restart
+				} else {
+					if it.Error == "" && rows[ii].Slug != "" && !ClaimSlug(it.ID, bid) {
+						it.Error = fmt.Sprintf("Slug %s is already in use", rows[ii].Slug)
+					}
+					if it.Error == "" {
+						var err error
+						if it.QRURL, it.Encoded, err = SetupQR(it.ID, it.URL, user, base); err != nil {
+							it.Error = err.Error()
+						} else {
+							if it.Label != "" {
+								redisClient.Cmd("SET", fmt.Sprintf("qr-label:%s", it.ID), it.Label)
+							}
+							if rows[ii].Slug != "" {
+								redisClient.Cmd("SADD", "qr-slug-ids", it.ID)
+							}
+							redisClient.Cmd("HSET", mkey, ii, SVar(it))
+							EmitEvent(HookEvent{Event: "qr.created", ID: it.ID, URL: it.URL})
+						}
+					}
+				}
+
+				lock.Lock()
+				if it.Error == "" {
+					done++
+					redisClient.Cmd("HINCRBY", key, "done", 1)
+				} else {
+					failed++
+					redisClient.Cmd("HINCRBY", key, "failed", 1)
+				}
+				if progress != nil && !progress(done, failed) {
+					stop = true
+				}
+				lock.Unlock()
+			}
+		}()
+	}
+	for ii := range items {
+		work <- ii
+	}
+	close(work)
+	wg.Wait()
+
+	state := "done"
+	if stop {
+		state = "canceled"
+	}
+	ikey := fmt.Sprintf("qr-bulk-items:%s", bid)
+	redisClient.Cmd("SET", ikey, SVar(items))
+	redisClient.Cmd("EXPIRE", ikey, gCfg.BulkRetain)
+	redisClient.Cmd("EXPIRE", mkey, gCfg.BulkRetain)
+	redisClient.Cmd("HMSET", key, "state", state, "finished", time.Now().Unix())
+	return
+}
+
+// ClaimSlug is true if the slug id is now held by bid, or was already.  A slug that is not held but is in
+// use, made before slugs were claimed, is not given out.
+func ClaimSlug(id, bid string) bool {
+	key := fmt.Sprintf("qr-slug:%s", id)
+	r := redisClient.Cmd("SET", key, bid, "NX")
+	if r.Err != nil {
+		return false
+	}
+	if r.IsType(redis.Nil) {
+		owner, err := redisClient.Cmd("GET", key).Str()
+		return err == nil && owner == bid
+	}
+	if n, err := redisClient.Cmd("EXISTS", fmt.Sprintf("qrr:%s", id)).Int(); err != nil || n != 0 {
+		redisClient.Cmd("DEL", key)
+		return false
+	}
+	return true
+}
+
+// BulkJob is the params of a bulk job, the job ID is also the bulk_id.
+type BulkJob struct {
+	Rows    []BulkRow   `json:"rows"`
+	Threats []ThreatHit `json:"threats,omitempty"`
+	BaseURL string      `json:"base_url,omitempty"`
+}
+
+func runBulkJob(job *Job) (result interface{}, err error) {
+	var bj BulkJob
+	if err = json.Unmarshal([]byte(job.Params), &bj); err != nil {
+		return nil, err
+	}
+	if bj.BaseURL == "" {
+		bj.BaseURL = BaseURL()
+	}
+	items := RunBulk(job.JobID, bj.Rows, job.User, bj.BaseURL, func(done, failed int) bool {
+		job.Progress(done, failed, len(bj.Rows))
+		return !job.Canceled()
+	})
+	quarantineBulk(items, bj.Threats, job.User)
+	return map[string]string{"bulk_id": job.JobID, "zip_url": "/api/bulk-zip?bulk_id=" + job.JobID}, nil
+}
+
+// GetBulkStatus returns the progress of a bulk request.
+func GetBulkStatus(bid string) (st BulkStatus, err error) {
+	mm, err := redisClient.Cmd("HGETALL", fmt.Sprintf("qr-bulk:%s", bid)).Map()
+	if err != nil {
+		return st, err
+	}
+	if len(mm) == 0 {
+		return st, fmt.Errorf("Not Found")
+	}
+	num := func(k string) int64 {
+		n, _ := strconv.ParseInt(mm[k], 10, 64)
+		return n
+	}
+	st = BulkStatus{
+		BulkID:   mm["bulk_id"],
+		State:    mm["state"],
+		Total:    int(num("total")),
+		Done:     int(num("done")),
+		Failed:   int(num("failed")),
+		User:     mm["user"],
+		Created:  num("created"),
+		Finished: num("finished"),
+	}
+	return
+}
+
+// quarantineBulk quarantines the rows that were created with a URL that is on a threat list.
+func quarantineBulk(items []BulkItem, hits []ThreatHit, user string) {
+	for _, hit := range hits {
+		var ii int
+		fmt.Sscanf(hit.Field, "rows[%d]", &ii)
+		if ii < len(items) && items[ii].Error == "" {
+			Quarantine(items[ii].ID, user, []ThreatHit{hit})
+		}
+	}
+}
+
+// GetBulkItems returns the manifest of a bulk request that is done.
+func GetBulkItems(bid string) (items []BulkItem, err error) {
+	s, err := redisClient.Cmd("GET", fmt.Sprintf("qr-bulk-items:%s", bid)).Str()
+	if err != nil {
+		return nil, err
+	}
+	err = json.Unmarshal([]byte(s), &items)
+	return
+}
+
+// WriteBulkZip writes a ZIP of the images and the manifest, as manifest.csv and manifest.json.  Images
+// are named {id}.png, or {id}-{label}.png when there is a label.
+func WriteBulkZip(w io.Writer, items []BulkItem) error {
+	zw := zip.NewWriter(w)
+	var mf bytes.Buffer
+	cw := csv.NewWriter(&mf)
+	cw.Write([]string{"row", "id", "url", "label", "file", "qr_url", "qr_encoded", "error"})
+	for _, it := range items {
+		fn := ""
+		if it.Error == "" {
+			fn = it.ID + ".png"
+			if it.Label != "" {
+				fn = it.ID + "-" + safeFileName(it.Label) + ".png"
+			}
+			buf, err := ioutil.ReadFile(filepath.Join(gCfg.QRDir, it.ID+".png"))
+			if err != nil {
+				return err
+			}
+			f, err := zw.CreateHeader(&zip.FileHeader{Name: "images/" + fn, Method: zip.Store, Modified: time.Now()})
+			if err != nil {
+				return err
+			}
+			f.Write(buf)
+		}
+		cw.Write([]string{fmt.Sprintf("%d", it.Row), it.ID, it.URL, it.Label, fn, it.QRURL, it.Encoded, it.Error})
+	}
+	cw.Flush()
+	if f, err := zw.Create("manifest.csv"); err == nil {
+		f.Write(mf.Bytes())
+	}
+	if f, err := zw.Create("manifest.json"); err == nil {
+		f.Write([]byte(SVar(items)))
+	}
+	return zw.Close()
+}
+
+func safeFileName(s string) string {
+	s = strings.Map(func(r rune) rune {
+		switch {
+		case r >= 'a' && r <= 'z', r >= 'A' && r <= 'Z', r >= '0' && r <= '9', r == '-', r == '_', r == '.':
+			return r
+		}
+		return '_'
+	}, s)
+	if len(s) > 64 {
+		s = s[:64]
+	}
+	return strings.Trim(s, ".")
+}
+
+/*
+/api/bulk-qr - POST a CSV or JSON list as "file" (multipart) or "data", with format=csv|json if it can not
+be worked out, and domain=D for one of the user's short domains.  Returns a bulk_id at once, the QRs are made by a job with the same ID, which can be
+followed and canceled with /api/job-status and /api/job-cancel.  If any URL or slug is
+not valid nothing is created and the errors are returned.  The body is limited to page_max_file, see LimitUpload.
+*/
+func respHandlerBulkQR(www http.ResponseWriter, req *http.Request) {
+	if !CheckAuth(www, req) || !LimitUpload(www, req) {
+		return
+	}
+
+	format := GetParam(www, req, "format", "")
+	var data []byte
+	if fh := pageUpload(req); fh != nil {
+		f, err := fh.Open()
+		if err != nil {
+			AnError(www, req, 406, "Invalid file")
+			return
+		}
+		data, _ = ioutil.ReadAll(f)
+		f.Close()
+	} else {
+		data = []byte(GetParam(www, req, "data", ""))
+	}
+	if len(data) == 0 {
+		AnError(www, req, 406, "Missing Parameter")
+		return
+	}
+
+	rows, err := ParseBulk(data, format)
+	if err != nil {
+		AnError(www, req, 406, err.Error())
+		return
+	}
+	var vv Validator
+	ValidateBulk(rows, &vv)
+	if vv.Send(www, req) {
+		return
+	}
+
+	user := AuthUser(req)
+	base, err := ChooseBaseURL(user, GetParam(www, req, "domain", ""))
+	if err != nil {
+		AnError(www, req, 406, err.Error())
+		return
+	}
+	bid, err := NewJobID()
+	if err == nil {
+		if _, err = StartBulk(bid, len(rows), user); err == nil {
+			_, err = EnqueueJob(bid, "bulk", BulkJob{Rows: rows, Threats: vv.Threats, BaseURL: base}, user)
+		}
+	}
+	if err != nil {
+		AnError(www, req, 500, "Config Error 30")
+		return
+	}
+
+	www.Header().Set("Content-Type", "application/json; charset=utf-8")
+	fmt.Fprintf(www, `{"status":"success","bulk_id":%q,"job_id":%q,"total":%d,"status_url":"/api/bulk-status?bulk_id=%s","zip_url":"/api/bulk-zip?bulk_id=%s"}`+"\n",
+		bid, bid, len(rows), bid, bid)
+}
+
+/*
+/api/bulk-status?bulk_id=B - progress of a bulk request, and the manifest once it is done.
+*/
+func respHandlerBulkStatus(www http.ResponseWriter, req *http.Request) {
+	if !CheckAuth(www, req) {
+		return
+	}
+
+	bid := GetParam(www, req, "bulk_id", "")
+	if bid == "" {
+		AnError(www, req, 406, "Missing Parameter")
+		return
+	}
+	st, err := GetBulkStatus(bid)
+	if err != nil || (st.User != AuthUser(req) && !IsAdmin(req)) {
+		AnError(www, req, 404, "Not Found")
+		return
+	}
+	items, _ := GetBulkItems(bid)
+	if items == nil {
+		items = []BulkItem{}
+	}
+
+	www.Header().Set("Content-Type", "application/json; charset=utf-8")
+	fmt.Fprintf(www, `{"status":"success","bulk":%s,"items":%s}`+"\n", SVar(st), SVar(items))
+}
+
+/*
+/api/bulk-zip?bulk_id=B - ZIP of the images and manifest of a bulk request that is done.
+*/
+func respHandlerBulkZip(www http.ResponseWriter, req *http.Request) {
+	if !CheckAuth(www, req) {
+		return
+	}
+
+	bid := GetParam(www, req, "bulk_id", "")
+	if bid == "" {
+		AnError(www, req, 406, "Missing Parameter")
+		return
+	}
+	st, err := GetBulkStatus(bid)
+	if err != nil || (st.User != AuthUser(req) && !IsAdmin(req)) {
+		AnError(www, req, 404, "Not Found")
+		return
+	}
+	items, err := GetBulkItems(bid)
+	if err != nil {
+		if st.State == "queued" || st.State == "running" {
+			AnError(www, req, 409, "Not finished")
+			return
+		}
+		AnError(www, req, 404, "Not Found")
+		return
+	}
+
+	var buf bytes.Buffer
+	if err = WriteBulkZip(&buf, items); err != nil {
+		AnError(www, req, 500, "Config Error 31")
+		return
+	}
+	www.Header().Set("Content-Type", "application/zip")
+	www.Header().Set("Content-Disposition", fmt.Sprintf(`attachment; filename="qr-bulk-%s.zip"`, bid))
+	www.Write(buf.Bytes())
+}
+
+// BulkCLI runs a bulk request from the command line, --bulk FILE, and writes the ZIP to out.
+func BulkCLI(fn, out, user string) error {
+	data, err := ioutil.ReadFile(fn)
+	if err != nil {
+		return err
+	}
+	format := ""
+	switch strings.ToLower(filepath.Ext(fn)) {
+	case ".json":
+		format = "json"
+	case ".csv":
+		format = "csv"
+	}
+	rows, err := ParseBulk(data, format)
+	if err != nil {
+		return err
+	}
+	var vv Validator
+	ValidateBulk(rows, &vv)
+	if len(vv.Errors) > 0 {
+		for _, ve := range vv.Errors {
+			fmt.Fprintf(os.Stderr, "%s\n", ve)
+		}
+		return fmt.Errorf("%d rows are not valid", len(vv.Errors))
+	}
+
+	bid, err := StartBulk("", len(rows), user)
+	if err != nil {
+		return err
+	}
+	items := RunBulk(bid, rows, user, BaseURL(), func(done, failed int) bool {
+		fmt.Fprintf(os.Stderr, "\r%d of %d done, %d failed", done+failed, len(rows), failed)
+		return true
+	})
+	fmt.Fprintf(os.Stderr, "\n")
+	quarantineBulk(items, vv.Threats, user)
+
+	if out == "" {
+		out = fmt.Sprintf("qr-bulk-%s.zip", bid)
+	}
+	fh, err := Fopen(out, "w")
+	if err != nil {
+		return err
+	}
+	defer fh.Close()
+	if err = WriteBulkZip(fh, items); err != nil {
+		return err
+	}
+	fmt.Printf("Bulk %s: %d rows, manifest and images in %s\n", bid, len(rows), out)
+	return nil
+}
+
+/* vim: set noai ts=4 sw=4: */
@@ -0,0 +1,193 @@
+package main
+
+// MIT Licensed - see LICENSE
+
+import (
+	"archive/zip"
+	"bytes"
+	"fmt"
+	"net/http/httptest"
+	"reflect"
+	"sync"
+	"sync/atomic"
+	"testing"
+)
+
+func TestParseBulk(t *testing.T) {
+	gCfg.BulkMaxRows = 3
+	defer func() { gCfg.BulkMaxRows = 10000 }()
+
+	tests := []struct {
+		data     string
+		format   string
+		expected []BulkRow
+		isErr    bool
+	}{
+		{"https://a.example.com/,Box A,box-a\nhttps://b.example.com/\n", "", []BulkRow{
+			{URL: "https://a.example.com/", Label: "Box A", Slug: "box-a"},
+			{URL: "https://b.example.com/"},
+		}, false},
+		{"\xef\xbb\xbfSlug,URL\nsku-1,https://a.example.com/\n", "csv", []BulkRow{
+			{URL: "https://a.example.com/", Slug: "sku-1"},
+		}, false},
+		{`[{"url":"https://a.example.com/","label":"A"}]`, "", []BulkRow{
+			{URL: "https://a.example.com/", Label: "A"},
+		}, false},
+		{"a\nb\nc\nd\n", "csv", nil, true},
+		{"", "csv", nil, true},
+		{"[{]", "json", nil, true},
+		{"x", "xml", nil, true},
+	}
+
+	for ii, test := range tests {
+		got, err := ParseBulk([]byte(test.data), test.format)
+		if test.isErr {
+			if err == nil {
+				t.Errorf("Test %d, expected an error\n", ii)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("Test %d, error %s\n", ii, err)
+		} else if !reflect.DeepEqual(got, test.expected) {
+			t.Errorf("Test %d, expected %s got %s\n", ii, SVar(test.expected), SVar(got))
+		}
+	}
+}
+
+func TestValidateBulk(t *testing.T) {
+	gCfg.URLSchemes = "http,https"
+	rows := []BulkRow{
+		{URL: "a.example.com"},
+		{URL: "https://b.example.com/", Slug: "promo-1"},
+		{URL: "https://c.example.com/", Slug: "promo-1"},
+		{URL: "https://d.example.com/", Slug: "12345"},
+		{URL: "javascript:x", Slug: "ab"},
+	}
+	var vv Validator
+	ValidateBulk(rows, &vv)
+	var codes []string
+	for _, ve := range vv.Errors {
+		codes = append(codes, ve.Field+":"+ve.Code)
+	}
+	expected := []string{"rows[2].slug:duplicate_slug", "rows[3].slug:invalid_slug", "rows[4].url:scheme_not_allowed", "rows[4].slug:invalid_slug"}
+	if !reflect.DeepEqual(codes, expected) {
+		t.Errorf("Expected %s got %s\n", SVar(expected), SVar(codes))
+	}
+	if rows[0].URL != "https://a.example.com/" {
+		t.Errorf("Expected the url to be normalized, got %s\n", rows[0].URL)
+	}
+}
+
+func TestWriteBulkZip(t *testing.T) {
+	gCfg.QRDir = "./testdata"
+	defer func() { gCfg.QRDir = "./www/q" }()
+
+	items := []BulkItem{
+		{Row: 0, ID: "bulk", URL: "https://a.example.com/", Label: "Box A/1"},
+		{Row: 1, URL: "https://b.example.com/", Error: "Slug in use"},
+	}
+	var buf bytes.Buffer
+	if err := WriteBulkZip(&buf, items); err != nil {
+		t.Fatalf("Error %s\n", err)
+	}
+	zr, err := zip.NewReader(bytes.NewReader(buf.Bytes()), int64(buf.Len()))
+	if err != nil {
+		t.Fatalf("Error %s\n", err)
+	}
+	var names []string
+	for _, f := range zr.File {
+		names = append(names, f.Name)
+	}
+	expected := []string{"images/bulk-Box_A_1.png", "manifest.csv", "manifest.json"}
+	if !reflect.DeepEqual(names, expected) {
+		t.Errorf("Expected %s got %s\n", SVar(expected), SVar(names))
+	}
+}
+
+func TestClaimSlug(t *testing.T) {
+	_, done := testRedis(t)
+	defer done()
+
+	redisClient.Cmd("SET", "qrr:old-slug", "http://example.com/") // made before slugs were claimed
+
+	tests := []struct {
+		id       string
+		bid      string
+		expected bool
+	}{
+		{"promo", "b1", true},
+		{"promo", "b1", true}, // its own, after a restart
+		{"promo", "b2", false},
+		{"old-slug", "b2", false},
+		{"old-slug", "b2", false},
+		{"promo@brand-b.link", "b2", true},
+	}
+	for ii, test := range tests {
+		if got := ClaimSlug(test.id, test.bid); got != test.expected {
+			t.Errorf("Test %d, %s for %s expected %v got %v\n", ii, test.id, test.bid, test.expected, got)
+		}
+	}
+
+	// Only one of the bulk requests at the same time gets the slug.
+	var wg sync.WaitGroup
+	var won int32
+	for ii := 0; ii < 10; ii++ {
+		wg.Add(1)
+		go func(ii int) {
+			defer wg.Done()
+			if ClaimSlug("race", fmt.Sprintf("b%d", ii)) {
+				atomic.AddInt32(&won, 1)
+			}
+		}(ii)
+	}
+	wg.Wait()
+	if won != 1 {
+		t.Errorf("Expected one claim of the slug to win, got %d\n", won)
+	}
+}
+
+func TestBulkAccess(t *testing.T) {
+	_, done := testRedis(t)
+	defer done()
+	defer func(admins, dir string) { gCfg.AdminUsers, gCfg.QRDir = admins, dir }(gCfg.AdminUsers, gCfg.QRDir)
+	gCfg.AdminUsers, gCfg.QRDir = "root", "./testdata"
+
+	redisClient.Cmd("MSET", "qr-token:bob", "bob", "qr-token:eve", "eve", "qr-token:root", "root")
+	redisClient.Cmd("HMSET", "qr-bulk:b1", "bulk_id", "b1", "state", "done", "user", "bob")
+	redisClient.Cmd("SET", "qr-bulk-items:b1", SVar([]BulkItem{{Row: 0, ID: "bulk", URL: "http://a.example.com/"}}))
+	redisClient.Cmd("HMSET", "qr-bulk:b2", "bulk_id", "b2", "state", "running", "user", "bob")
+
+	tests := []struct {
+		token  string
+		bid    string
+		status int
+		zip    int
+	}{
+		{token: "bob", bid: "b1", status: 200, zip: 200},
+		{token: "root", bid: "b1", status: 200, zip: 200},
+		{token: "eve", bid: "b1", status: 404, zip: 404},
+		{token: "bob", bid: "b2", status: 200, zip: 409},
+		{token: "eve", bid: "b2", status: 404, zip: 404},
+		{token: "bob", bid: "b3", status: 404, zip: 404},
+	}
+	for ii, test := range tests {
+		req := httptest.NewRequest("GET", "/api/bulk-status?bulk_id="+test.bid, nil)
+		req.Header.Set("X-Auth", test.token)
+		rec := httptest.NewRecorder()
+		respHandlerBulkStatus(rec, req)
+		if rec.Code != test.status {
+			t.Errorf("Test %d, bulk-status expected %d got %d %s\n", ii, test.status, rec.Code, rec.Body.String())
+		}
+
+		req = httptest.NewRequest("GET", "/api/bulk-zip?bulk_id="+test.bid, nil)
+		req.Header.Set("X-Auth", test.token)
+		rec = httptest.NewRecorder()
+		respHandlerBulkZip(rec, req)
+		if rec.Code != test.zip {
+			t.Errorf("Test %d, bulk-zip expected %d got %d %s\n", ii, test.zip, rec.Code, rec.Body.String())
+		}
+	}
+}
+
+/* vim: set noai ts=4 sw=4: */
@@ -0,0 +1,19 @@
+//go:build !windows
+// +build !windows
+
+package main
+
+// MIT Licensed - see LICENSE
+
+import "syscall"
+
+// diskFree is the bytes free to this user on the file system dir is on.
+func diskFree(dir string) (int64, error) {
+	var st syscall.Statfs_t
+	if err := syscall.Statfs(dir, &st); err != nil {
+		return 0, err
+	}
+	return int64(st.Bavail) * int64(st.Bsize), nil
+}
+
+/* vim: set noai ts=4 sw=4: */
@@ -0,0 +1,27 @@
+//go:build windows
+// +build windows
+
+package main
+
+// MIT Licensed - see LICENSE
+
+import (
+	"syscall"
+	"unsafe"
+)
+
+// diskFree is the bytes free to this user on the volume dir is on.
+func diskFree(dir string) (int64, error) {
+	p, err := syscall.UTF16PtrFromString(dir)
+	if err != nil {
+		return 0, err
+	}
+	var free uint64
+	proc := syscall.NewLazyDLL("kernel32.dll").NewProc("GetDiskFreeSpaceExW")
+	if r, _, err := proc.Call(uintptr(unsafe.Pointer(p)), uintptr(unsafe.Pointer(&free)), 0, 0); r == 0 {
+		return 0, err
+	}
+	return int64(free), nil
+}
+
+/* vim: set noai ts=4 sw=4: */
@@ -0,0 +1,386 @@
+package main
+
+// MIT Licensed - see LICENSE
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pschlump/json"
+)
+
+// Custom short domains.
+//
+// Admins register domains in the hash qr-domain: (field is the host, value the JSON DomainType) and
+// give them to users, directly or through teams kept in the hash qr-team: (field is the team, value a
+// JSON list of users).  Both are held in memory and reloaded every domainReload, and at once on this
+// server when they are changed.
+//
+// Until a custom domain is set up, registered or in user_domains, every host is the default host and
+// scans are served whatever the Host header is, as they were before custom domains - a proxy that
+// rewrites Host, or a public_base_url that has changed, keeps working.  Once there is a custom domain a
+// scan is only served on the host its QR was made for, the default host (host_port, public_base_url,
+// extra_hosts or loopback) for QRs made with the default base URL, and requests for any other host are
+// rejected with a 421.  Before adding the first domain, list in extra_hosts the other names the
+// server is reached by: old public_base_url hosts still printed on QRs and the Host a proxy sends.
+// Slugs are scoped by host: a slug on a custom domain is stored as {slug}@{host}, so
+// go.brand-a.com/Q/promo and brand-b.link/Q/promo are two QRs.  Numbered IDs are the same on every host.
+
+const domainReload = 30 * time.Second
+
+// DomainType is a registered short domain.
+type DomainType struct {
+	Host    string   `json:"host"`
+	BaseURL string   `json:"base_url"`
+	Users   []string `json:"users,omitempty"`
+	Teams   []string `json:"teams,omitempty"`
+	Created int64    `json:"created"`
+}
+
+type domainRegistry struct {
+	lock    sync.RWMutex
+	domains map[string]DomainType // by host
+	teams   map[string][]string   // users by team
+}
+
+var domains domainRegistry
+
+// LoadDomains reads the domains and teams from Redis.
+func LoadDomains() error {
+	dm, err := redisClient.Cmd("HGETALL", "qr-domain:").Map()
+	if err != nil {
+		return err
+	}
+	tm, err := redisClient.Cmd("HGETALL", "qr-team:").Map()
+	if err != nil {
+		return err
+	}
+	nd := make(map[string]DomainType)
+	for host, s := range dm {
+		var dt DomainType
+		if json.Unmarshal([]byte(s), &dt) == nil {
+			nd[host] = dt
+		}
+	}
+	nt := make(map[string][]string)
+	for team, s := range tm {
+		var users []string
+		if json.Unmarshal([]byte(s), &users) == nil {
+			nt[team] = users
+		}
+	}
+	SetDomains(nd, nt)
+	return nil
+}
+
+// SetDomains replaces the domains and teams held in memory.
+func SetDomains(nd map[string]DomainType, nt map[string][]string) {
+	domains.lock.Lock()
+	domains.domains, domains.teams = nd, nt
+	domains.lock.Unlock()
+}
+
+// DomainWatcher reloads the domains every domainReload so changes made on other servers are seen.
+func DomainWatcher() {
+	for sleepOrStop(domainReload) {
+		if err := LoadDomains(); err != nil {
+			logger.Error("unable to load domains", "error", err)
+		}
+	}
+}
+
+// hostName is host in lower case without a port.
+func hostName(host string) string {
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		host = h
+	}
+	return strings.ToLower(strings.TrimSuffix(host, "."))
+}
+
+// baseHost is the host name of a base URL.
+func baseHost(base string) string {
+	if u, err := url.Parse(base); err == nil {
+		return hostName(u.Host)
+	}
+	return ""
+}
+
+// HasCustomDomains is true if a domain is registered or a user has one in user_domains.
+func HasCustomDomains() bool {
+	domains.lock.RLock()
+	n := len(domains.domains)
+	domains.lock.RUnlock()
+	if n > 0 {
+		return true
+	}
+	for _, list := range gCfg.UserDomains {
+		if len(list) > 0 {
+			return true
+		}
+	}
+	return false
+}
+
+// IsDefaultHost is true if host is the default host of the QRs made with the default base URL.
+func IsDefaultHost(host string) bool {
+	host = hostName(host)
+	if host == "" || host == "localhost" || host == "127.0.0.1" || host == "::1" {
+		return true
+	}
+	if host == hostName(gCfg.HostPort) || host == baseHost(BaseURL()) {
+		return true
+	}
+	for _, h := range strings.Split(gCfg.ExtraHosts, ",") {
+		if hostName(strings.TrimSpace(h)) == host {
+			return true
+		}
+	}
+	return false
+}
+
+// ScansDefault is true if scans on host are for the QRs made with the default base URL: host is the
+// default host, or there are no custom domains and every host is.
+func ScansDefault(host string) bool {
+	return !HasCustomDomains() || IsDefaultHost(host)
+}
+
+// CustomBaseURL returns the base URL of host if it is a custom domain, registered or in user_domains.
+func CustomBaseURL(host string) (string, bool) {
+	host = hostName(host)
+	domains.lock.RLock()
+	dt, ok := domains.domains[host]
+	domains.lock.RUnlock()
+	if ok {
+		return dt.BaseURL, true
+	}
+	for _, list := range gCfg.UserDomains {
+		for _, base := range list {
+			if baseHost(base) == host {
+				return base, true
+			}
+		}
+	}
+	return "", false
+}
+
+// UserDomainURLs are the base URLs of the registered domains that user has, directly or by a team.
+func UserDomainURLs(user string) (list []string) {
+	domains.lock.RLock()
+	defer domains.lock.RUnlock()
+	inTeam := make(map[string]bool)
+	for team, users := range domains.teams {
+		for _, u := range users {
+			if u == user {
+				inTeam[team] = true
+			}
+		}
+	}
+	for _, dt := range domains.domains {
+		has := false
+		for _, u := range dt.Users {
+			has = has || u == user
+		}
+		for _, t := range dt.Teams {
+			has = has || inTeam[t]
+		}
+		if has {
+			list = append(list, dt.BaseURL)
+		}
+	}
+	sort.Strings(list)
+	return
+}
+
+// ScopedID is the ID that name, the part of the path after /Q/, has on host.
+func ScopedID(host, name string) string {
+	if ScansDefault(host) || allDigits.MatchString(name) {
+		return name
+	}
+	return name + "@" + hostName(host)
+}
+
+// PublicName is the part of id that goes in the URL.
+func PublicName(id string) string {
+	if i := strings.Index(id, "@"); i >= 0 {
+		return id[:i]
+	}
+	return id
+}
+
+// ServedOn is true if a QR made with base may be scanned on host.
+func ServedOn(base, host string) bool {
+	if base == BaseURL() {
+		return ScansDefault(host)
+	}
+	return baseHost(base) == hostName(host)
+}
+
+// RequestHost is the host the request was sent to.
+func RequestHost(req *http.Request) string {
+	return hostName(req.Host)
+}
+
+// sendDomains writes the domain list.
+func sendDomains(www http.ResponseWriter, list []DomainType) {
+	sort.Slice(list, func(i, j int) bool { return list[i].Host < list[j].Host })
+	www.Header().Set("Content-Type", "application/json; charset=utf-8")
+	fmt.Fprintf(www, `{"status":"success","default":%q,"list":%s}`+"\n", BaseURL(), SVar(list))
+}
+
+/*
+/api/add-domain?base_url=https://go.brand-a.com&users=a,b&teams=t1,t2 - registers a short domain, or
+replaces the users and teams of one that is registered.  The domain must point at this server.  Admin only.
+*/
+func respHandlerAddDomain(www http.ResponseWriter, req *http.Request) {
+	if !CheckAuth(www, req) {
+		return
+	}
+	if !IsAdmin(req) {
+		AnError(www, req, 403, "Admin only")
+		return
+	}
+
+	base, err := NormalizeBaseURL(GetParam(www, req, "base_url", ""))
+	if err != nil {
+		AnError(www, req, 406, err.Error())
+		return
+	}
+	host := baseHost(base)
+	if IsDefaultHost(host) {
+		AnError(www, req, 406, fmt.Sprintf("%s is the default host", host))
+		return
+	}
+	dt := DomainType{Host: host, BaseURL: base, Users: splitList(GetParam(www, req, "users", "")),
+		Teams: splitList(GetParam(www, req, "teams", "")), Created: time.Now().Unix()}
+	if err = redisClient.Cmd("HSET", "qr-domain:", host, SVar(dt)).Err; err != nil {
+		AnError(www, req, 500, "Config Error 36")
+		return
+	}
+	LoadDomains()
+
+	www.Header().Set("Content-Type", "application/json; charset=utf-8")
+	fmt.Fprintf(www, `{"status":"success","domain":%s}`+"\n", SVar(dt))
+}
+
+/*
+/api/del-domain?host=go.brand-a.com - removes a short domain.  Its QRs stop working until it is added
+again.  Admin only.
+*/
+func respHandlerDelDomain(www http.ResponseWriter, req *http.Request) {
+	if !CheckAuth(www, req) {
+		return
+	}
+	if !IsAdmin(req) {
+		AnError(www, req, 403, "Admin only")
+		return
+	}
+
+	host := hostName(GetParam(www, req, "host", ""))
+	if host == "" {
+		AnError(www, req, 406, "Missing Parameter")
+		return
+	}
+	if n, err := redisClient.Cmd("HDEL", "qr-domain:", host).Int(); err != nil || n == 0 {
+		AnError(www, req, 404, "Not Found")
+		return
+	}
+	LoadDomains()
+
+	www.Header().Set("Content-Type", "application/json; charset=utf-8")
+	fmt.Fprintf(www, `{"status":"success"}`+"\n")
+}
+
+/*
+/api/list-domain - the registered domains, for an admin, or the domains the user can make QRs with.
+*/
+func respHandlerListDomain(www http.ResponseWriter, req *http.Request) {
+	if !CheckAuth(www, req) {
+		return
+	}
+
+	list := []DomainType{}
+	if IsAdmin(req) {
+		domains.lock.RLock()
+		for _, dt := range domains.domains {
+			list = append(list, dt)
+		}
+		domains.lock.RUnlock()
+	} else {
+		for _, base := range UserBaseURLs(AuthUser(req))[1:] {
+			list = append(list, DomainType{Host: baseHost(base), BaseURL: base})
+		}
+	}
+	sendDomains(www, list)
+}
+
+/*
+/api/set-team?team=T&users=a,b,c - sets the users in a team, users= empty removes the team.  Admin only.
+*/
+func respHandlerSetTeam(www http.ResponseWriter, req *http.Request) {
+	if !CheckAuth(www, req) {
+		return
+	}
+	if !IsAdmin(req) {
+		AnError(www, req, 403, "Admin only")
+		return
+	}
+
+	team := strings.TrimSpace(GetParam(www, req, "team", ""))
+	if team == "" {
+		AnError(www, req, 406, "Missing Parameter")
+		return
+	}
+	users := splitList(GetParam(www, req, "users", ""))
+	var err error
+	if len(users) == 0 {
+		err = redisClient.Cmd("HDEL", "qr-team:", team).Err
+	} else {
+		err = redisClient.Cmd("HSET", "qr-team:", team, SVar(users)).Err
+	}
+	if err != nil {
+		AnError(www, req, 500, "Config Error 37")
+		return
+	}
+	LoadDomains()
+
+	www.Header().Set("Content-Type", "application/json; charset=utf-8")
+	fmt.Fprintf(www, `{"status":"success","team":%q,"users":%s}`+"\n", team, SVar(users))
+}
+
+/*
+/api/list-team - the teams and their users.  Admin only.
+*/
+func respHandlerListTeam(www http.ResponseWriter, req *http.Request) {
+	if !CheckAuth(www, req) {
+		return
+	}
+	if !IsAdmin(req) {
+		AnError(www, req, 403, "Admin only")
+		return
+	}
+
+	domains.lock.RLock()
+	teams := SVar(domains.teams)
+	domains.lock.RUnlock()
+
+	www.Header().Set("Content-Type", "application/json; charset=utf-8")
+	fmt.Fprintf(www, `{"status":"success","teams":%s}`+"\n", teams)
+}
+
+// splitList splits a comma separated list, dropping empty entries.
+func splitList(s string) (list []string) {
+	for _, v := range strings.Split(s, ",") {
+		if v = strings.TrimSpace(v); v != "" {
+			list = append(list, v)
+		}
+	}
+	return
+}
+
+/* vim: set noai ts=4 sw=4: */
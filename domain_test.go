@@ -0,0 +1,110 @@
+package main
+
+// MIT Licensed - see LICENSE
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestScopedID(t *testing.T) {
+	gCfg.HostPort, gCfg.PublicBaseURL, gCfg.ExtraHosts = "localhost:8333", "https://qr.example.com", "10.0.0.5"
+	SetDomains(map[string]DomainType{
+		"go.brand-a.com": {Host: "go.brand-a.com", BaseURL: "https://go.brand-a.com"},
+		"brand-b.link":   {Host: "brand-b.link", BaseURL: "https://brand-b.link"},
+	}, nil)
+	defer func() { gCfg.PublicBaseURL, gCfg.ExtraHosts = "", ""; SetDomains(nil, nil) }()
+
+	tests := []struct {
+		host     string
+		name     string
+		own      bool
+		expected string
+	}{
+		{"qr.example.com", "promo", true, "promo"},
+		{"localhost:8333", "10001", true, "10001"},
+		{"10.0.0.5:8333", "promo", true, "promo"},
+		{"GO.Brand-A.com", "promo", true, "promo@go.brand-a.com"},
+		{"brand-b.link:443", "promo", true, "promo@brand-b.link"},
+		{"brand-b.link", "10001", true, "10001"},
+		{"evil.example.com", "promo", false, ""},
+	}
+
+	for ii, test := range tests {
+		if own := IsOwnHost(test.host); own != test.own {
+			t.Errorf("Test %d, %s expected own %v\n", ii, test.host, test.own)
+		}
+		if !test.own {
+			continue
+		}
+		if got := ScopedID(test.host, test.name); got != test.expected {
+			t.Errorf("Test %d, expected %s got %s\n", ii, test.expected, got)
+		}
+	}
+
+	if got := QRContentAt("https://go.brand-a.com", "promo@go.brand-a.com"); got != "https://go.brand-a.com/Q/promo" {
+		t.Errorf("Expected the slug without its host, got %s\n", got)
+	}
+
+	// Without custom domains any host is served, as before there were custom domains.
+	SetDomains(nil, nil)
+	for ii, host := range []string{"evil.example.com", "old-name.example.com:8080", "backend"} {
+		if !ScansDefault(host) || ScopedID(host, "promo") != "promo" || !ServedOn(BaseURL(), host) {
+			t.Errorf("Test %d, expected %s to be the default host with no custom domains\n", ii, host)
+		}
+	}
+}
+
+func TestServedOn(t *testing.T) {
+	gCfg.HostPort, gCfg.PublicBaseURL = "localhost:8333", "https://qr.example.com"
+	SetDomains(map[string]DomainType{"go.brand-a.com": {Host: "go.brand-a.com", BaseURL: "https://go.brand-a.com"}}, nil)
+	defer func() { gCfg.PublicBaseURL = ""; SetDomains(nil, nil) }()
+
+	tests := []struct {
+		base     string
+		host     string
+		expected bool
+	}{
+		{"https://qr.example.com", "qr.example.com", true},
+		{"https://qr.example.com", "localhost:8333", true},
+		{"https://qr.example.com", "go.brand-a.com", false},
+		{"https://go.brand-a.com", "go.brand-a.com", true},
+		{"https://go.brand-a.com", "qr.example.com", false},
+		{"https://go.brand-a.com", "brand-b.link", false},
+	}
+
+	for ii, test := range tests {
+		if got := ServedOn(test.base, test.host); got != test.expected {
+			t.Errorf("Test %d, expected %v got %v\n", ii, test.expected, got)
+		}
+	}
+}
+
+func TestUserDomainURLs(t *testing.T) {
+	gCfg.HostPort = "localhost:8333"
+	SetDomains(map[string]DomainType{
+		"go.brand-a.com": {Host: "go.brand-a.com", BaseURL: "https://go.brand-a.com", Users: []string{"bob"}},
+		"brand-b.link":   {Host: "brand-b.link", BaseURL: "https://brand-b.link", Teams: []string{"brand-b"}},
+	}, map[string][]string{"brand-b": {"alice", "bob"}})
+	defer SetDomains(nil, nil)
+
+	tests := []struct {
+		user     string
+		expected []string
+	}{
+		{"bob", []string{"http://localhost:8333", "https://brand-b.link", "https://go.brand-a.com"}},
+		{"alice", []string{"http://localhost:8333", "https://brand-b.link"}},
+		{"carol", []string{"http://localhost:8333"}},
+	}
+
+	for ii, test := range tests {
+		if got := UserBaseURLs(test.user); !reflect.DeepEqual(got, test.expected) {
+			t.Errorf("Test %d, expected %s got %s\n", ii, SVar(test.expected), SVar(got))
+		}
+	}
+	if _, err := ChooseBaseURL("alice", "go.brand-a.com"); err == nil {
+		t.Errorf("Expected alice not to have go.brand-a.com\n")
+	}
+}
+
+/* vim: set noai ts=4 sw=4: */
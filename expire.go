@@ -0,0 +1,101 @@
+package main
+
+// MIT Licensed - see LICENSE
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"path/filepath"
+	"strconv"
+	"time"
+
+	"github.com/pschlump/json"
+)
+
+// ExpireType limits how long or how many times a QR will redirect.  It is kept in qr-expire:{id}.
+type ExpireType struct {
+	Expires  int64 `json:"expires,omitempty"`   // unix time after which the QR stops redirecting, 0 for never
+	MaxScans int64 `json:"max_scans,omitempty"` // number of scans allowed, 0 for no limit
+}
+
+// IsZero is true if there is no limit set.
+func (ex ExpireType) IsZero() bool {
+	return ex.Expires == 0 && ex.MaxScans == 0
+}
+
+// TimeExpired is true if the expiry time has passed at now.
+func (ex ExpireType) TimeExpired(now time.Time) bool {
+	return ex.Expires != 0 && now.Unix() >= ex.Expires
+}
+
+// Expired is true if the expiry time has passed or count scans is over the limit.
+func (ex ExpireType) Expired(now time.Time, count int64) bool {
+	return ex.TimeExpired(now) || (ex.MaxScans != 0 && count >= ex.MaxScans)
+}
+
+// GetExpire returns the limits on id.  A QR without limits returns a zero ExpireType.
+func GetExpire(id string) (ex ExpireType) {
+	s, err := redisClient.Cmd("GET", fmt.Sprintf("qr-expire:%s", id)).Str()
+	if err == nil {
+		json.Unmarshal([]byte(s), &ex)
+	}
+	return
+}
+
+// SaveExpire stores the limits on id, removing the key if there are none.
+func SaveExpire(id string, ex ExpireType) error {
+	key := fmt.Sprintf("qr-expire:%s", id)
+	if ex.IsZero() {
+		return redisClient.Cmd("DEL", key).Err
+	}
+	return redisClient.Cmd("SET", key, SVar(ex)).Err
+}
+
+// ParseExpireParams applies the "expires" and "max_scans" parameters to ex.  expires is a unix time or a
+// date/time in UTC, max_scans a count.  "none" or "0" removes the limit.  An empty string leaves it as is.
+func ParseExpireParams(ex ExpireType, sExpires, sMaxScans string) (ExpireType, error) {
+	switch sExpires {
+	case "":
+	case "none", "0":
+		ex.Expires = 0
+	default:
+		if n, err := strconv.ParseInt(sExpires, 10, 64); err == nil {
+			ex.Expires = n
+		} else if t, err := parseScheduleTime(sExpires, time.UTC); err == nil {
+			ex.Expires = t.Unix()
+		} else {
+			return ex, fmt.Errorf("Invalid expires %q", sExpires)
+		}
+	}
+	switch sMaxScans {
+	case "":
+	case "none":
+		ex.MaxScans = 0
+	default:
+		n, err := strconv.ParseInt(sMaxScans, 10, 64)
+		if err != nil || n < 0 {
+			return ex, fmt.Errorf("Invalid max_scans %q", sMaxScans)
+		}
+		ex.MaxScans = n
+	}
+	return ex, nil
+}
+
+// ServeExpired sends the response for a scan of a QR that has expired.  This is the page in gCfg.ExpiredPage,
+// under gCfg.Dir, if one is configured - or a plain 410 Gone.
+func ServeExpired(www http.ResponseWriter, req *http.Request) {
+	if gCfg.ExpiredPage != "" {
+		buf, err := ioutil.ReadFile(filepath.Join(gCfg.Dir, gCfg.ExpiredPage))
+		if err == nil {
+			www.Header().Set("Content-Type", "text/html; charset=utf-8")
+			www.WriteHeader(http.StatusGone)
+			www.Write(buf)
+			return
+		}
+		LogReq(req, LevelError, "unable to read expired page", "file", gCfg.ExpiredPage, "error", err)
+	}
+	http.Error(www, "This QR code has expired\n", http.StatusGone)
+}
+
+/* vim: set noai ts=4 sw=4: */
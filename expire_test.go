@@ -0,0 +1,164 @@
+package main
+
+// MIT Licensed - see LICENSE
+
+import (
+	"fmt"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/pschlump/json"
+)
+
+func TestParseExpireParams(t *testing.T) {
+	old := ExpireType{Expires: 1800000000, MaxScans: 10}
+	tests := []struct {
+		expires  string
+		maxScans string
+		expected ExpireType
+		isErr    bool
+	}{
+		{"", "", old, false},
+		{"1900000000", "", ExpireType{Expires: 1900000000, MaxScans: 10}, false},
+		{"2030-01-02 03:04", "", ExpireType{Expires: time.Date(2030, 1, 2, 3, 4, 0, 0, time.UTC).Unix(), MaxScans: 10}, false},
+		{"none", "none", ExpireType{}, false},
+		{"0", "5", ExpireType{MaxScans: 5}, false},
+		{"", "0", ExpireType{Expires: 1800000000}, false},
+		{"soon", "", old, true},
+		{"", "-1", old, true},
+		{"", "many", old, true},
+	}
+
+	for ii, test := range tests {
+		got, err := ParseExpireParams(old, test.expires, test.maxScans)
+		if (err != nil) != test.isErr {
+			t.Errorf("Test %d, expected error %v got %v\n", ii, test.isErr, err)
+		} else if !test.isErr && got != test.expected {
+			t.Errorf("Test %d, expected %s got %s\n", ii, SVar(test.expected), SVar(got))
+		}
+	}
+}
+
+func TestExpired(t *testing.T) {
+	now := time.Unix(1800000000, 0)
+	tests := []struct {
+		ex       ExpireType
+		count    int64
+		expected bool
+	}{
+		{ExpireType{}, 1000, false},
+		{ExpireType{Expires: 1800000001}, 0, false},
+		{ExpireType{Expires: 1800000000}, 0, true},
+		{ExpireType{MaxScans: 3}, 2, false},
+		{ExpireType{MaxScans: 3}, 3, true},
+		{ExpireType{Expires: 1900000000, MaxScans: 3}, 4, true},
+	}
+
+	for ii, test := range tests {
+		if got := test.ex.Expired(now, test.count); got != test.expected {
+			t.Errorf("Test %d, expected %v got %v\n", ii, test.expected, got)
+		}
+	}
+}
+
+func TestMaxScans(t *testing.T) {
+	_, done := testRedis(t)
+	defer done()
+
+	redisClient.Cmd("MSET", "qrr:10001", "http://a.example.com/", "qr-count:10001", 0)
+	SaveExpire("10001", ExpireType{MaxScans: 2})
+
+	tests := []struct {
+		code  int
+		count int64
+	}{
+		{code: 303, count: 1},
+		{code: 303, count: 2},
+		{code: 410, count: 2}, // scans after the limit are not counted
+		{code: 410, count: 2},
+	}
+	for ii, test := range tests {
+		rec := httptest.NewRecorder()
+		respHandlerRedirect(rec, httptest.NewRequest("GET", "/q/10001", nil))
+		count, _ := redisClient.Cmd("GET", "qr-count:10001").Int64()
+		if rec.Code != test.code || count != test.count {
+			t.Errorf("Test %d, expected %d with count %d got %d %d\n", ii, test.code, test.count, rec.Code, count)
+		}
+	}
+}
+
+func TestUpdExpireEvent(t *testing.T) {
+	_, done := testRedis(t)
+	defer done()
+
+	redisClient.Cmd("MSET", "qrr:10001", "http://a.example.com/", "qr-token:tok", "bob")
+	redisClient.Cmd("HSET", "qr-hook:", "h1", SVar(HookType{HookID: "h1", URL: "http://127.0.0.1:1/", Events: []string{"qr.updated"}}))
+
+	req := httptest.NewRequest("GET", "/api/upd-qr?id=10001&max_scans=5", nil)
+	req.Header.Set("X-Auth", "tok")
+	rec := httptest.NewRecorder()
+	respHandlerUpdQR(rec, req)
+	if rec.Code != 200 {
+		t.Fatalf("Expected 200 got %d %s\n", rec.Code, rec.Body.String())
+	}
+
+	var keys []string
+	for ii := 0; ii < 100 && len(keys) == 0; ii++ { // the event is sent in the background
+		time.Sleep(10 * time.Millisecond)
+		keys, _ = redisClient.Cmd("KEYS", "qr-hook-dlv:*").List()
+	}
+	if len(keys) != 1 {
+		t.Fatalf("Expected one qr.updated delivery, got %d\n", len(keys))
+	}
+	s, _ := redisClient.Cmd("GET", keys[0]).Str()
+	var dl HookDelivery
+	json.Unmarshal([]byte(s), &dl)
+	if !strings.Contains(dl.Body, fmt.Sprintf(`"url":%q`, "http://a.example.com/")) {
+		t.Errorf("Expected the current target in the event, got %s\n", dl.Body)
+	}
+}
+
+func TestListQR(t *testing.T) {
+	_, done := testRedis(t)
+	defer done()
+
+	redisClient.Cmd("MSET", "qr-token:tok", "bob", "qr-id:", 10003, "qrr:10001", "http://a.example.com/", "qrr:10003", "http://c.example.com/",
+		"qrr:promo", "http://p.example.com/", "qrr:menu@brand-b.link", "http://m.example.com/", "qr-count:promo", 2)
+	redisClient.Cmd("SADD", "qr-slug-ids", "promo", "menu@brand-b.link")
+	SaveExpire("promo", ExpireType{Expires: 1900000000, MaxScans: 2})
+
+	tests := []struct {
+		query    string
+		expected []string
+	}{
+		{query: "", expected: []string{"10003", "10001", "menu@brand-b.link", "promo"}},
+		{query: "limit=2", expected: []string{"10003", "10001"}},
+		{query: "offset=2&limit=2", expected: []string{"10001", "menu@brand-b.link"}}, // 10002 was deleted
+		{query: "offset=3", expected: []string{"menu@brand-b.link", "promo"}},
+		{query: "offset=5", expected: []string{}},
+	}
+	for ii, test := range tests {
+		req := httptest.NewRequest("GET", "/api/list-qr?"+test.query, nil)
+		req.Header.Set("X-Auth", "tok")
+		rec := httptest.NewRecorder()
+		respHandlerListQR(rec, req)
+		var rv struct {
+			List []QRListItem `json:"list"`
+		}
+		json.Unmarshal(rec.Body.Bytes(), &rv)
+		ids := []string{}
+		for _, it := range rv.List {
+			ids = append(ids, it.ID)
+			if it.ID == "promo" && (it.Expires != 1900000000 || it.MaxScans != 2 || it.Count != 2 || !it.Expired) {
+				t.Errorf("Test %d, expected promo with its expiry and max_scans, got %s\n", ii, SVar(it))
+			}
+		}
+		if SVar(ids) != SVar(test.expected) {
+			t.Errorf("Test %d, expected %s got %s\n", ii, SVar(test.expected), SVar(ids))
+		}
+	}
+}
+
+/* vim: set noai ts=4 sw=4: */
@@ -0,0 +1,136 @@
+package main
+
+// MIT Licensed - see LICENSE
+
+import (
+	"bytes"
+	"encoding/csv"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/pschlump/json"
+)
+
+// ExportItem is one QR in an export.
+type ExportItem struct {
+	ID          string `json:"id"`
+	URL         string `json:"url"`
+	Label       string `json:"label,omitempty"`
+	Count       int64  `json:"count"`
+	Expires     int64  `json:"expires,omitempty"`
+	MaxScans    int64  `json:"max_scans,omitempty"`
+	Quarantined bool   `json:"quarantined"`
+}
+
+// ExportJob is the params of an export job.
+type ExportJob struct {
+	Format string `json:"format"` // csv or json
+}
+
+// ExportIDs returns the IDs of every QR, the numbered IDs in order then the slugs from qr-slug-ids.
+func ExportIDs() (ids []string, err error) {
+	last, err := redisClient.Cmd("GET", "qr-id:").Int()
+	if err != nil {
+		return nil, err
+	}
+	for id := 10001; id <= last; id++ { // IDs start at 10001, see CheckSetup.
+		ids = append(ids, strconv.Itoa(id))
+	}
+	slugs, _ := redisClient.Cmd("SORT", "qr-slug-ids", "ALPHA").List()
+	return append(ids, slugs...), nil
+}
+
+// WriteExport writes the items as CSV or JSON.
+func WriteExport(w io.Writer, items []ExportItem, format string) error {
+	if format == "json" {
+		_, err := io.WriteString(w, SVar(items)+"\n")
+		return err
+	}
+	cw := csv.NewWriter(w)
+	cw.Write([]string{"id", "url", "label", "count", "expires", "max_scans", "quarantined"})
+	for _, it := range items {
+		ex := ""
+		if it.Expires > 0 {
+			ex = time.Unix(it.Expires, 0).UTC().Format(time.RFC3339)
+		}
+		cw.Write([]string{it.ID, it.URL, it.Label, strconv.FormatInt(it.Count, 10), ex, strconv.FormatInt(it.MaxScans, 10), strconv.FormatBool(it.Quarantined)})
+	}
+	cw.Flush()
+	return cw.Error()
+}
+
+func runExportJob(job *Job) (result interface{}, err error) {
+	var ej ExportJob
+	if err = json.Unmarshal([]byte(job.Params), &ej); err != nil {
+		return nil, err
+	}
+	ids, err := ExportIDs()
+	if err != nil {
+		return nil, err
+	}
+
+	items := make([]ExportItem, 0, len(ids))
+	for ii, id := range ids {
+		if ii%100 == 0 {
+			if job.Canceled() {
+				return nil, nil
+			}
+			job.Progress(ii, 0, len(ids))
+		}
+		to, err := redisClient.Cmd("GET", fmt.Sprintf("qrr:%s", id)).Str()
+		if err != nil {
+			continue // deleted
+		}
+		it := ExportItem{ID: id, URL: to}
+		it.Label, _ = redisClient.Cmd("GET", fmt.Sprintf("qr-label:%s", id)).Str()
+		it.Count, _ = redisClient.Cmd("GET", fmt.Sprintf("qr-count:%s", id)).Int64()
+		ex := GetExpire(id)
+		it.Expires, it.MaxScans = ex.Expires, ex.MaxScans
+		n, _ := redisClient.Cmd("EXISTS", fmt.Sprintf("qr-quarantine:%s", id)).Int()
+		it.Quarantined = n > 0
+		items = append(items, it)
+	}
+	job.Progress(len(ids), 0, len(ids))
+
+	var buf bytes.Buffer
+	if err = WriteExport(&buf, items, ej.Format); err != nil {
+		return nil, err
+	}
+	ct := "text/csv; charset=utf-8"
+	if ej.Format == "json" {
+		ct = "application/json; charset=utf-8"
+	}
+	if err = job.SaveFile(fmt.Sprintf("qr-export-%s.%s", time.Now().UTC().Format("20060102-150405"), ej.Format), ct, buf.Bytes()); err != nil {
+		return nil, err
+	}
+	return map[string]int{"rows": len(items)}, nil
+}
+
+/*
+/api/export?format=csv|json - queues an export of every QR with its target, label, count and limits.
+Returns a job_id, the file is downloaded from /api/job-result when the job is done.
+*/
+func respHandlerExport(www http.ResponseWriter, req *http.Request) {
+	if !CheckAuth(www, req) {
+		return
+	}
+
+	format := GetParam(www, req, "format", "csv")
+	if format != "csv" && format != "json" {
+		AnError(www, req, 406, fmt.Sprintf("Invalid format %q", format))
+		return
+	}
+	jid, err := EnqueueJob("", "export", ExportJob{Format: format}, AuthUser(req))
+	if err != nil {
+		AnError(www, req, 500, "Config Error 34")
+		return
+	}
+
+	www.Header().Set("Content-Type", "application/json; charset=utf-8")
+	fmt.Fprintf(www, `{"status":"success","job_id":%q,"status_url":"/api/job-status?job_id=%s","result_url":"/api/job-result?job_id=%s"}`+"\n", jid, jid, jid)
+}
+
+/* vim: set noai ts=4 sw=4: */
@@ -0,0 +1,36 @@
+package main
+
+// MIT Licensed - see LICENSE
+
+import (
+	"bytes"
+	"testing"
+)
+
+func TestWriteExport(t *testing.T) {
+	items := []ExportItem{
+		{ID: "10001", URL: "https://a.example.com/", Label: "Box, A", Count: 12, Expires: 1735689600, MaxScans: 100},
+		{ID: "promo-1", URL: "https://b.example.com/", Quarantined: true},
+	}
+	tests := []struct {
+		format   string
+		expected string
+	}{
+		{"csv", "id,url,label,count,expires,max_scans,quarantined\n" +
+			"10001,https://a.example.com/,\"Box, A\",12,2025-01-01T00:00:00Z,100,false\n" +
+			"promo-1,https://b.example.com/,,0,,0,true\n"},
+		{"json", `[{"id":"10001","url":"https://a.example.com/","label":"Box, A","count":12,"expires":1735689600,"max_scans":100,"quarantined":false},` +
+			`{"id":"promo-1","url":"https://b.example.com/","count":0,"quarantined":true}]` + "\n"},
+	}
+
+	for ii, test := range tests {
+		var buf bytes.Buffer
+		if err := WriteExport(&buf, items, test.format); err != nil {
+			t.Errorf("Test %d, error %s\n", ii, err)
+		} else if buf.String() != test.expected {
+			t.Errorf("Test %d, expected\n%s\ngot\n%s\n", ii, test.expected, buf.String())
+		}
+	}
+}
+
+/* vim: set noai ts=4 sw=4: */
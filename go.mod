@@ -3,7 +3,11 @@ module github.com/pschlump/qr-svr
 go 1.13
 
 require (
+	github.com/alicebob/miniredis/v2 v2.14.3
 	github.com/fatih/structtag v1.2.0
+	github.com/prometheus/client_golang v1.11.1
+	github.com/prometheus/client_model v0.2.0
+	github.com/prometheus/common v0.26.0
 	github.com/pschlump/MiscLib v1.0.0
 	github.com/pschlump/godebug v1.0.1
 	github.com/pschlump/goqrcode v1.0.1
@@ -11,5 +15,6 @@ require (
 	github.com/pschlump/jsonSyntaxErrorLib v1.0.1
 	github.com/pschlump/radix.v2 v0.2.1
 	github.com/pschlump/uuid v1.0.3
-	golang.org/x/crypto v0.0.0-20200406173513-056763e48d71
+	github.com/yuin/goldmark v1.2.1
+	golang.org/x/crypto v0.0.0-20200622213623-75b288015ac9
 )
@@ -0,0 +1,173 @@
+package main
+
+// MIT Licensed - see LICENSE
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"time"
+)
+
+// Health checks.
+//
+// /healthz is liveness: it answers as long as the process is serving, and checks nothing else, so a
+// Redis outage does not get the server restarted.  /readyz is readiness: Redis, a write to QRDir, the
+// free space on the disk QRDir is on and the config are each checked, and any failure is a 503 so a load
+// balancer stops sending traffic.  Version and Commit are set when building, see the Makefile.
+
+var (
+	Version = "dev"     // -ldflags "-X main.Version=..."
+	Commit  = "unknown" // -ldflags "-X main.Commit=..."
+)
+
+var startTime = time.Now()
+
+var checkTimeout = 2 * time.Second
+
+// CheckResult is the outcome of one readiness check.
+type CheckResult struct {
+	Name      string  `json:"name"`
+	Status    string  `json:"status"` // ok or fail
+	LatencyMS float64 `json:"latency_ms"`
+	Error     string  `json:"error,omitempty"`
+}
+
+// HealthCheck is a named check, it returns nil if all is well.
+type HealthCheck struct {
+	Name  string
+	Check func() error
+}
+
+// ReadyChecks are the checks /readyz runs.
+func ReadyChecks() []HealthCheck {
+	return []HealthCheck{
+		{Name: "redis", Check: checkRedis},
+		{Name: "qr_dir", Check: func() error { return checkWritable(gCfg.QRDir) }},
+		{Name: "disk", Check: func() error { return checkDiskFree(gCfg.QRDir, int64(gCfg.MinFreeMB)<<20) }},
+		{Name: "config", Check: CheckConfig},
+	}
+}
+
+// RunChecks runs the checks at the same time, each with checkTimeout, and is true if all of them pass.
+func RunChecks(checks []HealthCheck) (ok bool, results []CheckResult) {
+	results = make([]CheckResult, len(checks))
+	done := make(chan int, len(checks))
+	for ii, hc := range checks {
+		go func(ii int, hc HealthCheck) {
+			start := time.Now()
+			errCh := make(chan error, 1)
+			go func() { errCh <- hc.Check() }()
+			var err error
+			select {
+			case err = <-errCh:
+			case <-time.After(checkTimeout):
+				err = fmt.Errorf("Timed out after %s", checkTimeout)
+			}
+			results[ii] = CheckResult{Name: hc.Name, Status: "ok", LatencyMS: float64(time.Since(start).Microseconds()) / 1000}
+			if err != nil {
+				results[ii].Status, results[ii].Error = "fail", err.Error()
+			}
+			done <- ii
+		}(ii, hc)
+	}
+	ok = true
+	for range checks {
+		if ii := <-done; results[ii].Status != "ok" {
+			ok = false
+		}
+	}
+	return
+}
+
+func checkRedis() error {
+	if redisClient == nil {
+		return fmt.Errorf("Not connected")
+	}
+	if s, err := redisClient.Cmd("PING").Str(); err != nil {
+		return err
+	} else if s != "PONG" {
+		return fmt.Errorf("PING returned %q", s)
+	}
+	return nil
+}
+
+// checkWritable writes and removes a file in dir.
+func checkWritable(dir string) error {
+	fh, err := ioutil.TempFile(dir, ".readyz-")
+	if err != nil {
+		return err
+	}
+	name := fh.Name()
+	_, err = fh.Write([]byte("ok\n"))
+	if e := fh.Close(); err == nil {
+		err = e
+	}
+	os.Remove(name)
+	return err
+}
+
+// checkDiskFree fails if dir has less than min bytes free, or the free space can not be found.
+func checkDiskFree(dir string, min int64) error {
+	free, err := diskFree(dir)
+	if err != nil {
+		return err
+	}
+	if free < min {
+		return fmt.Errorf("%d MB free, less than min_free_mb %d", free>>20, min>>20)
+	}
+	return nil
+}
+
+// CheckConfig checks the settings that are read once and would otherwise only fail when used.
+func CheckConfig() error {
+	if gCfg.HostPort == "" {
+		return fmt.Errorf("host_port is not set")
+	}
+	if gCfg.QRDir == "" {
+		return fmt.Errorf("QRDir is not set")
+	}
+	if gCfg.PublicBaseURL != "" {
+		if _, err := NormalizeBaseURL(gCfg.PublicBaseURL); err != nil {
+			return err
+		}
+	}
+	if _, err := ParseLevel(gCfg.LogLevel); err != nil {
+		return err
+	}
+	if (gCfg.TLSCert == "") != (gCfg.TLSKey == "") {
+		return fmt.Errorf("tls_cert and tls_key must both be set")
+	}
+	if !RedirectModes[gCfg.RedirectMode] {
+		return fmt.Errorf("Invalid redirect_mode %q", gCfg.RedirectMode)
+	}
+	return nil
+}
+
+/*
+/healthz - liveness, 200 while the process is serving requests.
+*/
+func respHandlerHealthz(www http.ResponseWriter, req *http.Request) {
+	www.Header().Set("Content-Type", "application/json; charset=utf-8")
+	www.Header().Set("Cache-Control", "no-store")
+	fmt.Fprintf(www, `{"status":"ok","version":%q,"commit":%q,"uptime_s":%d}`+"\n", Version, Commit, int64(time.Since(startTime).Seconds()))
+}
+
+/*
+/readyz - readiness, 200 if every check passes, else 503, with the result of each check.
+*/
+func respHandlerReadyz(www http.ResponseWriter, req *http.Request) {
+	ok, results := RunChecks(ReadyChecks())
+	status, code := "ok", http.StatusOK
+	if !ok {
+		status, code = "fail", http.StatusServiceUnavailable
+		LogReq(req, LevelWarn, "not ready", "checks", results)
+	}
+	www.Header().Set("Content-Type", "application/json; charset=utf-8")
+	www.Header().Set("Cache-Control", "no-store")
+	www.WriteHeader(code)
+	fmt.Fprintf(www, `{"status":%q,"version":%q,"commit":%q,"checks":%s}`+"\n", status, Version, Commit, SVar(results))
+}
+
+/* vim: set noai ts=4 sw=4: */
@@ -0,0 +1,136 @@
+package main
+
+// MIT Licensed - see LICENSE
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/pschlump/json"
+)
+
+func TestRunChecks(t *testing.T) {
+	defer func(d time.Duration) { checkTimeout = d }(checkTimeout)
+	checkTimeout = 50 * time.Millisecond
+
+	pass := HealthCheck{Name: "pass", Check: func() error { return nil }}
+	fail := HealthCheck{Name: "fail", Check: func() error { return fmt.Errorf("broken") }}
+	slow := HealthCheck{Name: "slow", Check: func() error { time.Sleep(time.Second); return nil }}
+
+	tests := []struct {
+		checks []HealthCheck
+		ok     bool
+		errs   []string
+	}{
+		{checks: []HealthCheck{pass}, ok: true, errs: []string{""}},
+		{checks: []HealthCheck{pass, fail}, ok: false, errs: []string{"", "broken"}},
+		{checks: []HealthCheck{slow, pass}, ok: false, errs: []string{"Timed out after 50ms", ""}},
+	}
+	for ii, test := range tests {
+		ok, results := RunChecks(test.checks)
+		if ok != test.ok {
+			t.Errorf("Test %d, expected ok %v, got %v\n", ii, test.ok, ok)
+		}
+		for jj, r := range results {
+			if r.Name != test.checks[jj].Name || r.Error != test.errs[jj] || (r.Status == "ok") != (test.errs[jj] == "") {
+				t.Errorf("Test %d, check %d, expected %s with error %q, got %+v\n", ii, jj, test.checks[jj].Name, test.errs[jj], r)
+			}
+		}
+	}
+}
+
+func TestCheckDisk(t *testing.T) {
+	dir, err := ioutil.TempDir("", "qr-health")
+	if err != nil {
+		t.Fatalf("TempDir: %s\n", err)
+	}
+	defer os.RemoveAll(dir)
+
+	tests := []struct {
+		err error
+		ok  bool
+	}{
+		{err: checkWritable(dir), ok: true},
+		{err: checkWritable(filepath.Join(dir, "missing")), ok: false},
+		{err: checkDiskFree(dir, 0), ok: true},
+		{err: checkDiskFree(dir, 1<<62), ok: false},
+	}
+	for ii, test := range tests {
+		if (test.err == nil) != test.ok {
+			t.Errorf("Test %d, expected ok %v, got %v\n", ii, test.ok, test.err)
+		}
+	}
+	if list, _ := ioutil.ReadDir(dir); len(list) != 0 {
+		t.Errorf("Test %d, expected the check file to be removed, found %d files\n", len(tests), len(list))
+	}
+}
+
+func TestCheckConfig(t *testing.T) {
+	saved := gCfg
+	defer func() { gCfg = saved }()
+
+	tests := []struct {
+		set func()
+		err string
+	}{
+		{set: func() {}, err: ""},
+		{set: func() { gCfg.HostPort = "" }, err: "host_port"},
+		{set: func() { gCfg.PublicBaseURL = "ftp://x" }, err: "must be http or https"},
+		{set: func() { gCfg.LogLevel = "loud" }, err: "Invalid log level"},
+		{set: func() { gCfg.TLSCert = "cert.pem" }, err: "tls_key"},
+		{set: func() { gCfg.RedirectMode = "999" }, err: "redirect_mode"},
+	}
+	for ii, test := range tests {
+		gCfg = saved
+		gCfg.HostPort, gCfg.QRDir, gCfg.LogLevel, gCfg.RedirectMode = "localhost:8333", "./www/q", "info", "303"
+		gCfg.PublicBaseURL, gCfg.TLSCert, gCfg.TLSKey = "", "", ""
+		test.set()
+		err := CheckConfig()
+		if test.err == "" && err != nil {
+			t.Errorf("Test %d, expected no error, got %s\n", ii, err)
+		} else if test.err != "" && (err == nil || !strings.Contains(err.Error(), test.err)) {
+			t.Errorf("Test %d, expected an error with %q, got %v\n", ii, test.err, err)
+		}
+	}
+}
+
+func TestHealthEndpoints(t *testing.T) {
+	rec := httptest.NewRecorder()
+	respHandlerHealthz(rec, httptest.NewRequest("GET", "/healthz", nil))
+	if rec.Code != 200 || !strings.Contains(rec.Body.String(), `"version":"`+Version+`"`) {
+		t.Errorf("Test 0, expected 200 with the version, got %d %s\n", rec.Code, rec.Body.String())
+	}
+
+	// There is no Redis in the tests, so /readyz fails on that check alone.
+	rec = httptest.NewRecorder()
+	respHandlerReadyz(rec, httptest.NewRequest("GET", "/readyz", nil))
+	var rv struct {
+		Status string        `json:"status"`
+		Checks []CheckResult `json:"checks"`
+	}
+	if err := json.Unmarshal(rec.Body.Bytes(), &rv); err != nil {
+		t.Fatalf("Test 1, invalid JSON %s: %s\n", rec.Body.String(), err)
+	}
+	if rec.Code != 503 || rv.Status != "fail" || len(rv.Checks) != 4 {
+		t.Errorf("Test 1, expected 503 with 4 checks, got %d %s\n", rec.Code, rec.Body.String())
+	}
+	for _, c := range rv.Checks {
+		if c.Name == "redis" && c.Status != "fail" {
+			t.Errorf("Test 1, expected the redis check to fail, got %+v\n", c)
+		}
+	}
+
+	rec = httptest.NewRecorder()
+	respHandlerStatus(rec, httptest.NewRequest("GET", "/api/status", nil))
+	if rec.Code != 503 || rec.Body.Len() == 0 {
+		t.Errorf("Test 2, expected a 503 with a message, got %d %q\n", rec.Code, rec.Body.String())
+	}
+}
+
+/* vim: set noai ts=4 sw=4: */
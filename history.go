@@ -0,0 +1,178 @@
+package main
+
+// MIT Licensed - see LICENSE
+
+import (
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/pschlump/json"
+	"github.com/pschlump/radix.v2/redis"
+)
+
+// HistoryType is one version of the target URL of a QR.  The versions are kept oldest first in the
+// list qr-hist:{id} so that version N is at index N-1, the version is set from the index when the list
+// is read.
+type HistoryType struct {
+	Version    int    `json:"version"`
+	URL        string `json:"url"`
+	User       string `json:"user"`
+	Time       int64  `json:"time"`
+	RollbackOf int    `json:"rollback_of,omitempty"` // version that was restored, if this was a rollback
+}
+
+// SetTargetURL sets qrr:{id} to xurl and records the change in qr-hist:{id}.  If the QR has no history
+// yet (it was created before history was kept) then the current URL is saved first so it is not lost.
+// The SET and RPUSH are done in one MULTI/EXEC with a WATCH on the history, if another update gets in
+// after the length was read the EXEC fails and it is tried again.  The version is the length of the list
+// after the push, so two updates at the same time get different versions.
+func SetTargetURL(id, xurl, user string, rollbackOf int) (version int, err error) {
+	conn, err := redisClient.Get()
+	if err != nil {
+		return 0, err
+	}
+	defer redisClient.Put(conn)
+
+	key := fmt.Sprintf("qr-hist:%s", id)
+	h := HistoryType{URL: xurl, User: user, Time: time.Now().Unix(), RollbackOf: rollbackOf}
+	for {
+		if err = conn.Cmd("WATCH", key).Err; err != nil {
+			return 0, err
+		}
+		n, err := conn.Cmd("LLEN", key).Int()
+		if err != nil {
+			conn.Cmd("UNWATCH")
+			return 0, err
+		}
+		push := []interface{}{key}
+		if n == 0 {
+			if old, err := conn.Cmd("GET", fmt.Sprintf("qrr:%s", id)).Str(); err == nil {
+				push = append(push, SVar(HistoryType{URL: old}))
+			}
+		}
+
+		conn.Cmd("MULTI")
+		conn.Cmd("SET", fmt.Sprintf("qrr:%s", id), xurl)
+		conn.Cmd("RPUSH", append(push, SVar(h))...)
+		resp := conn.Cmd("EXEC")
+		if resp.Err != nil {
+			return 0, resp.Err
+		}
+		if resp.IsType(redis.Nil) { // history changed, try again
+			continue
+		}
+		rs, err := resp.Array()
+		if err != nil || len(rs) != 2 {
+			return 0, fmt.Errorf("Unexpected reply to EXEC: %v", resp)
+		}
+		if err = rs[0].Err; err != nil {
+			return 0, err
+		}
+		return rs[1].Int()
+	}
+}
+
+// GetHistory returns all the versions of the target URL for id, oldest first.
+func GetHistory(id string) (rv []HistoryType, err error) {
+	lst, err := redisClient.Cmd("LRANGE", fmt.Sprintf("qr-hist:%s", id), 0, -1).List()
+	if err != nil {
+		return nil, err
+	}
+	rv = make([]HistoryType, 0, len(lst))
+	for ii, s := range lst {
+		var h HistoryType
+		if json.Unmarshal([]byte(s), &h) == nil {
+			h.Version = ii + 1
+			rv = append(rv, h)
+		}
+	}
+	return
+}
+
+/*
+/api/qr-history?id=ID
+*/
+func respHandlerHistory(www http.ResponseWriter, req *http.Request) {
+	if !CheckAuth(www, req) {
+		return
+	}
+
+	id := GetParam(www, req, "id", "")
+	if id == "" {
+		AnError(www, req, 406, "Missing Parameter")
+		return
+	}
+
+	hist, err := GetHistory(id)
+	if err != nil {
+		AnError(www, req, 500, "Config Error 16")
+		return
+	}
+	if len(hist) == 0 {
+		to, err := redisClient.Cmd("GET", fmt.Sprintf("qrr:%s", id)).Str()
+		if err != nil {
+			AnError(www, req, 404, "Not Found")
+			return
+		}
+		hist = append(hist, HistoryType{Version: 1, URL: to})
+	}
+
+	www.Header().Set("Content-Type", "application/json; charset=utf-8")
+	fmt.Fprintf(www, `{"status":"success","history":%s}`+"\n", SVar(hist))
+}
+
+/*
+/api/rollback-qr?id=ID&version=N - sets the target URL back to version N.  The rollback is itself
+recorded as a new version.
+*/
+func respHandlerRollback(www http.ResponseWriter, req *http.Request) {
+	if !CheckAuth(www, req) {
+		return
+	}
+
+	id := GetParam(www, req, "id", "")
+	if id == "" {
+		AnError(www, req, 406, "Missing Parameter")
+		return
+	}
+	version, err := strconv.Atoi(GetParam(www, req, "version", ""))
+	if err != nil || version < 1 {
+		AnError(www, req, 406, "Missing Parameter")
+		return
+	}
+
+	s, err := redisClient.Cmd("LINDEX", fmt.Sprintf("qr-hist:%s", id), version-1).Str()
+	if err != nil {
+		AnError(www, req, 404, "Not Found")
+		return
+	}
+	var h HistoryType
+	if err := json.Unmarshal([]byte(s), &h); err != nil {
+		AnError(www, req, 500, "Config Error 17")
+		return
+	}
+
+	// The old URL may have been blocked or put on a threat list since, it is checked like a new one.
+	var vv Validator
+	vv.URL("url", &h.URL)
+	if vv.Send(www, req) {
+		return
+	}
+
+	newVersion, err := SetTargetURL(id, h.URL, AuthUser(req), version)
+	if err != nil {
+		AnError(www, req, 500, "Config Error 18")
+		return
+	}
+
+	Quarantine(id, AuthUser(req), vv.Threats)
+
+	go EmitEvent(HookEvent{Event: "qr.updated", ID: id, URL: h.URL})
+
+	www.Header().Set("Content-Type", "application/json; charset=utf-8")
+	fmt.Fprintf(www, `{"status":"success","url":%q,"version":%d,"quarantined":%d}`+"\n", h.URL, newVersion, len(vv.Threats))
+}
+
+/* vim: set noai ts=4 sw=4: */
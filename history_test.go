@@ -0,0 +1,134 @@
+package main
+
+// MIT Licensed - see LICENSE
+
+import (
+	"fmt"
+	"net/http/httptest"
+	"sort"
+	"sync"
+	"testing"
+)
+
+func TestSetTargetURL(t *testing.T) {
+	_, done := testRedis(t)
+	defer done()
+
+	redisClient.Cmd("SET", "qrr:10001", "http://old.example.com/")
+
+	tests := []struct {
+		url     string
+		version int
+		hist    int
+	}{
+		{url: "http://a.example.com/", version: 2, hist: 2}, // the URL from before history is saved as version 1
+		{url: "http://b.example.com/", version: 3, hist: 3},
+	}
+	for ii, test := range tests {
+		version, err := SetTargetURL("10001", test.url, "bob", 0)
+		if err != nil || version != test.version {
+			t.Errorf("Test %d, expected version %d got %d %v\n", ii, test.version, version, err)
+		}
+		hist, _ := GetHistory("10001")
+		if len(hist) != test.hist || hist[len(hist)-1].URL != test.url || hist[len(hist)-1].Version != test.version {
+			t.Errorf("Test %d, expected %d versions ending with %s, got %s\n", ii, test.hist, test.url, SVar(hist))
+		}
+	}
+
+	// Updates at the same time each get their own version.
+	var wg sync.WaitGroup
+	versions := make([]int, 10)
+	for ii := range versions {
+		wg.Add(1)
+		go func(ii int) {
+			defer wg.Done()
+			versions[ii], _ = SetTargetURL("10001", fmt.Sprintf("http://%d.example.com/", ii), "bob", 0)
+		}(ii)
+	}
+	wg.Wait()
+	sort.Ints(versions)
+	for ii, v := range versions {
+		if v != ii+4 {
+			t.Errorf("Expected versions 4 to 13, got %v\n", versions)
+			break
+		}
+	}
+	if hist, _ := GetHistory("10001"); len(hist) != 13 {
+		t.Errorf("Expected 13 versions, got %d\n", len(hist))
+	}
+}
+
+func TestRollback(t *testing.T) {
+	_, done := testRedis(t)
+	defer done()
+	defer func(schemes, block, threats string) {
+		gCfg.URLSchemes, gCfg.DomainBlockFile, gCfg.ThreatURLFile = schemes, block, threats
+	}(gCfg.URLSchemes, gCfg.DomainBlockFile, gCfg.ThreatURLFile)
+	gCfg.URLSchemes, gCfg.DomainBlockFile, gCfg.ThreatURLFile = "http,https", "", ""
+
+	redisClient.Cmd("SET", "qr-token:tok", "bob")
+	redisClient.Cmd("SET", "qrr:10001", "http://v1.example.com/")
+	SetTargetURL("10001", "http://v2.example.com/", "bob", 0)
+	SetTargetURL("10001", "http://v3.example.com/", "bob", 0)
+
+	tests := []struct {
+		query   string
+		code    int
+		url     string // qrr:10001 after
+		version int    // latest version after
+	}{
+		{query: "id=10001&version=1", code: 200, url: "http://v1.example.com/", version: 4},
+		{query: "id=10001&version=3", code: 200, url: "http://v3.example.com/", version: 5},
+		{query: "id=10001&version=9", code: 404, url: "http://v3.example.com/", version: 5},
+		{query: "id=10001&version=0", code: 406, url: "http://v3.example.com/", version: 5},
+		{query: "version=1", code: 406, url: "http://v3.example.com/", version: 5},
+		{query: "id=10002&version=1", code: 404, url: "http://v3.example.com/", version: 5},
+	}
+	for ii, test := range tests {
+		req := httptest.NewRequest("GET", "/api/rollback-qr?"+test.query, nil)
+		req.Header.Set("X-Auth", "tok")
+		rec := httptest.NewRecorder()
+		respHandlerRollback(rec, req)
+		if rec.Code != test.code {
+			t.Errorf("Test %d, expected %d got %d %s\n", ii, test.code, rec.Code, rec.Body.String())
+		}
+		if got, _ := redisClient.Cmd("GET", "qrr:10001").Str(); got != test.url {
+			t.Errorf("Test %d, expected target %s got %s\n", ii, test.url, got)
+		}
+		hist, _ := GetHistory("10001")
+		if len(hist) != test.version {
+			t.Errorf("Test %d, expected %d versions got %d\n", ii, test.version, len(hist))
+		} else if test.code == 200 && hist[len(hist)-1].RollbackOf == 0 {
+			t.Errorf("Test %d, expected rollback_of on the new version, got %s\n", ii, SVar(hist[len(hist)-1]))
+		}
+	}
+
+	// Versions whose URL has been blocked or put on a threat list since are checked like new URLs.
+	SetTargetURL("10001", "http://bad.example.com/x", "bob", 0)        // version 6
+	SetTargetURL("10001", "http://malware.test/payload.exe", "bob", 0) // version 7
+	SetTargetURL("10001", "http://v8.example.com/", "bob", 0)
+	gCfg.DomainBlockFile, gCfg.ThreatURLFile = "./testdata/block.txt", "./testdata/urlhaus.csv"
+
+	tests2 := []struct {
+		version     int
+		code        int
+		url         string
+		quarantined bool
+	}{
+		{version: 6, code: 406, url: "http://v8.example.com/"},
+		{version: 7, code: 200, url: "http://malware.test/payload.exe", quarantined: true},
+	}
+	for ii, test := range tests2 {
+		req := httptest.NewRequest("GET", fmt.Sprintf("/api/rollback-qr?id=10001&version=%d", test.version), nil)
+		req.Header.Set("X-Auth", "tok")
+		rec := httptest.NewRecorder()
+		respHandlerRollback(rec, req)
+		got, _ := redisClient.Cmd("GET", "qrr:10001").Str()
+		q, _ := redisClient.Cmd("HEXISTS", "qr-quarantine:10001", test.url).Int()
+		if rec.Code != test.code || got != test.url || (q == 1) != test.quarantined {
+			t.Errorf("Test %d, expected %d %s quarantined %v, got %d %s %d\n", ii, test.code, test.url, test.quarantined, rec.Code, got, q)
+		}
+	}
+}
+
+/* vim: set noai ts=4 sw=4: */
@@ -0,0 +1,523 @@
+package main
+
+// MIT Licensed - see LICENSE
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/pschlump/json"
+	"github.com/pschlump/uuid"
+)
+
+// Lifecycle webhooks.
+//
+// Subscriptions are kept in the hash qr-hook: (field is the hook ID, value the JSON HookType).  Each event
+// turns into one delivery per matching subscription.  Deliveries are stored in qr-hook-dlv:{delivery_id}
+// and queued in the sorted set qr-hook-retry: scored by the unix time of the next attempt, so the queue
+// survives a restart.  Deliveries that run out of attempts move to the sorted set qr-hook-failed: where
+// they can be looked at and replayed.
+
+// HookEvents is the set of events that can be subscribed to.
+var HookEvents = map[string]bool{
+	"qr.created":     true,
+	"qr.updated":     true,
+	"qr.scanned":     true,
+	"qr.quarantined": true,
+}
+
+// HookType is a webhook subscription.
+type HookType struct {
+	HookID  string   `json:"hook_id"`
+	URL     string   `json:"url"`
+	Events  []string `json:"events"`
+	Secret  string   `json:"secret,omitempty"` // if empty then gCfg.WebhookSecret is used
+	Created int64    `json:"created"`
+}
+
+// HookEvent is the body that is posted.  qr.scanned events are batched and carry the scans per ID
+// since the last batch in Scans.
+type HookEvent struct {
+	Event      string           `json:"event"`
+	DeliveryID string           `json:"delivery_id"`
+	ID         string           `json:"id,omitempty"`
+	URL        string           `json:"url,omitempty"`
+	Scans      map[string]int64 `json:"scans,omitempty"`
+	Time       int64            `json:"time"`
+}
+
+// HookDelivery is one queued delivery of an event to a subscription.
+type HookDelivery struct {
+	DeliveryID string `json:"delivery_id"`
+	HookID     string `json:"hook_id,omitempty"`
+	URL        string `json:"url,omitempty"` // set instead of HookID for alerts, see QueueAlert
+	Event      string `json:"event"`
+	Body       string `json:"body"`
+	Attempts   int    `json:"attempts"`
+	Status     int    `json:"status,omitempty"`
+	Error      string `json:"error,omitempty"`
+	Created    int64  `json:"created"`
+}
+
+func (hk *HookType) wants(event string) bool {
+	for _, ev := range hk.Events {
+		if ev == event || ev == "*" {
+			return true
+		}
+	}
+	return false
+}
+
+// GetHooks returns all the webhook subscriptions.
+func GetHooks() (rv []HookType, err error) {
+	mm, err := redisClient.Cmd("HGETALL", "qr-hook:").Map()
+	if err != nil {
+		return nil, err
+	}
+	rv = make([]HookType, 0, len(mm))
+	for _, s := range mm {
+		var hk HookType
+		if json.Unmarshal([]byte(s), &hk) == nil {
+			rv = append(rv, hk)
+		}
+	}
+	return
+}
+
+// EmitEvent queues a delivery of ev to every subscription that wants it.
+func EmitEvent(ev HookEvent) {
+	hooks, err := GetHooks()
+	if err != nil {
+		logger.Error("unable to read webhooks", "error", err)
+		return
+	}
+	now := time.Now().Unix()
+	ev.Time = now
+	for _, hk := range hooks {
+		if !hk.wants(ev.Event) {
+			continue
+		}
+		newUUID, err := uuid.NewV4()
+		if err != nil {
+			continue
+		}
+		ev.DeliveryID = newUUID.String()
+		dl := HookDelivery{
+			DeliveryID: ev.DeliveryID,
+			HookID:     hk.HookID,
+			Event:      ev.Event,
+			Body:       SVar(ev),
+			Created:    now,
+		}
+		redisClient.Cmd("SET", fmt.Sprintf("qr-hook-dlv:%s", dl.DeliveryID), SVar(dl))
+		redisClient.Cmd("ZADD", "qr-hook-retry:", now, dl.DeliveryID)
+	}
+}
+
+var scanBatch = make(map[string]int64)
+var scanBatchLock sync.Mutex
+var scanHooked int32 // 1 if a subscription wants qr.scanned, atomic
+
+// RefreshScanHooked checks whether any subscription wants qr.scanned.  The hook worker calls it each
+// second, and it is called at once when a subscription is added or removed.
+func RefreshScanHooked() {
+	hooks, err := GetHooks()
+	if err != nil {
+		return
+	}
+	var n int32
+	for _, hk := range hooks {
+		if hk.wants("qr.scanned") {
+			n = 1
+		}
+	}
+	atomic.StoreInt32(&scanHooked, n)
+}
+
+// HookScan records a scan of id for the next batched qr.scanned event.  Nothing is kept when batching is
+// off or nobody has subscribed.
+func HookScan(id string) {
+	if gCfg.WebhookScanBatch <= 0 || atomic.LoadInt32(&scanHooked) == 0 {
+		return
+	}
+	scanBatchLock.Lock()
+	scanBatch[id]++
+	scanBatchLock.Unlock()
+}
+
+// FlushScans sends the scans recorded since the last flush as a single qr.scanned event.
+func FlushScans() {
+	scanBatchLock.Lock()
+	scans := scanBatch
+	scanBatch = make(map[string]int64)
+	scanBatchLock.Unlock()
+	if len(scans) > 0 {
+		EmitEvent(HookEvent{Event: "qr.scanned", Scans: scans})
+	}
+}
+
+// HookWorker runs until the workers are stopped, sending the queued deliveries that are due and flushing the scan batch.
+func HookWorker() {
+	lastFlush := time.Now()
+	for sleepOrStop(time.Second) {
+		RefreshScanHooked()
+		if gCfg.WebhookScanBatch > 0 && time.Since(lastFlush) >= time.Duration(gCfg.WebhookScanBatch)*time.Second {
+			FlushScans()
+			lastFlush = time.Now()
+		}
+		RunHookQueue(time.Now())
+	}
+}
+
+// RunHookQueue makes one attempt at every delivery that is due.
+func RunHookQueue(now time.Time) {
+	ids, err := redisClient.Cmd("ZRANGEBYSCORE", "qr-hook-retry:", 0, now.Unix()).List()
+	if err != nil {
+		return
+	}
+	for _, did := range ids {
+		// ZREM is the claim - only one worker gets a 1 back.
+		if n, err := redisClient.Cmd("ZREM", "qr-hook-retry:", did).Int(); err != nil || n == 0 {
+			continue
+		}
+		deliverHook(did, now)
+	}
+}
+
+func deliverHook(did string, now time.Time) {
+	key := fmt.Sprintf("qr-hook-dlv:%s", did)
+	s, err := redisClient.Cmd("GET", key).Str()
+	if err != nil {
+		return
+	}
+	var dl HookDelivery
+	if json.Unmarshal([]byte(s), &dl) != nil {
+		redisClient.Cmd("DEL", key)
+		return
+	}
+	xurl, secret := dl.URL, gCfg.WebhookSecret
+	if dl.HookID != "" {
+		hs, err := redisClient.Cmd("HGET", "qr-hook:", dl.HookID).Str()
+		var hk HookType
+		if err != nil || json.Unmarshal([]byte(hs), &hk) != nil { // subscription was removed
+			redisClient.Cmd("DEL", key)
+			return
+		}
+		xurl = hk.URL
+		if hk.Secret != "" {
+			secret = hk.Secret
+		}
+	}
+
+	dl.Attempts++
+	dl.Status, err = postWebhookOnce(xurl, secret, dl.Event, []byte(dl.Body))
+	if err == nil && dl.Status >= 200 && dl.Status < 300 {
+		if dl.HookID == "" {
+			dl.Error = ""
+			LogAlert(dl, now)
+		}
+		redisClient.Cmd("DEL", key)
+		return
+	}
+	if err != nil {
+		dl.Error = err.Error()
+	} else {
+		dl.Error = fmt.Sprintf("Webhook failed with status %d", dl.Status)
+	}
+	redisClient.Cmd("SET", key, SVar(dl))
+	if dl.Attempts >= gCfg.WebhookTries {
+		logger.Error("webhook delivery failed", "delivery_id", did, "url", xurl, "attempts", dl.Attempts, "error", dl.Error)
+		if dl.HookID == "" {
+			LogAlert(dl, now)
+		}
+		redisClient.Cmd("ZADD", "qr-hook-failed:", now.Unix(), did)
+		return
+	}
+	redisClient.Cmd("ZADD", "qr-hook-retry:", now.Unix()+HookBackoff(dl.Attempts), did)
+}
+
+// HookBackoff returns the number of seconds to wait after a failed attempt.  It doubles with each attempt
+// and is capped at one day.
+func HookBackoff(attempts int) int64 {
+	wait := int64(gCfg.WebhookBackoff)
+	if wait <= 0 {
+		wait = 1
+	}
+	for ii := 1; ii < attempts && wait < 86400; ii++ {
+		wait *= 2
+	}
+	if wait > 86400 {
+		wait = 86400
+	}
+	return wait
+}
+
+// privateNets are the networks, other than loopback and link-local, that webhooks are not sent to.
+var privateNets = parseCIDRs("10.0.0.0/8", "172.16.0.0/12", "192.168.0.0/16", "100.64.0.0/10", "fc00::/7")
+
+func parseCIDRs(cidrs ...string) (nets []*net.IPNet) {
+	for _, c := range cidrs {
+		_, n, err := net.ParseCIDR(c)
+		if err != nil {
+			panic(err)
+		}
+		nets = append(nets, n)
+	}
+	return
+}
+
+// CheckWebhookURL returns an error if xurl is not a place webhooks may be sent.  It has to be http or https
+// with a host, and the host may not resolve to a loopback, link-local, private or unspecified address unless
+// the host or the address is in gCfg.WebhookAllowHosts.
+func CheckWebhookURL(xurl string) error {
+	pu, err := url.Parse(xurl)
+	if err != nil || (pu.Scheme != "http" && pu.Scheme != "https") || pu.Hostname() == "" {
+		return fmt.Errorf("Invalid webhook URL, must be http or https with a host")
+	}
+	host := pu.Hostname()
+	if webhookAllowed(host, nil) {
+		return nil
+	}
+	ips := []net.IP{net.ParseIP(host)}
+	if ips[0] == nil {
+		if ips, err = net.LookupIP(host); err != nil || len(ips) == 0 {
+			return fmt.Errorf("Invalid webhook URL, unable to resolve %s", host)
+		}
+	}
+	for _, ip := range ips {
+		if !internalIP(ip) || webhookAllowed("", ip) {
+			continue
+		}
+		return fmt.Errorf("Invalid webhook URL, %s is on an internal network", host)
+	}
+	return nil
+}
+
+func internalIP(ip net.IP) bool {
+	if ip.IsLoopback() || ip.IsLinkLocalUnicast() || ip.IsLinkLocalMulticast() || ip.IsUnspecified() {
+		return true
+	}
+	for _, n := range privateNets {
+		if n.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// webhookAllowed is true if host or ip is in gCfg.WebhookAllowHosts.
+func webhookAllowed(host string, ip net.IP) bool {
+	for _, a := range strings.Split(gCfg.WebhookAllowHosts, ",") {
+		a = strings.TrimSpace(a)
+		if a == "" {
+			continue
+		}
+		if _, cidr, err := net.ParseCIDR(a); err == nil {
+			if ip != nil && cidr.Contains(ip) {
+				return true
+			}
+		} else if aip := net.ParseIP(a); aip != nil {
+			if ip != nil && aip.Equal(ip) {
+				return true
+			}
+		} else if host != "" && strings.EqualFold(a, host) {
+			return true
+		}
+	}
+	return false
+}
+
+/*
+/api/add-hook?url=URL&events=qr.created,qr.updated[&secret=S]
+*/
+func respHandlerAddHook(www http.ResponseWriter, req *http.Request) {
+	if !CheckAuth(www, req) {
+		return
+	}
+
+	xurl := GetParam(www, req, "url", "")
+	if xurl == "" {
+		AnError(www, req, 406, "Missing Parameter")
+		return
+	}
+	if err := CheckWebhookURL(xurl); err != nil {
+		AnError(www, req, 406, err.Error())
+		return
+	}
+	events := GetParam(www, req, "events", "")
+	if events == "" {
+		AnError(www, req, 406, "Missing Parameter")
+		return
+	}
+
+	hk := HookType{
+		URL:     xurl,
+		Secret:  GetParam(www, req, "secret", ""),
+		Created: time.Now().Unix(),
+	}
+	for _, ev := range strings.Split(events, ",") {
+		ev = strings.TrimSpace(ev)
+		if !HookEvents[ev] && ev != "*" {
+			AnError(www, req, 406, fmt.Sprintf("Invalid event %q", ev))
+			return
+		}
+		hk.Events = append(hk.Events, ev)
+	}
+
+	newUUID, err := uuid.NewV4()
+	if err != nil {
+		AnError(www, req, 500, "Config Error 11")
+		return
+	}
+	hk.HookID = newUUID.String()
+
+	err = redisClient.Cmd("HSET", "qr-hook:", hk.HookID, SVar(hk)).Err
+	if err != nil {
+		AnError(www, req, 500, "Config Error 12")
+		return
+	}
+	RefreshScanHooked()
+
+	www.Header().Set("Content-Type", "application/json; charset=utf-8")
+	fmt.Fprintf(www, `{"status":"success","hook_id":%q}`+"\n", hk.HookID)
+}
+
+/*
+/api/list-hook
+*/
+func respHandlerListHook(www http.ResponseWriter, req *http.Request) {
+	if !CheckAuth(www, req) {
+		return
+	}
+
+	hooks, err := GetHooks()
+	if err != nil {
+		AnError(www, req, 500, "Config Error 13")
+		return
+	}
+	for ii := range hooks {
+		if hooks[ii].Secret != "" {
+			hooks[ii].Secret = "***"
+		}
+	}
+
+	www.Header().Set("Content-Type", "application/json; charset=utf-8")
+	fmt.Fprintf(www, `{"status":"success","hooks":%s}`+"\n", SVar(hooks))
+}
+
+/*
+/api/del-hook?hook_id=ID
+*/
+func respHandlerDelHook(www http.ResponseWriter, req *http.Request) {
+	if !CheckAuth(www, req) {
+		return
+	}
+
+	hookID := GetParam(www, req, "hook_id", "")
+	if hookID == "" {
+		AnError(www, req, 406, "Missing Parameter")
+		return
+	}
+
+	n, err := redisClient.Cmd("HDEL", "qr-hook:", hookID).Int()
+	if err != nil || n == 0 {
+		AnError(www, req, 404, "Not Found")
+		return
+	}
+	RefreshScanHooked()
+
+	www.Header().Set("Content-Type", "application/json; charset=utf-8")
+	fmt.Fprintf(www, `{"status":"success"}`)
+}
+
+/*
+/api/failed-hook - deliveries that ran out of attempts, oldest first.
+*/
+func respHandlerFailedHook(www http.ResponseWriter, req *http.Request) {
+	if !CheckAuth(www, req) {
+		return
+	}
+
+	ids, err := redisClient.Cmd("ZRANGE", "qr-hook-failed:", 0, -1).List()
+	if err != nil {
+		AnError(www, req, 500, "Config Error 14")
+		return
+	}
+	failed := make([]HookDelivery, 0, len(ids))
+	for _, did := range ids {
+		s, err := redisClient.Cmd("GET", fmt.Sprintf("qr-hook-dlv:%s", did)).Str()
+		if err != nil {
+			continue
+		}
+		var dl HookDelivery
+		if json.Unmarshal([]byte(s), &dl) == nil {
+			failed = append(failed, dl)
+		}
+	}
+
+	www.Header().Set("Content-Type", "application/json; charset=utf-8")
+	fmt.Fprintf(www, `{"status":"success","failed":%s}`+"\n", SVar(failed))
+}
+
+/*
+/api/replay-hook?delivery_id=ID - puts a failed delivery back on the queue, delivery_id=all replays all of them.
+*/
+func respHandlerReplayHook(www http.ResponseWriter, req *http.Request) {
+	if !CheckAuth(www, req) {
+		return
+	}
+
+	did := GetParam(www, req, "delivery_id", "")
+	if did == "" {
+		AnError(www, req, 406, "Missing Parameter")
+		return
+	}
+
+	var ids []string
+	if did == "all" {
+		var err error
+		ids, err = redisClient.Cmd("ZRANGE", "qr-hook-failed:", 0, -1).List()
+		if err != nil {
+			AnError(www, req, 500, "Config Error 15")
+			return
+		}
+	} else {
+		ids = []string{did}
+	}
+
+	now := time.Now().Unix()
+	n := 0
+	for _, did := range ids {
+		if m, err := redisClient.Cmd("ZREM", "qr-hook-failed:", did).Int(); err != nil || m == 0 {
+			continue
+		}
+		key := fmt.Sprintf("qr-hook-dlv:%s", did)
+		s, err := redisClient.Cmd("GET", key).Str()
+		if err != nil {
+			continue
+		}
+		var dl HookDelivery
+		if json.Unmarshal([]byte(s), &dl) != nil {
+			continue
+		}
+		dl.Attempts = 0
+		redisClient.Cmd("SET", key, SVar(dl))
+		redisClient.Cmd("ZADD", "qr-hook-retry:", now, did)
+		n++
+	}
+	if n == 0 && did != "all" {
+		AnError(www, req, 404, "Not Found")
+		return
+	}
+
+	www.Header().Set("Content-Type", "application/json; charset=utf-8")
+	fmt.Fprintf(www, `{"status":"success","replayed":%d}`+"\n", n)
+}
+
+/* vim: set noai ts=4 sw=4: */
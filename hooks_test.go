@@ -0,0 +1,196 @@
+package main
+
+// MIT Licensed - see LICENSE
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestSignWebhook(t *testing.T) {
+	tests := []struct {
+		secret   string
+		ts       int64
+		body     string
+		expected string
+	}{
+		{"secret", 1600000000, `{}`, "1e56a11da123b137c26fa37b7c222060bdf22988aa9b3248c31244f8b2ef4a28"},
+		{"", 0, ``, "b849d5a581847b281957065739df36df2463d1977ea8d6e1e4e6cf33fadc68c3"},
+		{"k", 42, `{"event":"qr.created"}`, "a3a70561ca04958508a745328f6c03acb71f0dc035156a53d8def7a0b5d04a09"},
+	}
+
+	for ii, test := range tests {
+		if got := SignWebhook(test.secret, test.ts, []byte(test.body)); got != test.expected {
+			t.Errorf("Test %d, expected %s got %s\n", ii, test.expected, got)
+		}
+	}
+}
+
+func TestHookBackoff(t *testing.T) {
+	defer func(n int) { gCfg.WebhookBackoff = n }(gCfg.WebhookBackoff)
+
+	tests := []struct {
+		backoff  int
+		attempts int
+		expected int64
+	}{
+		{30, 1, 30},
+		{30, 2, 60},
+		{30, 4, 240},
+		{30, 20, 86400},
+		{0, 1, 1},
+		{0, 3, 4},
+	}
+
+	for ii, test := range tests {
+		gCfg.WebhookBackoff = test.backoff
+		if got := HookBackoff(test.attempts); got != test.expected {
+			t.Errorf("Test %d, expected %d got %d\n", ii, test.expected, got)
+		}
+	}
+}
+
+func TestCheckWebhookURL(t *testing.T) {
+	defer func(allow string) { gCfg.WebhookAllowHosts = allow }(gCfg.WebhookAllowHosts)
+
+	tests := []struct {
+		url   string
+		allow string
+		isErr bool
+	}{
+		{url: "https://93.184.216.34/hook", isErr: false},
+		{url: "http://93.184.216.34:8080/hook", isErr: false},
+		{url: "x", isErr: true},
+		{url: "ftp://93.184.216.34/hook", isErr: true},
+		{url: "http:///hook", isErr: true},
+		{url: "http://127.0.0.1/hook", isErr: true},
+		{url: "http://localhost:9090/hook", isErr: true},
+		{url: "http://[::1]/hook", isErr: true},
+		{url: "http://169.254.169.254/latest/meta-data/", isErr: true},
+		{url: "http://10.1.2.3/hook", isErr: true},
+		{url: "http://172.20.0.1/hook", isErr: true},
+		{url: "http://192.168.1.1/hook", isErr: true},
+		{url: "http://0.0.0.0/hook", isErr: true},
+		{url: "http://10.1.2.3/hook", allow: "10.0.0.0/8", isErr: false},
+		{url: "http://192.168.1.1/hook", allow: "10.0.0.0/8, 192.168.1.1", isErr: false},
+		{url: "http://localhost:9090/hook", allow: "localhost", isErr: false},
+		{url: "http://192.168.1.2/hook", allow: "192.168.1.1", isErr: true},
+	}
+
+	for ii, test := range tests {
+		gCfg.WebhookAllowHosts = test.allow
+		if err := CheckWebhookURL(test.url); (err != nil) != test.isErr {
+			t.Errorf("Test %d, %s expected error %v got %v\n", ii, test.url, test.isErr, err)
+		}
+	}
+}
+
+func TestHookQueue(t *testing.T) {
+	_, done := testRedis(t)
+	defer done()
+	defer func(tries, backoff int, admins string) {
+		gCfg.WebhookTries, gCfg.WebhookBackoff, gCfg.AdminUsers = tries, backoff, admins
+	}(gCfg.WebhookTries, gCfg.WebhookBackoff, gCfg.AdminUsers)
+	gCfg.WebhookTries, gCfg.WebhookBackoff, gCfg.AdminUsers = 3, 10, ""
+
+	var status, calls int32 = 503, 0
+	srv := httptest.NewServer(http.HandlerFunc(func(www http.ResponseWriter, req *http.Request) {
+		atomic.AddInt32(&calls, 1)
+		www.WriteHeader(int(atomic.LoadInt32(&status)))
+	}))
+	defer srv.Close()
+
+	redisClient.Cmd("HSET", "qr-hook:", "h1", SVar(HookType{HookID: "h1", URL: srv.URL, Events: []string{"qr.created"}, Secret: "s"}))
+	redisClient.Cmd("HSET", "qr-hook:", "h2", SVar(HookType{HookID: "h2", URL: srv.URL, Events: []string{"qr.updated"}}))
+	redisClient.Cmd("SET", "qr-token:tok", "admin")
+	EmitEvent(HookEvent{Event: "qr.created", ID: "10001"})
+
+	now := time.Now()
+	tests := []struct {
+		at      time.Duration // after now
+		status  int32
+		replay  bool // replay the failed deliveries first
+		calls   int32
+		retry   int
+		failed  int
+		stored  int
+		comment string
+	}{
+		{at: 0, status: 503, calls: 1, retry: 1, failed: 0, stored: 1, comment: "first attempt fails"},
+		{at: 5 * time.Second, status: 503, calls: 1, retry: 1, failed: 0, stored: 1, comment: "not due until +10s"},
+		{at: 10 * time.Second, status: 503, calls: 2, retry: 1, failed: 0, stored: 1, comment: "second attempt, next in 20s"},
+		{at: 25 * time.Second, status: 503, calls: 2, retry: 1, failed: 0, stored: 1, comment: "not due until +30s"},
+		{at: 30 * time.Second, status: 503, calls: 3, retry: 0, failed: 1, stored: 1, comment: "out of attempts"},
+		{at: time.Hour, status: 503, calls: 3, retry: 0, failed: 1, stored: 1, comment: "failed are not retried"},
+		{at: 0, status: 200, replay: true, calls: 4, retry: 0, failed: 0, stored: 0, comment: "replayed and delivered"},
+	}
+
+	for ii, test := range tests {
+		atomic.StoreInt32(&status, test.status)
+		if test.replay {
+			req := httptest.NewRequest("GET", "/api/replay-hook?delivery_id=all", nil)
+			req.Header.Set("X-Auth", "tok")
+			rec := httptest.NewRecorder()
+			respHandlerReplayHook(rec, req)
+			if rec.Code != 200 {
+				t.Errorf("Test %d, replay returned %d %s\n", ii, rec.Code, rec.Body.String())
+			}
+		}
+		at := now.Add(test.at)
+		if test.replay {
+			at = time.Now()
+		}
+		RunHookQueue(at)
+
+		retry, _ := redisClient.Cmd("ZCARD", "qr-hook-retry:").Int()
+		failed, _ := redisClient.Cmd("ZCARD", "qr-hook-failed:").Int()
+		stored, _ := redisClient.Cmd("KEYS", "qr-hook-dlv:*").List()
+		if got := atomic.LoadInt32(&calls); got != test.calls || retry != test.retry || failed != test.failed || len(stored) != test.stored {
+			t.Errorf("Test %d (%s), expected calls %d retry %d failed %d stored %d, got %d %d %d %d\n", ii, test.comment,
+				test.calls, test.retry, test.failed, test.stored, got, retry, failed, len(stored))
+		}
+	}
+}
+
+func TestHookScan(t *testing.T) {
+	_, done := testRedis(t)
+	defer done()
+	defer func(n int) { gCfg.WebhookScanBatch = n }(gCfg.WebhookScanBatch)
+
+	tests := []struct {
+		batch  int
+		events []string
+		scans  int // deliveries queued by the flush
+	}{
+		{batch: 0, events: []string{"qr.scanned"}, scans: 0},
+		{batch: 60, events: []string{"qr.created"}, scans: 0},
+		{batch: 60, events: []string{"qr.scanned"}, scans: 1},
+		{batch: 60, events: []string{"*"}, scans: 1},
+	}
+
+	for ii, test := range tests {
+		redisClient.Cmd("DEL", "qr-hook:", "qr-hook-retry:")
+		redisClient.Cmd("HSET", "qr-hook:", "h", SVar(HookType{HookID: "h", URL: "http://127.0.0.1:1/", Events: test.events}))
+		RefreshScanHooked()
+		gCfg.WebhookScanBatch = test.batch
+		for jj := 0; jj < 3; jj++ {
+			HookScan(fmt.Sprintf("%d", 10001+jj%2))
+		}
+		scanBatchLock.Lock()
+		kept := len(scanBatch)
+		scanBatchLock.Unlock()
+		if (kept > 0) != (test.scans > 0) {
+			t.Errorf("Test %d, expected scans kept %v, got %d IDs\n", ii, test.scans > 0, kept)
+		}
+		FlushScans()
+		if n, _ := redisClient.Cmd("ZCARD", "qr-hook-retry:").Int(); n != test.scans {
+			t.Errorf("Test %d, expected %d qr.scanned deliveries got %d\n", ii, test.scans, n)
+		}
+	}
+}
+
+/* vim: set noai ts=4 sw=4: */
@@ -0,0 +1,434 @@
+package main
+
+// MIT Licensed - see LICENSE
+
+import (
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/pschlump/json"
+	"github.com/pschlump/uuid"
+)
+
+// Background jobs.
+//
+// Work that is too big for a request - bulk creation, exports, re-rendering - is queued as a job.  A job
+// is the hash qr-job:{job_id}.  Its ID is LPUSHed on the list qr-job-queue and gCfg.JobWorkers
+// goroutines take the oldest with RPOPLPUSH onto qr-job-running, removing it when the job is finished.
+// Anything left on qr-job-running at startup was cut off by a restart and is put back on the queue, so
+// job functions must be safe to run again.  This assumes one server owns the queue.  Finished jobs, and
+// the file a job writes to qr-job-file:{job_id}, are kept for gCfg.JobRetain seconds.  qr-job-ids is a
+// sorted set of the job IDs by the time they were created, for listing.
+
+// JobFunc does the work of a job.  The result is saved as JSON.  A long job should report its progress
+// with job.Progress and stop early if job.Canceled is true.
+type JobFunc func(job *Job) (result interface{}, err error)
+
+// JobKinds are the kinds of job that can be queued.
+var JobKinds = map[string]JobFunc{
+	"bulk":     runBulkJob,
+	"export":   runExportJob,
+	"rerender": runRerenderJob,
+}
+
+// Job is a job that is being run.
+type Job struct {
+	JobID  string
+	Kind   string
+	User   string
+	Params string // JSON
+}
+
+// JobStatus is a job as returned by the API.
+type JobStatus struct {
+	JobID    string          `json:"job_id"`
+	Kind     string          `json:"kind"`
+	State    string          `json:"state"` // queued, running, done, failed or canceled
+	User     string          `json:"user,omitempty"`
+	Total    int             `json:"total"`
+	Done     int             `json:"done"`
+	Failed   int             `json:"failed"`
+	Attempts int             `json:"attempts"`
+	Error    string          `json:"error,omitempty"`
+	Result   json.RawMessage `json:"result,omitempty"`
+	File     string          `json:"file,omitempty"` // name of the file the job wrote, from /api/job-result
+	Created  int64           `json:"created"`
+	Started  int64           `json:"started,omitempty"`
+	Finished int64           `json:"finished,omitempty"`
+}
+
+// IsFinished is true if the job will not run again.
+func (st JobStatus) IsFinished() bool {
+	return st.State == "done" || st.State == "failed" || st.State == "canceled"
+}
+
+// NewJobID returns an ID for a job, used when something else needs to be keyed by it before the job is queued.
+func NewJobID() (string, error) {
+	newUUID, err := uuid.NewV4()
+	if err != nil {
+		return "", err
+	}
+	return newUUID.String(), nil
+}
+
+// EnqueueJob queues a job of kind with params, which is saved as JSON.  If jid is "" a new ID is made.
+func EnqueueJob(jid, kind string, params interface{}, user string) (string, error) {
+	jid, err := CreateJob(jid, kind, params, user)
+	if err != nil {
+		return "", err
+	}
+	if err = redisClient.Cmd("LPUSH", "qr-job-queue", jid).Err; err != nil {
+		return "", err
+	}
+	return jid, nil
+}
+
+// CreateJob records a job without queueing it, for jobs run from the command line with RunJob.
+func CreateJob(jid, kind string, params interface{}, user string) (string, error) {
+	if _, ok := JobKinds[kind]; !ok {
+		return "", fmt.Errorf("Invalid job kind %q", kind)
+	}
+	if jid == "" {
+		var err error
+		if jid, err = NewJobID(); err != nil {
+			return "", err
+		}
+	}
+	now := time.Now().Unix()
+	key := fmt.Sprintf("qr-job:%s", jid)
+	err := redisClient.Cmd("HMSET", key, "job_id", jid, "kind", kind, "params", SVar(params), "user", user,
+		"state", "queued", "total", 0, "done", 0, "failed", 0, "attempts", 0, "created", now).Err
+	if err != nil {
+		return "", err
+	}
+	redisClient.Cmd("ZADD", "qr-job-ids", now, jid)
+	return jid, nil
+}
+
+// ParseJobStatus converts the hash of a job.
+func ParseJobStatus(mm map[string]string) (st JobStatus) {
+	num := func(k string) int64 {
+		n, _ := strconv.ParseInt(mm[k], 10, 64)
+		return n
+	}
+	st = JobStatus{
+		JobID:    mm["job_id"],
+		Kind:     mm["kind"],
+		State:    mm["state"],
+		User:     mm["user"],
+		Total:    int(num("total")),
+		Done:     int(num("done")),
+		Failed:   int(num("failed")),
+		Attempts: int(num("attempts")),
+		Error:    mm["error"],
+		File:     mm["file_name"],
+		Created:  num("created"),
+		Started:  num("started"),
+		Finished: num("finished"),
+	}
+	if mm["result"] != "" {
+		st.Result = json.RawMessage(mm["result"])
+	}
+	return
+}
+
+// GetJobStatus returns the state of a job.
+func GetJobStatus(jid string) (st JobStatus, err error) {
+	mm, err := redisClient.Cmd("HGETALL", fmt.Sprintf("qr-job:%s", jid)).Map()
+	if err != nil {
+		return st, err
+	}
+	if len(mm) == 0 {
+		return st, fmt.Errorf("Not Found")
+	}
+	return ParseJobStatus(mm), nil
+}
+
+// Progress records how far the job has got.
+func (job *Job) Progress(done, failed, total int) {
+	redisClient.Cmd("HMSET", fmt.Sprintf("qr-job:%s", job.JobID), "done", done, "failed", failed, "total", total)
+}
+
+// Canceled is true if the job has been asked to stop.
+func (job *Job) Canceled() bool {
+	s, _ := redisClient.Cmd("HGET", fmt.Sprintf("qr-job:%s", job.JobID), "cancel").Str()
+	return s == "1"
+}
+
+// Cursor returns the position saved by SetCursor, 0 if there is none.  A job that is run again after a
+// restart uses it to carry on from where it got to.
+func (job *Job) Cursor() int {
+	n, _ := redisClient.Cmd("HGET", fmt.Sprintf("qr-job:%s", job.JobID), "cursor").Int()
+	return n
+}
+
+// SetCursor saves how far the job has got.
+func (job *Job) SetCursor(n int) {
+	redisClient.Cmd("HSET", fmt.Sprintf("qr-job:%s", job.JobID), "cursor", n)
+}
+
+// SaveFile keeps a file made by the job, it is downloaded with /api/job-result.
+func (job *Job) SaveFile(name, contentType string, body []byte) error {
+	if err := redisClient.Cmd("SET", fmt.Sprintf("qr-job-file:%s", job.JobID), body).Err; err != nil {
+		return err
+	}
+	return redisClient.Cmd("HMSET", fmt.Sprintf("qr-job:%s", job.JobID), "file_name", name, "file_type", contentType).Err
+}
+
+// CancelJob stops a job.  A queued job is taken off the queue, a running job is asked to stop and is
+// canceled when its function returns.
+func CancelJob(jid string) (st JobStatus, err error) {
+	if st, err = GetJobStatus(jid); err != nil {
+		return
+	}
+	if st.IsFinished() {
+		return st, fmt.Errorf("Job is already %s", st.State)
+	}
+	key := fmt.Sprintf("qr-job:%s", jid)
+	redisClient.Cmd("HSET", key, "cancel", "1")
+	if n, _ := redisClient.Cmd("LREM", "qr-job-queue", 0, jid).Int(); n > 0 {
+		finishJob(jid, "canceled", "", "")
+	}
+	return GetJobStatus(jid)
+}
+
+// RecoverJobs puts the jobs that were running when the server stopped back on the queue, they are run first.
+func RecoverJobs() (n int) {
+	for {
+		jid, err := redisClient.Cmd("RPOP", "qr-job-running").Str()
+		if err != nil || jid == "" {
+			return
+		}
+		redisClient.Cmd("HSET", fmt.Sprintf("qr-job:%s", jid), "state", "queued")
+		redisClient.Cmd("RPUSH", "qr-job-queue", jid)
+		logger.Warn("job was running at the last stop, requeued", "job_id", jid)
+		n++
+	}
+}
+
+// JobWorker recovers the interrupted jobs then starts n Background workers on the queue.  Once the
+// workers are stopped no more jobs are taken.  A job that is running is left on qr-job-running and is
+// run again at the next start if the process exits before it is finished.
+func JobWorker(n int) {
+	RecoverJobs()
+	if n < 1 {
+		n = 1
+	}
+	for w := 0; w < n; w++ {
+		Background(jobLoop)
+	}
+}
+
+func jobLoop() {
+	for {
+		select {
+		case <-stopWorkers:
+			return
+		default:
+		}
+		jid, err := redisClient.Cmd("RPOPLPUSH", "qr-job-queue", "qr-job-running").Str()
+		if err != nil || jid == "" {
+			if !sleepOrStop(time.Second) {
+				return
+			}
+			continue
+		}
+		RunJob(jid)
+		redisClient.Cmd("LREM", "qr-job-running", 0, jid)
+	}
+}
+
+// RunJob runs the job jid and records the outcome.
+func RunJob(jid string) {
+	key := fmt.Sprintf("qr-job:%s", jid)
+	mm, err := redisClient.Cmd("HGETALL", key).Map()
+	if err != nil || len(mm) == 0 {
+		return
+	}
+	if mm["state"] != "queued" && mm["state"] != "running" {
+		return
+	}
+	job := &Job{JobID: jid, Kind: mm["kind"], User: mm["user"], Params: mm["params"]}
+	if job.Canceled() {
+		finishJob(jid, "canceled", "", "")
+		return
+	}
+	fn, ok := JobKinds[job.Kind]
+	if !ok {
+		finishJob(jid, "failed", fmt.Sprintf("Invalid job kind %q", job.Kind), "")
+		return
+	}
+	redisClient.Cmd("HMSET", key, "state", "running", "started", time.Now().Unix())
+	redisClient.Cmd("HINCRBY", key, "attempts", 1)
+
+	result, err := callJob(fn, job)
+	switch {
+	case job.Canceled():
+		finishJob(jid, "canceled", "", SVar(result))
+	case err != nil:
+		logger.Error("job failed", "job_id", jid, "kind", job.Kind, "error", err)
+		finishJob(jid, "failed", err.Error(), "")
+	default:
+		finishJob(jid, "done", "", SVar(result))
+	}
+}
+
+// callJob runs fn, turning a panic into an error so one bad job does not stop the server.
+func callJob(fn JobFunc, job *Job) (result interface{}, err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			err = fmt.Errorf("Job panic: %v", r)
+		}
+	}()
+	return fn(job)
+}
+
+func finishJob(jid, state, msg, result string) {
+	key := fmt.Sprintf("qr-job:%s", jid)
+	args := []interface{}{key, "state", state, "finished", time.Now().Unix()}
+	if msg != "" {
+		args = append(args, "error", msg)
+	}
+	if result != "" && result != "null" {
+		args = append(args, "result", result)
+	}
+	redisClient.Cmd("HMSET", args...)
+	redisClient.Cmd("EXPIRE", key, gCfg.JobRetain)
+	redisClient.Cmd("EXPIRE", fmt.Sprintf("qr-job-file:%s", jid), gCfg.JobRetain)
+}
+
+// canSeeJob is true if the user of req started the job or is an admin.
+func canSeeJob(req *http.Request, st JobStatus) bool {
+	return st.User == AuthUser(req) || IsAdmin(req)
+}
+
+// getJobParam returns the job named by the job_id parameter, or sends the error.
+func getJobParam(www http.ResponseWriter, req *http.Request) (st JobStatus, ok bool) {
+	jid := GetParam(www, req, "job_id", "")
+	if jid == "" {
+		AnError(www, req, 406, "Missing Parameter")
+		return
+	}
+	st, err := GetJobStatus(jid)
+	if err != nil || !canSeeJob(req, st) {
+		AnError(www, req, 404, "Not Found")
+		return
+	}
+	return st, true
+}
+
+/*
+/api/job-status?job_id=J - state and progress of a job, and its result once it is done.
+*/
+func respHandlerJobStatus(www http.ResponseWriter, req *http.Request) {
+	if !CheckAuth(www, req) {
+		return
+	}
+
+	st, ok := getJobParam(www, req)
+	if !ok {
+		return
+	}
+
+	www.Header().Set("Content-Type", "application/json; charset=utf-8")
+	fmt.Fprintf(www, `{"status":"success","job":%s}`+"\n", SVar(st))
+}
+
+/*
+/api/job-list?kind=K&state=S&limit=N - jobs newest first, an admin sees everyone's jobs.
+*/
+func respHandlerJobList(www http.ResponseWriter, req *http.Request) {
+	if !CheckAuth(www, req) {
+		return
+	}
+
+	kind := GetParam(www, req, "kind", "")
+	state := GetParam(www, req, "state", "")
+	limit, _ := strconv.Atoi(GetParam(www, req, "limit", "100"))
+	if limit <= 0 || limit > 1000 {
+		limit = 100
+	}
+
+	ids, err := redisClient.Cmd("ZREVRANGE", "qr-job-ids", 0, -1).List()
+	if err != nil {
+		AnError(www, req, 500, "Config Error 33")
+		return
+	}
+	list := make([]JobStatus, 0, limit)
+	for _, jid := range ids {
+		if len(list) >= limit {
+			break
+		}
+		st, err := GetJobStatus(jid)
+		if err != nil {
+			redisClient.Cmd("ZREM", "qr-job-ids", jid) // expired
+			continue
+		}
+		if !canSeeJob(req, st) || (kind != "" && st.Kind != kind) || (state != "" && st.State != state) {
+			continue
+		}
+		st.Result = nil
+		list = append(list, st)
+	}
+
+	www.Header().Set("Content-Type", "application/json; charset=utf-8")
+	fmt.Fprintf(www, `{"status":"success","list":%s}`+"\n", SVar(list))
+}
+
+/*
+/api/job-cancel?job_id=J - cancels a queued or running job.  What a running job had already done is kept.
+*/
+func respHandlerJobCancel(www http.ResponseWriter, req *http.Request) {
+	if !CheckAuth(www, req) {
+		return
+	}
+
+	st, ok := getJobParam(www, req)
+	if !ok {
+		return
+	}
+	st, err := CancelJob(st.JobID)
+	if err != nil {
+		AnError(www, req, 409, err.Error())
+		return
+	}
+
+	www.Header().Set("Content-Type", "application/json; charset=utf-8")
+	fmt.Fprintf(www, `{"status":"success","job":%s}`+"\n", SVar(st))
+}
+
+/*
+/api/job-result?job_id=J - downloads the file written by a job that is done, such as an export.
+*/
+func respHandlerJobResult(www http.ResponseWriter, req *http.Request) {
+	if !CheckAuth(www, req) {
+		return
+	}
+
+	st, ok := getJobParam(www, req)
+	if !ok {
+		return
+	}
+	if !st.IsFinished() {
+		AnError(www, req, 409, "Not finished")
+		return
+	}
+	body, err := redisClient.Cmd("GET", fmt.Sprintf("qr-job-file:%s", st.JobID)).Bytes()
+	if err != nil || st.File == "" {
+		AnError(www, req, 404, "Not Found")
+		return
+	}
+	ct, _ := redisClient.Cmd("HGET", fmt.Sprintf("qr-job:%s", st.JobID), "file_type").Str()
+	if ct == "" {
+		ct = "application/octet-stream"
+	}
+
+	www.Header().Set("Content-Type", ct)
+	www.Header().Set("Content-Disposition", fmt.Sprintf(`attachment; filename="%s"`, strings.Replace(st.File, `"`, "", -1)))
+	www.Write(body)
+}
+
+/* vim: set noai ts=4 sw=4: */
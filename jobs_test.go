@@ -0,0 +1,50 @@
+package main
+
+// MIT Licensed - see LICENSE
+
+import (
+	"testing"
+)
+
+func TestParseJobStatus(t *testing.T) {
+	tests := []struct {
+		hash     map[string]string
+		expected string
+		finished bool
+	}{
+		{map[string]string{"job_id": "j1", "kind": "bulk", "state": "queued", "user": "bob", "created": "100"},
+			`{"job_id":"j1","kind":"bulk","state":"queued","user":"bob","total":0,"done":0,"failed":0,"attempts":0,"created":100}`, false},
+		{map[string]string{"job_id": "j2", "kind": "export", "state": "done", "total": "10", "done": "9", "failed": "1", "attempts": "2",
+			"result": `{"rows":9}`, "file_name": "x.csv", "created": "100", "started": "101", "finished": "105"},
+			`{"job_id":"j2","kind":"export","state":"done","total":10,"done":9,"failed":1,"attempts":2,"result":{"rows":9},"file":"x.csv","created":100,"started":101,"finished":105}`, true},
+		{map[string]string{"job_id": "j3", "kind": "bulk", "state": "failed", "error": "boom"},
+			`{"job_id":"j3","kind":"bulk","state":"failed","total":0,"done":0,"failed":0,"attempts":0,"error":"boom","created":0}`, true},
+		{map[string]string{"job_id": "j4", "state": "canceled"},
+			`{"job_id":"j4","kind":"","state":"canceled","total":0,"done":0,"failed":0,"attempts":0,"created":0}`, true},
+		{map[string]string{"job_id": "j5", "state": "running"},
+			`{"job_id":"j5","kind":"","state":"running","total":0,"done":0,"failed":0,"attempts":0,"created":0}`, false},
+	}
+
+	for ii, test := range tests {
+		st := ParseJobStatus(test.hash)
+		if got := SVar(st); got != test.expected {
+			t.Errorf("Test %d, expected %s got %s\n", ii, test.expected, got)
+		}
+		if st.IsFinished() != test.finished {
+			t.Errorf("Test %d, expected finished %v\n", ii, test.finished)
+		}
+	}
+}
+
+func TestCallJob(t *testing.T) {
+	_, err := callJob(func(job *Job) (interface{}, error) { panic("bad row") }, &Job{JobID: "j1"})
+	if err == nil || err.Error() != "Job panic: bad row" {
+		t.Errorf("Expected the panic as an error, got %v\n", err)
+	}
+	res, err := callJob(func(job *Job) (interface{}, error) { return job.JobID, nil }, &Job{JobID: "j2"})
+	if err != nil || res != "j2" {
+		t.Errorf("Expected j2 got %v %v\n", res, err)
+	}
+}
+
+/* vim: set noai ts=4 sw=4: */
@@ -0,0 +1,376 @@
+package main
+
+// MIT Licensed - see LICENSE
+
+import (
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/pschlump/json"
+)
+
+// SheetTemplate is the layout of a sheet of labels.  All sizes are in millimeters.  The labels fill the
+// page inside the margins in Rows x Cols cells, with GapX and GapY between them.  Caption is printed under
+// each code, "{id}", "{label}" and "{url}" (the URL in the code) are replaced and "\n" starts a new line.
+type SheetTemplate struct {
+	PageWidth    float64 `json:"page_width"`
+	PageHeight   float64 `json:"page_height"`
+	MarginTop    float64 `json:"margin_top"`
+	MarginBottom float64 `json:"margin_bottom"`
+	MarginLeft   float64 `json:"margin_left"`
+	MarginRight  float64 `json:"margin_right"`
+	Rows         int     `json:"rows"`
+	Cols         int     `json:"cols"`
+	GapX         float64 `json:"gap_x"`
+	GapY         float64 `json:"gap_y"`
+	Padding      float64 `json:"padding"`   // space inside each label
+	Caption      string  `json:"caption"`   // e.g. "{label}\n{url}"
+	FontSize     float64 `json:"font_size"` // points
+	CropMarks    bool    `json:"crop_marks"`
+}
+
+// SheetTemplates are the built in layouts.
+var SheetTemplates = map[string]SheetTemplate{
+	// Letter, 3 x 4 labels 2 inches square
+	"letter-2in": {PageWidth: 215.9, PageHeight: 279.4, MarginTop: 15.875, MarginBottom: 15.875, MarginLeft: 15.875, MarginRight: 15.875,
+		Rows: 4, Cols: 3, GapX: 15.875, GapY: 14.817, Padding: 2, Caption: "{id}", FontSize: 7, CropMarks: true},
+	// Letter, 3 x 10 address labels 2 5/8 x 1 inch (like Avery 5160), no caption as they are short
+	"letter-30": {PageWidth: 215.9, PageHeight: 279.4, MarginTop: 12.7, MarginBottom: 12.7, MarginLeft: 4.7625, MarginRight: 4.7625,
+		Rows: 10, Cols: 3, GapX: 3.175, GapY: 0, Padding: 1, Caption: "", FontSize: 6},
+	// A4, 3 x 7 labels 63.5 x 38.1 (like Avery L7160)
+	"a4-21": {PageWidth: 210, PageHeight: 297, MarginTop: 15.15, MarginBottom: 15.15, MarginLeft: 7.25, MarginRight: 7.25,
+		Rows: 7, Cols: 3, GapX: 2.5, GapY: 0, Padding: 1.5, Caption: "{id}", FontSize: 6},
+	// A4, 4 x 6 codes with crop marks, to be cut apart
+	"a4-cut": {PageWidth: 210, PageHeight: 297, MarginTop: 15, MarginBottom: 15, MarginLeft: 15, MarginRight: 15,
+		Rows: 6, Cols: 4, GapX: 0, GapY: 0, Padding: 4, Caption: "{label}\n{url}", FontSize: 6, CropMarks: true},
+}
+
+// LabelItem is one code to print.
+type LabelItem struct {
+	ID     string
+	Label  string
+	URL    string   // what is encoded
+	Bitmap [][]bool // the modules, with the quiet zone
+}
+
+// CellSize is the size of one label in millimeters.
+func (st *SheetTemplate) CellSize() (w, h float64) {
+	w = (st.PageWidth - st.MarginLeft - st.MarginRight - st.GapX*float64(st.Cols-1)) / float64(st.Cols)
+	h = (st.PageHeight - st.MarginTop - st.MarginBottom - st.GapY*float64(st.Rows-1)) / float64(st.Rows)
+	return
+}
+
+// Validate checks that the layout fits on the page.
+func (st *SheetTemplate) Validate() error {
+	if st.PageWidth <= 0 || st.PageHeight <= 0 || st.PageWidth > 2000 || st.PageHeight > 2000 {
+		return fmt.Errorf("Invalid page size")
+	}
+	if st.Rows < 1 || st.Cols < 1 || st.Rows > 100 || st.Cols > 100 {
+		return fmt.Errorf("Invalid rows or cols")
+	}
+	if st.MarginTop < 0 || st.MarginBottom < 0 || st.MarginLeft < 0 || st.MarginRight < 0 || st.GapX < 0 || st.GapY < 0 || st.Padding < 0 {
+		return fmt.Errorf("Margins, gaps and padding can not be negative")
+	}
+	if st.FontSize <= 0 {
+		st.FontSize = 7
+	}
+	w, h := st.CellSize()
+	if w-2*st.Padding < 5 || h-2*st.Padding-st.captionHeight() < 5 {
+		return fmt.Errorf("Labels are too small, %.1f x %.1f mm", w, h)
+	}
+	return nil
+}
+
+// captionLines returns the caption for it, without empty lines.
+func (st *SheetTemplate) captionLines(it LabelItem) (rv []string) {
+	if st.Caption == "" {
+		return nil
+	}
+	s := strings.NewReplacer("{id}", it.ID, "{label}", it.Label, "{url}", it.URL).Replace(st.Caption)
+	for _, line := range strings.Split(s, "\n") {
+		if line = strings.TrimSpace(line); line != "" {
+			rv = append(rv, line)
+		}
+	}
+	return
+}
+
+// captionHeight is the height in mm kept for the caption, enough for the lines in the template.
+func (st *SheetTemplate) captionHeight() float64 {
+	if st.Caption == "" {
+		return 0
+	}
+	n := strings.Count(st.Caption, "\n") + 1
+	return float64(n) * st.FontSize * 1.2 / PointsPerMM
+}
+
+// fitText shortens s, with "...", to fit in width points.
+func fitText(s string, size, width float64) string {
+	if TextWidth(s, size) <= width {
+		return s
+	}
+	r := []rune(s)
+	for len(r) > 0 && TextWidth(string(r)+"...", size) > width {
+		r = r[:len(r)-1]
+	}
+	return string(r) + "..."
+}
+
+// RenderLabelPDF lays out the items on as many sheets as it takes and returns the PDF.  The modules are
+// drawn as filled rectangles so the codes stay sharp at any print resolution.
+func RenderLabelPDF(st SheetTemplate, items []LabelItem) ([]byte, error) {
+	if err := st.Validate(); err != nil {
+		return nil, err
+	}
+	mm := PointsPerMM
+	pw, ph := st.PageWidth*mm, st.PageHeight*mm
+	cw, ch := st.CellSize()
+	cw, ch = cw*mm, ch*mm
+	pad := st.Padding * mm
+	capH := st.captionHeight() * mm
+	perPage := st.Rows * st.Cols
+
+	var doc PDFDoc
+	for ii, it := range items {
+		if ii%perPage == 0 {
+			doc.AddPage(pw, ph)
+			if st.CropMarks {
+				drawCropMarks(&doc, &st)
+			}
+		}
+		pos := ii % perPage
+		row, col := pos/st.Cols, pos%st.Cols
+		x := st.MarginLeft*mm + float64(col)*(cw+st.GapX*mm)
+		top := ph - st.MarginTop*mm - float64(row)*(ch+st.GapY*mm)
+
+		// The code, as big a square as fits above the caption, centered across the label.
+		size := cw - 2*pad
+		if h := ch - 2*pad - capH; h < size {
+			size = h
+		}
+		qx := x + (cw-size)/2
+		qtop := top - pad
+		n := len(it.Bitmap)
+		if n > 0 {
+			m := size / float64(n)
+			for y, line := range it.Bitmap {
+				for bx := 0; bx < len(line); bx++ {
+					if !line[bx] {
+						continue
+					}
+					start := bx
+					for bx < len(line) && line[bx] {
+						bx++
+					}
+					doc.Rect(qx+float64(start)*m, qtop-float64(y+1)*m, float64(bx-start)*m, m)
+				}
+			}
+			doc.Fill()
+		}
+
+		// The caption, centered under the code.
+		base := qtop - size - st.FontSize
+		for _, line := range st.captionLines(it) {
+			line = fitText(line, st.FontSize, cw-2*pad)
+			doc.Text(x+(cw-TextWidth(line, st.FontSize))/2, base, st.FontSize, line)
+			base -= st.FontSize * 1.2
+		}
+	}
+	if len(items) == 0 {
+		doc.AddPage(pw, ph)
+	}
+	return doc.Bytes()
+}
+
+// drawCropMarks puts marks in the page margins in line with the edges of every row and column.  They
+// are kept out of the labels so they never print over a code.
+func drawCropMarks(doc *PDFDoc, st *SheetTemplate) {
+	mm := PointsPerMM
+	pw, ph := st.PageWidth*mm, st.PageHeight*mm
+	cw, ch := st.CellSize()
+	const gap, length, width = 1.5 * PointsPerMM, 5 * PointsPerMM, 0.25
+
+	mark := func(x1, y1, x2, y2 float64) {
+		if x1 < 0 {
+			x1 = 0
+		}
+		if x2 > pw {
+			x2 = pw
+		}
+		if y1 < 0 {
+			y1 = 0
+		}
+		if y2 > ph {
+			y2 = ph
+		}
+		if x2 > x1 || y2 > y1 {
+			doc.Line(x1, y1, x2, y2, width)
+		}
+	}
+
+	var xs, ys []float64
+	add := func(lst []float64, v float64) []float64 { // labels with no gap share an edge
+		if n := len(lst); n > 0 && lst[n-1]-v < 0.01 && v-lst[n-1] < 0.01 {
+			return lst
+		}
+		return append(lst, v)
+	}
+	for c := 0; c < st.Cols; c++ {
+		x := (st.MarginLeft + float64(c)*(cw+st.GapX)) * mm
+		xs = add(add(xs, x), x+cw*mm)
+	}
+	for r := 0; r < st.Rows; r++ {
+		y := ph - (st.MarginTop+float64(r)*(ch+st.GapY))*mm
+		ys = add(add(ys, y), y-ch*mm)
+	}
+	top, bottom := ph-st.MarginTop*mm, st.MarginBottom*mm
+	left, right := st.MarginLeft*mm, pw-st.MarginRight*mm
+	for _, x := range xs {
+		if top+gap < ph {
+			mark(x, top+gap, x, top+gap+length)
+		}
+		if bottom-gap > 0 {
+			mark(x, bottom-gap-length, x, bottom-gap)
+		}
+	}
+	for _, y := range ys {
+		if left-gap > 0 {
+			mark(left-gap-length, y, left-gap, y)
+		}
+		if right+gap < pw {
+			mark(right+gap, y, right+gap+length, y)
+		}
+	}
+}
+
+// ParseIDList reads a list of IDs, "10001,10002,10010-10020".  It is an error if there are more than
+// limit IDs, unless limit is 0.
+func ParseIDList(s string, limit int) (ids []string, err error) {
+	tooMany := func(n int) error {
+		return fmt.Errorf("Too many IDs, %d, the limit is %d", n, limit)
+	}
+	for _, part := range strings.Split(s, ",") {
+		part = strings.TrimSpace(part)
+		if part == "" {
+			continue
+		}
+		if i := strings.Index(part, "-"); i > 0 {
+			lo, err1 := strconv.Atoi(part[:i])
+			hi, err2 := strconv.Atoi(part[i+1:])
+			if err1 == nil && err2 == nil {
+				if hi < lo || hi-lo >= 10000 {
+					return nil, fmt.Errorf("Invalid range %q", part)
+				}
+				if limit > 0 && len(ids)+hi-lo+1 > limit {
+					return nil, tooMany(len(ids) + hi - lo + 1)
+				}
+				for n := lo; n <= hi; n++ {
+					ids = append(ids, strconv.Itoa(n))
+				}
+				continue
+			}
+		}
+		if limit > 0 && len(ids)+1 > limit {
+			return nil, tooMany(len(ids) + 1)
+		}
+		ids = append(ids, part) // a slug
+	}
+	return
+}
+
+// GetLabelItems looks up the label of each ID and encodes the same URL, at the same level, as GenQR.
+func GetLabelItems(ids []string) (items []LabelItem, err error) {
+	for _, id := range ids {
+		if _, err := redisClient.Cmd("GET", fmt.Sprintf("qrr:%s", id)).Str(); err != nil {
+			return nil, fmt.Errorf("ID %s Not Found", id)
+		}
+		label, _ := redisClient.Cmd("GET", fmt.Sprintf("qr-label:%s", id)).Str()
+		uri := QRContent(id)
+		q, err := NewQRCode(uri, gCfg.Level)
+		if err != nil {
+			return nil, err
+		}
+		items = append(items, LabelItem{ID: id, Label: label, URL: uri, Bitmap: q.Bitmap()})
+	}
+	return
+}
+
+/*
+/api/label-pdf?ids=10001,10005-10050[&bulk_id=B][&template=letter-2in|letter-30|a4-21|a4-cut][&layout={...}][&caption=C]
+A PDF of label sheets for the IDs, or for the QRs made by a bulk request.  layout is a SheetTemplate as JSON,
+any field that is left out comes from template (default letter-2in).  At most label_max_ids QRs are put on
+one PDF.  A bulk_id must be from a bulk request made by the same user, unless they are an admin.
+*/
+func respHandlerLabelPDF(www http.ResponseWriter, req *http.Request) {
+	if !CheckAuth(www, req) {
+		return
+	}
+
+	ids, err := ParseIDList(GetParam(www, req, "ids", ""), gCfg.LabelMaxIDs)
+	if err != nil {
+		AnError(www, req, 406, err.Error())
+		return
+	}
+	if bid := GetParam(www, req, "bulk_id", ""); bid != "" {
+		if bs, err := GetBulkStatus(bid); err != nil || (bs.User != AuthUser(req) && !IsAdmin(req)) {
+			AnError(www, req, 404, "Not Found")
+			return
+		}
+		bi, err := GetBulkItems(bid)
+		if err != nil {
+			AnError(www, req, 404, "Not Found")
+			return
+		}
+		for _, it := range bi {
+			if it.Error == "" {
+				ids = append(ids, it.ID)
+			}
+		}
+		if gCfg.LabelMaxIDs > 0 && len(ids) > gCfg.LabelMaxIDs {
+			AnError(www, req, 406, fmt.Sprintf("Too many IDs, %d, the limit is %d", len(ids), gCfg.LabelMaxIDs))
+			return
+		}
+	}
+	if len(ids) == 0 {
+		AnError(www, req, 406, "Missing Parameter")
+		return
+	}
+
+	st, ok := SheetTemplates[GetParam(www, req, "template", "letter-2in")]
+	if !ok {
+		AnError(www, req, 406, "Invalid template")
+		return
+	}
+	if layout := GetParam(www, req, "layout", ""); layout != "" {
+		if err = json.Unmarshal([]byte(layout), &st); err != nil {
+			AnError(www, req, 406, fmt.Sprintf("Invalid layout: %s", err))
+			return
+		}
+	}
+	if caption, ok := getParamSet(www, req, "caption"); ok {
+		st.Caption = caption
+	}
+	if err = st.Validate(); err != nil {
+		AnError(www, req, 406, err.Error())
+		return
+	}
+
+	items, err := GetLabelItems(ids)
+	if err != nil {
+		AnError(www, req, 404, err.Error())
+		return
+	}
+	pdf, err := RenderLabelPDF(st, items)
+	if err != nil {
+		AnError(www, req, 500, "Config Error 32")
+		return
+	}
+
+	www.Header().Set("Content-Type", "application/pdf")
+	www.Header().Set("Content-Disposition", `inline; filename="qr-labels.pdf"`)
+	www.Write(pdf)
+}
+
+/* vim: set noai ts=4 sw=4: */
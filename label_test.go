@@ -0,0 +1,160 @@
+package main
+
+// MIT Licensed - see LICENSE
+
+import (
+	"bytes"
+	"compress/zlib"
+	"fmt"
+	"io/ioutil"
+	"net/http/httptest"
+	"reflect"
+	"regexp"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+func TestSheetTemplates(t *testing.T) {
+	sizes := map[string][2]float64{
+		"letter-2in": {50.8, 50.8},
+		"letter-30":  {66.675, 25.4},
+		"a4-21":      {63.5, 38.1},
+	}
+	for name, st := range SheetTemplates {
+		if err := st.Validate(); err != nil {
+			t.Errorf("Template %s: %s\n", name, err)
+		}
+		if want, ok := sizes[name]; ok {
+			w, h := st.CellSize()
+			if fmt.Sprintf("%.3f %.3f", w, h) != fmt.Sprintf("%.3f %.3f", want[0], want[1]) {
+				t.Errorf("Template %s: expected %v got %.3f %.3f\n", name, want, w, h)
+			}
+		}
+	}
+}
+
+func TestRenderLabelPDF(t *testing.T) {
+	st := SheetTemplates["a4-cut"]
+	var items []LabelItem
+	for ii := 0; ii < 30; ii++ { // 24 to a page, so 2 pages
+		q, err := NewQRCode(fmt.Sprintf("http://localhost:8333/Q/%d", 10001+ii), "H")
+		if err != nil {
+			t.Fatalf("Error %s\n", err)
+		}
+		items = append(items, LabelItem{ID: fmt.Sprintf("%d", 10001+ii), Label: "Box (A)", URL: q.Content, Bitmap: q.Bitmap()})
+	}
+
+	pdf, err := RenderLabelPDF(st, items)
+	if err != nil {
+		t.Fatalf("Error %s\n", err)
+	}
+	if !bytes.HasPrefix(pdf, []byte("%PDF-1.4\n")) || !bytes.HasSuffix(pdf, []byte("%%EOF\n")) {
+		t.Errorf("Not a PDF\n")
+	}
+	if !bytes.Contains(pdf, []byte("/Count 2 >>")) {
+		t.Errorf("Expected 2 pages\n")
+	}
+
+	// every entry in the xref table must point at its object
+	m := regexp.MustCompile(`startxref\n(\d+)\n`).FindSubmatch(pdf)
+	if m == nil {
+		t.Fatalf("No startxref\n")
+	}
+	xref, _ := strconv.Atoi(string(m[1]))
+	lines := strings.Split(string(pdf[xref:]), "\n")
+	for ii, line := range lines[3:10] { // objects 1 to 7
+		off, _ := strconv.Atoi(line[:10])
+		if want := fmt.Sprintf("%d 0 obj\n", ii+1); !bytes.HasPrefix(pdf[off:], []byte(want)) {
+			t.Errorf("xref entry %d does not point at its object\n", ii+1)
+		}
+	}
+
+	// the first page has 24 codes, captions and crop marks
+	start := bytes.Index(pdf, []byte("stream\n")) + len("stream\n")
+	zr, err := zlib.NewReader(bytes.NewReader(pdf[start:]))
+	if err != nil {
+		t.Fatalf("Error %s\n", err)
+	}
+	content, _ := ioutil.ReadAll(zr)
+	if n := bytes.Count(content, []byte("0 g f\n")); n != 24 {
+		t.Errorf("Expected 24 codes got %d\n", n)
+	}
+	if !bytes.Contains(content, []byte(`(Box \(A\)) Tj`)) || !bytes.Contains(content, []byte(`(http://localhost:8333/Q/10001) Tj`)) {
+		t.Errorf("Missing caption\n")
+	}
+	if n := bytes.Count(content, []byte(" l S\n")); n != 5*2+7*2 { // 4 x 6 labels with no gaps have 5 x 7 edges
+		t.Errorf("Expected %d crop marks got %d\n", 5*2+7*2, n)
+	}
+}
+
+func TestFitText(t *testing.T) {
+	if got := fitText("short", 6, 100); got != "short" {
+		t.Errorf("Expected short got %s\n", got)
+	}
+	got := fitText("https://example.com/a/very/long/path/that/will/not/fit", 6, 60)
+	if !strings.HasSuffix(got, "...") || TextWidth(got, 6) > 60 {
+		t.Errorf("Did not fit: %s %.1f\n", got, TextWidth(got, 6))
+	}
+}
+
+func TestParseIDList(t *testing.T) {
+	tests := []struct {
+		list     string
+		limit    int
+		expected []string
+		isErr    bool
+	}{
+		{"10001, 10005-10007,promo-1", 0, []string{"10001", "10005", "10006", "10007", "promo-1"}, false},
+		{"10001, 10005-10007,promo-1", 5, []string{"10001", "10005", "10006", "10007", "promo-1"}, false},
+		{"10001, 10005-10007,promo-1", 4, nil, true},
+		{"10001-10003,10001-10003", 5, nil, true},
+		{"10-1", 0, nil, true},
+	}
+	for ii, test := range tests {
+		got, err := ParseIDList(test.list, test.limit)
+		if (err != nil) != test.isErr || (!test.isErr && !reflect.DeepEqual(got, test.expected)) {
+			t.Errorf("Test %d, expected %s error %v got %s %v\n", ii, test.expected, test.isErr, got, err)
+		}
+	}
+}
+
+func TestLabelPDFBulk(t *testing.T) {
+	_, done := testRedis(t)
+	defer done()
+	defer func(admins, level string, n int) {
+		gCfg.AdminUsers, gCfg.Level, gCfg.LabelMaxIDs = admins, level, n
+	}(gCfg.AdminUsers, gCfg.Level, gCfg.LabelMaxIDs)
+	gCfg.AdminUsers, gCfg.Level = "root", "M"
+
+	redisClient.Cmd("MSET", "qr-token:bob", "bob", "qr-token:eve", "eve", "qr-token:root", "root", "qrr:10001", "http://a.example.com/", "qrr:10002", "http://b.example.com/")
+	redisClient.Cmd("HMSET", "qr-bulk:b1", "bulk_id", "b1", "state", "done", "user", "bob")
+	redisClient.Cmd("SET", "qr-bulk-items:b1", SVar([]BulkItem{{Row: 0, ID: "10001"}, {Row: 1, ID: "10002"}}))
+
+	tests := []struct {
+		token string
+		query string
+		limit int
+		code  int
+	}{
+		{token: "bob", query: "bulk_id=b1", limit: 0, code: 200},
+		{token: "root", query: "bulk_id=b1", limit: 0, code: 200},
+		{token: "eve", query: "bulk_id=b1", limit: 0, code: 404},
+		{token: "bob", query: "bulk_id=b2", limit: 0, code: 404},
+		{token: "bob", query: "bulk_id=b1", limit: 1, code: 406},
+		{token: "bob", query: "ids=10001-10002", limit: 1, code: 406},
+		{token: "bob", query: "ids=10001-10002", limit: 2, code: 200},
+	}
+	for ii, test := range tests {
+		gCfg.LabelMaxIDs = test.limit
+		req := httptest.NewRequest("GET", "/api/label-pdf?"+test.query, nil)
+		req.Header.Set("X-Auth", test.token)
+		rec := httptest.NewRecorder()
+		respHandlerLabelPDF(rec, req)
+		if rec.Code != test.code {
+			t.Errorf("Test %d, expected %d got %d %s\n", ii, test.code, rec.Code, rec.Body.String())
+		}
+	}
+}
+
+/* vim: set noai ts=4 sw=4: */
@@ -6,8 +6,10 @@ import (
 	"crypto/sha256"
 	"errors"
 	"fmt"
+	"net"
 	"net/http"
 	"os"
+	"strings"
 
 	"github.com/pschlump/godebug"
 	"github.com/pschlump/json"
@@ -50,44 +52,29 @@ func GetParam(www http.ResponseWriter, req *http.Request, name string, dflt stri
 	value := dflt
 
 	method := req.Method
-	if dbFlag["GetVal"] {
-		fmt.Printf("GetVar name=%s req.Method %s AT:%s\n", name, method, godebug.LF())
-	}
 	if method == "POST" || method == "PUT" {
 		if str := req.PostFormValue(name); str != "" {
 			value = str
 			found = true
 		}
 	} else if method == "GET" || method == "DELETE" {
-		if dbFlag["GetVal"] {
-			fmt.Printf("AT:%s\n", godebug.LF())
-		}
 		qq := req.URL.Query()
 		strArr, ok := qq[name]
-		if dbFlag["GetVal"] {
-			fmt.Printf("AT:%s strArr = %s ok = %v\n", godebug.LF(), godebug.SVar(strArr), ok)
-		}
 		if ok {
-			if dbFlag["GetVal"] {
-				fmt.Printf("AT:%s\n", godebug.LF())
-			}
 			if len(strArr) > 0 {
-				if dbFlag["GetVal"] {
-					fmt.Printf("AT:%s\n", godebug.LF())
-				}
 				value = strArr[0]
 				found = true
 			} else {
-				if dbFlag["GetVal"] {
-					fmt.Printf("AT:%s\n", godebug.LF())
-				}
-				fmt.Fprintf(os.Stderr, "Multiple values for [%s]\n", name)
 				found = false
 			}
 		}
+		if logger.DebugOn("GetVal") {
+			logger.Debug("GetVal", "GetParam", "name", name, "method", method, "values", strArr, "at", godebug.LF(2))
+		}
 	}
-	if found {
-		rv = value
+	rv = value
+	if found && name == "id" {
+		LogQRID(req, rv)
 	}
 	return
 }
@@ -119,6 +106,7 @@ func SVarI(v interface{}) string {
 func CheckAuth(www http.ResponseWriter, req *http.Request) (ok bool) {
 	token := req.Header.Get("X-Auth")
 	if token == "" {
+		authFailures.WithLabelValues("missing_token").Inc()
 		AnError(www, req, 401, "Login required")
 		return false
 	}
@@ -127,17 +115,82 @@ func CheckAuth(www http.ResponseWriter, req *http.Request) (ok bool) {
 
 	str, err := redisClient.Cmd("GET", key).Str()
 	if err != nil || str == "" {
+		authFailures.WithLabelValues("invalid_token").Inc()
 		AnError(www, req, 401, "Login required")
 		return false
 	}
+	if str != "yes" { // tokens issued before the username was saved are "yes"
+		LogUser(req, str)
+	}
 
 	return true
 }
 
+// AuthUser returns the username that the X-Auth token was issued to.  Tokens issued before the
+// username was saved with the token return "".
+func AuthUser(req *http.Request) string {
+	token := req.Header.Get("X-Auth")
+	if token == "" {
+		return ""
+	}
+	un, err := redisClient.Cmd("GET", fmt.Sprintf("qr-token:%s", token)).Str()
+	if err != nil || un == "yes" {
+		return ""
+	}
+	return un
+}
+
+// TrustedProxy is true if ip is in gCfg.TrustedProxies.
+func TrustedProxy(ip string) bool {
+	addr := net.ParseIP(ip)
+	if addr == nil {
+		return false
+	}
+	for _, p := range strings.Split(gCfg.TrustedProxies, ",") {
+		p = strings.TrimSpace(p)
+		if _, cidr, err := net.ParseCIDR(p); err == nil {
+			if cidr.Contains(addr) {
+				return true
+			}
+		} else if pa := net.ParseIP(p); pa != nil && pa.Equal(addr) {
+			return true
+		}
+	}
+	return false
+}
+
+// ClientIP returns the address of the client.  X-Forwarded-For is only used if the request came from a
+// trusted proxy, the client is then the last address in it that is not a trusted proxy - the ones before
+// that are sent by the client and can be anything.
+func ClientIP(req *http.Request) string {
+	host, _, err := net.SplitHostPort(req.RemoteAddr)
+	if err != nil {
+		host = req.RemoteAddr
+	}
+	if !TrustedProxy(host) {
+		return host
+	}
+	xff := strings.Split(strings.Join(req.Header["X-Forwarded-For"], ","), ",")
+	for ii := len(xff) - 1; ii >= 0; ii-- {
+		ip := strings.TrimSpace(xff[ii])
+		if ip == "" {
+			continue
+		}
+		if !TrustedProxy(ip) {
+			return ip
+		}
+		host = ip
+	}
+	return host
+}
+
 // AnError reports an error and logs the error to stderr.
 func AnError(www http.ResponseWriter, req *http.Request, httpStatus int, msg string) {
-	fmt.Fprintf(os.Stderr, "Error: uri=%s status=%d msg=%s at:%s\n", req.RequestURI, httpStatus, msg, godebug.LF(-4))
-	fmt.Fprintf(logFile, "Error: uri=%s status=%d msg=%s at:%s\n", req.RequestURI, httpStatus, msg, godebug.LF(-4))
+	level := LevelWarn
+	if httpStatus >= 500 {
+		level = LevelError
+	}
+	LogReq(req, level, msg, "status", httpStatus, "at", godebug.LF(-4))
 	http.Error(www, fmt.Sprintf("Error: %s\n", msg), httpStatus)
 }
 
@@ -0,0 +1,39 @@
+package main
+
+// MIT Licensed - see LICENSE
+
+import (
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestGetParam(t *testing.T) {
+	tests := []struct {
+		method   string
+		query    string
+		name     string
+		dflt     string
+		expected string
+	}{
+		{"GET", "limit=5", "limit", "100", "5"},
+		{"GET", "", "limit", "100", "100"},
+		{"GET", "limit=", "limit", "100", ""},
+		{"GET", "", "id", "", ""},
+		{"POST", "format=json", "format", "csv", "json"},
+		{"POST", "", "format", "csv", "csv"},
+	}
+
+	for ii, test := range tests {
+		req := httptest.NewRequest(test.method, "/api/x?"+test.query, nil)
+		if test.method == "POST" {
+			req = httptest.NewRequest("POST", "/api/x", strings.NewReader(test.query))
+			req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		}
+		if got := GetParam(httptest.NewRecorder(), req, test.name, test.dflt); got != test.expected {
+			t.Errorf("Test %d, expected %q got %q\n", ii, test.expected, got)
+		}
+	}
+}
+
+/* vim: set noai ts=4 sw=4: */
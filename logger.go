@@ -0,0 +1,430 @@
+package main
+
+// MIT Licensed - see LICENSE
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/pschlump/json"
+	"github.com/pschlump/uuid"
+)
+
+// Logging.
+//
+// The log is one JSON object a line: time, level and msg, then the fields of the entry.  Every request is
+// logged by LogRequests with the X-Request-ID it came with, or a new one, which is sent back and added to
+// any entry logged with LogReq.  Debug entries are named by a flag, the old dbFlag names such as GetVal
+// and GenQR, and are written only if that flag is on or the level is debug.  /api/set-log changes both
+// at runtime.  log_file is rotated when it reaches log_max_size MB or is log_rotate hours old, and
+// log_keep old files are kept.
+
+// Level is the severity of a log entry.
+type Level int32
+
+const (
+	LevelDebug Level = iota
+	LevelInfo
+	LevelWarn
+	LevelError
+)
+
+var levelNames = []string{"debug", "info", "warn", "error"}
+
+func (lv Level) String() string {
+	if lv < LevelDebug || lv > LevelError {
+		return "unknown"
+	}
+	return levelNames[lv]
+}
+
+// ParseLevel returns the level named s.
+func ParseLevel(s string) (Level, error) {
+	for ii, n := range levelNames {
+		if strings.EqualFold(s, n) {
+			return Level(ii), nil
+		}
+	}
+	return LevelInfo, fmt.Errorf("Invalid log level %q, must be one of %s", s, strings.Join(levelNames, ", "))
+}
+
+// Logger writes JSON entries to out.
+type Logger struct {
+	lock  sync.Mutex
+	out   io.Writer
+	level int32        // a Level, atomic
+	flags atomic.Value // map[string]bool of the debug flags that are on
+}
+
+// NewLogger makes a logger that writes entries at level and above to out.
+func NewLogger(out io.Writer, level Level) *Logger {
+	lg := &Logger{out: out, level: int32(level)}
+	lg.flags.Store(map[string]bool{})
+	return lg
+}
+
+var logger = NewLogger(os.Stderr, LevelInfo)
+
+// SetOutput changes where entries are written, the old output is closed if it is a file other than stderr.
+func (lg *Logger) SetOutput(out io.Writer) {
+	lg.lock.Lock()
+	old := lg.out
+	lg.out = out
+	lg.lock.Unlock()
+	closeLog(old)
+}
+
+// Close sends the log back to stderr.
+func (lg *Logger) Close() {
+	lg.SetOutput(os.Stderr)
+}
+
+func closeLog(w io.Writer) {
+	if c, ok := w.(io.Closer); ok && w != io.Writer(os.Stderr) && w != io.Writer(os.Stdout) {
+		c.Close()
+	}
+}
+
+// Level is the lowest level written.
+func (lg *Logger) Level() Level {
+	return Level(atomic.LoadInt32(&lg.level))
+}
+
+// SetLevel changes the lowest level written.
+func (lg *Logger) SetLevel(level Level) {
+	atomic.StoreInt32(&lg.level, int32(level))
+}
+
+// DebugFlags are the debug flags that are on, sorted.
+func (lg *Logger) DebugFlags() []string {
+	list := []string{}
+	for f := range lg.flags.Load().(map[string]bool) {
+		list = append(list, f)
+	}
+	sort.Strings(list)
+	return list
+}
+
+// SetDebugFlags replaces the debug flags that are on.
+func (lg *Logger) SetDebugFlags(list []string) {
+	m := make(map[string]bool)
+	for _, f := range list {
+		m[f] = true
+	}
+	lg.flags.Store(m)
+}
+
+// DebugOn is true if debug entries for flag are written.
+func (lg *Logger) DebugOn(flag string) bool {
+	return lg.Level() == LevelDebug || lg.flags.Load().(map[string]bool)[flag]
+}
+
+// Debug logs an entry for the debug flag.
+func (lg *Logger) Debug(flag, msg string, kv ...interface{}) {
+	if lg.DebugOn(flag) {
+		lg.write(LevelDebug, msg, append([]interface{}{"flag", flag}, kv...))
+	}
+}
+
+// Info logs an entry, kv are pairs of field name and value.
+func (lg *Logger) Info(msg string, kv ...interface{}) {
+	lg.Log(LevelInfo, msg, kv...)
+}
+
+// Warn logs an entry, kv are pairs of field name and value.
+func (lg *Logger) Warn(msg string, kv ...interface{}) {
+	lg.Log(LevelWarn, msg, kv...)
+}
+
+// Error logs an entry, kv are pairs of field name and value.
+func (lg *Logger) Error(msg string, kv ...interface{}) {
+	lg.Log(LevelError, msg, kv...)
+}
+
+// Log logs an entry at level.
+func (lg *Logger) Log(level Level, msg string, kv ...interface{}) {
+	if level >= lg.Level() {
+		lg.write(level, msg, kv)
+	}
+}
+
+func (lg *Logger) write(level Level, msg string, kv []interface{}) {
+	var buf bytes.Buffer
+	fmt.Fprintf(&buf, `{"time":%q,"level":%q,"msg":%s`, time.Now().UTC().Format(time.RFC3339Nano), level, jsonValue(msg))
+	for ii := 0; ii < len(kv); ii += 2 {
+		name := fmt.Sprintf("%v", kv[ii])
+		var v interface{} = "(missing)"
+		if ii+1 < len(kv) {
+			v = kv[ii+1]
+		}
+		fmt.Fprintf(&buf, `,%s:%s`, jsonValue(name), jsonValue(v))
+	}
+	buf.WriteString("}\n")
+	lg.lock.Lock()
+	lg.out.Write(buf.Bytes())
+	lg.lock.Unlock()
+}
+
+func jsonValue(v interface{}) []byte {
+	switch x := v.(type) {
+	case error:
+		v = x.Error()
+	case time.Duration:
+		v = x.Seconds()
+	case fmt.Stringer:
+		v = x.String()
+	}
+	b, err := json.Marshal(v)
+	if err != nil {
+		b, _ = json.Marshal(fmt.Sprintf("%v", v))
+	}
+	return b
+}
+
+// StdLog is a log.Logger that writes each line as an entry at level, for http.Server.ErrorLog.
+func (lg *Logger) StdLog(level Level, msg string) *log.Logger {
+	return log.New(stdLogWriter{lg: lg, level: level, msg: msg}, "", 0)
+}
+
+type stdLogWriter struct {
+	lg    *Logger
+	level Level
+	msg   string
+}
+
+func (w stdLogWriter) Write(b []byte) (int, error) {
+	w.lg.Log(w.level, w.msg, "error", strings.TrimSpace(string(b)))
+	return len(b), nil
+}
+
+// RotateWriter is a log file that is moved to {name}.{time} and started again when it reaches maxSize
+// bytes or is older than every.  Only keep of the old files are kept, 0 keeps all of them.
+type RotateWriter struct {
+	name    string
+	maxSize int64
+	every   time.Duration
+	keep    int
+
+	lock   sync.Mutex
+	fh     *os.File
+	size   int64
+	opened time.Time
+}
+
+// NewRotateWriter opens name for append, a maxSize or every of 0 turns off that check.
+func NewRotateWriter(name string, maxSize int64, every time.Duration, keep int) (*RotateWriter, error) {
+	if err := os.MkdirAll(filepath.Dir(name), 0755); err != nil {
+		return nil, err
+	}
+	rw := &RotateWriter{name: name, maxSize: maxSize, every: every, keep: keep}
+	if err := rw.open(); err != nil {
+		return nil, err
+	}
+	return rw, nil
+}
+
+func (rw *RotateWriter) open() error {
+	fh, err := Fopen(rw.name, "a")
+	if err != nil {
+		return err
+	}
+	rw.fh, rw.size, rw.opened = fh, 0, time.Now()
+	if fi, err := fh.Stat(); err == nil {
+		rw.size = fi.Size()
+		if rw.size > 0 {
+			rw.opened = fi.ModTime() // for the age, a file carried on with is as old as its last write
+		}
+	}
+	return nil
+}
+
+// Write writes b, rotating first if b would take the file past maxSize or it is too old.
+func (rw *RotateWriter) Write(b []byte) (int, error) {
+	rw.lock.Lock()
+	defer rw.lock.Unlock()
+	if rw.fh == nil {
+		return 0, os.ErrClosed
+	}
+	if rw.size > 0 && ((rw.maxSize > 0 && rw.size+int64(len(b)) > rw.maxSize) || (rw.every > 0 && time.Since(rw.opened) >= rw.every)) {
+		if err := rw.rotate(); err != nil {
+			fmt.Fprintf(os.Stderr, "Unable to rotate log file %s: %s\n", rw.name, err)
+		}
+	}
+	n, err := rw.fh.Write(b)
+	rw.size += int64(n)
+	return n, err
+}
+
+// Rotate starts a new file now.
+func (rw *RotateWriter) Rotate() error {
+	rw.lock.Lock()
+	defer rw.lock.Unlock()
+	return rw.rotate()
+}
+
+func (rw *RotateWriter) rotate() error {
+	rw.fh.Close()
+	old := rw.name + "." + time.Now().UTC().Format("20060102-150405.000")
+	if err := os.Rename(rw.name, old); err != nil {
+		rw.open()
+		return err
+	}
+	if err := rw.open(); err != nil {
+		return err
+	}
+	rw.prune()
+	return nil
+}
+
+// prune removes the oldest rotated files past keep.
+func (rw *RotateWriter) prune() {
+	if rw.keep <= 0 {
+		return
+	}
+	list, _ := filepath.Glob(rw.name + ".*")
+	sort.Strings(list) // the time in the name sorts oldest first
+	for len(list) > rw.keep {
+		os.Remove(list[0])
+		list = list[1:]
+	}
+}
+
+// Close closes the file.
+func (rw *RotateWriter) Close() error {
+	rw.lock.Lock()
+	defer rw.lock.Unlock()
+	if rw.fh == nil {
+		return nil
+	}
+	err := rw.fh.Close()
+	rw.fh = nil
+	return err
+}
+
+// reqInfo is what the handlers tell the request log.
+type reqInfo struct {
+	ID   string
+	User string
+	QRID string
+}
+
+type reqInfoKey struct{}
+
+func getReqInfo(req *http.Request) *reqInfo {
+	if ri, ok := req.Context().Value(reqInfoKey{}).(*reqInfo); ok {
+		return ri
+	}
+	return nil
+}
+
+// RequestID is the X-Request-ID of req, "" outside LogRequests.
+func RequestID(req *http.Request) string {
+	if ri := getReqInfo(req); ri != nil {
+		return ri.ID
+	}
+	return ""
+}
+
+// LogUser records the user the request is for.
+func LogUser(req *http.Request, user string) {
+	if ri := getReqInfo(req); ri != nil {
+		ri.User = user
+	}
+}
+
+// LogQRID records the QR the request is for.
+func LogQRID(req *http.Request, id string) {
+	if ri := getReqInfo(req); ri != nil {
+		ri.QRID = id
+	}
+}
+
+// LogReq logs an entry at level with the request ID and URI of req.
+func LogReq(req *http.Request, level Level, msg string, kv ...interface{}) {
+	logger.Log(level, msg, append([]interface{}{"request_id", RequestID(req), "uri", req.RequestURI}, kv...)...)
+}
+
+// validRequestID is true for an ID from a client that can go in the log and back in a header.
+func validRequestID(s string) bool {
+	if s == "" || len(s) > 128 {
+		return false
+	}
+	for _, c := range s {
+		if c <= ' ' || c > '~' {
+			return false
+		}
+	}
+	return true
+}
+
+// NewRequestID makes an ID for a request that came without one.
+func NewRequestID() string {
+	if u, err := uuid.NewV4(); err == nil {
+		return u.String()
+	}
+	return fmt.Sprintf("%x", time.Now().UnixNano())
+}
+
+// LogRequests sets the X-Request-ID of each request and logs it once it is served.
+func LogRequests(h http.Handler) http.Handler {
+	return http.HandlerFunc(func(www http.ResponseWriter, req *http.Request) {
+		ri := &reqInfo{ID: req.Header.Get("X-Request-ID")}
+		if !validRequestID(ri.ID) {
+			ri.ID = NewRequestID()
+		}
+		www.Header().Set("X-Request-ID", ri.ID)
+		req = req.WithContext(context.WithValue(req.Context(), reqInfoKey{}, ri))
+
+		rec := &statusRecorder{ResponseWriter: www}
+		start := time.Now()
+		h.ServeHTTP(rec, req)
+
+		logger.Info("request", "request_id", ri.ID, "method", req.Method, "path", req.URL.Path, "status", rec.Status(),
+			"latency_ms", float64(time.Since(start).Microseconds())/1000, "user", ri.User, "qr_id", ri.QRID,
+			"bytes", rec.size, "remote", ClientIP(req))
+	})
+}
+
+/*
+/api/set-log?level=debug&debug=GetVal,GenQR - changes the log level and the debug flags that are on, either
+may be left out.  debug= empty turns off all the flags.  Admin only.
+*/
+func respHandlerSetLog(www http.ResponseWriter, req *http.Request) {
+	if !CheckAuth(www, req) {
+		return
+	}
+	if !IsAdmin(req) {
+		AnError(www, req, 403, "Admin only")
+		return
+	}
+
+	if s := GetParam(www, req, "level", ""); s != "" {
+		level, err := ParseLevel(s)
+		if err != nil {
+			AnError(www, req, 406, err.Error())
+			return
+		}
+		logger.SetLevel(level)
+	}
+	req.ParseForm()
+	if _, ok := req.Form["debug"]; ok {
+		logger.SetDebugFlags(splitList(GetParam(www, req, "debug", "")))
+	}
+	LogReq(req, LevelWarn, "log settings changed", "level", logger.Level(), "debug", logger.DebugFlags())
+
+	www.Header().Set("Content-Type", "application/json; charset=utf-8")
+	fmt.Fprintf(www, `{"status":"success","level":%q,"debug":%s}`+"\n", logger.Level(), SVar(logger.DebugFlags()))
+}
+
+/* vim: set noai ts=4 sw=4: */
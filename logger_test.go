@@ -0,0 +1,166 @@
+package main
+
+// MIT Licensed - see LICENSE
+
+import (
+	"bytes"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/pschlump/json"
+)
+
+func TestLoggerLevels(t *testing.T) {
+	var buf bytes.Buffer
+	lg := NewLogger(&buf, LevelInfo)
+	lg.SetDebugFlags([]string{"GenQR"})
+
+	tests := []struct {
+		fn   func()
+		want string // "" for nothing logged
+	}{
+		{fn: func() { lg.Info("hello", "n", 3, "d", 1500*time.Millisecond) }, want: `"level":"info","msg":"hello","n":3,"d":1.5}`},
+		{fn: func() { lg.Error("bad", "error", os.ErrNotExist) }, want: `"msg":"bad","error":"file does not exist"}`},
+		{fn: func() { lg.Debug("GetVal", "param") }, want: ""},
+		{fn: func() { lg.Debug("GenQR", "gen", "uri", "a\"b") }, want: `"level":"debug","msg":"gen","flag":"GenQR","uri":"a\"b"}`},
+		{fn: func() { lg.SetLevel(LevelWarn); lg.Info("quiet") }, want: ""},
+		{fn: func() { lg.SetLevel(LevelDebug); lg.Debug("GetVal", "param") }, want: `"msg":"param","flag":"GetVal"}`},
+		{fn: func() { lg.Warn("odd", "k") }, want: `"k":"(missing)"}`},
+	}
+	for ii, test := range tests {
+		buf.Reset()
+		test.fn()
+		got := buf.String()
+		if test.want == "" {
+			if got != "" {
+				t.Errorf("Test %d, expected nothing logged, got %s\n", ii, got)
+			}
+			continue
+		}
+		var m map[string]interface{}
+		if err := json.Unmarshal([]byte(got), &m); err != nil {
+			t.Errorf("Test %d, invalid JSON %s: %s\n", ii, got, err)
+		}
+		if !strings.HasSuffix(got, test.want+"\n") {
+			t.Errorf("Test %d, expected to end with %s, got %s\n", ii, test.want, got)
+		}
+	}
+}
+
+func TestParseLevel(t *testing.T) {
+	tests := []struct {
+		s    string
+		want Level
+		err  bool
+	}{
+		{s: "debug", want: LevelDebug},
+		{s: "WARN", want: LevelWarn},
+		{s: "error", want: LevelError},
+		{s: "verbose", err: true},
+	}
+	for ii, test := range tests {
+		got, err := ParseLevel(test.s)
+		if (err != nil) != test.err {
+			t.Errorf("Test %d, expected error %v, got %v\n", ii, test.err, err)
+		} else if !test.err && got != test.want {
+			t.Errorf("Test %d, expected %s, got %s\n", ii, test.want, got)
+		}
+	}
+}
+
+func TestRotateWriter(t *testing.T) {
+	dir, err := ioutil.TempDir("", "qr-log")
+	if err != nil {
+		t.Fatalf("TempDir: %s\n", err)
+	}
+	defer os.RemoveAll(dir)
+	fn := filepath.Join(dir, "log", "log.out")
+
+	rw, err := NewRotateWriter(fn, 20, 0, 2)
+	if err != nil {
+		t.Fatalf("NewRotateWriter: %s\n", err)
+	}
+	defer rw.Close()
+	for ii := 0; ii < 5; ii++ {
+		rw.Write([]byte("0123456789abcde\n")) // 16 bytes, so each write after the first rotates
+		time.Sleep(2 * time.Millisecond)      // rotated names are to the millisecond
+	}
+
+	old, _ := filepath.Glob(fn + ".*")
+	if len(old) != 2 {
+		t.Errorf("Test 0, expected 2 rotated files kept, got %d: %s\n", len(old), old)
+	}
+	b, _ := ioutil.ReadFile(fn)
+	if string(b) != "0123456789abcde\n" {
+		t.Errorf("Test 1, expected the current file to have the last write only, got %q\n", b)
+	}
+
+	rw2, err := NewRotateWriter(filepath.Join(dir, "age.out"), 0, time.Millisecond, 0)
+	if err != nil {
+		t.Fatalf("NewRotateWriter: %s\n", err)
+	}
+	defer rw2.Close()
+	rw2.Write([]byte("one\n"))
+	time.Sleep(5 * time.Millisecond)
+	rw2.Write([]byte("two\n"))
+	if old, _ := filepath.Glob(filepath.Join(dir, "age.out.*")); len(old) != 1 {
+		t.Errorf("Test 2, expected 1 file rotated by age, got %d\n", len(old))
+	}
+}
+
+func TestLogRequests(t *testing.T) {
+	defer func(out *Logger) { logger = out }(logger)
+	var buf bytes.Buffer
+	logger = NewLogger(&buf, LevelInfo)
+
+	h := LogRequests(http.HandlerFunc(func(www http.ResponseWriter, req *http.Request) {
+		LogUser(req, "bob")
+		GetParam(www, req, "id", "")
+		www.Write([]byte("hello"))
+	}))
+
+	tests := []struct {
+		header string
+		same   bool // the ID sent is the one used
+	}{
+		{header: "abc-123", same: true},
+		{header: "", same: false},
+		{header: "bad id\n", same: false},
+	}
+	for ii, test := range tests {
+		buf.Reset()
+		req := httptest.NewRequest("GET", "/api/status?id=42", nil)
+		if test.header != "" {
+			req.Header.Set("X-Request-ID", test.header)
+		}
+		rec := httptest.NewRecorder()
+		h.ServeHTTP(rec, req)
+
+		rid := rec.Header().Get("X-Request-ID")
+		if test.same && rid != test.header {
+			t.Errorf("Test %d, expected request ID %s, got %s\n", ii, test.header, rid)
+		} else if !test.same && (rid == "" || rid == test.header) {
+			t.Errorf("Test %d, expected a new request ID, got %q\n", ii, rid)
+		}
+		var m map[string]interface{}
+		if err := json.Unmarshal(buf.Bytes(), &m); err != nil {
+			t.Errorf("Test %d, invalid JSON %s: %s\n", ii, buf.String(), err)
+			continue
+		}
+		want := map[string]interface{}{"request_id": rid, "method": "GET", "path": "/api/status", "status": 200.0,
+			"user": "bob", "qr_id": "42", "bytes": 5.0}
+		for k, v := range want {
+			if m[k] != v {
+				t.Errorf("Test %d, expected %s=%v, got %v\n", ii, k, v, m[k])
+			}
+		}
+	}
+}
+
+/* vim: set noai ts=4 sw=4: */
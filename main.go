@@ -6,16 +6,16 @@ import (
 	"crypto/sha256"
 	"flag"
 	"fmt"
-	"io"
-	"log"
 	"net/http"
 	"os"
-	"path/filepath"
+	"sort"
+	"strconv"
 	"strings"
+	"time"
 
 	"github.com/pschlump/godebug"
+	"github.com/pschlump/json"
 	"github.com/pschlump/qr-svr/ReadConfig"
-	"github.com/pschlump/radix.v2/redis"
 	"github.com/pschlump/uuid"
 	"golang.org/x/crypto/pbkdf2"
 )
@@ -26,6 +26,7 @@ type ConfigType struct {
 	RedisConnectHost string `json:"redis_host" default:"$ENV$REDIS_HOST"`
 	RedisConnectAuth string `json:"redis_auth" default:"$ENV$REDIS_AUTH"`
 	RedisConnectPort string `json:"redis_port" default:"6379"`
+	RedisPoolSize    int    `json:"redis_pool_size" default:"10"` // Idle connections kept open to Redis
 
 	// server config
 	HostPort string `json:"host_port" default:"localhost:8333"` //
@@ -34,12 +35,107 @@ type ConfigType struct {
 	QRUri    string `json:"dir" default:"./q"`                  // URL path for serving QRs
 	LogFile  string `json:"log_file" default:"./log/log.out"`   //
 
+	// Proxies in front of the server, see ClientIP
+	TrustedProxies string `json:"trusted_proxies" default:""` // IPs or CIDRs, comma separated, whose X-Forwarded-For is used for the client address, "" for none
+
+	// Logging, see logger.go
+	LogLevel   string `json:"log_level" default:"info"`   // debug, info, warn or error
+	LogDebug   string `json:"log_debug" default:""`       // Debug flags to turn on, comma separated, e.g. "GetVal,GenQR"
+	LogMaxSize int    `json:"log_max_size" default:"100"` // MB the log file reaches before it is rotated, 0 for no limit
+	LogRotate  int    `json:"log_rotate" default:"24"`    // Hours between rotations of the log file, 0 for none
+	LogKeep    int    `json:"log_keep" default:"7"`       // Rotated log files kept, 0 keeps all of them
+
+	// Public URLs, see baseurl.go
+	PublicBaseURL string              `json:"public_base_url" default:""` // Scheme, host and optional path prefix of the URLs in QRs and links, "" for http(s)://{host_port}
+	UserDomains   map[string][]string `json:"user_domains"`               // Other base URLs each user can make QRs with, by username
+	ExtraHosts    string              `json:"extra_hosts" default:""`     // Other host names the default domain is served on, comma separated; only checked once there are custom domains, see domain.go
+
+	// HTTP server, in seconds
+	ReadTimeout       int `json:"read_timeout" default:"30"`          // Time to read a whole request, uploads included
+	ReadHeaderTimeout int `json:"read_header_timeout" default:"10"`   // Time to read the request headers
+	WriteTimeout      int `json:"write_timeout" default:"120"`        // Time to write a response, ZIPs and PDFs included
+	IdleTimeout       int `json:"idle_timeout" default:"120"`         // Time a keep-alive connection is kept open between requests
+	MaxHeaderBytes    int `json:"max_header_bytes" default:"1048576"` // Largest request header
+	ShutdownTimeout   int `json:"shutdown_timeout" default:"30"`      // Time requests in flight are given to finish on SIGTERM or SIGINT
+
+	// Readiness, see health.go
+	MinFreeMB int `json:"min_free_mb" default:"100"` // /readyz fails with less than this free on the disk QRDir is on
+
+	// Metrics, see metrics.go
+	MetricsAddr  string `json:"metrics_addr" default:""`                       // Address of a listener for /metrics only, "" to serve it with everything else
+	MetricsToken string `json:"metrics_token" default:"$ENV$QR_METRICS_TOKEN"` // Bearer token /metrics needs, "" for none
+
+	// TLS, see tls.go
+	TLSCert        string `json:"tls_cert" default:""`                     // Certificate (PEM, with any chain) to listen with TLS, "" for plain HTTP
+	TLSKey         string `json:"tls_key" default:""`                      // Key for TLSCert
+	TLSReload      int    `json:"tls_reload" default:"60"`                 // Seconds between checks for a new certificate
+	RedirectHTTP   string `json:"redirect_http" default:""`                // Address of a plain listener that redirects to HTTPS, e.g. ":80"
+	HSTSMaxAge     int    `json:"hsts_max_age" default:"31536000"`         // Strict-Transport-Security max-age sent over TLS, 0 for none
+	HSTSSubDomains bool   `json:"hsts_include_subdomains" default:"false"` // Add includeSubDomains to Strict-Transport-Security, only if every sub-domain has HTTPS
+
+	// Redirects
+	RedirectMode         string `json:"redirect_mode" default:"303"`                            // 301, 302, 303, 307, 308 or interstitial, can be set per QR
+	InterstitialTemplate string `json:"interstitial_template" default:"tmpl/interstitial.html"` // Template in Dir for the interstitial page
+	InterstitialDelay    int    `json:"interstitial_delay" default:"5"`                         // Seconds before the interstitial page goes on
+
+	// Target URL checks
+	URLSchemes      string `json:"url_schemes" default:"http,https,tel,mailto,sms,smsto,geo"` // Schemes allowed in target URLs
+	DomainAllowFile string `json:"domain_allow_file" default:""`                              // If set only these domains (one per line) may be targets
+	DomainBlockFile string `json:"domain_block_file" default:""`                              // Domains (one per line) that may not be targets
+
+	// Offline threat lists, targets that match are quarantined
+	ThreatHashFile  string `json:"threat_hash_file" default:""`  // Hex SHA-256 prefixes of Safe Browsing style expressions, one per line
+	ThreatURLFile   string `json:"threat_url_file" default:""`   // URLhaus CSV dump or a list of URLs
+	ThreatURLSource string `json:"threat_url_source" default:""` // Where --refresh-threats downloads ThreatURLFile from
+	AdminUsers      string `json:"admin_users" default:""`       // Users that can see and release quarantined targets and other admin pages, "" for nobody
+
+	// Landing pages
+	PageDir      string `json:"page_dir" default:"./data/pages"`        // Directory for files attached to landing pages
+	PageTemplate string `json:"page_template" default:"tmpl/page.html"` // Template in Dir for landing pages
+	PageMaxFile  int    `json:"page_max_file" default:"10485760"`       // Largest file that can be attached to a page, 0 for no limit
+
+	// Bulk creation
+	BulkWorkers int `json:"bulk_workers" default:"4"`      // Goroutines making images for a bulk request
+	BulkMaxRows int `json:"bulk_max_rows" default:"10000"` // Most rows in one bulk request, 0 for no limit
+	BulkRetain  int `json:"bulk_retain" default:"604800"`  // Seconds the progress and manifest of a bulk request are kept
+
+	// Label sheets, see label.go
+	LabelMaxIDs int `json:"label_max_ids" default:"1000"` // Most QRs on one /api/label-pdf, 0 for no limit
+
+	// Background jobs
+	JobWorkers int `json:"job_workers" default:"2"`     // Jobs run at the same time
+	JobRetain  int `json:"job_retain" default:"604800"` // Seconds a finished job, its result and file are kept
+
+	// Re-rendering
+	RenderWorkers int `json:"render_workers" default:"4"` // Goroutines making images for a rerender job
+
+	// Expired QRs
+	ExpiredPage string `json:"expired_page" default:""` // Page in Dir served with a 410 when a QR has expired, "" for a plain 410
+
+	// Routing rules
+	CountryHeader string `json:"country_header" default:"X-Country-Code"` // Header with the client's country, set by the proxy/CDN
+
+	// Default UTM tags added on redirect, can be set per QR with /api/set-utm
+	UTMSource      string `json:"utm_source" default:""`
+	UTMMedium      string `json:"utm_medium" default:""`
+	UTMCampaign    string `json:"utm_campaign" default:""`
+	UTMPassthrough bool   `json:"utm_passthrough" default:"false"` // Pass the query string of the scanned URL on to the target
+
 	// Login Duration
 	LoginTTL int `json:"session_persistence" default:"2592000"` // 30 days * # of sec per day ( 60 * 60 * 24 )
 
 	// QR config stuff
-	Level  string `json:"qr_level" default:"H"`  // Redundancy level in QR
+	Level  string `json:"qr_level" default:"H"`  // Redundancy level in QR: L, M, Q or H
 	QRSize int    `json:"qr_size" default:"256"` // Pixel size of image
+
+	// Alerts and webhooks
+	AlertInterval     int    `json:"alert_interval" default:"60"`                     // Seconds between checks of the scan alerts, 0 turns them off
+	AlertLogSize      int    `json:"alert_log_size" default:"100"`                    // Number of deliveries kept in the log for each QR
+	WebhookSecret     string `json:"webhook_secret" default:"$ENV$QR_WEBHOOK_SECRET"` // Key used to sign webhook bodies
+	WebhookTries      int    `json:"webhook_tries" default:"5"`                       // Attempts at a delivery before giving up
+	WebhookBackoff    int    `json:"webhook_backoff" default:"30"`                    // Seconds before the first retry of a queued delivery, doubles after each attempt
+	WebhookScanBatch  int    `json:"webhook_scan_batch" default:"60"`                 // Seconds of scans collected into one qr.scanned event, 0 turns them off
+	WebhookAllowHosts string `json:"webhook_allow_hosts" default:""`                  // Hosts, IPs or CIDRs, comma separated, on a loopback, link-local or private network that webhooks may be sent to
 }
 
 var gCfg ConfigType
@@ -49,35 +145,28 @@ var optHostPort = flag.String("hostport", "", "Host/Port to listen on")
 var optDir = flag.String("dir", "", "Directory to server from")
 var optCreateUser = flag.String("create-user", "", "Username to create (must also have --password)")
 var optPassword = flag.String("password", "", "Password to go with username")
+var optBulk = flag.String("bulk", "", "CSV or JSON file of QRs to create")
+var optBulkOut = flag.String("bulk-out", "", "ZIP file to write the --bulk images and manifest to")
+var optBulkUser = flag.String("bulk-user", "", "Username to record as the creator of --bulk QRs")
+var optRerender = flag.Bool("rerender", false, "Make all the images again from the current config and exit")
+var optDryRun = flag.Bool("dry-run", false, "With --rerender, list the images that would change without writing them")
+var optRerenderResume = flag.String("rerender-resume", "", "Carry on with a --rerender job that was stopped")
+var optVersion = flag.Bool("version", false, "Print the version and exit")
+var optRefreshThreats = flag.Bool("refresh-threats", false, "Download the threat URL list and exit (run from cron)")
 
-var dbFlag map[string]bool
 var NIterations = 50000 // # of iterations of hashing for passwords
-var redisClient *redis.Client
-var logFile *os.File
-
-func init() {
-	dbFlag = make(map[string]bool)
-	logFile = os.Stderr
-}
+var redisClient *RedisPool
 
 // repHandlerStatus returns a status that show if the server is connected and live.
+// See /readyz in health.go for the checks a load balancer should use.
 func respHandlerStatus(www http.ResponseWriter, req *http.Request) {
-	q := req.RequestURI
-
-	var rv, rok string
-	rok = "Redis OK"
-
-	// check redis connection
-	_, err := redisClient.Cmd("GET", "qr-id:").Int()
-	if err != nil {
-		rok = "Failed to connect to Redis"
+	if err := checkRedis(); err != nil {
+		AnError(www, req, 503, "Failed to connect to Redis")
 		return
 	}
 
 	www.Header().Set("Content-Type", "application/json; charset=utf-8")
-	rv = fmt.Sprintf(`{"status":"success","name":"qr-svr version 1.0.0","URI":%q,"req":%s, "response_header":%s, "redis":%q}`, q, SVarI(req), SVarI(www.Header()), rok)
-
-	io.WriteString(www, rv)
+	fmt.Fprintf(www, `{"status":"success","name":"qr-svr","version":%q,"commit":%q,"redis":"Redis OK"}`+"\n", Version, Commit)
 }
 
 /*
@@ -102,11 +191,17 @@ func respHandlerCount(www http.ResponseWriter, req *http.Request) {
 	}
 
 	www.Header().Set("Content-Type", "application/json; charset=utf-8")
+	if vc := GetVariantCounts(id); vc != nil {
+		fmt.Fprintf(www, `{"status":"success","count":%q,"variants":%s}`+"\n", n, SVar(vc))
+		return
+	}
 	fmt.Fprintf(www, `{"status":"success","count":%q}`+"\n", n)
 }
 
 /*
-/api/upd-qr?id=ID&url=XXX
+/api/upd-qr?id=ID&url=XXX&expires=TIME&max_scans=N&mode=M&variants=[{"name":"a","url":"...","weight":50},...]
+At least one of url, expires, max_scans, mode or variants is required.  variants=[] removes the A/B split.
+mode is one of 301, 302, 303, 307, 308, interstitial or default.
 */
 func respHandlerUpdQR(www http.ResponseWriter, req *http.Request) {
 	if !CheckAuth(www, req) {
@@ -119,25 +214,91 @@ func respHandlerUpdQR(www http.ResponseWriter, req *http.Request) {
 		return
 	}
 	xurl := GetParam(www, req, "url", "")
-	if xurl == "" {
+	sExpires := GetParam(www, req, "expires", "")
+	sMaxScans := GetParam(www, req, "max_scans", "")
+	sVariants := GetParam(www, req, "variants", "")
+	mode := GetParam(www, req, "mode", "")
+	if xurl == "" && sExpires == "" && sMaxScans == "" && sVariants == "" && mode == "" {
 		AnError(www, req, 406, "Missing Parameter")
 		return
 	}
+	if mode != "" && mode != "default" && !RedirectModes[mode] {
+		AnError(www, req, 406, fmt.Sprintf("Invalid mode %q", mode))
+		return
+	}
 
-	key := fmt.Sprintf("qrr:%s", id)
-
-	err := redisClient.Cmd("SET", key, xurl).Err
+	ex, err := ParseExpireParams(GetExpire(id), sExpires, sMaxScans)
 	if err != nil {
-		AnError(www, req, 500, "Config Error 5")
+		AnError(www, req, 406, err.Error())
+		return
+	}
+	var variants []SplitVariant
+	if sVariants != "" {
+		if err = json.Unmarshal([]byte(sVariants), &variants); err != nil {
+			AnError(www, req, 406, fmt.Sprintf("Invalid variants: %s", err))
+			return
+		}
+		if err = ValidateSplit(variants); err != nil {
+			AnError(www, req, 406, err.Error())
+			return
+		}
+	}
+	var vv Validator
+	if xurl != "" {
+		vv.URL("url", &xurl)
+	}
+	for ii := range variants {
+		vv.URL(fmt.Sprintf("variants[%d].url", ii), &variants[ii].URL)
+	}
+	if vv.Send(www, req) {
+		return
+	}
+
+	version := 0
+	if xurl != "" {
+		version, err = SetTargetURL(id, xurl, AuthUser(req), 0)
+		if err != nil {
+			AnError(www, req, 500, "Config Error 5")
+			return
+		}
+	} else if xurl, err = redisClient.Cmd("GET", fmt.Sprintf("qrr:%s", id)).Str(); err != nil {
+		AnError(www, req, 404, "Not Found")
 		return
 	}
 
+	if sExpires != "" || sMaxScans != "" {
+		if err = SaveExpire(id, ex); err != nil {
+			AnError(www, req, 500, "Config Error 20")
+			return
+		}
+	}
+	if sVariants != "" {
+		if err = SaveSplit(id, variants); err != nil {
+			AnError(www, req, 500, "Config Error 23")
+			return
+		}
+	}
+	if mode != "" {
+		if mode == "default" {
+			mode = ""
+		}
+		if err = SaveRedirectMode(id, mode); err != nil {
+			AnError(www, req, 500, "Config Error 25")
+			return
+		}
+	}
+
+	Quarantine(id, AuthUser(req), vv.Threats)
+
+	go EmitEvent(HookEvent{Event: "qr.updated", ID: id, URL: xurl})
+
 	www.Header().Set("Content-Type", "application/json; charset=utf-8")
-	fmt.Fprintf(www, `{"status":"success"}`)
+	fmt.Fprintf(www, `{"status":"success","version":%d,"expires":%d,"max_scans":%d,"quarantined":%d}`, version, ex.Expires, ex.MaxScans, len(vv.Threats))
 }
 
 /*
-/api/gen-qr?url=XXX - initial XXX url to set ID to, returns QR and ID as JSON
+/api/gen-qr?url=XXX&expires=TIME&max_scans=N&mode=M&domain=D - initial XXX url to set ID to, returns QR and ID as JSON
+domain picks one of the user's short domains for the encoded URL, by host or base URL.
 */
 func respHandlerGenQR(www http.ResponseWriter, req *http.Request) {
 	if !CheckAuth(www, req) {
@@ -147,55 +308,101 @@ func respHandlerGenQR(www http.ResponseWriter, req *http.Request) {
 	// fmt.Printf("AT: %s\n", godebug.LF())
 	xurl := GetParam(www, req, "url", "")
 	if xurl == "" {
-		xurl = fmt.Sprintf("http://%s/404page.html", gCfg.HostPort)
+		xurl = BaseURL() + "/404page.html"
 	}
-
-	key := fmt.Sprintf("qr-id:")
-
-	// fmt.Printf("AT: %s\n", godebug.LF())
-	// get the ID / Increment it.
-	id, err := redisClient.Cmd("INCR", key).Int()
+	var vv Validator
+	vv.URL("url", &xurl)
+	if vv.Send(www, req) {
+		return
+	}
+	ex, err := ParseExpireParams(ExpireType{}, GetParam(www, req, "expires", ""), GetParam(www, req, "max_scans", ""))
 	if err != nil {
-		AnError(www, req, 500, fmt.Sprintf("Config Error 1: %s at:%s", err, godebug.LF()))
+		AnError(www, req, 406, err.Error())
 		return
 	}
-
-	// fmt.Printf("AT: %s\n", godebug.LF())
-	// GenQR call - to generate image and save it.
-	uri, _ /*pth*/, err := GenQR(gCfg.QRDir, gCfg.QRUri, gCfg.HostPort, fmt.Sprintf("%d", id))
+	mode := GetParam(www, req, "mode", "")
+	if mode != "" && !RedirectModes[mode] {
+		AnError(www, req, 406, fmt.Sprintf("Invalid mode %q", mode))
+		return
+	}
+	base, err := ChooseBaseURL(AuthUser(req), GetParam(www, req, "domain", ""))
 	if err != nil {
-		AnError(www, req, 500, "Config Error 2")
+		AnError(www, req, 406, err.Error())
 		return
 	}
 
-	// fmt.Printf("AT: %s\n", godebug.LF())
-	// set in Redis
-	key = fmt.Sprintf("qrr:%d", id)
-	err = redisClient.Cmd("SET", key, xurl).Err
+	id, img, uri, err := CreateQR(xurl, AuthUser(req), base)
 	if err != nil {
-		AnError(www, req, 500, "Config Error 3")
+		AnError(www, req, 500, err.Error())
 		return
 	}
-	// fmt.Printf("AT: %s\n", godebug.LF())
-	key = fmt.Sprintf("qr-count:%d", id)
-	err = redisClient.Cmd("SET", key, "0").Err
-	if err != nil {
-		AnError(www, req, 500, "Config Error 4")
+	if err = SaveExpire(id, ex); err != nil {
+		AnError(www, req, 500, "Config Error 20")
+		return
+	}
+	if err = SaveRedirectMode(id, mode); err != nil {
+		AnError(www, req, 500, "Config Error 25")
 		return
 	}
 
-	img := fmt.Sprintf("http://%s/%s/%d.png", gCfg.HostPort, gCfg.QRUri, id)
+	Quarantine(id, AuthUser(req), vv.Threats)
+
+	go EmitEvent(HookEvent{Event: "qr.created", ID: id, URL: xurl})
 
 	// fmt.Printf("AT: %s\n", godebug.LF())
 	// generate JSON response w/ ID and QR
 	www.Header().Set("Content-Type", "application/json; charset=utf-8")
 	// fmt.Fprintf(www, `{"status":"success", "id":"%d", "url":%q, "qr_url":%q }`, id, xurl, uri)
-	fmt.Fprintf(www, `{"status":"success", "id":"%d", "url":%q, "qr_url":%q, "qr_encoded":%q }`, id, xurl, img, uri)
+	fmt.Fprintf(www, `{"status":"success", "id":%q, "url":%q, "qr_url":%q, "qr_encoded":%q, "quarantined":%d }`, id, xurl, img, uri, len(vv.Threats))
 
 }
 
+// CreateQR allocates the next ID, generates its image and points it at xurl, with any "{id}" in xurl
+// replaced by the ID.  base is the base URL to encode, "" for the default.  img is the URL of the image
+// and uri is what is encoded in it.
+func CreateQR(xurl, user, base string) (id, img, uri string, err error) {
+	// fmt.Printf("AT: %s\n", godebug.LF())
+	// get the ID / Increment it.
+	nid, err := redisClient.Cmd("INCR", "qr-id:").Int()
+	if err != nil {
+		return "", "", "", fmt.Errorf("Config Error 1: %s at:%s", err, godebug.LF())
+	}
+	id = fmt.Sprintf("%d", nid)
+	img, uri, err = SetupQR(id, xurl, user, base)
+	return
+}
+
+// SetupQR generates the image for an ID that has been allocated and points it at xurl.
+func SetupQR(id, xurl, user, base string) (img, uri string, err error) {
+	if err = SetQRBaseURL(id, base); err != nil {
+		return "", "", fmt.Errorf("Config Error 2")
+	}
+
+	// fmt.Printf("AT: %s\n", godebug.LF())
+	// GenQR call - to generate image and save it.
+	uri, _ /*pth*/, err = GenQR(gCfg.QRDir, id)
+	if err != nil {
+		return "", "", fmt.Errorf("Config Error 2")
+	}
+	SaveRenderSpec(id, CurrentRenderSpec(id))
+
+	// fmt.Printf("AT: %s\n", godebug.LF())
+	// set in Redis
+	if _, err = SetTargetURL(id, strings.Replace(xurl, "{id}", id, -1), user, 0); err != nil {
+		return "", "", fmt.Errorf("Config Error 3")
+	}
+	if err = redisClient.Cmd("SET", fmt.Sprintf("qr-count:%s", id), "0").Err; err != nil {
+		return "", "", fmt.Errorf("Config Error 4")
+	}
+	createdCount.Inc()
+
+	img = ImageURL(id)
+	return
+}
+
 /*
 /api/get-jwt?un=X&pw=Y -> token
+
 	If missing un/pw params then 406
 	Generate token if valid - else 401
 	Lookup in redis qr-salt:X to get per-user salt
@@ -220,6 +427,7 @@ func respHandlerGetAuth(www http.ResponseWriter, req *http.Request) {
 
 	pwHash, err := redisClient.Cmd("GET", key).Str()
 	if err != nil {
+		authFailures.WithLabelValues("unknown_user").Inc()
 		AnError(www, req, 401, "Not Found")
 		return
 	}
@@ -236,6 +444,7 @@ func respHandlerGetAuth(www http.ResponseWriter, req *http.Request) {
 	dk := fmt.Sprintf("%x", pbkdf2.Key([]byte(pw), []byte(salt), NIterations, 64, sha256.New))
 
 	if pwHash != dk {
+		authFailures.WithLabelValues("bad_password").Inc()
 		AnError(www, req, 401, "Not Found")
 		return
 	}
@@ -251,7 +460,7 @@ func respHandlerGetAuth(www http.ResponseWriter, req *http.Request) {
 	key = fmt.Sprintf("qr-token:%s", token)
 
 	// fmt.Printf("AT: %s\n", godebug.LF())
-	err = redisClient.Cmd("SETEX", key, gCfg.LoginTTL, "yes").Err
+	err = redisClient.Cmd("SETEX", key, gCfg.LoginTTL, un).Err
 	if err != nil {
 		AnError(www, req, 500, "Config Error 8")
 		return
@@ -262,36 +471,90 @@ func respHandlerGetAuth(www http.ResponseWriter, req *http.Request) {
 
 }
 
+// SelectTarget picks where a scan of id goes: the first matching routing rule, then the active schedule
+// window, then the A/B split and last of all to, the target in qrr:{id}.  variant is the split variant
+// that was used, if any.
+func SelectTarget(id, to string, req *http.Request, now time.Time) (target, variant string) {
+	if rt, ok := RoutedTarget(id, req); ok {
+		return rt, ""
+	}
+	if st, ok := ScheduledTarget(id, now); ok {
+		return st, ""
+	}
+	if st, v, ok := SplitTarget(id, req); ok {
+		return st, v
+	}
+	return to, ""
+}
+
 /*
 /q/{ID}
 */
 func respHandlerRedirect(www http.ResponseWriter, req *http.Request) {
-	if len(req.RequestURI[3:]) <= 3 {
+	if len(req.URL.Path[3:]) <= 3 {
 		AnError(www, req, 404, "Not Found")
 		return
 	}
 	// fmt.Printf("AT: %s URi ->%s<\n", godebug.LF(), req.RequestURI)
 
-	id := req.RequestURI[3:]
+	host := RequestHost(req)
+	if !ScansDefault(host) && !IsOwnHost(host) {
+		redirectCount.WithLabelValues("unknown_host").Inc()
+		AnError(www, req, 421, "Unknown Host")
+		return
+	}
+	id := ScopedID(host, req.URL.Path[3:]) // the query string is not part of the ID
+	LogQRID(req, id)
 	// fmt.Printf("AT: %s id ->%s<\n", godebug.LF(), id)
 
 	key := fmt.Sprintf("qrr:%s", id)
 	to, err := redisClient.Cmd("GET", key).Str()
-	if err != nil {
+	if err != nil || !ServedOn(QRBaseURL(id), host) {
+		redirectCount.WithLabelValues("miss").Inc()
 		AnError(www, req, 404, "Not Found")
 		return
 	}
 
+	now := timeNow()
+	ex := GetExpire(id)
+	if ex.TimeExpired(now) {
+		redirectCount.WithLabelValues("expired").Inc()
+		ServeExpired(www, req)
+		return
+	}
+
+	to, variant := SelectTarget(id, to, req, now)
+	if IsQuarantined(id, to) {
+		redirectCount.WithLabelValues("quarantined").Inc()
+		ServeQuarantined(www, req)
+		return
+	}
+	page := IsOwnURL(to, "/L/"+id)
+	to = AddQueryParams(to, id, GetUTM(id), req.URL.Query())
+
 	// fmt.Printf("AT: %s\n", godebug.LF())
 	key = fmt.Sprintf("qr-count:%s", id)
-	redisClient.Cmd("INCR", key)
+	n, err := redisClient.Cmd("INCR", key).Int64()
+	if err == nil && ex.MaxScans != 0 && n > ex.MaxScans {
+		redisClient.Cmd("DECR", key) // scans after the limit are not counted
+		redirectCount.WithLabelValues("expired").Inc()
+		ServeExpired(www, req)
+		return
+	}
+	if variant != "" {
+		redisClient.Cmd("INCR", fmt.Sprintf("qr-count:%s:%s", id, variant))
+		SetVariantCookie(www, id, variant)
+	}
+	HookScan(id)
+	redirectCount.WithLabelValues("hit").Inc()
 
-	// fmt.Printf("AT: %s\n", godebug.LF())
-	h := www.Header()
-	h.Set("Location", HexEscapeNonASCII(to))
-	www.WriteHeader(303)
+	if page { // our own landing page, no need to redirect
+		ServePage(www, req, id)
+		return
+	}
 
-	fmt.Fprintf(www, `<center><a href="%s">Redirect To: %s</a></center>\n`, to, to)
+	// fmt.Printf("AT: %s\n", godebug.LF())
+	SendRedirect(www, req, id, to, GetRedirectMode(id))
 }
 
 // Returns a status on valid/invalid tokens - used for testing.
@@ -320,12 +583,78 @@ func respHandlerLookup(www http.ResponseWriter, req *http.Request) {
 		return
 	}
 
+	now := timeNow()
+	to, _ = SelectTarget(id, to, req, now)
+	quarantined := IsQuarantined(id, to)
+	to = AddQueryParams(to, id, GetUTM(id), nil)
 	to = strings.Replace(to, "/./", "/", -1)
-	uri := fmt.Sprintf("http://%s/%s/%s.png", gCfg.HostPort, gCfg.QRUri, id)
-	uri = strings.Replace(uri, "/./", "/", -1)
+	uri := ImageURL(id)
+
+	ex := GetExpire(id)
+	count, _ := redisClient.Cmd("GET", fmt.Sprintf("qr-count:%s", id)).Int64()
 
 	www.Header().Set("Content-Type", "application/json; charset=utf-8")
-	fmt.Fprintf(www, `{"status":"success", "url":%q, "qr":%q}`+"\n", to, uri)
+	fmt.Fprintf(www, `{"status":"success", "url":%q, "qr":%q, "qr_encoded":%q, "expires":%d, "max_scans":%d, "expired":%v, "mode":%q, "quarantined":%v}`+"\n",
+		to, uri, QRContent(id), ex.Expires, ex.MaxScans, ex.Expired(now, count), GetRedirectMode(id), quarantined)
+}
+
+// QRListItem is one QR in the /api/list-qr response.
+type QRListItem struct {
+	ID       string `json:"id"`
+	URL      string `json:"url"`
+	Count    int64  `json:"count"`
+	Expires  int64  `json:"expires,omitempty"`
+	MaxScans int64  `json:"max_scans,omitempty"`
+	Expired  bool   `json:"expired"`
+}
+
+/*
+/api/list-qr?offset=N&limit=M - lists QRs, the numbered ones newest first and then the slugs from
+qr-slug-ids in order.
+*/
+func respHandlerListQR(www http.ResponseWriter, req *http.Request) {
+	if !CheckAuth(www, req) {
+		return
+	}
+
+	offset, _ := strconv.Atoi(GetParam(www, req, "offset", "0"))
+	limit, _ := strconv.Atoi(GetParam(www, req, "limit", "100"))
+	if offset < 0 {
+		offset = 0
+	}
+	if limit <= 0 || limit > 1000 {
+		limit = 100
+	}
+
+	last, err := redisClient.Cmd("GET", "qr-id:").Int()
+	if err != nil {
+		AnError(www, req, 500, "Config Error 21")
+		return
+	}
+
+	slugs, _ := redisClient.Cmd("SMEMBERS", "qr-slug-ids").List()
+	sort.Strings(slugs)
+
+	now := timeNow()
+	list := make([]QRListItem, 0, limit)
+	// IDs start at 10001, see CheckSetup, the offset counts through them and then the slugs.  Deleted IDs are skipped.
+	nNum := last - 10000
+	for pos := offset; pos < nNum+len(slugs) && len(list) < limit; pos++ {
+		sid := strconv.Itoa(last - pos)
+		if pos >= nNum {
+			sid = slugs[pos-nNum]
+		}
+		to, err := redisClient.Cmd("GET", fmt.Sprintf("qrr:%s", sid)).Str()
+		if err != nil {
+			continue
+		}
+		count, _ := redisClient.Cmd("GET", fmt.Sprintf("qr-count:%s", sid)).Int64()
+		ex := GetExpire(sid)
+		list = append(list, QRListItem{ID: sid, URL: to, Count: count, Expires: ex.Expires, MaxScans: ex.MaxScans, Expired: ex.Expired(now, count)})
+	}
+
+	www.Header().Set("Content-Type", "application/json; charset=utf-8")
+	fmt.Fprintf(www, `{"status":"success","list":%s}`+"\n", SVar(list))
 }
 
 func main() {
@@ -335,6 +664,11 @@ func main() {
 	// ------------------------------------------------------------------------------
 	flag.Parse()
 
+	if *optVersion {
+		fmt.Printf("qr-svr %s (%s)\n", Version, Commit)
+		os.Exit(0)
+	}
+
 	fns := flag.Args()
 	if len(fns) != 0 {
 		fmt.Fprintf(os.Stderr, "Error: extra argument supplied\n")
@@ -359,12 +693,31 @@ func main() {
 		fmt.Fprintf(os.Stderr, "Unable to read configuration: %s error %s\n", sCfg, err)
 		os.Exit(1)
 	}
+	if err = CheckBaseURLs(); err != nil {
+		fmt.Fprintf(os.Stderr, "Invalid configuration: %s\n", err)
+		os.Exit(1)
+	}
+	level, err := ParseLevel(gCfg.LogLevel)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Invalid configuration: %s\n", err)
+		os.Exit(1)
+	}
+	logger.SetLevel(level)
+	logger.SetDebugFlags(splitList(gCfg.LogDebug))
+
+	if *optRefreshThreats { // Run from cron to keep the threat list up to date.
+		if err := RefreshThreatList(); err != nil {
+			fmt.Fprintf(os.Stderr, "Error: unable to refresh threat list: %s\n", err)
+			os.Exit(1)
+		}
+		os.Exit(0)
+	}
 
 	// ------------------------------------------------------------------------------
 	// Connect to Redis
 	// ------------------------------------------------------------------------------
 	var ok bool
-	redisClient, ok = RedisClient(dbFlag, &gCfg)
+	redisClient, ok = RedisClient(&gCfg)
 	if !ok {
 		fmt.Fprintf(os.Stderr, "Unable to connect to Redis\n")
 		os.Exit(1)
@@ -374,6 +727,10 @@ func main() {
 	// Setup
 	// ------------------------------------------------------------------------------
 	CheckSetup() // Check that Redis is setup - if not - then create keys.
+	if err = LoadDomains(); err != nil {
+		fmt.Fprintf(os.Stderr, "Unable to load domains: %s\n", err)
+		os.Exit(1)
+	}
 
 	if *optCreateUser != "" { // See if we are running at the command line to create a user.
 		if *optPassword == "" {
@@ -401,33 +758,132 @@ func main() {
 	if !Exists(gCfg.QRDir) {
 		os.MkdirAll(gCfg.QRDir, 0755)
 	}
-	if !Exists(filepath.Dir(gCfg.LogFile)) {
-		os.MkdirAll(filepath.Dir(gCfg.LogFile), 0755)
-	}
-	logFile, err = Fopen(gCfg.LogFile, "a")
+	rw, err := NewRotateWriter(gCfg.LogFile, int64(gCfg.LogMaxSize)<<20, time.Duration(gCfg.LogRotate)*time.Hour, gCfg.LogKeep)
 	if err != nil {
 		fmt.Fprintf(os.Stderr, "Unable to open log file >%s< error:%s\n", gCfg.LogFile, err)
 		os.Exit(1)
 	}
+	logger.SetOutput(rw)
+
+	if *optBulk != "" { // Bulk creation from the command line.
+		if err := BulkCLI(*optBulk, *optBulkOut, *optBulkUser); err != nil {
+			fmt.Fprintf(os.Stderr, "Error: %s\n", err)
+			os.Exit(1)
+		}
+		os.Exit(0)
+	}
+
+	if *optRerender || *optRerenderResume != "" { // Re-render the images from the command line.
+		if err := RerenderCLI(*optDryRun, *optRerenderResume); err != nil {
+			fmt.Fprintf(os.Stderr, "Error: %s\n", err)
+			os.Exit(1)
+		}
+		os.Exit(0)
+	}
 
 	// ------------------------------------------------------------------------------
 	// URI Paths - Mux
 	// ------------------------------------------------------------------------------
 	http.HandleFunc("/api/status", respHandlerStatus)
+	http.HandleFunc("/healthz", respHandlerHealthz)
+	http.HandleFunc("/readyz", respHandlerReadyz)
 	http.HandleFunc("/api/count", respHandlerCount)
 	http.HandleFunc("/api/upd-qr", respHandlerUpdQR)
 	http.HandleFunc("/api/get-qr", respHandlerGenQR)
 	http.HandleFunc("/api/gen-qr", respHandlerGenQR)
 	http.HandleFunc("/api/get-auth", respHandlerGetAuth)
 	http.HandleFunc("/api/lookup", respHandlerLookup)
+	http.HandleFunc("/api/list-qr", respHandlerListQR)
 	http.HandleFunc("/api/auth-token-valid", respHandlerAuthTokenValid)
+	http.HandleFunc("/api/set-alert", respHandlerSetAlert)
+	http.HandleFunc("/api/get-alert", respHandlerGetAlert)
+	http.HandleFunc("/api/alert-log", respHandlerAlertLog)
+	http.HandleFunc("/api/qr-history", respHandlerHistory)
+	http.HandleFunc("/api/rollback-qr", respHandlerRollback)
+	http.HandleFunc("/api/set-schedule", respHandlerSetSchedule)
+	http.HandleFunc("/api/get-schedule", respHandlerGetSchedule)
+	http.HandleFunc("/api/set-route", respHandlerSetRoute)
+	http.HandleFunc("/api/get-route", respHandlerGetRoute)
+	http.HandleFunc("/api/route-test", respHandlerRouteTest)
+	http.HandleFunc("/api/quarantine-list", respHandlerQuarantineList)
+	http.HandleFunc("/api/quarantine-release", respHandlerQuarantineRelease)
+	http.HandleFunc("/api/gen-payload", respHandlerGenPayload)
+	http.HandleFunc("/api/set-payload", respHandlerSetPayload)
+	http.HandleFunc("/api/get-payload", respHandlerGetPayload)
+	http.HandleFunc("/api/gen-page", respHandlerGenPage)
+	http.HandleFunc("/api/set-page", respHandlerSetPage)
+	http.HandleFunc("/api/get-page", respHandlerGetPage)
+	http.HandleFunc("/api/static-qr", respHandlerStaticQR)
+	http.HandleFunc("/api/bulk-qr", respHandlerBulkQR)
+	http.HandleFunc("/api/bulk-status", respHandlerBulkStatus)
+	http.HandleFunc("/api/bulk-zip", respHandlerBulkZip)
+	http.HandleFunc("/api/label-pdf", respHandlerLabelPDF)
+	http.HandleFunc("/api/export", respHandlerExport)
+	http.HandleFunc("/api/rerender", respHandlerRerender)
+	http.HandleFunc("/api/add-domain", respHandlerAddDomain)
+	http.HandleFunc("/api/del-domain", respHandlerDelDomain)
+	http.HandleFunc("/api/list-domain", respHandlerListDomain)
+	http.HandleFunc("/api/set-team", respHandlerSetTeam)
+	http.HandleFunc("/api/list-team", respHandlerListTeam)
+	http.HandleFunc("/api/set-log", respHandlerSetLog)
+	http.HandleFunc("/api/job-status", respHandlerJobStatus)
+	http.HandleFunc("/api/job-list", respHandlerJobList)
+	http.HandleFunc("/api/job-cancel", respHandlerJobCancel)
+	http.HandleFunc("/api/job-result", respHandlerJobResult)
+	http.HandleFunc("/api/convert", respHandlerConvert)
+	http.HandleFunc("/api/set-utm", respHandlerSetUTM)
+	http.HandleFunc("/api/get-utm", respHandlerGetUTM)
+	http.HandleFunc("/api/add-hook", respHandlerAddHook)
+	http.HandleFunc("/api/list-hook", respHandlerListHook)
+	http.HandleFunc("/api/del-hook", respHandlerDelHook)
+	http.HandleFunc("/api/failed-hook", respHandlerFailedHook)
+	http.HandleFunc("/api/replay-hook", respHandlerReplayHook)
 	http.HandleFunc("/Q/", respHandlerRedirect)
+	http.HandleFunc("/P/", respHandlerPayloadFile)
+	http.HandleFunc("/L/", respHandlerPage)
 	http.Handle("/", http.FileServer(http.Dir(gCfg.Dir)))
 
+	// ------------------------------------------------------------------------------
+	// Background Workers
+	// ------------------------------------------------------------------------------
+	if gCfg.AlertInterval > 0 {
+		Background(func() { AlertEvaluator(time.Duration(gCfg.AlertInterval) * time.Second) })
+	}
+	Background(HookWorker)
+	JobWorker(gCfg.JobWorkers)
+	Background(DomainWatcher)
+
 	// ------------------------------------------------------------------------------
 	// Run Server
 	// ------------------------------------------------------------------------------
-	log.Fatal(http.ListenAndServe(gCfg.HostPort, nil))
+	var extra []*http.Server
+	if gCfg.MetricsAddr != "" {
+		mm := http.NewServeMux()
+		mm.HandleFunc("/metrics", respHandlerMetrics)
+		extra = append(extra, NewServer(gCfg.MetricsAddr, mm))
+	} else {
+		http.HandleFunc("/metrics", respHandlerMetrics)
+	}
+	srv := NewServer(gCfg.HostPort, LogRequests(InstrumentMux(http.DefaultServeMux)))
+	if gCfg.TLSCert != "" {
+		cl, err := NewCertLoader(gCfg.TLSCert, gCfg.TLSKey)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "%s\n", err)
+			os.Exit(1)
+		}
+		go cl.Watch(time.Duration(gCfg.TLSReload) * time.Second)
+		srv.Handler = HSTS(gCfg.HSTSMaxAge, gCfg.HSTSSubDomains, srv.Handler)
+		srv.TLSConfig = TLSConfig(cl)
+		if gCfg.RedirectHTTP != "" {
+			extra = append(extra, NewServer(gCfg.RedirectHTTP, RedirectHTTPS(gCfg.HostPort)))
+		}
+	}
+	err = Serve(srv, extra...)
+	Cleanup()
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error: %s\n", err)
+		os.Exit(1)
+	}
 }
 
 /* vim: set noai ts=4 sw=4: */
@@ -0,0 +1,85 @@
+package main
+
+// MIT Licensed - see LICENSE
+
+import (
+	"bytes"
+	"strings"
+
+	"github.com/yuin/goldmark"
+	"github.com/yuin/goldmark/ast"
+	"github.com/yuin/goldmark/parser"
+	"github.com/yuin/goldmark/text"
+	"github.com/yuin/goldmark/util"
+)
+
+// Landing page markdown is CommonMark, rendered by goldmark.  Raw HTML is left out of the output and only
+// http, https, mailto, tel and relative links are kept (images only http and https), the link text is
+// kept without the link otherwise, so the output is safe to put in a page.
+
+var mdRenderer = goldmark.New(goldmark.WithParserOptions(parser.WithASTTransformers(util.Prioritized(linkFilter{}, 100))))
+
+// RenderMarkdown converts the markdown of a landing page to HTML.
+func RenderMarkdown(src string) string {
+	var buf bytes.Buffer
+	if err := mdRenderer.Convert([]byte(src), &buf); err != nil {
+		return ""
+	}
+	return buf.String()
+}
+
+// allowedLink is true if u is relative or has one of the schemes.
+func allowedLink(u string, schemes ...string) bool {
+	lower := strings.ToLower(strings.TrimSpace(u))
+	i := strings.IndexAny(lower, ":/?#")
+	if i < 0 || lower[i] != ':' {
+		return true
+	}
+	for _, s := range schemes {
+		if lower[:i] == s {
+			return true
+		}
+	}
+	return false
+}
+
+// linkFilter replaces links and images that are not allowed by their text.
+type linkFilter struct{}
+
+func (linkFilter) Transform(doc *ast.Document, reader text.Reader, pc parser.Context) {
+	source := reader.Source()
+	var drop []ast.Node
+	ast.Walk(doc, func(n ast.Node, entering bool) (ast.WalkStatus, error) {
+		if !entering {
+			return ast.WalkContinue, nil
+		}
+		switch x := n.(type) {
+		case *ast.Link:
+			if !allowedLink(string(x.Destination), "http", "https", "mailto", "tel") {
+				drop = append(drop, n)
+			}
+		case *ast.Image:
+			if !allowedLink(string(x.Destination), "http", "https") {
+				drop = append(drop, n)
+			}
+		case *ast.AutoLink:
+			if x.AutoLinkType == ast.AutoLinkURL && !allowedLink(string(x.URL(source)), "http", "https") {
+				drop = append(drop, n)
+			}
+		}
+		return ast.WalkContinue, nil
+	})
+	for _, n := range drop {
+		parent := n.Parent()
+		if a, ok := n.(*ast.AutoLink); ok {
+			parent.ReplaceChild(parent, n, ast.NewString(a.Label(source)))
+			continue
+		}
+		for c := n.FirstChild(); c != nil; c = n.FirstChild() {
+			parent.InsertBefore(parent, n, c)
+		}
+		parent.RemoveChild(parent, n)
+	}
+}
+
+/* vim: set noai ts=4 sw=4: */
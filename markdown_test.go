@@ -0,0 +1,39 @@
+package main
+
+// MIT Licensed - see LICENSE
+
+import (
+	"testing"
+)
+
+func TestRenderMarkdown(t *testing.T) {
+	tests := []struct {
+		src      string
+		expected string
+	}{
+		{"# Menu", "<h1>Menu</h1>\n"},
+		{"Hello *there* and **you**", "<p>Hello <em>there</em> and <strong>you</strong></p>\n"},
+		{"snake_case_name", "<p>snake_case_name</p>\n"},
+		{"[Site](https://example.com/a?b=1&c=2)", `<p><a href="https://example.com/a?b=1&amp;c=2">Site</a></p>` + "\n"},
+		{"[bad](javascript:alert(1))", "<p>bad</p>\n"},
+		{"[bad](JavaScript:alert(1))", "<p>bad</p>\n"},
+		{"[*bad*](vbscript:x) ok", "<p><em>bad</em> ok</p>\n"},
+		{"![logo](https://example.com/l.png)", `<p><img src="https://example.com/l.png" alt="logo"></p>` + "\n"},
+		{"![x](data:text/html,hi)", "<p>x</p>\n"},
+		{"<script>alert(1)</script>", "<!-- raw HTML omitted -->\n"},
+		{"a <b onclick=x>b</b>", "<p>a <!-- raw HTML omitted -->b<!-- raw HTML omitted --></p>\n"},
+		{"<https://example.com>", `<p><a href="https://example.com">https://example.com</a></p>` + "\n"},
+		{"<javascript:alert(1)>", "<p>javascript:alert(1)</p>\n"},
+		{"- Eggs\n- Ham\n\nDone", "<ul>\n<li>Eggs</li>\n<li>Ham</li>\n</ul>\n<p>Done</p>\n"},
+		{"[Call](tel:+15551234)", `<p><a href="tel:+15551234">Call</a></p>` + "\n"},
+	}
+
+	for ii, test := range tests {
+		got := RenderMarkdown(test.src)
+		if got != test.expected {
+			t.Errorf("Test %d, expected %q got %q\n", ii, test.expected, got)
+		}
+	}
+}
+
+/* vim: set noai ts=4 sw=4: */
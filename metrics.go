@@ -0,0 +1,121 @@
+package main
+
+// MIT Licensed - see LICENSE
+
+import (
+	"crypto/subtle"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+// Metrics.
+//
+// /metrics is served by the Prometheus client library, in the text format unless the scraper asks for
+// another.  It is served on metrics_addr if that is set, otherwise on the main listener, and if
+// metrics_token is set it needs an "Authorization: Bearer {token}" header.
+// Handlers are labeled by the pattern they were registered with, never by the path, so the number of
+// series stays small.
+
+var (
+	httpBuckets  = []float64{.005, .01, .025, .05, .1, .25, .5, 1, 2.5, 5, 10}
+	redisBuckets = []float64{.0001, .00025, .0005, .001, .0025, .005, .01, .025, .05, .1, .5}
+	renderBucket = []float64{.001, .0025, .005, .01, .025, .05, .1, .25, .5, 1}
+
+	httpRequests = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "qr_http_requests_total", Help: "HTTP requests by handler and status code."}, []string{"handler", "code"})
+	httpDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Name: "qr_http_request_duration_seconds", Help: "Time to serve HTTP requests by handler.", Buckets: httpBuckets}, []string{"handler"})
+	redirectCount = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "qr_redirects_total", Help: "Scans by outcome: hit, miss, expired, quarantined or unknown_host."}, []string{"outcome"})
+	createdCount = prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "qr_created_total", Help: "QR codes created."})
+	authFailures = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "qr_auth_failures_total", Help: "Requests refused for a missing or invalid login."}, []string{"reason"})
+	redisDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Name: "qr_redis_command_duration_seconds", Help: "Time of Redis commands by command.", Buckets: redisBuckets}, []string{"command"})
+	redisErrors = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "qr_redis_errors_total", Help: "Redis commands that failed by command."}, []string{"command"})
+	renderDuration = prometheus.NewHistogram(prometheus.HistogramOpts{
+		Name: "qr_render_duration_seconds", Help: "Time to render a QR code image.", Buckets: renderBucket})
+)
+
+// metricsRegistry has our metrics and the Go runtime and process ones.  It is not the default registry
+// so nothing a library registers there ends up on /metrics.
+var metricsRegistry = prometheus.NewRegistry()
+
+var metricsHandler = promhttp.HandlerFor(metricsRegistry, promhttp.HandlerOpts{})
+
+func init() {
+	metricsRegistry.MustRegister(httpRequests, httpDuration, redirectCount, createdCount, authFailures,
+		redisDuration, redisErrors, renderDuration,
+		prometheus.NewGoCollector(), prometheus.NewProcessCollector(prometheus.ProcessCollectorOpts{}))
+}
+
+// statusRecorder keeps the status code and size of a response.
+type statusRecorder struct {
+	http.ResponseWriter
+	status int
+	size   int64
+}
+
+func (rec *statusRecorder) WriteHeader(code int) {
+	if rec.status == 0 {
+		rec.status = code
+	}
+	rec.ResponseWriter.WriteHeader(code)
+}
+
+func (rec *statusRecorder) Write(b []byte) (int, error) {
+	if rec.status == 0 {
+		rec.status = http.StatusOK
+	}
+	n, err := rec.ResponseWriter.Write(b)
+	rec.size += int64(n)
+	return n, err
+}
+
+// Status is the code sent, 200 if the handler did not write anything.
+func (rec *statusRecorder) Status() int {
+	if rec.status == 0 {
+		return http.StatusOK
+	}
+	return rec.status
+}
+
+// InstrumentMux counts and times the requests served by mux, by the pattern of the handler.
+func InstrumentMux(mux *http.ServeMux) http.Handler {
+	return http.HandlerFunc(func(www http.ResponseWriter, req *http.Request) {
+		_, pattern := mux.Handler(req)
+		if pattern == "" {
+			pattern = "none"
+		}
+		rec := &statusRecorder{ResponseWriter: www}
+		start := time.Now()
+		mux.ServeHTTP(rec, req)
+		httpDuration.WithLabelValues(pattern).Observe(time.Since(start).Seconds())
+		httpRequests.WithLabelValues(pattern, strconv.Itoa(rec.Status())).Inc()
+	})
+}
+
+/*
+/metrics - Prometheus metrics.  Needs "Authorization: Bearer {metrics_token}" if metrics_token is set.
+*/
+func respHandlerMetrics(www http.ResponseWriter, req *http.Request) {
+	if gCfg.MetricsToken != "" {
+		got := strings.TrimPrefix(req.Header.Get("Authorization"), "Bearer ")
+		if subtle.ConstantTimeCompare([]byte(got), []byte(gCfg.MetricsToken)) != 1 {
+			authFailures.WithLabelValues("metrics_token").Inc()
+			AnError(www, req, 401, "Login required")
+			return
+		}
+	}
+
+	metricsHandler.ServeHTTP(www, req)
+}
+
+/* vim: set noai ts=4 sw=4: */
@@ -0,0 +1,120 @@
+package main
+
+// MIT Licensed - see LICENSE
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	dto "github.com/prometheus/client_model/go"
+	"github.com/prometheus/common/expfmt"
+)
+
+func TestMetricsExposition(t *testing.T) {
+	redirectCount.WithLabelValues("hit").Inc()
+	authFailures.WithLabelValues(`q"\` + "\n").Inc()
+	renderDuration.Observe(.05)
+
+	rec := httptest.NewRecorder()
+	respHandlerMetrics(rec, httptest.NewRequest("GET", "/metrics", nil))
+	var parser expfmt.TextParser
+	families, err := parser.TextToMetricFamilies(rec.Body)
+	if err != nil {
+		t.Fatalf("Unable to parse /metrics: %s\n", err)
+	}
+
+	tests := []struct {
+		name string
+		typ  dto.MetricType
+	}{
+		{"qr_http_requests_total", dto.MetricType_COUNTER},
+		{"qr_redirects_total", dto.MetricType_COUNTER},
+		{"qr_created_total", dto.MetricType_COUNTER},
+		{"qr_auth_failures_total", dto.MetricType_COUNTER},
+		{"qr_render_duration_seconds", dto.MetricType_HISTOGRAM},
+		{"go_goroutines", dto.MetricType_GAUGE},
+	}
+	for ii, test := range tests {
+		mf, ok := families[test.name]
+		if !ok {
+			if test.name != "qr_http_requests_total" { // no requests have been counted in this test
+				t.Errorf("Test %d, missing %s\n", ii, test.name)
+			}
+			continue
+		}
+		if mf.GetType() != test.typ {
+			t.Errorf("Test %d, expected %s to be %s got %s\n", ii, test.name, test.typ, mf.GetType())
+		}
+	}
+	if mf := families["qr_auth_failures_total"]; mf != nil {
+		found := false
+		for _, m := range mf.GetMetric() {
+			for _, lp := range m.GetLabel() {
+				found = found || (lp.GetName() == "reason" && lp.GetValue() == `q"\`+"\n")
+			}
+		}
+		if !found {
+			t.Errorf("Expected the escaped reason label to come back the same\n")
+		}
+	}
+}
+
+func TestInstrumentMux(t *testing.T) {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/api/thing", func(www http.ResponseWriter, req *http.Request) {
+		AnError(www, req, 406, "Missing Parameter")
+	})
+	h := InstrumentMux(mux)
+
+	tests := []struct {
+		path    string
+		handler string
+		code    string
+	}{
+		{path: "/api/thing?id=1", handler: "/api/thing", code: "406"},
+		{path: "/api/thing/other", handler: "none", code: "404"},
+	}
+	for ii, test := range tests {
+		c := httpRequests.WithLabelValues(test.handler, test.code)
+		before := testutil.ToFloat64(c)
+		h.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", test.path, nil))
+		if got := testutil.ToFloat64(c); got != before+1 {
+			t.Errorf("Test %d, expected count for %s %s to go from %v to %v, got %v\n", ii, test.handler, test.code, before, before+1, got)
+		}
+	}
+}
+
+func TestMetricsToken(t *testing.T) {
+	defer func(s string) { gCfg.MetricsToken = s }(gCfg.MetricsToken)
+
+	tests := []struct {
+		token string
+		auth  string
+		code  int
+	}{
+		{token: "", auth: "", code: 200},
+		{token: "sekrit", auth: "", code: 401},
+		{token: "sekrit", auth: "Bearer wrong", code: 401},
+		{token: "sekrit", auth: "Bearer sekrit", code: 200},
+	}
+	for ii, test := range tests {
+		gCfg.MetricsToken = test.token
+		req := httptest.NewRequest("GET", "/metrics", nil)
+		if test.auth != "" {
+			req.Header.Set("Authorization", test.auth)
+		}
+		rec := httptest.NewRecorder()
+		respHandlerMetrics(rec, req)
+		if rec.Code != test.code {
+			t.Errorf("Test %d, expected %d, got %d\n", ii, test.code, rec.Code)
+		}
+		if rec.Code == 200 && !strings.Contains(rec.Body.String(), "# TYPE qr_created_total counter") {
+			t.Errorf("Test %d, missing qr_created_total in\n%s\n", ii, rec.Body.String())
+		}
+	}
+}
+
+/* vim: set noai ts=4 sw=4: */
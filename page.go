@@ -0,0 +1,427 @@
+package main
+
+// MIT Licensed - see LICENSE
+
+import (
+	"fmt"
+	"html/template"
+	"io"
+	"mime"
+	"mime/multipart"
+	"net/http"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/pschlump/json"
+)
+
+// PageType is a landing page hosted by us, kept in qr-page:{id}.  A page has a title and any of: markdown
+// content, a list of links and one file.  The file is saved as gCfg.PageDir/{id}.  The QR points at
+// /L/{id}; a scan of /Q/{id} that goes there is counted and the page is served without a redirect.
+type PageType struct {
+	Title    string     `json:"title"`
+	Markdown string     `json:"markdown,omitempty"`
+	Links    []PageLink `json:"links,omitempty"`
+	File     *PageFile  `json:"file,omitempty"`
+	Updated  int64      `json:"updated"`
+}
+
+// PageLink is one entry in the link list of a page.
+type PageLink struct {
+	Title string `json:"title"`
+	URL   string `json:"url"`
+}
+
+// PageFile is the file attached to a page.
+type PageFile struct {
+	Name        string `json:"name"`
+	ContentType string `json:"content_type"`
+	Size        int64  `json:"size"`
+}
+
+// PageData is passed to the page template.
+type PageData struct {
+	ID      string
+	Title   string
+	Body    template.HTML
+	Links   []PageLink
+	File    *PageFile
+	FileURL string
+}
+
+// dfltPage is used if the template in gCfg.Dir can not be read.
+const dfltPage = `<!DOCTYPE html>
+<html lang="en">
+<head>
+<meta charset="utf-8">
+<meta name="viewport" content="width=device-width, initial-scale=1">
+<link rel="stylesheet" href="/css/markdown.css">
+<title>{{.Title}}</title>
+</head>
+<body>
+<div class="markdown-body">
+<h1>{{.Title}}</h1>
+{{.Body}}
+{{if .Links}}<ul>{{range .Links}}<li><a href="{{.URL}}">{{.Title}}</a></li>{{end}}</ul>{{end}}
+{{if .File}}<p><a href="{{.FileURL}}">{{.File.Name}}</a></p>{{end}}
+</div>
+</body>
+</html>
+`
+
+// PageURL is the address of the landing page for id.
+func PageURL(id string) string {
+	return BaseURL() + "/L/" + id
+}
+
+// GetPage returns the landing page for id.
+func GetPage(id string) (pg *PageType, err error) {
+	s, err := redisClient.Cmd("GET", fmt.Sprintf("qr-page:%s", id)).Str()
+	if err != nil {
+		return nil, err
+	}
+	pg = &PageType{}
+	err = json.Unmarshal([]byte(s), pg)
+	return
+}
+
+// SavePage stores the page for id and points the QR at it.
+func SavePage(id string, pg *PageType, user string) error {
+	pg.Updated = time.Now().Unix()
+	if err := redisClient.Cmd("SET", fmt.Sprintf("qr-page:%s", id), SVar(pg)).Err; err != nil {
+		return err
+	}
+	if cur, _ := redisClient.Cmd("GET", fmt.Sprintf("qrr:%s", id)).Str(); !IsOwnURL(cur, "/L/"+id) {
+		if _, err := SetTargetURL(id, PageURL(id), user, 0); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// DelPage removes the page for id and its file.
+func DelPage(id string) {
+	redisClient.Cmd("DEL", fmt.Sprintf("qr-page:%s", id))
+	os.Remove(filepath.Join(gCfg.PageDir, id))
+}
+
+// ParsePageParams fills in pg from the request.  title, markdown and links replace what is in pg when
+// they are sent.
+func ParsePageParams(www http.ResponseWriter, req *http.Request, pg *PageType, vv *Validator) error {
+	if title := GetParam(www, req, "title", ""); title != "" {
+		pg.Title = title
+	}
+	if md, ok := getParamSet(www, req, "markdown"); ok {
+		pg.Markdown = md
+	}
+	if sLinks, ok := getParamSet(www, req, "links"); ok {
+		pg.Links = nil
+		if sLinks != "" {
+			if err := json.Unmarshal([]byte(sLinks), &pg.Links); err != nil {
+				return fmt.Errorf("Invalid links: %s", err)
+			}
+		}
+	}
+	for ii := range pg.Links {
+		if pg.Links[ii].Title == "" {
+			pg.Links[ii].Title = pg.Links[ii].URL
+		}
+		vv.URL(fmt.Sprintf("links[%d].url", ii), &pg.Links[ii].URL)
+	}
+	if pg.Title == "" {
+		vv.Add("title", "missing_title", "", "Title is required")
+	}
+	if fh := pageUpload(req); fh != nil && gCfg.PageMaxFile > 0 && fh.Size > int64(gCfg.PageMaxFile) {
+		vv.Add("file", "too_large", fh.Filename, fmt.Sprintf("File is larger than %d bytes", gCfg.PageMaxFile))
+	}
+	return nil
+}
+
+// uploadOverhead is the room left for the other form fields and the multipart headers in a request with an upload.
+const uploadOverhead = 1 << 20
+
+// LimitUpload caps the body of a request that can carry an upload at gCfg.PageMaxFile plus uploadOverhead,
+// so that a large upload is cut off as it is read and not spooled to disk first, and parses the form.  It
+// sends a 413 and returns false if the body is too large.
+func LimitUpload(www http.ResponseWriter, req *http.Request) bool {
+	if gCfg.PageMaxFile > 0 {
+		req.Body = http.MaxBytesReader(www, req.Body, int64(gCfg.PageMaxFile)+uploadOverhead)
+	}
+	if req.Method != "POST" && req.Method != "PUT" {
+		return true
+	}
+	var err error
+	if strings.HasPrefix(req.Header.Get("Content-Type"), "multipart/form-data") {
+		err = req.ParseMultipartForm(32 << 20)
+	} else {
+		err = req.ParseForm()
+	}
+	if err != nil && strings.Contains(err.Error(), "request body too large") {
+		AnError(www, req, 413, fmt.Sprintf("Request is larger than %d bytes", int64(gCfg.PageMaxFile)+uploadOverhead))
+		return false
+	}
+	return true
+}
+
+func pageUpload(req *http.Request) *multipart.FileHeader {
+	if req.MultipartForm == nil {
+		req.ParseMultipartForm(32 << 20)
+	}
+	if req.MultipartForm == nil || len(req.MultipartForm.File["file"]) == 0 {
+		return nil
+	}
+	return req.MultipartForm.File["file"][0]
+}
+
+// SavePageFile saves the upload, "file", as gCfg.PageDir/{id} and attaches it to pg.  remove_file=true
+// removes the file that is there.
+func SavePageFile(www http.ResponseWriter, req *http.Request, id string, pg *PageType) error {
+	if GetParam(www, req, "remove_file", "") == "true" {
+		os.Remove(filepath.Join(gCfg.PageDir, id))
+		pg.File = nil
+	}
+	fh := pageUpload(req)
+	if fh == nil {
+		return nil
+	}
+	src, err := fh.Open()
+	if err != nil {
+		return err
+	}
+	defer src.Close()
+
+	if !Exists(gCfg.PageDir) {
+		os.MkdirAll(gCfg.PageDir, 0755)
+	}
+	dst, err := Fopen(filepath.Join(gCfg.PageDir, id), "w")
+	if err != nil {
+		return err
+	}
+	defer dst.Close()
+	n, err := io.Copy(dst, src)
+	if err != nil {
+		return err
+	}
+
+	name := strings.Map(func(r rune) rune {
+		if r < ' ' || r == '"' || r == '\\' || r == '/' {
+			return '_'
+		}
+		return r
+	}, path.Base(strings.Replace(fh.Filename, "\\", "/", -1)))
+	ct := fh.Header.Get("Content-Type")
+	if ct == "" || ct == "application/octet-stream" {
+		if ct = mime.TypeByExtension(filepath.Ext(name)); ct == "" {
+			ct = "application/octet-stream"
+		}
+	}
+	pg.File = &PageFile{Name: name, ContentType: ct, Size: n}
+	return nil
+}
+
+// inlineFileTypes are the attached file types shown in the browser.  Any other file is sent as a download
+// of application/octet-stream, so an HTML or SVG upload can not run script on this origin.
+var inlineFileTypes = map[string]bool{
+	"application/pdf": true,
+	"image/png":       true,
+	"image/jpeg":      true,
+}
+
+// fileDisposition returns the Content-Type and Content-Disposition to serve an attached file with.
+func fileDisposition(ct, name string) (string, string) {
+	mt, _, err := mime.ParseMediaType(ct)
+	if err != nil || !inlineFileTypes[mt] {
+		return "application/octet-stream", mime.FormatMediaType("attachment", map[string]string{"filename": name})
+	}
+	return mt, mime.FormatMediaType("inline", map[string]string{"filename": name})
+}
+
+// getParamSet is GetParam for a parameter that may be set to "", ok is true if it was sent at all.
+func getParamSet(www http.ResponseWriter, req *http.Request, name string) (string, bool) {
+	if v := GetParam(www, req, name, ""); v != "" {
+		return v, true
+	}
+	req.ParseForm()
+	_, ok := req.Form[name]
+	return "", ok
+}
+
+// ServePage renders the landing page for id from gCfg.PageTemplate in gCfg.Dir.
+func ServePage(www http.ResponseWriter, req *http.Request, id string) {
+	pg, err := GetPage(id)
+	if err != nil {
+		AnError(www, req, 404, "Not Found")
+		return
+	}
+
+	data := PageData{
+		ID:    id,
+		Title: pg.Title,
+		Body:  template.HTML(RenderMarkdown(pg.Markdown)),
+		Links: pg.Links,
+		File:  pg.File,
+	}
+	if pg.File != nil {
+		data.FileURL = fmt.Sprintf("/L/%s/file", id)
+	}
+
+	t, err := template.ParseFiles(filepath.Join(gCfg.Dir, gCfg.PageTemplate))
+	if err != nil {
+		LogReq(req, LevelError, "unable to read page template", "file", gCfg.PageTemplate, "error", err)
+		t = template.Must(template.New("page").Parse(dfltPage))
+	}
+
+	www.Header().Set("Content-Type", "text/html; charset=utf-8")
+	www.Header().Set("Cache-Control", "no-cache")
+	if err := t.Execute(www, data); err != nil {
+		LogReq(req, LevelError, "page template failed", "file", gCfg.PageTemplate, "error", err)
+	}
+}
+
+/*
+/L/{ID} - the landing page, /L/{ID}/file - its attached file.  Only PDF, PNG and JPEG files are shown
+inline, others are downloads.  A visit here directly is not counted as a scan; scans come in through /Q/{ID}.
+*/
+func respHandlerPage(www http.ResponseWriter, req *http.Request) {
+	p := strings.TrimPrefix(req.URL.Path, "/L/")
+	if !strings.HasSuffix(p, "/file") {
+		ServePage(www, req, p)
+		return
+	}
+
+	id := strings.TrimSuffix(p, "/file")
+	pg, err := GetPage(id)
+	if err != nil || pg.File == nil {
+		AnError(www, req, 404, "Not Found")
+		return
+	}
+	fh, err := os.Open(filepath.Join(gCfg.PageDir, id))
+	if err != nil {
+		AnError(www, req, 404, "Not Found")
+		return
+	}
+	defer fh.Close()
+
+	ct, disp := fileDisposition(pg.File.ContentType, pg.File.Name)
+	www.Header().Set("Content-Type", ct)
+	www.Header().Set("Content-Disposition", disp)
+	www.Header().Set("Content-Security-Policy", "sandbox")
+	www.Header().Set("X-Content-Type-Options", "nosniff")
+	http.ServeContent(www, req, "", time.Unix(pg.Updated, 0), fh)
+}
+
+/*
+/api/gen-page?title=T&markdown=M&links=[{"title":"Menu","url":"https://..."}] - creates a QR with a landing page.
+Send as a multipart POST with "file" to attach a file.
+*/
+func respHandlerGenPage(www http.ResponseWriter, req *http.Request) {
+	if !CheckAuth(www, req) || !LimitUpload(www, req) {
+		return
+	}
+
+	var vv Validator
+	pg := &PageType{}
+	if err := ParsePageParams(www, req, pg, &vv); err != nil {
+		AnError(www, req, 406, err.Error())
+		return
+	}
+	if vv.Send(www, req) {
+		return
+	}
+
+	id, img, uri, err := CreateQR(PageURL("{id}"), AuthUser(req), "")
+	if err != nil {
+		AnError(www, req, 500, err.Error())
+		return
+	}
+	if err = SavePageFile(www, req, id, pg); err != nil {
+		AnError(www, req, 500, "Config Error 29")
+		return
+	}
+	if err = SavePage(id, pg, AuthUser(req)); err != nil {
+		AnError(www, req, 500, "Config Error 28")
+		return
+	}
+	Quarantine(id, AuthUser(req), vv.Threats)
+
+	go EmitEvent(HookEvent{Event: "qr.created", ID: id, URL: PageURL(id)})
+
+	www.Header().Set("Content-Type", "application/json; charset=utf-8")
+	fmt.Fprintf(www, `{"status":"success", "id":%q, "url":%q, "qr_url":%q, "qr_encoded":%q, "page":%s }`+"\n", id, PageURL(id), img, uri, SVar(pg))
+}
+
+/*
+/api/set-page?id=ID&title=T&markdown=M&links=[...]&remove_file=true - changes the landing page.  Parameters
+that are left out are not changed.  It can also be used to give a QR that redirects a landing page.
+*/
+func respHandlerSetPage(www http.ResponseWriter, req *http.Request) {
+	if !CheckAuth(www, req) || !LimitUpload(www, req) {
+		return
+	}
+
+	id := GetParam(www, req, "id", "")
+	if id == "" {
+		AnError(www, req, 406, "Missing Parameter")
+		return
+	}
+	if _, err := redisClient.Cmd("GET", fmt.Sprintf("qrr:%s", id)).Str(); err != nil {
+		AnError(www, req, 404, "Not Found")
+		return
+	}
+
+	pg, err := GetPage(id)
+	if err != nil {
+		pg = &PageType{}
+	}
+	var vv Validator
+	if err = ParsePageParams(www, req, pg, &vv); err != nil {
+		AnError(www, req, 406, err.Error())
+		return
+	}
+	if vv.Send(www, req) {
+		return
+	}
+	if err = SavePageFile(www, req, id, pg); err != nil {
+		AnError(www, req, 500, "Config Error 29")
+		return
+	}
+	if err = SavePage(id, pg, AuthUser(req)); err != nil {
+		AnError(www, req, 500, "Config Error 28")
+		return
+	}
+	Quarantine(id, AuthUser(req), vv.Threats)
+
+	go EmitEvent(HookEvent{Event: "qr.updated", ID: id, URL: PageURL(id)})
+
+	www.Header().Set("Content-Type", "application/json; charset=utf-8")
+	fmt.Fprintf(www, `{"status":"success","url":%q,"page":%s}`+"\n", PageURL(id), SVar(pg))
+}
+
+/*
+/api/get-page?id=ID
+*/
+func respHandlerGetPage(www http.ResponseWriter, req *http.Request) {
+	if !CheckAuth(www, req) {
+		return
+	}
+
+	id := GetParam(www, req, "id", "")
+	if id == "" {
+		AnError(www, req, 406, "Missing Parameter")
+		return
+	}
+
+	pg, err := GetPage(id)
+	if err != nil {
+		AnError(www, req, 404, "Not Found")
+		return
+	}
+
+	www.Header().Set("Content-Type", "application/json; charset=utf-8")
+	fmt.Fprintf(www, `{"status":"success","url":%q,"page":%s}`+"\n", PageURL(id), SVar(pg))
+}
+
+/* vim: set noai ts=4 sw=4: */
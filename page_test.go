@@ -0,0 +1,69 @@
+package main
+
+// MIT Licensed - see LICENSE
+
+import (
+	"bytes"
+	"mime/multipart"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestFileDisposition(t *testing.T) {
+	tests := []struct {
+		ct   string
+		name string
+		ect  string
+		disp string
+	}{
+		{"application/pdf", "menu.pdf", "application/pdf", `inline; filename=menu.pdf`},
+		{"image/PNG", "a.png", "image/png", `inline; filename=a.png`},
+		{"image/jpeg; charset=x", "a b.jpg", "image/jpeg", `inline; filename="a b.jpg"`},
+		{"text/html", "x.html", "application/octet-stream", `attachment; filename=x.html`},
+		{"image/svg+xml", "x.svg", "application/octet-stream", `attachment; filename=x.svg`},
+		{"", "x", "application/octet-stream", `attachment; filename=x`},
+	}
+
+	for ii, test := range tests {
+		ct, disp := fileDisposition(test.ct, test.name)
+		if ct != test.ect || disp != test.disp {
+			t.Errorf("Test %d, expected %s %s got %s %s\n", ii, test.ect, test.disp, ct, disp)
+		}
+	}
+}
+
+func TestLimitUpload(t *testing.T) {
+	defer func(n int) { gCfg.PageMaxFile = n }(gCfg.PageMaxFile)
+	gCfg.PageMaxFile = 1000
+
+	tests := []struct {
+		size   int
+		ok     bool
+		code   int
+		upload bool
+	}{
+		{size: 500, ok: true, code: 200, upload: true},
+		{size: 1000 + uploadOverhead/2, ok: true, code: 200, upload: true}, // caught later by the check on the file size
+		{size: 1000 + uploadOverhead, ok: false, code: 413},
+	}
+	for ii, test := range tests {
+		var body bytes.Buffer
+		mw := multipart.NewWriter(&body)
+		mw.WriteField("title", "Menu")
+		fw, _ := mw.CreateFormFile("file", "menu.pdf")
+		fw.Write(bytes.Repeat([]byte("x"), test.size))
+		mw.Close()
+
+		req := httptest.NewRequest("POST", "/api/gen-page", &body)
+		req.Header.Set("Content-Type", mw.FormDataContentType())
+		rec := httptest.NewRecorder()
+		ok := LimitUpload(rec, req)
+		if ok != test.ok || rec.Code != test.code {
+			t.Errorf("Test %d, expected %v %d got %v %d\n", ii, test.ok, test.code, ok, rec.Code)
+		} else if test.ok && (pageUpload(req) == nil) == test.upload {
+			t.Errorf("Test %d, expected the upload\n", ii)
+		}
+	}
+}
+
+/* vim: set noai ts=4 sw=4: */
@@ -0,0 +1,603 @@
+package main
+
+// MIT Licensed - see LICENSE
+
+import (
+	"encoding/base64"
+	"fmt"
+	"net"
+	"net/http"
+	"net/mail"
+	"net/url"
+	"path"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/pschlump/json"
+)
+
+// Payload is content other than a URL to encode in a QR code.
+type Payload interface {
+	Validate(vv *Validator) // checks the fields, errors are added to vv
+	Text() string           // the text encoded in a static QR code
+}
+
+// FilePayload is a payload that can also be a dynamic code.  The QR code goes to /Q/{id} as usual and
+// that sends the scan on to /P/{id}.{ext} where the file is served, so the content can be changed later.
+type FilePayload interface {
+	Payload
+	File(id string) (ext, contentType string, body []byte)
+}
+
+// PayloadTypes are the types that can be passed to /api/gen-payload.
+var PayloadTypes = map[string]func() Payload{
+	"wifi":   func() Payload { return &WiFiPayload{} },
+	"vcard":  func() Payload { return &ContactPayload{} },
+	"mecard": func() Payload { return &ContactPayload{MeCard: true} },
+	"sms":    func() Payload { return &SMSPayload{} },
+	"geo":    func() Payload { return &GeoPayload{} },
+	"event":  func() Payload { return &EventPayload{} },
+}
+
+// ParsePayload decodes the JSON data for a payload of type typ and validates it.
+func ParsePayload(typ, data string, vv *Validator) (Payload, error) {
+	mk, ok := PayloadTypes[typ]
+	if !ok {
+		return nil, fmt.Errorf("Invalid type %q", typ)
+	}
+	pl := mk()
+	if err := json.Unmarshal([]byte(data), pl); err != nil {
+		return nil, fmt.Errorf("Invalid data: %s", err)
+	}
+	pl.Validate(vv)
+	return pl, nil
+}
+
+// StoredPayload is the payload of a dynamic code, kept in qr-payload:{id}.
+type StoredPayload struct {
+	Type string          `json:"type"`
+	Data json.RawMessage `json:"data"`
+}
+
+// GetPayload returns the payload of the dynamic code id.
+func GetPayload(id string) (typ string, pl FilePayload, err error) {
+	s, err := redisClient.Cmd("GET", fmt.Sprintf("qr-payload:%s", id)).Str()
+	if err != nil {
+		return "", nil, err
+	}
+	var sp StoredPayload
+	if err = json.Unmarshal([]byte(s), &sp); err != nil {
+		return "", nil, err
+	}
+	mk, ok := PayloadTypes[sp.Type]
+	if !ok {
+		return "", nil, fmt.Errorf("Invalid type %q", sp.Type)
+	}
+	p := mk()
+	if err = json.Unmarshal(sp.Data, p); err != nil {
+		return "", nil, err
+	}
+	p.Validate(&Validator{}) // sets up the parsed fields
+	if pl, ok = p.(FilePayload); !ok {
+		return "", nil, fmt.Errorf("Type %q can not be dynamic", sp.Type)
+	}
+	return sp.Type, pl, nil
+}
+
+// SavePayload stores the payload for id and points the QR at the file.
+func SavePayload(id, typ string, pl FilePayload, user string) (xurl string, err error) {
+	err = redisClient.Cmd("SET", fmt.Sprintf("qr-payload:%s", id), SVar(StoredPayload{Type: typ, Data: json.RawMessage(SVar(pl))})).Err
+	if err != nil {
+		return "", err
+	}
+	xurl = strings.Replace(PayloadURL(pl), "{id}", id, -1)
+	if cur, _ := redisClient.Cmd("GET", fmt.Sprintf("qrr:%s", id)).Str(); cur != xurl {
+		_, err = SetTargetURL(id, xurl, user, 0)
+	}
+	return
+}
+
+// PayloadURL is where a dynamic code with pl sends its scans, with "{id}" in place of the ID.
+func PayloadURL(pl FilePayload) string {
+	ext, _, _ := pl.File("")
+	return BaseURL() + "/P/{id}." + ext
+}
+
+// Add records a validation error that is not about a URL.
+func (vv *Validator) Add(field, code, value, msg string) {
+	vv.Errors = append(vv.Errors, &ValidationError{Field: field, Code: code, Value: value, Msg: msg})
+}
+
+// escapeMeCard escapes the characters that are special in WIFI: and MECARD: fields.
+func escapeMeCard(s string) string {
+	return strings.NewReplacer(`\`, `\\`, `;`, `\;`, `,`, `\,`, `:`, `\:`, `"`, `\"`).Replace(s)
+}
+
+// escapeICal escapes a text value in a vCard or iCalendar property.
+func escapeICal(s string) string {
+	return strings.NewReplacer(`\`, `\\`, `;`, `\;`, `,`, `\,`, "\r\n", `\n`, "\n", `\n`).Replace(s)
+}
+
+// foldLines joins the content lines with CRLF, folding any that are longer than 75 octets.
+func foldLines(lines []string) string {
+	var b strings.Builder
+	for _, line := range lines {
+		for len(line) > 75 {
+			n := 75
+			for n > 0 && (line[n]&0xC0) == 0x80 { // do not split a UTF-8 sequence
+				n--
+			}
+			b.WriteString(line[:n] + "\r\n ")
+			line = line[n:]
+		}
+		b.WriteString(line + "\r\n")
+	}
+	return b.String()
+}
+
+func validPhone(s string) bool {
+	digits := 0
+	for ii, c := range s {
+		switch {
+		case c >= '0' && c <= '9':
+			digits++
+		case c == '+' && ii == 0:
+		case c == ' ' || c == '-' || c == '.' || c == '(' || c == ')':
+		default:
+			return false
+		}
+	}
+	return digits >= 3
+}
+
+// WiFiPayload is a network to join, WIFI:T:WPA;S:ssid;P:password;;
+type WiFiPayload struct {
+	SSID     string `json:"ssid"`
+	Password string `json:"password,omitempty"`
+	Auth     string `json:"auth,omitempty"` // WPA (the default with a password), WEP or nopass
+	Hidden   bool   `json:"hidden,omitempty"`
+}
+
+func (w *WiFiPayload) Validate(vv *Validator) {
+	if w.Auth == "" {
+		w.Auth = "nopass"
+		if w.Password != "" {
+			w.Auth = "WPA"
+		}
+	}
+	w.Auth = strings.ToUpper(w.Auth)
+	if w.Auth == "NOPASS" {
+		w.Auth = "nopass"
+	}
+	if w.SSID == "" || len(w.SSID) > 32 {
+		vv.Add("ssid", "invalid_ssid", w.SSID, "SSID must be 1 to 32 bytes")
+	}
+	switch w.Auth {
+	case "WPA":
+		if len(w.Password) < 8 || len(w.Password) > 63 {
+			vv.Add("password", "invalid_password", "", "WPA password must be 8 to 63 characters")
+		}
+	case "WEP":
+		if n := len(w.Password); n != 5 && n != 13 && n != 10 && n != 26 {
+			vv.Add("password", "invalid_password", "", "WEP key must be 5 or 13 characters or 10 or 26 hex digits")
+		}
+	case "nopass":
+		if w.Password != "" {
+			vv.Add("password", "invalid_password", "", "An open network can not have a password")
+		}
+	default:
+		vv.Add("auth", "invalid_auth", w.Auth, "auth must be WPA, WEP or nopass")
+	}
+}
+
+func (w *WiFiPayload) Text() string {
+	s := fmt.Sprintf("WIFI:T:%s;S:%s;", w.Auth, escapeMeCard(w.SSID))
+	if w.Auth != "nopass" {
+		s += fmt.Sprintf("P:%s;", escapeMeCard(w.Password))
+	}
+	if w.Hidden {
+		s += "H:true;"
+	}
+	return s + ";"
+}
+
+// ContactPayload is a contact card, a vCard 3.0 or, for a smaller static code, a MeCard.  A dynamic code
+// always serves a .vcf.
+type ContactPayload struct {
+	MeCard  bool     `json:"-"`
+	First   string   `json:"first,omitempty"`
+	Last    string   `json:"last,omitempty"`
+	Org     string   `json:"org,omitempty"`
+	Title   string   `json:"title,omitempty"`
+	Phone   []string `json:"phone,omitempty"`
+	Email   []string `json:"email,omitempty"`
+	URL     string   `json:"url,omitempty"`
+	Address string   `json:"address,omitempty"` // one line, used as the street
+	Note    string   `json:"note,omitempty"`
+}
+
+func (c *ContactPayload) Validate(vv *Validator) {
+	if c.First == "" && c.Last == "" && c.Org == "" {
+		vv.Add("first", "missing_name", "", "A name or org is required")
+	}
+	for ii, p := range c.Phone {
+		if !validPhone(p) {
+			vv.Add(fmt.Sprintf("phone[%d]", ii), "invalid_phone", p, "Invalid phone number")
+		}
+	}
+	for ii, e := range c.Email {
+		if a, err := mail.ParseAddress(e); err != nil || a.Address != e {
+			vv.Add(fmt.Sprintf("email[%d]", ii), "invalid_email", e, "Invalid email address")
+		}
+	}
+	if c.URL != "" {
+		if n, ve := ValidateTargetURL("url", c.URL); ve != nil {
+			vv.Errors = append(vv.Errors, ve)
+		} else {
+			c.URL = n
+		}
+	}
+}
+
+func (c *ContactPayload) fullName() string {
+	if fn := strings.TrimSpace(c.First + " " + c.Last); fn != "" {
+		return fn
+	}
+	return c.Org
+}
+
+func (c *ContactPayload) vCard() []string {
+	lines := []string{
+		"BEGIN:VCARD",
+		"VERSION:3.0",
+		"N:" + escapeICal(c.Last) + ";" + escapeICal(c.First) + ";;;",
+		"FN:" + escapeICal(c.fullName()),
+	}
+	if c.Org != "" {
+		lines = append(lines, "ORG:"+escapeICal(c.Org))
+	}
+	if c.Title != "" {
+		lines = append(lines, "TITLE:"+escapeICal(c.Title))
+	}
+	for _, p := range c.Phone {
+		lines = append(lines, "TEL:"+escapeICal(p))
+	}
+	for _, e := range c.Email {
+		lines = append(lines, "EMAIL:"+escapeICal(e))
+	}
+	if c.URL != "" {
+		lines = append(lines, "URL:"+c.URL)
+	}
+	if c.Address != "" {
+		lines = append(lines, "ADR:;;"+escapeICal(c.Address)+";;;;")
+	}
+	if c.Note != "" {
+		lines = append(lines, "NOTE:"+escapeICal(c.Note))
+	}
+	return append(lines, "END:VCARD")
+}
+
+func (c *ContactPayload) Text() string {
+	if !c.MeCard {
+		return foldLines(c.vCard())
+	}
+	s := "MECARD:N:" + escapeMeCard(c.Last)
+	if c.First != "" {
+		s += "," + escapeMeCard(c.First)
+	}
+	s += ";"
+	if c.Last == "" && c.First == "" {
+		s = "MECARD:N:" + escapeMeCard(c.Org) + ";"
+	} else if c.Org != "" {
+		s += "ORG:" + escapeMeCard(c.Org) + ";"
+	}
+	for _, p := range c.Phone {
+		s += "TEL:" + escapeMeCard(p) + ";"
+	}
+	for _, e := range c.Email {
+		s += "EMAIL:" + escapeMeCard(e) + ";"
+	}
+	if c.URL != "" {
+		s += "URL:" + escapeMeCard(c.URL) + ";"
+	}
+	if c.Address != "" {
+		s += "ADR:" + escapeMeCard(c.Address) + ";"
+	}
+	if c.Note != "" {
+		s += "NOTE:" + escapeMeCard(c.Note) + ";"
+	}
+	return s + ";"
+}
+
+func (c *ContactPayload) File(id string) (ext, contentType string, body []byte) {
+	return "vcf", "text/vcard; charset=utf-8", []byte(foldLines(c.vCard()))
+}
+
+// SMSPayload is a text message to send, SMSTO:number:message
+type SMSPayload struct {
+	Phone   string `json:"phone"`
+	Message string `json:"message,omitempty"`
+}
+
+func (s *SMSPayload) Validate(vv *Validator) {
+	if !validPhone(s.Phone) {
+		vv.Add("phone", "invalid_phone", s.Phone, "Invalid phone number")
+	}
+}
+
+func (s *SMSPayload) Text() string {
+	return fmt.Sprintf("SMSTO:%s:%s", s.Phone, s.Message)
+}
+
+// GeoPayload is a location, geo:lat,lon?q=query
+type GeoPayload struct {
+	Lat   float64 `json:"lat"`
+	Lon   float64 `json:"lon"`
+	Query string  `json:"query,omitempty"` // a place name or address to show
+}
+
+func (g *GeoPayload) Validate(vv *Validator) {
+	if g.Lat < -90 || g.Lat > 90 {
+		vv.Add("lat", "invalid_lat", strconv.FormatFloat(g.Lat, 'f', -1, 64), "Latitude must be -90 to 90")
+	}
+	if g.Lon < -180 || g.Lon > 180 {
+		vv.Add("lon", "invalid_lon", strconv.FormatFloat(g.Lon, 'f', -1, 64), "Longitude must be -180 to 180")
+	}
+}
+
+func (g *GeoPayload) Text() string {
+	s := "geo:" + strconv.FormatFloat(g.Lat, 'f', -1, 64) + "," + strconv.FormatFloat(g.Lon, 'f', -1, 64)
+	if g.Query != "" {
+		s += "?q=" + url.QueryEscape(g.Query)
+	}
+	return s
+}
+
+// EventPayload is a calendar event.  A static code holds just the VEVENT, a dynamic code serves an .ics.
+// Start and End use the same formats as schedule windows, in TZ (default UTC).
+type EventPayload struct {
+	Summary     string `json:"summary"`
+	Start       string `json:"start"`
+	End         string `json:"end,omitempty"`
+	TZ          string `json:"tz,omitempty"`
+	Location    string `json:"location,omitempty"`
+	Description string `json:"description,omitempty"`
+	URL         string `json:"url,omitempty"`
+	start, end  time.Time
+}
+
+func (e *EventPayload) Validate(vv *Validator) {
+	if e.Summary == "" {
+		vv.Add("summary", "missing_summary", "", "Summary is required")
+	}
+	loc := time.UTC
+	if e.TZ != "" {
+		var err error
+		if loc, err = time.LoadLocation(e.TZ); err != nil {
+			vv.Add("tz", "invalid_tz", e.TZ, "Invalid time zone")
+			return
+		}
+	}
+	var err error
+	if e.start, err = parseScheduleTime(e.Start, loc); err != nil {
+		vv.Add("start", "invalid_time", e.Start, err.Error())
+	}
+	if e.End != "" {
+		if e.end, err = parseScheduleTime(e.End, loc); err != nil {
+			vv.Add("end", "invalid_time", e.End, err.Error())
+		} else if e.end.Before(e.start) {
+			vv.Add("end", "invalid_time", e.End, "End is before start")
+		}
+	}
+	if e.URL != "" {
+		if n, ve := ValidateTargetURL("url", e.URL); ve != nil {
+			vv.Errors = append(vv.Errors, ve)
+		} else {
+			e.URL = n
+		}
+	}
+}
+
+const iCalTime = "20060102T150405Z"
+
+func (e *EventPayload) vEvent() []string {
+	lines := []string{
+		"BEGIN:VEVENT",
+		"SUMMARY:" + escapeICal(e.Summary),
+		"DTSTART:" + e.start.UTC().Format(iCalTime),
+	}
+	if !e.end.IsZero() {
+		lines = append(lines, "DTEND:"+e.end.UTC().Format(iCalTime))
+	}
+	if e.Location != "" {
+		lines = append(lines, "LOCATION:"+escapeICal(e.Location))
+	}
+	if e.Description != "" {
+		lines = append(lines, "DESCRIPTION:"+escapeICal(e.Description))
+	}
+	if e.URL != "" {
+		lines = append(lines, "URL:"+e.URL)
+	}
+	return lines
+}
+
+func (e *EventPayload) Text() string {
+	return foldLines(append(e.vEvent(), "END:VEVENT"))
+}
+
+func (e *EventPayload) File(id string) (ext, contentType string, body []byte) {
+	host := gCfg.HostPort
+	if u, err := url.Parse(BaseURL()); err == nil {
+		host = u.Host
+	}
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		host = h
+	}
+	lines := []string{"BEGIN:VCALENDAR", "VERSION:2.0", "PRODID:-//qr-svr//EN", "METHOD:PUBLISH"}
+	lines = append(lines, e.vEvent()...)
+	lines = append(lines,
+		fmt.Sprintf("UID:qr-%s@%s", id, host),
+		"DTSTAMP:"+timeNow().UTC().Format(iCalTime),
+		"END:VEVENT",
+		"END:VCALENDAR",
+	)
+	return "ics", "text/calendar; charset=utf-8", []byte(foldLines(lines))
+}
+
+/*
+/api/gen-payload?type=wifi&data={"ssid":"Guest","password":"..."}[&dynamic=true]
+type is one of wifi, vcard, mecard, sms, geo or event.  A static code is returned inline as a PNG data URI with
+the text it encodes.  With dynamic=true (vcard, mecard and event only) a new ID is allocated that serves
+a .vcf or .ics, and can be changed later with /api/set-payload.
+*/
+func respHandlerGenPayload(www http.ResponseWriter, req *http.Request) {
+	if !CheckAuth(www, req) {
+		return
+	}
+
+	typ := GetParam(www, req, "type", "")
+	data := GetParam(www, req, "data", "")
+	if typ == "" || data == "" {
+		AnError(www, req, 406, "Missing Parameter")
+		return
+	}
+	dynamic := GetParam(www, req, "dynamic", "") == "true"
+
+	var vv Validator
+	pl, err := ParsePayload(typ, data, &vv)
+	if err != nil {
+		AnError(www, req, 406, err.Error())
+		return
+	}
+	if vv.Send(www, req) {
+		return
+	}
+
+	www.Header().Set("Content-Type", "application/json; charset=utf-8")
+	if !dynamic {
+		text := pl.Text()
+		png, err := RenderQR(text, gCfg.Level, gCfg.QRSize)
+		if err != nil {
+			AnError(www, req, 406, err.Error())
+			return
+		}
+		fmt.Fprintf(www, `{"status":"success","type":%q,"payload":%q,"qr_png":"data:image/png;base64,%s"}`+"\n",
+			typ, text, base64.StdEncoding.EncodeToString(png))
+		return
+	}
+
+	fp, ok := pl.(FilePayload)
+	if !ok {
+		AnError(www, req, 406, fmt.Sprintf("Type %q can not be dynamic", typ))
+		return
+	}
+	id, img, uri, err := CreateQR(PayloadURL(fp), AuthUser(req), "")
+	if err != nil {
+		AnError(www, req, 500, err.Error())
+		return
+	}
+	xurl, err := SavePayload(id, typ, fp, AuthUser(req))
+	if err != nil {
+		AnError(www, req, 500, "Config Error 27")
+		return
+	}
+
+	go EmitEvent(HookEvent{Event: "qr.created", ID: id, URL: xurl})
+
+	fmt.Fprintf(www, `{"status":"success", "id":%q, "type":%q, "url":%q, "qr_url":%q, "qr_encoded":%q }`+"\n", id, typ, xurl, img, uri)
+}
+
+/*
+/api/set-payload?id=ID&type=event&data={...} - replaces the payload of a dynamic code.  It can also be used
+to turn a QR that redirects into one that serves a file.
+*/
+func respHandlerSetPayload(www http.ResponseWriter, req *http.Request) {
+	if !CheckAuth(www, req) {
+		return
+	}
+
+	id := GetParam(www, req, "id", "")
+	typ := GetParam(www, req, "type", "")
+	data := GetParam(www, req, "data", "")
+	if id == "" || typ == "" || data == "" {
+		AnError(www, req, 406, "Missing Parameter")
+		return
+	}
+
+	var vv Validator
+	pl, err := ParsePayload(typ, data, &vv)
+	if err != nil {
+		AnError(www, req, 406, err.Error())
+		return
+	}
+	if vv.Send(www, req) {
+		return
+	}
+	fp, ok := pl.(FilePayload)
+	if !ok {
+		AnError(www, req, 406, fmt.Sprintf("Type %q can not be dynamic", typ))
+		return
+	}
+
+	if _, err := redisClient.Cmd("GET", fmt.Sprintf("qrr:%s", id)).Str(); err != nil {
+		AnError(www, req, 404, "Not Found")
+		return
+	}
+	xurl, err := SavePayload(id, typ, fp, AuthUser(req))
+	if err != nil {
+		AnError(www, req, 500, "Config Error 27")
+		return
+	}
+
+	go EmitEvent(HookEvent{Event: "qr.updated", ID: id, URL: xurl})
+
+	www.Header().Set("Content-Type", "application/json; charset=utf-8")
+	fmt.Fprintf(www, `{"status":"success","type":%q,"url":%q}`+"\n", typ, xurl)
+}
+
+/*
+/api/get-payload?id=ID
+*/
+func respHandlerGetPayload(www http.ResponseWriter, req *http.Request) {
+	if !CheckAuth(www, req) {
+		return
+	}
+
+	id := GetParam(www, req, "id", "")
+	if id == "" {
+		AnError(www, req, 406, "Missing Parameter")
+		return
+	}
+
+	typ, pl, err := GetPayload(id)
+	if err != nil {
+		AnError(www, req, 404, "Not Found")
+		return
+	}
+
+	www.Header().Set("Content-Type", "application/json; charset=utf-8")
+	fmt.Fprintf(www, `{"status":"success","type":%q,"data":%s}`+"\n", typ, SVar(pl))
+}
+
+/*
+/P/{ID}.{ext} - the file for a dynamic payload code.  Scans are counted by /Q/{ID} before it sends them here.
+*/
+func respHandlerPayloadFile(www http.ResponseWriter, req *http.Request) {
+	name := path.Base(req.URL.Path)
+	id := strings.TrimSuffix(name, path.Ext(name))
+
+	_, pl, err := GetPayload(id)
+	if err != nil {
+		AnError(www, req, 404, "Not Found")
+		return
+	}
+
+	ext, contentType, body := pl.File(id)
+	www.Header().Set("Content-Type", contentType)
+	www.Header().Set("Content-Disposition", fmt.Sprintf(`attachment; filename="qr-%s.%s"`, id, ext))
+	www.Header().Set("Cache-Control", "no-cache")
+	www.Write(body)
+}
+
+/* vim: set noai ts=4 sw=4: */
@@ -0,0 +1,89 @@
+package main
+
+// MIT Licensed - see LICENSE
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestPayloadText(t *testing.T) {
+	gCfg.URLSchemes = "http,https"
+	gCfg.HostPort = "localhost:8333"
+
+	tests := []struct {
+		typ      string
+		data     string
+		expected string
+		nErr     int
+	}{
+		{"wifi", `{"ssid":"Guest;Net","password":"p:ss\\word"}`, `WIFI:T:WPA;S:Guest\;Net;P:p\:ss\\word;;`, 0},
+		{"wifi", `{"ssid":"Open","hidden":true}`, `WIFI:T:nopass;S:Open;H:true;;`, 0},
+		{"wifi", `{"ssid":"Guest","password":"short"}`, ``, 1},
+		{"wifi", `{"ssid":"","auth":"wpa3","password":"12345678"}`, ``, 2},
+		{"mecard", `{"first":"Ann","last":"Lee","phone":["+1 555 0100"],"email":["ann@example.com"]}`,
+			`MECARD:N:Lee,Ann;TEL:+1 555 0100;EMAIL:ann@example.com;;`, 0},
+		{"vcard", `{"first":"Ann","last":"Lee","org":"A, B; C"}`,
+			"BEGIN:VCARD\r\nVERSION:3.0\r\nN:Lee;Ann;;;\r\nFN:Ann Lee\r\nORG:A\\, B\\; C\r\nEND:VCARD\r\n", 0},
+		{"vcard", `{"phone":["call me"],"email":["not-an-email"]}`, ``, 3},
+		{"sms", `{"phone":"+15550100","message":"Hi there"}`, `SMSTO:+15550100:Hi there`, 0},
+		{"geo", `{"lat":40.7128,"lon":-74.006,"query":"City Hall"}`, `geo:40.7128,-74.006?q=City+Hall`, 0},
+		{"geo", `{"lat":91,"lon":0}`, ``, 1},
+		{"event", `{"summary":"Launch","start":"2026-11-02 09:00","end":"2026-11-02 10:30","tz":"America/Denver"}`,
+			"BEGIN:VEVENT\r\nSUMMARY:Launch\r\nDTSTART:20261102T160000Z\r\nDTEND:20261102T173000Z\r\nEND:VEVENT\r\n", 0},
+		{"event", `{"summary":"Launch","start":"2026-11-02 09:00","end":"2026-11-01 10:30"}`, ``, 1},
+	}
+
+	for ii, test := range tests {
+		var vv Validator
+		pl, err := ParsePayload(test.typ, test.data, &vv)
+		if err != nil {
+			t.Errorf("Test %d, error %s\n", ii, err)
+			continue
+		}
+		if len(vv.Errors) != test.nErr {
+			t.Errorf("Test %d, expected %d errors got %s\n", ii, test.nErr, SVar(vv.Errors))
+			continue
+		}
+		if test.nErr == 0 && pl.Text() != test.expected {
+			t.Errorf("Test %d, expected %q got %q\n", ii, test.expected, pl.Text())
+		}
+	}
+
+	if _, err := ParsePayload("fax", `{}`, &Validator{}); err == nil {
+		t.Errorf("Expected an error for an invalid type\n")
+	}
+}
+
+func TestPayloadFile(t *testing.T) {
+	gCfg.HostPort = "localhost:8333"
+	timeNow = func() time.Time { return time.Date(2026, 10, 19, 12, 0, 0, 0, time.UTC) }
+	defer func() { timeNow = time.Now }()
+
+	var vv Validator
+	pl, _ := ParsePayload("event", `{"summary":"A long summary that is going to need folding because it is over the limit","start":"2026-11-02T09:00:00Z"}`, &vv)
+	ext, ct, body := pl.(FilePayload).File("10042")
+	if ext != "ics" || !strings.HasPrefix(ct, "text/calendar") {
+		t.Errorf("Expected ics text/calendar got %s %s\n", ext, ct)
+	}
+	for _, want := range []string{"BEGIN:VCALENDAR\r\n", "UID:qr-10042@localhost\r\n", "DTSTAMP:20261019T120000Z\r\n", "END:VCALENDAR\r\n"} {
+		if !strings.Contains(string(body), want) {
+			t.Errorf("Expected %q in %q\n", want, body)
+		}
+	}
+	if !strings.Contains(string(body), "\r\n ") {
+		t.Errorf("Expected the summary to be folded in %q\n", body)
+	}
+	for _, line := range strings.Split(string(body), "\r\n") {
+		if len(line) > 75 {
+			t.Errorf("Line longer than 75 octets: %q\n", line)
+		}
+	}
+
+	if _, ok := Payload(&WiFiPayload{}).(FilePayload); ok {
+		t.Errorf("wifi should not be a dynamic type\n")
+	}
+}
+
+/* vim: set noai ts=4 sw=4: */
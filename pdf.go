@@ -0,0 +1,154 @@
+package main
+
+// MIT Licensed - see LICENSE
+
+import (
+	"bytes"
+	"compress/zlib"
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// PDFDoc is just enough of a PDF writer for label sheets: pages of vector drawing and text in the
+// standard Helvetica font, so nothing has to be embedded.
+type PDFDoc struct {
+	pages []pdfPage
+}
+
+type pdfPage struct {
+	width, height float64
+	content       bytes.Buffer
+}
+
+// PointsPerMM converts millimeters to PDF points.
+const PointsPerMM = 72.0 / 25.4
+
+// AddPage starts a new page, sizes are in points.
+func (doc *PDFDoc) AddPage(width, height float64) {
+	doc.pages = append(doc.pages, pdfPage{width: width, height: height})
+}
+
+func (doc *PDFDoc) page() *bytes.Buffer {
+	return &doc.pages[len(doc.pages)-1].content
+}
+
+// pdfNum formats a number with no more than 3 decimals and no trailing zeros.
+func pdfNum(f float64) string {
+	s := strconv.FormatFloat(f, 'f', 3, 64)
+	s = strings.TrimRight(strings.TrimRight(s, "0"), ".")
+	if s == "-0" || s == "" {
+		return "0"
+	}
+	return s
+}
+
+// Rect adds a rectangle to the current path, (x, y) is the lower left corner.
+func (doc *PDFDoc) Rect(x, y, w, h float64) {
+	fmt.Fprintf(doc.page(), "%s %s %s %s re\n", pdfNum(x), pdfNum(y), pdfNum(w), pdfNum(h))
+}
+
+// Fill fills the current path in black.
+func (doc *PDFDoc) Fill() {
+	doc.page().WriteString("0 g f\n")
+}
+
+// Line strokes a black line width points wide.
+func (doc *PDFDoc) Line(x1, y1, x2, y2, width float64) {
+	fmt.Fprintf(doc.page(), "0 G %s w %s %s m %s %s l S\n", pdfNum(width), pdfNum(x1), pdfNum(y1), pdfNum(x2), pdfNum(y2))
+}
+
+// Text draws s in Helvetica at size points with its baseline starting at (x, y).
+func (doc *PDFDoc) Text(x, y, size float64, s string) {
+	fmt.Fprintf(doc.page(), "BT /F1 %s Tf %s %s Td (%s) Tj ET\n", pdfNum(size), pdfNum(x), pdfNum(y), pdfString(s))
+}
+
+// pdfString encodes s for a literal string in WinAnsi, characters it does not have become "?".
+func pdfString(s string) string {
+	var b strings.Builder
+	for _, r := range s {
+		switch {
+		case r == '(' || r == ')' || r == '\\':
+			b.WriteByte('\\')
+			b.WriteRune(r)
+		case r >= 32 && r < 127:
+			b.WriteRune(r)
+		case r >= 0xA0 && r <= 0xFF:
+			fmt.Fprintf(&b, "\\%03o", r)
+		default:
+			b.WriteByte('?')
+		}
+	}
+	return b.String()
+}
+
+// helveticaWidths are the widths of the printable ASCII characters in Helvetica, 1/1000 of the size.
+var helveticaWidths = [95]int{
+	278, 278, 355, 556, 556, 889, 667, 191, 333, 333, 389, 584, 278, 333, 278, 278, // space to /
+	556, 556, 556, 556, 556, 556, 556, 556, 556, 556, 278, 278, 584, 584, 584, 556, // 0 to ?
+	1015, 667, 667, 722, 722, 667, 611, 778, 722, 278, 500, 667, 556, 833, 722, 778, // @ to O
+	667, 778, 722, 667, 611, 722, 667, 944, 667, 667, 611, 278, 278, 278, 469, 556, // P to _
+	333, 556, 556, 500, 556, 556, 278, 556, 556, 222, 222, 500, 222, 833, 556, 556, // ` to o
+	556, 556, 333, 500, 278, 556, 500, 722, 500, 500, 500, 334, 260, 334, 584, // p to ~
+}
+
+// TextWidth is the width in points of s in Helvetica at size.
+func TextWidth(s string, size float64) float64 {
+	w := 0
+	for _, r := range s {
+		if r >= 32 && r < 127 {
+			w += helveticaWidths[r-32]
+		} else {
+			w += 556
+		}
+	}
+	return float64(w) * size / 1000
+}
+
+// Bytes returns the finished PDF.
+func (doc *PDFDoc) Bytes() ([]byte, error) {
+	var out bytes.Buffer
+	var offsets []int
+	obj := func(body string) {
+		offsets = append(offsets, out.Len())
+		fmt.Fprintf(&out, "%d 0 obj\n%s\nendobj\n", len(offsets), body)
+	}
+
+	out.WriteString("%PDF-1.4\n%\xe2\xe3\xcf\xd3\n")
+	// 1 catalog, 2 pages, 3 font, then a page and its content for each page.
+	kids := make([]string, len(doc.pages))
+	for ii := range doc.pages {
+		kids[ii] = fmt.Sprintf("%d 0 R", 4+ii*2)
+	}
+	obj("<< /Type /Catalog /Pages 2 0 R >>")
+	obj(fmt.Sprintf("<< /Type /Pages /Kids [%s] /Count %d >>", strings.Join(kids, " "), len(doc.pages)))
+	obj("<< /Type /Font /Subtype /Type1 /BaseFont /Helvetica /Encoding /WinAnsiEncoding >>")
+	for ii := range doc.pages {
+		pg := &doc.pages[ii]
+		obj(fmt.Sprintf("<< /Type /Page /Parent 2 0 R /MediaBox [0 0 %s %s] /Resources << /Font << /F1 3 0 R >> >> /Contents %d 0 R >>",
+			pdfNum(pg.width), pdfNum(pg.height), 5+ii*2))
+
+		var z bytes.Buffer
+		zw := zlib.NewWriter(&z)
+		if _, err := zw.Write(pg.content.Bytes()); err != nil {
+			return nil, err
+		}
+		if err := zw.Close(); err != nil {
+			return nil, err
+		}
+		offsets = append(offsets, out.Len())
+		fmt.Fprintf(&out, "%d 0 obj\n<< /Length %d /Filter /FlateDecode >>\nstream\n", len(offsets), z.Len())
+		out.Write(z.Bytes())
+		out.WriteString("\nendstream\nendobj\n")
+	}
+
+	xref := out.Len()
+	fmt.Fprintf(&out, "xref\n0 %d\n0000000000 65535 f \n", len(offsets)+1)
+	for _, off := range offsets {
+		fmt.Fprintf(&out, "%010d 00000 n \n", off)
+	}
+	fmt.Fprintf(&out, "trailer\n<< /Size %d /Root 1 0 R >>\nstartxref\n%d\n%%%%EOF\n", len(offsets)+1, xref)
+	return out.Bytes(), nil
+}
+
+/* vim: set noai ts=4 sw=4: */
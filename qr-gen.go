@@ -7,46 +7,24 @@ import (
 	"os"
 	"strings"
 
+	"github.com/prometheus/client_golang/prometheus"
 	"github.com/pschlump/goqrcode"
 )
 
 // GenQR generates the image for the QR code as a .png in basePath.
 // fn is the final path of the QR.
-func GenQR(QRDir, QRUri, HostPort, id string) (uri, pth string, err error) {
+func GenQR(QRDir, id string) (uri, pth string, err error) {
 	pth = fmt.Sprintf("./%s/%s.png", QRDir, id)
 	pth = strings.Replace(pth, "/./", "/", -1)
-	uri = fmt.Sprintf("http://%s/Q/%s", gCfg.HostPort, id)
-	uri = strings.Replace(uri, "/./", "/", -1)
+	uri = QRContent(id)
 
-	if dbFlag["GenQR"] {
-		fmt.Printf("GenQR: pth [%s] uri [%s]\n", pth, uri)
-	}
-
-	redundancy := goqrcode.Highest
-	switch gCfg.Level {
-	case "h", "high", "H":
-	case "m", "medium", "M":
-		redundancy = goqrcode.Medium
-	case "l", "low", "L":
-		redundancy = goqrcode.Low
-	default:
-		err = fmt.Errorf("Invalid level")
-		return
-	}
+	logger.Debug("GenQR", "GenQR", "path", pth, "uri", uri)
 
-	// Generate the QR code in internal format
-	var q *goqrcode.QRCode
-	q, err = goqrcode.New(uri, redundancy)
-	goqrcode.CheckError(err)
-
-	// Output QR Code as a PNG
 	var png []byte
-	png, err = q.PNG(gCfg.QRSize)
+	png, err = RenderQR(uri, gCfg.Level, gCfg.QRSize)
 	if err != nil {
-		err = fmt.Errorf("Failed to generate QR: %s", err)
 		return
 	}
-	goqrcode.CheckError(err)
 
 	var fh *os.File
 	fh, err = Fopen(pth, "w")
@@ -60,4 +38,101 @@ func GenQR(QRDir, QRUri, HostPort, id string) (uri, pth string, err error) {
 	return
 }
 
+// QRContent is the URL encoded in the QR for id.
+func QRContent(id string) string {
+	return QRContentAt(QRBaseURL(id), id)
+}
+
+// QRLevels are the names of the error correction levels, in config and the API.  "h" and "high" have
+// always meant the highest level, 30%; "q" is the 25% level.
+var QRLevels = map[string]goqrcode.RecoveryLevel{
+	"l":        goqrcode.Low,
+	"low":      goqrcode.Low,
+	"m":        goqrcode.Medium,
+	"medium":   goqrcode.Medium,
+	"q":        goqrcode.High,
+	"quartile": goqrcode.High,
+	"h":        goqrcode.Highest,
+	"high":     goqrcode.Highest,
+}
+
+// QRFormats are the image formats that RenderQRFormat can produce, with their content type.
+var QRFormats = map[string]string{
+	"png": "image/png",
+	"svg": "image/svg+xml",
+}
+
+// NewQRCode encodes content at level.  The encoder splits the content into numeric, alphanumeric and
+// byte mode segments to make the smallest code it can.
+func NewQRCode(content, level string) (*goqrcode.QRCode, error) {
+	redundancy, ok := QRLevels[strings.ToLower(level)]
+	if !ok {
+		return nil, fmt.Errorf("Invalid level")
+	}
+
+	// Generate the QR code in internal format
+	q, err := goqrcode.New(content, redundancy)
+	if err != nil {
+		return nil, fmt.Errorf("Failed to generate QR: %s", err)
+	}
+	return q, nil
+}
+
+// RenderQR encodes content as a QR code and returns it as a .png of size pixels.
+func RenderQR(content, level string, size int) (png []byte, err error) {
+	png, _, err = RenderQRFormat(content, level, size, "png")
+	return
+}
+
+// RenderQRFormat encodes content as a QR code and returns it as an image in format, png or svg, that is
+// size pixels across.
+func RenderQRFormat(content, level string, size int, format string) (body []byte, contentType string, err error) {
+	contentType, ok := QRFormats[format]
+	if !ok {
+		return nil, "", fmt.Errorf("Invalid format %q", format)
+	}
+	defer prometheus.NewTimer(renderDuration).ObserveDuration()
+	q, err := NewQRCode(content, level)
+	if err != nil {
+		return nil, "", err
+	}
+
+	switch format {
+	case "svg":
+		body = QRSVG(q.Bitmap(), size)
+	default:
+		// Output QR Code as a PNG
+		body, err = q.PNG(size)
+		if err != nil {
+			return nil, "", fmt.Errorf("Failed to generate QR: %s", err)
+		}
+	}
+	return
+}
+
+// QRSVG draws the modules in bitmap, which includes the quiet zone, as an SVG that is size pixels across.
+// Each run of dark modules in a row is one rectangle in a single path, so it stays sharp at any scale.
+func QRSVG(bitmap [][]bool, size int) []byte {
+	n := len(bitmap)
+	var b strings.Builder
+	fmt.Fprintf(&b, `<?xml version="1.0" encoding="UTF-8"?>`+"\n")
+	fmt.Fprintf(&b, `<svg xmlns="http://www.w3.org/2000/svg" width="%d" height="%d" viewBox="0 0 %d %d" shape-rendering="crispEdges">`+"\n", size, size, n, n)
+	fmt.Fprintf(&b, `<rect width="%d" height="%d" fill="#fff"/>`+"\n", n, n)
+	b.WriteString(`<path fill="#000" d="`)
+	for y, row := range bitmap {
+		for x := 0; x < len(row); x++ {
+			if !row[x] {
+				continue
+			}
+			start := x
+			for x < len(row) && row[x] {
+				x++
+			}
+			fmt.Fprintf(&b, "M%d %dh%dv1h-%dz", start, y, x-start, x-start)
+		}
+	}
+	b.WriteString(`"/>` + "\n</svg>\n")
+	return []byte(b.String())
+}
+
 /* vim: set noai ts=4 sw=4: */
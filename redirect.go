@@ -0,0 +1,109 @@
+package main
+
+// MIT Licensed - see LICENSE
+
+import (
+	"fmt"
+	"html"
+	"html/template"
+	"net/http"
+	"net/url"
+	"path/filepath"
+	"strconv"
+)
+
+// RedirectModes are the ways a scan can be sent on to its target.  The numbers are the HTTP status used,
+// "interstitial" shows a page with the destination and a countdown before going on.
+var RedirectModes = map[string]bool{
+	"301":          true,
+	"302":          true,
+	"303":          true,
+	"307":          true,
+	"308":          true,
+	"interstitial": true,
+}
+
+// InterstitialData is passed to the interstitial template.
+type InterstitialData struct {
+	ID      string
+	URL     string
+	Domain  string
+	Seconds int
+}
+
+// dfltInterstitial is used if the template in gCfg.Dir can not be read.
+const dfltInterstitial = `<!DOCTYPE html>
+<html lang="en">
+<head>
+<meta charset="utf-8">
+<meta http-equiv="refresh" content="{{.Seconds}};url={{.URL}}">
+<title>Leaving for {{.Domain}}</title>
+</head>
+<body>
+<p>This QR code goes to <strong>{{.Domain}}</strong>, a site that we do not control.</p>
+<p>Check that the address is one you expect before entering any personal information.</p>
+<p>Continuing in {{.Seconds}} seconds: <a href="{{.URL}}">{{.URL}}</a></p>
+</body>
+</html>
+`
+
+// GetRedirectMode returns the redirect mode for id, qr-mode:{id}, or the configured default.
+func GetRedirectMode(id string) string {
+	if mode, err := redisClient.Cmd("GET", fmt.Sprintf("qr-mode:%s", id)).Str(); err == nil && RedirectModes[mode] {
+		return mode
+	}
+	if RedirectModes[gCfg.RedirectMode] {
+		return gCfg.RedirectMode
+	}
+	return "303"
+}
+
+// SaveRedirectMode sets the redirect mode for id.  "" goes back to the configured default.
+func SaveRedirectMode(id, mode string) error {
+	key := fmt.Sprintf("qr-mode:%s", id)
+	if mode == "" {
+		return redisClient.Cmd("DEL", key).Err
+	}
+	return redisClient.Cmd("SET", key, mode).Err
+}
+
+// SendRedirect sends the client on to "to" using mode.
+func SendRedirect(www http.ResponseWriter, req *http.Request, id, to, mode string) {
+	if mode == "interstitial" {
+		SendInterstitial(www, req, id, to)
+		return
+	}
+	status, err := strconv.Atoi(mode)
+	if err != nil {
+		status = http.StatusSeeOther
+	}
+
+	h := www.Header()
+	h.Set("Location", HexEscapeNonASCII(to))
+	h.Set("Content-Type", "text/html; charset=utf-8")
+	www.WriteHeader(status)
+
+	fmt.Fprintf(www, `<center><a href="%s">Redirect To: %s</a></center>`+"\n", html.EscapeString(to), html.EscapeString(to))
+}
+
+// SendInterstitial renders the interstitial page, gCfg.InterstitialTemplate in gCfg.Dir, for a redirect to "to".
+func SendInterstitial(www http.ResponseWriter, req *http.Request, id, to string) {
+	data := InterstitialData{ID: id, URL: to, Domain: to, Seconds: gCfg.InterstitialDelay}
+	if u, err := url.Parse(to); err == nil && u.Host != "" {
+		data.Domain = u.Hostname()
+	}
+
+	t, err := template.ParseFiles(filepath.Join(gCfg.Dir, gCfg.InterstitialTemplate))
+	if err != nil {
+		LogReq(req, LevelError, "unable to read interstitial template", "file", gCfg.InterstitialTemplate, "error", err)
+		t = template.Must(template.New("interstitial").Parse(dfltInterstitial))
+	}
+
+	www.Header().Set("Content-Type", "text/html; charset=utf-8")
+	www.Header().Set("Cache-Control", "no-store")
+	if err := t.Execute(www, data); err != nil {
+		LogReq(req, LevelError, "interstitial template failed", "file", gCfg.InterstitialTemplate, "error", err)
+	}
+}
+
+/* vim: set noai ts=4 sw=4: */
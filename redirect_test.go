@@ -0,0 +1,51 @@
+package main
+
+// MIT Licensed - see LICENSE
+
+import (
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestSendRedirect(t *testing.T) {
+	defer func(dir, tmpl string, delay int) {
+		gCfg.Dir, gCfg.InterstitialTemplate, gCfg.InterstitialDelay = dir, tmpl, delay
+	}(gCfg.Dir, gCfg.InterstitialTemplate, gCfg.InterstitialDelay)
+	gCfg.Dir = "./www"
+	gCfg.InterstitialTemplate = "tmpl/interstitial.html"
+	gCfg.InterstitialDelay = 5
+
+	tests := []struct {
+		mode     string
+		to       string
+		status   int
+		location string
+		body     string
+	}{
+		{"303", "http://example.com/a?b=1&c=2", 303, "http://example.com/a?b=1&c=2", "b=1&amp;c=2"},
+		{"308", "http://example.com/你好", 308, "http://example.com/%e4%bd%a0%e5%a5%bd", ""},
+		{"interstitial", "https://shop.example.com/x?\"><script>", 200, "", "<strong>shop.example.com</strong>"},
+	}
+
+	for ii, test := range tests {
+		req := httptest.NewRequest("GET", "/Q/10001", nil)
+		rec := httptest.NewRecorder()
+		SendRedirect(rec, req, "10001", test.to, test.mode)
+		if rec.Code != test.status {
+			t.Errorf("Test %d, expected status %d got %d\n", ii, test.status, rec.Code)
+		}
+		if got := rec.Header().Get("Location"); got != test.location {
+			t.Errorf("Test %d, expected location %s got %s\n", ii, test.location, got)
+		}
+		body := rec.Body.String()
+		if !strings.Contains(body, test.body) {
+			t.Errorf("Test %d, expected body to contain %s got %s\n", ii, test.body, body)
+		}
+		if strings.Contains(body, "<script>\"") || strings.Contains(body, "\"><script>") {
+			t.Errorf("Test %d, target was not escaped: %s\n", ii, body)
+		}
+	}
+}
+
+/* vim: set noai ts=4 sw=4: */
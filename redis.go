@@ -5,21 +5,47 @@ package main
 import (
 	"fmt"
 	"os"
+	"time"
 
 	"github.com/pschlump/MiscLib"
 	"github.com/pschlump/godebug"
+	"github.com/pschlump/radix.v2/pool"
 	"github.com/pschlump/radix.v2/redis"
 )
 
-// RedisClient makes a connection to the Redis datagbase and returns the client connection and a true/false flag.
+// RedisPool is the pool of connections, with each command timed for /metrics.
+type RedisPool struct {
+	*pool.Pool
+}
+
+// Cmd runs a command on a connection from the pool.
+func (p *RedisPool) Cmd(cmd string, args ...interface{}) *redis.Resp {
+	start := time.Now()
+	resp := p.Pool.Cmd(cmd, args...)
+	redisDuration.WithLabelValues(cmd).Observe(time.Since(start).Seconds())
+	if resp.Err != nil {
+		redisErrors.WithLabelValues(cmd).Inc()
+	}
+	return resp
+}
+
+// RedisClient makes a pool of connections to the Redis datagbase and returns the pool and a true/false flag.
+// A pool is used so that the HTTP handlers and the background workers can issue commands at the same time.
 // If the configuration includes an non-empty RedisConnectAuth then it will also do authenication with the AUTH
 // command in the redis system.
-func RedisClient(dbFlag map[string]bool, gCfg *ConfigType) (client *redis.Client, conFlag bool) {
+func RedisClient(gCfg *ConfigType) (client *RedisPool, conFlag bool) {
 	var err error
-	if dbFlag["RedisClient"] {
-		fmt.Printf("AT: connect to redis with: %s %s\n", godebug.LF(), gCfg.RedisConnectHost+":"+gCfg.RedisConnectPort)
+	var p *pool.Pool
+	logger.Debug("RedisClient", "connect to redis", "addr", gCfg.RedisConnectHost+":"+gCfg.RedisConnectPort)
+	size := gCfg.RedisPoolSize
+	if size <= 0 {
+		size = 1
+	}
+	if gCfg.RedisConnectAuth != "" {
+		p, err = pool.NewAuth("tcp", gCfg.RedisConnectHost+":"+gCfg.RedisConnectPort, size, gCfg.RedisConnectAuth)
+	} else {
+		p, err = pool.New("tcp", gCfg.RedisConnectHost+":"+gCfg.RedisConnectPort, size)
 	}
-	client, err = redis.Dial("tcp", gCfg.RedisConnectHost+":"+gCfg.RedisConnectPort)
 	if err != nil {
 		fmt.Printf("Error on connect to redis:%s, fatal\n", err)
 		fmt.Fprintf(os.Stderr, "%s\n\n\n-----------------------------------------------------------------------------------------------\nError on connect to redis:%s, fatal\n", MiscLib.ColorRed, err)
@@ -27,16 +53,7 @@ func RedisClient(dbFlag map[string]bool, gCfg *ConfigType) (client *redis.Client
 		fmt.Fprintf(os.Stderr, "\n-----------------------------------------------------------------------------------------------\n\n\n%s", MiscLib.ColorReset)
 		os.Exit(1)
 	}
-	if gCfg.RedisConnectAuth != "" {
-		err = client.Cmd("AUTH", gCfg.RedisConnectAuth).Err
-		if err != nil {
-			fmt.Printf("Error on connect to Redis --- Invalid authentication:%s, fatal\n", err)
-			fmt.Fprintf(os.Stderr, "%s\nError on connect to Redis --- Invalid authentication:%s, fatal%s\n\n", MiscLib.ColorRed, err, MiscLib.ColorReset)
-			os.Exit(1)
-		}
-		conFlag = true
-	}
-	conFlag = true
+	client, conFlag = &RedisPool{p}, true
 	return
 }
 
@@ -0,0 +1,33 @@
+package main
+
+// MIT Licensed - see LICENSE
+
+import (
+	"testing"
+
+	"github.com/alicebob/miniredis/v2"
+	"github.com/pschlump/radix.v2/pool"
+)
+
+// testRedis points redisClient at an in-memory Redis.  Call the returned func, with defer, to put
+// redisClient back when the test is done.
+func testRedis(t *testing.T) (*miniredis.Miniredis, func()) {
+	mr, err := miniredis.Run()
+	if err != nil {
+		t.Fatalf("miniredis: %s\n", err)
+	}
+	p, err := pool.New("tcp", mr.Addr(), 2)
+	if err != nil {
+		mr.Close()
+		t.Fatalf("pool: %s\n", err)
+	}
+	old := redisClient
+	redisClient = &RedisPool{p}
+	return mr, func() {
+		redisClient.Empty()
+		redisClient = old
+		mr.Close()
+	}
+}
+
+/* vim: set noai ts=4 sw=4: */
@@ -0,0 +1,375 @@
+package main
+
+// MIT Licensed - see LICENSE
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pschlump/json"
+)
+
+// Re-rendering.
+//
+// The images are made once, when a QR is created, so a change to the host, size or level in the config
+// leaves the old ones encoding the old values.  A rerender job walks every ID and makes the image again
+// from the config, writing it only if it is not the same as the file.  What each image was made from is
+// kept in qr-render:{id} so the diff can say what changed.  The job walks the numbered IDs by number
+// then the slugs by SSCAN of qr-slug-ids, saving its place in qr-job:{job_id} every rerenderChunk IDs,
+// and carries on from there if it is run again after a restart.  QRs made or deleted in between do not
+// move it.  The diffs are kept in the hash qr-rerender:{job_id}, by ID so an image checked again after
+// a restart is only listed once, and saved as the job's file when it is done.
+
+const rerenderChunk = 100
+
+// RenderSpec is what an image is made from.
+type RenderSpec struct {
+	URI   string `json:"uri"`
+	Size  int    `json:"size"`
+	Level string `json:"level"`
+}
+
+// RenderDiff is an image that is not what the config would make now.  Changes lists which of uri, size
+// and level are different, "missing" if there is no image, or "image" if the image is different and what
+// it was made from is not known.
+type RenderDiff struct {
+	ID      string      `json:"id"`
+	Changes []string    `json:"changes"`
+	Old     *RenderSpec `json:"old,omitempty"`
+	New     RenderSpec  `json:"new"`
+}
+
+// RerenderJob is the params of a rerender job.
+type RerenderJob struct {
+	DryRun bool `json:"dry_run"` // only work out the diff
+}
+
+// RerenderResult is the result of a rerender job.
+type RerenderResult struct {
+	DryRun  bool `json:"dry_run"`
+	Checked int  `json:"checked"`
+	Changed int  `json:"changed"`
+	Failed  int  `json:"failed"`
+}
+
+// CurrentRenderSpec is what the image for id would be made from with the current config.
+func CurrentRenderSpec(id string) RenderSpec {
+	return RenderSpec{URI: QRContent(id), Size: gCfg.QRSize, Level: gCfg.Level}
+}
+
+// SaveRenderSpec records what the image for id was made from.
+func SaveRenderSpec(id string, spec RenderSpec) {
+	redisClient.Cmd("SET", fmt.Sprintf("qr-render:%s", id), SVar(spec))
+}
+
+// GetRenderSpec returns what the image for id was made from, nil if that is not known.
+func GetRenderSpec(id string) *RenderSpec {
+	s, err := redisClient.Cmd("GET", fmt.Sprintf("qr-render:%s", id)).Str()
+	if err != nil {
+		return nil
+	}
+	var spec RenderSpec
+	if json.Unmarshal([]byte(s), &spec) != nil {
+		return nil
+	}
+	return &spec
+}
+
+// DiffRender makes the image for id from spec, what the current config gives, and compares it to file,
+// the image there is now (nil if there is none), made from old (nil if not known).  diff.Changes is empty
+// if they are the same.
+func DiffRender(id string, spec RenderSpec, old *RenderSpec, file []byte) (diff RenderDiff, png []byte, err error) {
+	diff = RenderDiff{ID: id, Changes: []string{}, Old: old, New: spec}
+	if png, err = RenderQR(diff.New.URI, diff.New.Level, diff.New.Size); err != nil {
+		return
+	}
+	switch {
+	case file == nil:
+		diff.Changes = append(diff.Changes, "missing")
+	case bytes.Equal(file, png):
+	case old != nil:
+		if old.URI != diff.New.URI {
+			diff.Changes = append(diff.Changes, "uri")
+		}
+		if old.Size != diff.New.Size {
+			diff.Changes = append(diff.Changes, "size")
+		}
+		if QRLevels[strings.ToLower(old.Level)] != QRLevels[strings.ToLower(diff.New.Level)] {
+			diff.Changes = append(diff.Changes, "level")
+		}
+		if len(diff.Changes) == 0 {
+			diff.Changes = append(diff.Changes, "image")
+		}
+	default:
+		diff.Changes = append(diff.Changes, "image")
+	}
+	return
+}
+
+// Rerender checks the image for id and, unless dryRun, writes it if it has changed.  ok is false if the
+// QR has been deleted.
+func Rerender(id string, dryRun bool) (diff RenderDiff, ok bool, err error) {
+	if _, err := redisClient.Cmd("GET", fmt.Sprintf("qrr:%s", id)).Str(); err != nil {
+		return diff, false, nil
+	}
+	pth := filepath.Join(gCfg.QRDir, id+".png")
+	file, err := ioutil.ReadFile(pth)
+	if err != nil && !os.IsNotExist(err) {
+		return diff, true, err
+	}
+	diff, png, err := DiffRender(id, CurrentRenderSpec(id), GetRenderSpec(id), file)
+	if err != nil || dryRun {
+		return diff, true, err
+	}
+	if len(diff.Changes) > 0 {
+		// Write then rename so a scan of the image never gets half a file.
+		tmp := pth + ".tmp"
+		if err = ioutil.WriteFile(tmp, png, 0644); err != nil {
+			return diff, true, err
+		}
+		if err = os.Rename(tmp, pth); err != nil {
+			return diff, true, err
+		}
+	}
+	if len(diff.Changes) > 0 || diff.Old == nil {
+		SaveRenderSpec(id, diff.New)
+	}
+	return diff, true, nil
+}
+
+// rerenderBatch returns the next IDs for the job and the fields of qr-job:{job_id} that save the place
+// after them, pos is nil once every QR has been checked.  cursor is the next numbered ID, slug_cursor the
+// SSCAN cursor of qr-slug-ids and slugs_done is set when the scan has come back to 0.
+func rerenderBatch(job *Job) (ids []string, pos []interface{}, err error) {
+	mm, err := redisClient.Cmd("HGETALL", fmt.Sprintf("qr-job:%s", job.JobID)).Map()
+	if err != nil {
+		return nil, nil, err
+	}
+	last, err := redisClient.Cmd("GET", "qr-id:").Int()
+	if err != nil {
+		return nil, nil, err
+	}
+	next, _ := strconv.Atoi(mm["cursor"])
+	if next < 10001 { // IDs start at 10001, see CheckSetup.
+		next = 10001
+	}
+	if next <= last {
+		end := next + rerenderChunk
+		if end > last+1 {
+			end = last + 1
+		}
+		for id := next; id < end; id++ {
+			ids = append(ids, strconv.Itoa(id))
+		}
+		return ids, []interface{}{"cursor", end}, nil
+	}
+	if mm["slugs_done"] == "1" {
+		return nil, nil, nil
+	}
+	cur := mm["slug_cursor"]
+	if cur == "" {
+		cur = "0"
+	}
+	arr, err := redisClient.Cmd("SSCAN", "qr-slug-ids", cur, "COUNT", rerenderChunk).Array()
+	if err != nil {
+		return nil, nil, err
+	}
+	if len(arr) != 2 {
+		return nil, nil, fmt.Errorf("Invalid SSCAN reply")
+	}
+	if cur, err = arr[0].Str(); err != nil {
+		return nil, nil, err
+	}
+	if ids, err = arr[1].List(); err != nil {
+		return nil, nil, err
+	}
+	pos = []interface{}{"slug_cursor", cur}
+	if cur == "0" {
+		pos = append(pos, "slugs_done", 1)
+	}
+	return ids, pos, nil
+}
+
+// RerenderDiffs returns the diffs of a rerender job as JSON, the numbered IDs in order then the slugs.
+func RerenderDiffs(jid string) []string {
+	mm, _ := redisClient.Cmd("HGETALL", fmt.Sprintf("qr-rerender:%s", jid)).Map()
+	ids := make([]string, 0, len(mm))
+	for id := range mm {
+		ids = append(ids, id)
+	}
+	sort.Slice(ids, func(i, j int) bool {
+		ni, ei := strconv.Atoi(ids[i])
+		nj, ej := strconv.Atoi(ids[j])
+		switch {
+		case ei == nil && ej == nil:
+			return ni < nj
+		case ei == nil || ej == nil:
+			return ei == nil
+		}
+		return ids[i] < ids[j]
+	})
+	diffs := make([]string, len(ids))
+	for ii, id := range ids {
+		diffs[ii] = mm[id]
+	}
+	return diffs
+}
+
+func runRerenderJob(job *Job) (result interface{}, err error) {
+	var rj RerenderJob
+	if err = json.Unmarshal([]byte(job.Params), &rj); err != nil {
+		return nil, err
+	}
+	dkey := fmt.Sprintf("qr-rerender:%s", job.JobID)
+	st, _ := GetJobStatus(job.JobID)
+	checked, failed := st.Done, st.Failed
+
+	nWorkers := gCfg.RenderWorkers
+	if nWorkers < 1 {
+		nWorkers = 1
+	}
+	for !job.Canceled() {
+		ids, pos, err := rerenderBatch(job)
+		if err != nil {
+			return nil, err
+		}
+		if pos == nil {
+			break
+		}
+		var lock sync.Mutex
+		var wg sync.WaitGroup
+		work := make(chan string)
+		for w := 0; w < nWorkers; w++ {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				for id := range work {
+					diff, ok, err := Rerender(id, rj.DryRun)
+					if err != nil {
+						logger.Error("rerender failed", "qr_id", id, "error", err)
+						lock.Lock()
+						failed++
+						lock.Unlock()
+					} else if ok && len(diff.Changes) > 0 {
+						redisClient.Cmd("HSET", dkey, id, SVar(diff))
+					}
+				}
+			}()
+		}
+		for _, id := range ids {
+			work <- id
+		}
+		close(work)
+		wg.Wait()
+
+		checked += len(ids)
+		redisClient.Cmd("HMSET", append([]interface{}{fmt.Sprintf("qr-job:%s", job.JobID)}, pos...)...)
+		last, _ := redisClient.Cmd("GET", "qr-id:").Int()
+		nSlugs, _ := redisClient.Cmd("SCARD", "qr-slug-ids").Int()
+		total := last - 10000 + nSlugs
+		if checked > total {
+			total = checked
+		}
+		job.Progress(checked, failed, total)
+	}
+
+	diffs := RerenderDiffs(job.JobID)
+	redisClient.Cmd("EXPIRE", dkey, gCfg.JobRetain)
+	name := "rerender"
+	if rj.DryRun {
+		name = "rerender-dry-run"
+	}
+	body := "[" + strings.Join(diffs, ",") + "]\n"
+	if err = job.SaveFile(fmt.Sprintf("qr-%s-%s.json", name, time.Now().UTC().Format("20060102-150405")), "application/json; charset=utf-8", []byte(body)); err != nil {
+		return nil, err
+	}
+	return RerenderResult{DryRun: rj.DryRun, Checked: checked, Changed: len(diffs), Failed: failed}, nil
+}
+
+/*
+/api/rerender?dry_run=true|false - queues a job that makes every image again from the current host, size
+and level, writing the ones that have changed.  With dry_run=true nothing is written.  The list of images
+that change is downloaded from /api/job-result when the job is done.  Admin only.
+*/
+func respHandlerRerender(www http.ResponseWriter, req *http.Request) {
+	if !CheckAuth(www, req) {
+		return
+	}
+	if !IsAdmin(req) {
+		AnError(www, req, 403, "Admin only")
+		return
+	}
+
+	dryRun := GetParam(www, req, "dry_run", "false") == "true"
+	jid, err := EnqueueJob("", "rerender", RerenderJob{DryRun: dryRun}, AuthUser(req))
+	if err != nil {
+		AnError(www, req, 500, "Config Error 35")
+		return
+	}
+
+	www.Header().Set("Content-Type", "application/json; charset=utf-8")
+	fmt.Fprintf(www, `{"status":"success","job_id":%q,"dry_run":%v,"status_url":"/api/job-status?job_id=%s","result_url":"/api/job-result?job_id=%s"}`+"\n",
+		jid, dryRun, jid, jid)
+}
+
+// RerenderCLI runs a rerender job from the command line, --rerender.  If resume is a job ID that job is
+// carried on from where it stopped.  The diff is written to stdout.
+func RerenderCLI(dryRun bool, resume string) error {
+	jid := resume
+	if jid != "" {
+		st, err := GetJobStatus(jid)
+		if err != nil || st.Kind != "rerender" {
+			return fmt.Errorf("No rerender job %s", jid)
+		}
+		if st.IsFinished() {
+			return fmt.Errorf("Job %s is already %s", jid, st.State)
+		}
+	} else {
+		var err error
+		if jid, err = CreateJob("", "rerender", RerenderJob{DryRun: dryRun}, "cli"); err != nil {
+			return err
+		}
+	}
+	fmt.Fprintf(os.Stderr, "Job %s, use --rerender-resume %s to carry on if this is stopped\n", jid, jid)
+
+	fin := make(chan bool)
+	go func() {
+		for {
+			select {
+			case <-fin:
+				return
+			case <-time.After(time.Second):
+				if st, err := GetJobStatus(jid); err == nil {
+					fmt.Fprintf(os.Stderr, "\r%d of %d checked, %d failed", st.Done, st.Total, st.Failed)
+				}
+			}
+		}
+	}()
+	RunJob(jid)
+	close(fin)
+	fmt.Fprintf(os.Stderr, "\n")
+
+	st, err := GetJobStatus(jid)
+	if err != nil {
+		return err
+	}
+	if st.State != "done" {
+		return fmt.Errorf("Job %s %s %s", jid, st.State, st.Error)
+	}
+	for _, s := range RerenderDiffs(jid) {
+		fmt.Println(s)
+	}
+	fmt.Fprintf(os.Stderr, "%s\n", st.Result)
+	return nil
+}
+
+/* vim: set noai ts=4 sw=4: */
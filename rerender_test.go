@@ -0,0 +1,116 @@
+package main
+
+// MIT Licensed - see LICENSE
+
+import (
+	"io/ioutil"
+	"os"
+	"reflect"
+	"testing"
+
+	"github.com/pschlump/json"
+)
+
+func TestDiffRender(t *testing.T) {
+	cur, err := RenderQR("http://qr.example.com/Q/10001", "H", 128)
+	if err != nil {
+		t.Fatalf("RenderQR: %s\n", err)
+	}
+	now := RenderSpec{URI: "http://qr.example.com/Q/10001", Size: 128, Level: "H"}
+
+	tests := []struct {
+		old      *RenderSpec
+		file     []byte
+		expected []string
+	}{
+		{nil, nil, []string{"missing"}},
+		{nil, cur, []string{}},
+		{&now, cur, []string{}},
+		{nil, []byte("old"), []string{"image"}},
+		{&RenderSpec{URI: "http://localhost:8333/Q/10001", Size: 256, Level: "h"}, []byte("old"), []string{"uri", "size"}},
+		{&RenderSpec{URI: "http://qr.example.com/Q/10001", Size: 128, Level: "M"}, []byte("old"), []string{"level"}},
+		{&now, []byte("old"), []string{"image"}},
+	}
+
+	for ii, test := range tests {
+		diff, png, err := DiffRender("10001", now, test.old, test.file)
+		if err != nil {
+			t.Errorf("Test %d, error %s\n", ii, err)
+			continue
+		}
+		if !reflect.DeepEqual(diff.Changes, test.expected) {
+			t.Errorf("Test %d, expected %s got %s\n", ii, SVar(test.expected), SVar(diff.Changes))
+		}
+		if diff.New != now || string(png) != string(cur) {
+			t.Errorf("Test %d, expected the image for %s\n", ii, SVar(now))
+		}
+	}
+}
+
+func TestRerenderJob(t *testing.T) {
+	_, done := testRedis(t)
+	defer done()
+	dir, err := ioutil.TempDir("", "rerender")
+	if err != nil {
+		t.Fatalf("TempDir: %s\n", err)
+	}
+	defer os.RemoveAll(dir)
+	defer func(d, l string, n, r int) {
+		gCfg.QRDir, gCfg.Level, gCfg.QRSize, gCfg.JobRetain = d, l, n, r
+	}(gCfg.QRDir, gCfg.Level, gCfg.QRSize, gCfg.JobRetain)
+	gCfg.QRDir, gCfg.Level, gCfg.QRSize, gCfg.JobRetain = dir, "M", 128, 3600
+
+	redisClient.Cmd("SET", "qr-id:", 10003)
+	redisClient.Cmd("MSET", "qrr:10001", "http://a.example.com/", "qrr:10003", "http://c.example.com/", "qrr:promo", "http://p.example.com/")
+	redisClient.Cmd("SADD", "qr-slug-ids", "promo")
+
+	tests := []struct {
+		cursor  int    // saved position to carry on from, 0 to start
+		done    int    // checked before the restart
+		checked int    // in the result
+		diffs   string // IDs in the job's diff
+	}{
+		{cursor: 0, done: 0, checked: 4, diffs: "10001,10003,promo"}, // 10002 is checked, it has been deleted
+		{cursor: 10003, done: 2, checked: 4, diffs: "10003,promo"},
+		{cursor: 10004, done: 3, checked: 4, diffs: "promo"},
+	}
+	for ii, test := range tests {
+		jid, err := CreateJob("", "rerender", RerenderJob{DryRun: true}, "cli")
+		if err != nil {
+			t.Fatalf("CreateJob: %s\n", err)
+		}
+		if test.cursor > 0 {
+			redisClient.Cmd("HMSET", "qr-job:"+jid, "cursor", test.cursor, "done", test.done)
+		}
+		job := &Job{JobID: jid, Kind: "rerender", Params: SVar(RerenderJob{DryRun: true})}
+		rv, err := runRerenderJob(job)
+		if err != nil {
+			t.Errorf("Test %d, error %s\n", ii, err)
+			continue
+		}
+		if rr := rv.(RerenderResult); rr.Checked != test.checked {
+			t.Errorf("Test %d, expected %d checked got %d\n", ii, test.checked, rr.Checked)
+		}
+		got := ""
+		for _, s := range RerenderDiffs(jid) {
+			var d RenderDiff
+			json.Unmarshal([]byte(s), &d)
+			if got != "" {
+				got += ","
+			}
+			got += d.ID
+		}
+		if got != test.diffs {
+			t.Errorf("Test %d, expected diffs for %s got %s\n", ii, test.diffs, got)
+		}
+
+		// Run again from the start, as after a restart, each ID is still listed once.
+		redisClient.Cmd("HDEL", "qr-job:"+jid, "cursor", "slug_cursor", "slugs_done")
+		runRerenderJob(job)
+		if n, _ := redisClient.Cmd("HLEN", "qr-rerender:"+jid).Int(); n != 3 {
+			t.Errorf("Test %d, expected 3 diffs after running again got %d\n", ii, n)
+		}
+	}
+}
+
+/* vim: set noai ts=4 sw=4: */
@@ -0,0 +1,344 @@
+package main
+
+// MIT Licensed - see LICENSE
+
+import (
+	"fmt"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/pschlump/json"
+)
+
+// RouteRule sends a scan to URL when the request matches.  Every condition that is set must match; inside
+// a condition any one of the values will do.  The rules for a QR are an ordered list in qr-route:{id},
+// the first match wins, and if none match the target is picked as in SelectTarget.
+type RouteRule struct {
+	OS      []string          `json:"os,omitempty"`      // ios, android, windows, macos, chromeos, linux, other
+	Device  []string          `json:"device,omitempty"`  // mobile, tablet, desktop
+	Lang    []string          `json:"lang,omitempty"`    // language tags, "fr" also matches "fr-CA"
+	Country []string          `json:"country,omitempty"` // ISO 3166 two letter codes
+	Param   map[string]string `json:"param,omitempty"`   // query parameters that must have this value, "*" for any value
+	URL     string            `json:"url"`
+}
+
+// ClientInfo is what the rules match against.
+type ClientInfo struct {
+	OS      string     `json:"os"`
+	Device  string     `json:"device"`
+	Lang    string     `json:"lang"`            // the client's most preferred language
+	Langs   []string   `json:"langs,omitempty"` // all of the client's languages, most preferred first
+	Country string     `json:"country"`
+	Query   url.Values `json:"query"`
+}
+
+// GetClientInfo pulls the OS and device out of the User-Agent, the language out of Accept-Language and the
+// country out of the header set by the proxy in front of us (gCfg.CountryHeader).
+func GetClientInfo(req *http.Request) (ci ClientInfo) {
+	ci.OS, ci.Device = ParseUserAgent(req.UserAgent())
+	ci.Langs = AcceptLangs(req.Header.Get("Accept-Language"))
+	if len(ci.Langs) > 0 {
+		ci.Lang = ci.Langs[0]
+	}
+	if gCfg.CountryHeader != "" {
+		ci.Country = strings.ToUpper(strings.TrimSpace(req.Header.Get(gCfg.CountryHeader)))
+	}
+	ci.Query = req.URL.Query()
+	return
+}
+
+// ParseUserAgent returns the OS and kind of device from a User-Agent string.
+func ParseUserAgent(ua string) (os, device string) {
+	switch {
+	case strings.Contains(ua, "iPhone") || strings.Contains(ua, "iPad") || strings.Contains(ua, "iPod"):
+		os = "ios"
+	case strings.Contains(ua, "Android"):
+		os = "android"
+	case strings.Contains(ua, "Windows"):
+		os = "windows"
+	case strings.Contains(ua, "CrOS"):
+		os = "chromeos"
+	case strings.Contains(ua, "Macintosh") || strings.Contains(ua, "Mac OS X"):
+		os = "macos"
+	case strings.Contains(ua, "Linux"):
+		os = "linux"
+	default:
+		os = "other"
+	}
+	switch {
+	case strings.Contains(ua, "iPad") || strings.Contains(ua, "Tablet") || (os == "android" && !strings.Contains(ua, "Mobile")):
+		device = "tablet"
+	case strings.Contains(ua, "Mobi") || os == "ios" || os == "android":
+		device = "mobile"
+	default:
+		device = "desktop"
+	}
+	return
+}
+
+// AcceptLangs returns the languages in an Accept-Language header, lower cased, highest q value first.
+// Languages with q=0 are left out.
+func AcceptLangs(al string) []string {
+	type langQ struct {
+		lang string
+		q    float64
+	}
+	var langs []langQ
+	for _, part := range strings.Split(al, ",") {
+		fields := strings.Split(strings.TrimSpace(part), ";")
+		lang := strings.ToLower(strings.TrimSpace(fields[0]))
+		if lang == "" || lang == "*" {
+			continue
+		}
+		q := 1.0
+		for _, f := range fields[1:] {
+			f = strings.TrimSpace(f)
+			if strings.HasPrefix(f, "q=") {
+				if v, err := strconv.ParseFloat(f[2:], 64); err == nil {
+					q = v
+				}
+			}
+		}
+		if q > 0 {
+			langs = append(langs, langQ{lang, q})
+		}
+	}
+	sort.SliceStable(langs, func(i, j int) bool { return langs[i].q > langs[j].q })
+	rv := make([]string, 0, len(langs))
+	for _, l := range langs {
+		rv = append(rv, l.lang)
+	}
+	return rv
+}
+
+func matchAny(vals []string, v string) bool {
+	if len(vals) == 0 {
+		return true
+	}
+	for _, x := range vals {
+		if strings.EqualFold(x, v) {
+			return true
+		}
+	}
+	return false
+}
+
+func matchLang(vals []string, lang string) bool {
+	if len(vals) == 0 {
+		return true
+	}
+	for _, x := range vals {
+		x = strings.ToLower(x)
+		if lang == x || strings.HasPrefix(lang, x+"-") {
+			return true
+		}
+	}
+	return false
+}
+
+// Match is true if every condition set in the rule matches ci.
+func (rr *RouteRule) Match(ci ClientInfo) bool {
+	if !matchAny(rr.OS, ci.OS) || !matchAny(rr.Device, ci.Device) || !matchAny(rr.Country, ci.Country) || !matchLang(rr.Lang, ci.Lang) {
+		return false
+	}
+	for name, want := range rr.Param {
+		got, ok := ci.Query[name]
+		if !ok || (want != "*" && (len(got) == 0 || got[0] != want)) {
+			return false
+		}
+	}
+	return true
+}
+
+// MatchRoute returns the index of the first rule that matches ci, or -1.  The client's languages are
+// tried in order of preference, so "de, fr;q=0.8" goes to a "fr" rule when there is no "de" one.
+func MatchRoute(rules []RouteRule, ci ClientInfo) int {
+	langs := ci.Langs
+	if len(langs) == 0 {
+		langs = []string{ci.Lang}
+	}
+	for _, lang := range langs {
+		ci.Lang = lang
+		for ii := range rules {
+			if rules[ii].Match(ci) {
+				return ii
+			}
+		}
+	}
+	return -1
+}
+
+// ValidateRouteRules checks a list of rules.
+func ValidateRouteRules(rules []RouteRule) error {
+	for ii, rr := range rules {
+		if rr.URL == "" {
+			return fmt.Errorf("Rule %d: missing url", ii)
+		}
+		for _, d := range rr.Device {
+			if d != "mobile" && d != "tablet" && d != "desktop" {
+				return fmt.Errorf("Rule %d: invalid device %q", ii, d)
+			}
+		}
+	}
+	return nil
+}
+
+// GetRouteRules returns the routing rules for id.
+func GetRouteRules(id string) (rules []RouteRule, err error) {
+	s, err := redisClient.Cmd("GET", fmt.Sprintf("qr-route:%s", id)).Str()
+	if err != nil {
+		return nil, err
+	}
+	err = json.Unmarshal([]byte(s), &rules)
+	return
+}
+
+// RoutedTarget returns the target of the first rule for id that matches req.
+func RoutedTarget(id string, req *http.Request) (string, bool) {
+	rules, err := GetRouteRules(id)
+	if err != nil || len(rules) == 0 {
+		return "", false
+	}
+	if ii := MatchRoute(rules, GetClientInfo(req)); ii >= 0 {
+		return rules[ii].URL, true
+	}
+	return "", false
+}
+
+/*
+/api/set-route?id=ID&rules=[{"os":["ios"],"url":"https://apps.apple.com/..."},{"lang":["fr"],"url":"..."}]
+An empty rules list, [], removes them.
+*/
+func respHandlerSetRoute(www http.ResponseWriter, req *http.Request) {
+	if !CheckAuth(www, req) {
+		return
+	}
+
+	id := GetParam(www, req, "id", "")
+	if id == "" {
+		AnError(www, req, 406, "Missing Parameter")
+		return
+	}
+	sRules := GetParam(www, req, "rules", "")
+	if sRules == "" {
+		AnError(www, req, 406, "Missing Parameter")
+		return
+	}
+
+	var rules []RouteRule
+	if err := json.Unmarshal([]byte(sRules), &rules); err != nil {
+		AnError(www, req, 406, fmt.Sprintf("Invalid rules: %s", err))
+		return
+	}
+	if err := ValidateRouteRules(rules); err != nil {
+		AnError(www, req, 406, err.Error())
+		return
+	}
+	var vv Validator
+	for ii := range rules {
+		vv.URL(fmt.Sprintf("rules[%d].url", ii), &rules[ii].URL)
+	}
+	if vv.Send(www, req) {
+		return
+	}
+
+	if _, err := redisClient.Cmd("GET", fmt.Sprintf("qrr:%s", id)).Str(); err != nil {
+		AnError(www, req, 404, "Not Found")
+		return
+	}
+
+	key := fmt.Sprintf("qr-route:%s", id)
+	if len(rules) == 0 {
+		redisClient.Cmd("DEL", key)
+	} else {
+		err := redisClient.Cmd("SET", key, SVar(rules)).Err
+		if err != nil {
+			AnError(www, req, 500, "Config Error 22")
+			return
+		}
+	}
+
+	Quarantine(id, AuthUser(req), vv.Threats)
+
+	www.Header().Set("Content-Type", "application/json; charset=utf-8")
+	fmt.Fprintf(www, `{"status":"success","rules":%s,"quarantined":%d}`+"\n", SVar(rules), len(vv.Threats))
+}
+
+/*
+/api/get-route?id=ID
+*/
+func respHandlerGetRoute(www http.ResponseWriter, req *http.Request) {
+	if !CheckAuth(www, req) {
+		return
+	}
+
+	id := GetParam(www, req, "id", "")
+	if id == "" {
+		AnError(www, req, 406, "Missing Parameter")
+		return
+	}
+
+	rules, err := GetRouteRules(id)
+	if err != nil {
+		rules = []RouteRule{}
+	}
+
+	www.Header().Set("Content-Type", "application/json; charset=utf-8")
+	fmt.Fprintf(www, `{"status":"success","rules":%s}`+"\n", SVar(rules))
+}
+
+/*
+/api/route-test?id=ID[&ua=UA&lang=LANG&country=CC&query=a%3D1] - dry run of the rules.  Without the optional
+parameters the headers of this request are used, country needs country_header to be set.  Returns the rule
+that would be used (-1 for none) and the target as SelectTarget picks it, with the schedule and split after the rules.
+*/
+func respHandlerRouteTest(www http.ResponseWriter, req *http.Request) {
+	if !CheckAuth(www, req) {
+		return
+	}
+
+	id := GetParam(www, req, "id", "")
+	if id == "" {
+		AnError(www, req, 406, "Missing Parameter")
+		return
+	}
+
+	to, err := redisClient.Cmd("GET", fmt.Sprintf("qrr:%s", id)).Str()
+	if err != nil {
+		AnError(www, req, 404, "Not Found")
+		return
+	}
+
+	// The dry run is a copy of this request with the headers and query that a scan would have.
+	treq := req.WithContext(req.Context())
+	treq.Header = req.Header.Clone()
+	treq.URL = &url.URL{Path: "/q/" + id}
+	if ua := GetParam(www, req, "ua", ""); ua != "" {
+		treq.Header.Set("User-Agent", ua)
+	}
+	if lang := GetParam(www, req, "lang", ""); lang != "" {
+		treq.Header.Set("Accept-Language", lang)
+	}
+	if country := GetParam(www, req, "country", ""); country != "" && gCfg.CountryHeader != "" {
+		treq.Header.Set(gCfg.CountryHeader, country)
+	}
+	query := GetParam(www, req, "query", "")
+	if _, err := url.ParseQuery(query); err != nil {
+		AnError(www, req, 406, fmt.Sprintf("Invalid query: %s", err))
+		return
+	}
+	treq.URL.RawQuery = query
+
+	ci := GetClientInfo(treq)
+	rules, _ := GetRouteRules(id)
+	ii := MatchRoute(rules, ci)
+	to, variant := SelectTarget(id, to, treq, timeNow())
+
+	www.Header().Set("Content-Type", "application/json; charset=utf-8")
+	fmt.Fprintf(www, `{"status":"success","rule":%d,"url":%q,"variant":%q,"client":%s}`+"\n", ii, to, variant, SVar(ci))
+}
+
+/* vim: set noai ts=4 sw=4: */
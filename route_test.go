@@ -0,0 +1,111 @@
+package main
+
+// MIT Licensed - see LICENSE
+
+import (
+	"net/http/httptest"
+	"net/url"
+	"testing"
+
+	"github.com/pschlump/json"
+)
+
+func TestMatchRoute(t *testing.T) {
+	rules := []RouteRule{
+		{OS: []string{"ios"}, URL: "https://apps.apple.com/app"},
+		{OS: []string{"android"}, URL: "https://play.google.com/app"},
+		{Lang: []string{"fr"}, Country: []string{"CA"}, URL: "https://example.com/fr-ca"},
+		{Lang: []string{"fr"}, URL: "https://example.com/fr"},
+		{Param: map[string]string{"src": "*"}, URL: "https://example.com/src"},
+	}
+
+	iphone := "Mozilla/5.0 (iPhone; CPU iPhone OS 17_0 like Mac OS X) AppleWebKit/605.1.15 Mobile/15E148"
+	pixel := "Mozilla/5.0 (Linux; Android 14; Pixel 8) AppleWebKit/537.36 Chrome/120.0 Mobile Safari/537.36"
+	desktop := "Mozilla/5.0 (Windows NT 10.0; Win64; x64) AppleWebKit/537.36 Chrome/120.0 Safari/537.36"
+
+	tests := []struct {
+		ua       string
+		lang     string
+		country  string
+		query    string
+		expected int
+	}{
+		{iphone, "en-US", "US", "", 0},
+		{pixel, "fr-FR", "FR", "", 1},
+		{desktop, "fr-CA,en;q=0.8", "CA", "", 2},
+		{desktop, "en;q=0.5,fr-FR", "FR", "", 3},
+		{desktop, "de-DE,fr;q=0.8", "FR", "", 3},
+		{desktop, "de-DE,en;q=0.9,fr-CA;q=0.8", "CA", "", 2},
+		{desktop, "de-DE,fr;q=0", "FR", "", -1},
+		{desktop, "en-US", "US", "src=flyer", 4},
+		{desktop, "en-US", "US", "other=1", -1},
+	}
+
+	for ii, test := range tests {
+		var ci ClientInfo
+		ci.OS, ci.Device = ParseUserAgent(test.ua)
+		ci.Langs = AcceptLangs(test.lang)
+		ci.Country = test.country
+		ci.Query, _ = url.ParseQuery(test.query)
+		got := MatchRoute(rules, ci)
+		if got != test.expected {
+			t.Errorf("Test %d, expected rule %d got %d for %s\n", ii, test.expected, got, SVar(ci))
+		}
+	}
+}
+
+func TestRouteTestHandler(t *testing.T) {
+	_, done := testRedis(t)
+	defer done()
+
+	redisClient.Cmd("MSET", "qr-token:tok", "bob", "qrr:10001", "https://example.com/")
+	redisClient.Cmd("SET", "qr-route:10001", SVar([]RouteRule{{Lang: []string{"fr"}, URL: "https://example.com/fr"}}))
+	SaveSplit("10001", []SplitVariant{{Name: "b", URL: "https://example.com/b", Weight: 1}})
+
+	tests := []struct {
+		lang    string
+		rule    int
+		url     string
+		variant string
+	}{
+		{lang: "fr-CA", rule: 0, url: "https://example.com/fr"},
+		{lang: "de,fr;q=0.5", rule: 0, url: "https://example.com/fr"},
+		{lang: "de", rule: -1, url: "https://example.com/b", variant: "b"},
+	}
+	for ii, test := range tests {
+		req := httptest.NewRequest("GET", "/api/route-test?id=10001&lang="+url.QueryEscape(test.lang), nil)
+		req.Header.Set("X-Auth", "tok")
+		rec := httptest.NewRecorder()
+		respHandlerRouteTest(rec, req)
+		var rv struct {
+			Rule    int    `json:"rule"`
+			URL     string `json:"url"`
+			Variant string `json:"variant"`
+		}
+		json.Unmarshal(rec.Body.Bytes(), &rv)
+		if rec.Code != 200 || rv.Rule != test.rule || rv.URL != test.url || rv.Variant != test.variant {
+			t.Errorf("Test %d, expected rule %d %s %q got %d %s\n", ii, test.rule, test.url, test.variant, rec.Code, rec.Body.String())
+		}
+	}
+}
+
+func TestParseUserAgent(t *testing.T) {
+	tests := []struct {
+		ua     string
+		os     string
+		device string
+	}{
+		{"Mozilla/5.0 (iPad; CPU OS 16_0 like Mac OS X) AppleWebKit/605.1.15", "ios", "tablet"},
+		{"Mozilla/5.0 (Linux; Android 13; SM-X200) AppleWebKit/537.36 Chrome/120.0 Safari/537.36", "android", "tablet"},
+		{"Mozilla/5.0 (Macintosh; Intel Mac OS X 10_15_7) AppleWebKit/605.1.15 Safari/605.1.15", "macos", "desktop"},
+		{"curl/8.0", "other", "desktop"},
+	}
+	for ii, test := range tests {
+		os, device := ParseUserAgent(test.ua)
+		if os != test.os || device != test.device {
+			t.Errorf("Test %d, expected %s/%s got %s/%s\n", ii, test.os, test.device, os, device)
+		}
+	}
+}
+
+/* vim: set noai ts=4 sw=4: */
@@ -0,0 +1,209 @@
+package main
+
+// MIT Licensed - see LICENSE
+
+import (
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/pschlump/json"
+)
+
+// timeNow is the clock used to pick the active target.  Tests replace it.
+var timeNow = time.Now
+
+// ScheduleWindow sends scans between Start and End to URL.  Start and End are in the schedule's time
+// zone unless they carry their own offset (RFC 3339).  An empty Start or End leaves that side open.
+type ScheduleWindow struct {
+	Start string `json:"start,omitempty"`
+	End   string `json:"end,omitempty"`
+	URL   string `json:"url"`
+
+	start, end time.Time
+}
+
+// ScheduleType is the time windowed set of targets for a QR, kept in qr-sched:{id}.  The first window
+// that contains the current time wins.  If none do then Default is used, and if that is empty then
+// the regular target in qrr:{id}.
+type ScheduleType struct {
+	TZ      string           `json:"tz,omitempty"` // IANA name, e.g. America/Denver, defaults to UTC
+	Windows []ScheduleWindow `json:"windows"`
+	Default string           `json:"default,omitempty"`
+}
+
+var scheduleTimeFormats = []string{
+	time.RFC3339,
+	"2006-01-02T15:04:05",
+	"2006-01-02T15:04",
+	"2006-01-02 15:04:05",
+	"2006-01-02 15:04",
+	"2006-01-02",
+}
+
+func parseScheduleTime(s string, loc *time.Location) (t time.Time, err error) {
+	for _, f := range scheduleTimeFormats {
+		if t, err = time.ParseInLocation(f, s, loc); err == nil {
+			return
+		}
+	}
+	return t, fmt.Errorf("Invalid time %q", s)
+}
+
+// Compile checks the schedule and parses the window times.  It must be called before Target.
+func (sc *ScheduleType) Compile() error {
+	loc := time.UTC
+	if sc.TZ != "" {
+		var err error
+		loc, err = time.LoadLocation(sc.TZ)
+		if err != nil {
+			return fmt.Errorf("Invalid time zone %q", sc.TZ)
+		}
+	}
+	for ii := range sc.Windows {
+		w := &sc.Windows[ii]
+		if w.URL == "" {
+			return fmt.Errorf("Window %d: missing url", ii)
+		}
+		var err error
+		if w.Start != "" {
+			if w.start, err = parseScheduleTime(w.Start, loc); err != nil {
+				return fmt.Errorf("Window %d: %s", ii, err)
+			}
+		}
+		if w.End != "" {
+			if w.end, err = parseScheduleTime(w.End, loc); err != nil {
+				return fmt.Errorf("Window %d: %s", ii, err)
+			}
+		}
+		if w.Start != "" && w.End != "" && !w.end.After(w.start) {
+			return fmt.Errorf("Window %d: end must be after start", ii)
+		}
+	}
+	return nil
+}
+
+// Target returns the URL that is active at now, or false if the schedule has nothing for that time.
+func (sc *ScheduleType) Target(now time.Time) (string, bool) {
+	for _, w := range sc.Windows {
+		if (w.start.IsZero() || !now.Before(w.start)) && (w.end.IsZero() || now.Before(w.end)) {
+			return w.URL, true
+		}
+	}
+	if sc.Default != "" {
+		return sc.Default, true
+	}
+	return "", false
+}
+
+// GetSchedule returns the compiled schedule for id.
+func GetSchedule(id string) (sc *ScheduleType, err error) {
+	s, err := redisClient.Cmd("GET", fmt.Sprintf("qr-sched:%s", id)).Str()
+	if err != nil {
+		return nil, err
+	}
+	sc = &ScheduleType{}
+	if err = json.Unmarshal([]byte(s), sc); err != nil {
+		return nil, err
+	}
+	err = sc.Compile()
+	return
+}
+
+// ScheduledTarget returns the target for id at now, or false if the QR has no schedule or the schedule
+// has nothing for now.
+func ScheduledTarget(id string, now time.Time) (string, bool) {
+	sc, err := GetSchedule(id)
+	if err != nil {
+		return "", false
+	}
+	return sc.Target(now)
+}
+
+/*
+/api/set-schedule?id=ID&schedule={"tz":"America/Denver","windows":[{"start":"2026-11-01","end":"2026-11-08","url":"..."}],"default":"..."}
+An empty schedule, {}, removes it.
+*/
+func respHandlerSetSchedule(www http.ResponseWriter, req *http.Request) {
+	if !CheckAuth(www, req) {
+		return
+	}
+
+	id := GetParam(www, req, "id", "")
+	if id == "" {
+		AnError(www, req, 406, "Missing Parameter")
+		return
+	}
+	sSched := GetParam(www, req, "schedule", "")
+	if sSched == "" {
+		AnError(www, req, 406, "Missing Parameter")
+		return
+	}
+
+	var sc ScheduleType
+	if err := json.Unmarshal([]byte(sSched), &sc); err != nil {
+		AnError(www, req, 406, fmt.Sprintf("Invalid schedule: %s", err))
+		return
+	}
+	if err := sc.Compile(); err != nil {
+		AnError(www, req, 406, err.Error())
+		return
+	}
+	var vv Validator
+	for ii := range sc.Windows {
+		vv.URL(fmt.Sprintf("windows[%d].url", ii), &sc.Windows[ii].URL)
+	}
+	if sc.Default != "" {
+		vv.URL("default", &sc.Default)
+	}
+	if vv.Send(www, req) {
+		return
+	}
+
+	if _, err := redisClient.Cmd("GET", fmt.Sprintf("qrr:%s", id)).Str(); err != nil {
+		AnError(www, req, 404, "Not Found")
+		return
+	}
+
+	key := fmt.Sprintf("qr-sched:%s", id)
+	if len(sc.Windows) == 0 && sc.Default == "" {
+		redisClient.Cmd("DEL", key)
+	} else {
+		err := redisClient.Cmd("SET", key, SVar(sc)).Err
+		if err != nil {
+			AnError(www, req, 500, "Config Error 19")
+			return
+		}
+	}
+
+	Quarantine(id, AuthUser(req), vv.Threats)
+
+	www.Header().Set("Content-Type", "application/json; charset=utf-8")
+	fmt.Fprintf(www, `{"status":"success","schedule":%s,"quarantined":%d}`+"\n", SVar(sc), len(vv.Threats))
+}
+
+/*
+/api/get-schedule?id=ID
+*/
+func respHandlerGetSchedule(www http.ResponseWriter, req *http.Request) {
+	if !CheckAuth(www, req) {
+		return
+	}
+
+	id := GetParam(www, req, "id", "")
+	if id == "" {
+		AnError(www, req, 406, "Missing Parameter")
+		return
+	}
+
+	sc, err := GetSchedule(id)
+	if err != nil {
+		sc = &ScheduleType{Windows: []ScheduleWindow{}}
+	}
+	active, _ := sc.Target(timeNow())
+
+	www.Header().Set("Content-Type", "application/json; charset=utf-8")
+	fmt.Fprintf(www, `{"status":"success","schedule":%s,"active":%q}`+"\n", SVar(sc), active)
+}
+
+/* vim: set noai ts=4 sw=4: */
@@ -0,0 +1,55 @@
+package main
+
+// MIT Licensed - see LICENSE
+
+import (
+	"testing"
+	"time"
+)
+
+func TestScheduleTarget(t *testing.T) {
+	sc := ScheduleType{
+		TZ: "America/Denver",
+		Windows: []ScheduleWindow{
+			{End: "2026-11-01T09:00", URL: "http://example.com/teaser"},
+			{Start: "2026-11-01T09:00", End: "2026-11-08", URL: "http://example.com/sale"},
+		},
+		Default: "http://example.com/ended",
+	}
+	if err := sc.Compile(); err != nil {
+		t.Fatalf("Unexpected error %s\n", err)
+	}
+
+	tests := []struct {
+		now      string
+		expected string
+	}{
+		{"2026-10-20T12:00:00Z", "http://example.com/teaser"},
+		{"2026-11-01T15:59:59Z", "http://example.com/teaser"}, // 08:59:59 in Denver, after the change to MST
+		{"2026-11-01T16:00:00Z", "http://example.com/sale"},
+		{"2026-11-08T06:59:59Z", "http://example.com/sale"}, // 23:59:59 on the 7th in Denver
+		{"2026-11-08T07:00:00Z", "http://example.com/ended"},
+	}
+
+	for ii, test := range tests {
+		now, _ := time.Parse(time.RFC3339, test.now)
+		timeNow = func() time.Time { return now }
+		got, ok := sc.Target(timeNow())
+		if !ok || got != test.expected {
+			t.Errorf("Test %d, expected %s got %s\n", ii, test.expected, got)
+		}
+	}
+	timeNow = time.Now
+
+	sc.Default = ""
+	if _, ok := sc.Target(time.Date(2027, 1, 1, 0, 0, 0, 0, time.UTC)); ok {
+		t.Errorf("Expected no target after the last window without a default\n")
+	}
+
+	bad := ScheduleType{Windows: []ScheduleWindow{{Start: "2026-11-08", End: "2026-11-01", URL: "x"}}}
+	if err := bad.Compile(); err == nil {
+		t.Errorf("Expected error for end before start\n")
+	}
+}
+
+/* vim: set noai ts=4 sw=4: */
@@ -0,0 +1,138 @@
+package main
+
+// MIT Licensed - see LICENSE
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"os"
+	"os/signal"
+	"sync"
+	"syscall"
+	"time"
+)
+
+func seconds(n int) time.Duration {
+	return time.Duration(n) * time.Second
+}
+
+// NewServer makes a server for addr with the timeouts and header limit from the config.
+func NewServer(addr string, h http.Handler) *http.Server {
+	return &http.Server{
+		Addr:              addr,
+		Handler:           h,
+		ReadTimeout:       seconds(gCfg.ReadTimeout),
+		ReadHeaderTimeout: seconds(gCfg.ReadHeaderTimeout),
+		WriteTimeout:      seconds(gCfg.WriteTimeout),
+		IdleTimeout:       seconds(gCfg.IdleTimeout),
+		MaxHeaderBytes:    gCfg.MaxHeaderBytes,
+		ErrorLog:          logger.StdLog(LevelWarn, "http server"),
+	}
+}
+
+// Serve runs srv, with TLS if it has a TLSConfig, and any extra plain servers such as the HTTPS redirect,
+// until one of them fails or the process gets SIGTERM or SIGINT.  Then the servers stop taking
+// connections and the requests in flight are given up to shutdown_timeout seconds to finish.
+func Serve(srv *http.Server, extra ...*http.Server) error {
+	all := append([]*http.Server{srv}, extra...)
+	errs := make(chan error, len(all))
+	for _, s := range all {
+		go func(s *http.Server) {
+			var err error
+			if s.TLSConfig != nil {
+				err = s.ListenAndServeTLS("", "")
+			} else {
+				err = s.ListenAndServe()
+			}
+			if err != http.ErrServerClosed {
+				errs <- fmt.Errorf("Listen on %s: %s", s.Addr, err)
+			}
+		}(s)
+	}
+
+	sig := make(chan os.Signal, 1)
+	signal.Notify(sig, syscall.SIGTERM, os.Interrupt)
+	defer signal.Stop(sig)
+	var err error
+	select {
+	case s := <-sig:
+		logger.Info("shutting down", "signal", s)
+	case err = <-errs:
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), seconds(gCfg.ShutdownTimeout))
+	defer cancel()
+	var wg sync.WaitGroup
+	for _, s := range all {
+		wg.Add(1)
+		go func(s *http.Server) {
+			defer wg.Done()
+			if e := s.Shutdown(ctx); e != nil {
+				logger.Error("shutdown failed", "addr", s.Addr, "error", e)
+			}
+		}(s)
+	}
+	wg.Wait()
+	return err
+}
+
+var (
+	stopWorkers = make(chan struct{})
+	workers     sync.WaitGroup
+)
+
+// Background runs fn in a goroutine that Cleanup waits for.  fn must return soon after stopWorkers is
+// closed, see sleepOrStop.
+func Background(fn func()) {
+	workers.Add(1)
+	go func() {
+		defer workers.Done()
+		fn()
+	}()
+}
+
+// sleepOrStop waits for d, it is false if the workers are being stopped.
+func sleepOrStop(d time.Duration) bool {
+	select {
+	case <-stopWorkers:
+		return false
+	case <-time.After(d):
+		return true
+	}
+}
+
+// StopWorkers tells the Background workers to stop and waits up to timeout for them, it is false if
+// some are still running.
+func StopWorkers(timeout time.Duration) bool {
+	close(stopWorkers)
+	done := make(chan struct{})
+	go func() {
+		workers.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+		return true
+	case <-time.After(timeout):
+		return false
+	}
+}
+
+// Cleanup is run once the servers have stopped.  It stops the workers - a job that is running is run
+// again at the next start - sends the scans batched for webhooks, and closes Redis and the log file.
+// If a worker does not stop in shutdown_timeout Redis is left open for it, the process is exiting anyway.
+func Cleanup() {
+	if StopWorkers(seconds(gCfg.ShutdownTimeout)) {
+		if gCfg.WebhookScanBatch > 0 {
+			FlushScans()
+		}
+		redisClient.Empty()
+	} else {
+		logger.Warn("workers did not stop, exiting with them running")
+	}
+	logger.Info("stopped")
+	logger.Close()
+}
+
+/* vim: set noai ts=4 sw=4: */
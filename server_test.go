@@ -0,0 +1,21 @@
+package main
+
+// MIT Licensed - see LICENSE
+
+import (
+	"net/http"
+	"testing"
+	"time"
+)
+
+func TestNewServer(t *testing.T) {
+	gCfg.ReadTimeout, gCfg.ReadHeaderTimeout, gCfg.WriteTimeout, gCfg.IdleTimeout, gCfg.MaxHeaderBytes = 30, 10, 120, 90, 65536
+	srv := NewServer(":8333", http.NotFoundHandler())
+	if srv.ReadTimeout != 30*time.Second || srv.ReadHeaderTimeout != 10*time.Second || srv.WriteTimeout != 2*time.Minute ||
+		srv.IdleTimeout != 90*time.Second || srv.MaxHeaderBytes != 65536 {
+		t.Errorf("Expected the timeouts from the config, got %v %v %v %v %d\n", srv.ReadTimeout, srv.ReadHeaderTimeout,
+			srv.WriteTimeout, srv.IdleTimeout, srv.MaxHeaderBytes)
+	}
+}
+
+/* vim: set noai ts=4 sw=4: */
@@ -0,0 +1,71 @@
+//go:build !windows
+// +build !windows
+
+package main
+
+// MIT Licensed - see LICENSE
+
+import (
+	"io/ioutil"
+	"net"
+	"net/http"
+	"os"
+	"syscall"
+	"testing"
+	"time"
+)
+
+func TestServeShutdown(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Listen: %s\n", err)
+	}
+	addr := l.Addr().String()
+	l.Close()
+
+	gCfg.ShutdownTimeout = 5
+	srv := NewServer(addr, http.HandlerFunc(func(www http.ResponseWriter, req *http.Request) {
+		time.Sleep(300 * time.Millisecond)
+		www.Write([]byte("done"))
+	}))
+	served := make(chan error, 1)
+	go func() { served <- Serve(srv) }()
+	for ii := 0; ii < 50; ii++ {
+		if c, err := net.Dial("tcp", addr); err == nil {
+			c.Close()
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	body := make(chan string, 1)
+	go func() {
+		resp, err := http.Get("http://" + addr + "/")
+		if err != nil {
+			body <- err.Error()
+			return
+		}
+		buf, _ := ioutil.ReadAll(resp.Body)
+		resp.Body.Close()
+		body <- string(buf)
+	}()
+	time.Sleep(100 * time.Millisecond)
+	syscall.Kill(os.Getpid(), syscall.SIGTERM)
+
+	if got := <-body; got != "done" {
+		t.Errorf("Expected the request in flight to finish, got %s\n", got)
+	}
+	select {
+	case err := <-served:
+		if err != nil {
+			t.Errorf("Expected a clean shutdown, got %s\n", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatalf("Serve did not return\n")
+	}
+	if _, err := net.Dial("tcp", addr); err == nil {
+		t.Errorf("Expected the listener to be closed\n")
+	}
+}
+
+/* vim: set noai ts=4 sw=4: */
@@ -0,0 +1,219 @@
+package main
+
+// MIT Licensed - see LICENSE
+
+import (
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+	"net/http"
+	"regexp"
+
+	"github.com/pschlump/json"
+)
+
+// SplitVariant is one of the weighted targets of an A/B split.  The variants of a QR are kept in
+// qr-split:{id}.  Scans of a variant are counted in qr-count:{id}:{name} (as well as the total in
+// qr-count:{id}) and conversions in qr-conv:{id}:{name}.
+type SplitVariant struct {
+	Name   string `json:"name"`
+	URL    string `json:"url"`
+	Weight int    `json:"weight"`
+}
+
+// VariantCount is the per-variant breakdown returned by /api/count.
+type VariantCount struct {
+	Weight      int   `json:"weight"`
+	Count       int64 `json:"count"`
+	Conversions int64 `json:"conversions"`
+}
+
+var validVariantName = regexp.MustCompile("^[a-zA-Z0-9_-]{1,32}$")
+
+const splitCookieMaxAge = 30 * 24 * 60 * 60
+
+// ValidateSplit checks a list of variants.
+func ValidateSplit(vv []SplitVariant) error {
+	total := 0
+	seen := make(map[string]bool)
+	for ii, v := range vv {
+		if !validVariantName.MatchString(v.Name) {
+			return fmt.Errorf("Variant %d: invalid name %q", ii, v.Name)
+		}
+		if seen[v.Name] {
+			return fmt.Errorf("Variant %d: duplicate name %q", ii, v.Name)
+		}
+		seen[v.Name] = true
+		if v.URL == "" {
+			return fmt.Errorf("Variant %d: missing url", ii)
+		}
+		if v.Weight < 0 {
+			return fmt.Errorf("Variant %d: weight must not be negative", ii)
+		}
+		total += v.Weight
+	}
+	if len(vv) > 0 && total == 0 {
+		return fmt.Errorf("At least one variant must have a weight")
+	}
+	return nil
+}
+
+// GetSplit returns the variants for id.
+func GetSplit(id string) (vv []SplitVariant, err error) {
+	s, err := redisClient.Cmd("GET", fmt.Sprintf("qr-split:%s", id)).Str()
+	if err != nil {
+		return nil, err
+	}
+	err = json.Unmarshal([]byte(s), &vv)
+	return
+}
+
+// SaveSplit stores the variants for id, removing the split if there are none.
+func SaveSplit(id string, vv []SplitVariant) error {
+	key := fmt.Sprintf("qr-split:%s", id)
+	if len(vv) == 0 {
+		return redisClient.Cmd("DEL", key).Err
+	}
+	return redisClient.Cmd("SET", key, SVar(vv)).Err
+}
+
+// VariantByHash picks a variant by weight using a hash of key, so the same key always lands on the same
+// variant as long as the weights do not change.
+func VariantByHash(vv []SplitVariant, key string) int {
+	total := 0
+	for _, v := range vv {
+		total += v.Weight
+	}
+	if total <= 0 {
+		return -1
+	}
+	sum := sha256.Sum256([]byte(key))
+	n := int(binary.BigEndian.Uint64(sum[:8]) % uint64(total))
+	for ii, v := range vv {
+		if n < v.Weight {
+			return ii
+		}
+		n -= v.Weight
+	}
+	return len(vv) - 1
+}
+
+// splitCookieName is the name of the cookie that keeps the variant of id.  The ID is hex encoded since slugs
+// and host scoped IDs (slug@host) can have characters that are not allowed in a cookie name.
+func splitCookieName(id string) string {
+	return "qr-v-" + hex.EncodeToString([]byte(id))
+}
+
+// ChooseVariant returns the variant of vv for this visitor.  A variant named in the visitor's cookie is
+// used if it still has a weight, otherwise the variant is picked from a hash of the ID and the client IP.
+func ChooseVariant(vv []SplitVariant, id string, req *http.Request) int {
+	if ck, err := req.Cookie(splitCookieName(id)); err == nil {
+		for ii, v := range vv {
+			if v.Name == ck.Value && v.Weight > 0 {
+				return ii
+			}
+		}
+	}
+	return VariantByHash(vv, id+"|"+ClientIP(req))
+}
+
+// SplitTarget returns the URL and name of the variant of id for this visitor.
+func SplitTarget(id string, req *http.Request) (to, variant string, ok bool) {
+	vv, err := GetSplit(id)
+	if err != nil || len(vv) == 0 {
+		return "", "", false
+	}
+	ii := ChooseVariant(vv, id, req)
+	if ii < 0 {
+		return "", "", false
+	}
+	return vv[ii].URL, vv[ii].Name, true
+}
+
+// SetVariantCookie makes the variant sticky for this visitor.
+func SetVariantCookie(www http.ResponseWriter, id, variant string) {
+	http.SetCookie(www, &http.Cookie{Name: splitCookieName(id), Value: variant, Path: "/", MaxAge: splitCookieMaxAge, HttpOnly: true})
+}
+
+// GetVariantCounts returns the scans and conversions for each variant of id.
+func GetVariantCounts(id string) map[string]VariantCount {
+	vv, err := GetSplit(id)
+	if err != nil || len(vv) == 0 {
+		return nil
+	}
+	rv := make(map[string]VariantCount, len(vv))
+	for _, v := range vv {
+		n, _ := redisClient.Cmd("GET", fmt.Sprintf("qr-count:%s:%s", id, v.Name)).Int64()
+		c, _ := redisClient.Cmd("GET", fmt.Sprintf("qr-conv:%s:%s", id, v.Name)).Int64()
+		rv[v.Name] = VariantCount{Weight: v.Weight, Count: n, Conversions: c}
+	}
+	return rv
+}
+
+// DelVariantCounts removes the per-variant counters of id, including those of variants that have since
+// been taken out of the split.
+func DelVariantCounts(id string) {
+	for _, pat := range []string{"qr-count:%s:*", "qr-conv:%s:*"} {
+		cur := "0"
+		for {
+			arr, err := redisClient.Cmd("SCAN", cur, "MATCH", fmt.Sprintf(pat, id), "COUNT", 100).Array()
+			if err != nil || len(arr) != 2 {
+				break
+			}
+			cur, _ = arr[0].Str()
+			if keys, _ := arr[1].List(); len(keys) > 0 {
+				args := make([]interface{}, len(keys))
+				for ii, k := range keys {
+					args[ii] = k
+				}
+				redisClient.Cmd("DEL", args...)
+			}
+			if cur == "0" || cur == "" {
+				break
+			}
+		}
+	}
+}
+
+/*
+/api/convert?id=ID[&variant=NAME] - records a conversion.  This is meant to be called from the landing
+page (a tracking pixel) so it does not need a login.  Without variant the visitor's cookie or IP is used.
+*/
+func respHandlerConvert(www http.ResponseWriter, req *http.Request) {
+	id := GetParam(www, req, "id", "")
+	if id == "" {
+		AnError(www, req, 406, "Missing Parameter")
+		return
+	}
+
+	vv, err := GetSplit(id)
+	if err != nil || len(vv) == 0 {
+		AnError(www, req, 404, "Not Found")
+		return
+	}
+
+	variant := GetParam(www, req, "variant", "")
+	if variant == "" {
+		if ii := ChooseVariant(vv, id, req); ii >= 0 {
+			variant = vv[ii].Name
+		}
+	}
+	found := false
+	for _, v := range vv {
+		if v.Name == variant {
+			found = true
+		}
+	}
+	if !found {
+		AnError(www, req, 404, "Not Found")
+		return
+	}
+
+	redisClient.Cmd("INCR", fmt.Sprintf("qr-conv:%s:%s", id, variant))
+
+	www.Header().Set("Content-Type", "application/json; charset=utf-8")
+	fmt.Fprintf(www, `{"status":"success","variant":%q}`+"\n", variant)
+}
+
+/* vim: set noai ts=4 sw=4: */
@@ -0,0 +1,133 @@
+package main
+
+// MIT Licensed - see LICENSE
+
+import (
+	"fmt"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestVariantByHash(t *testing.T) {
+	vv := []SplitVariant{
+		{Name: "a", URL: "http://example.com/a", Weight: 75},
+		{Name: "b", URL: "http://example.com/b", Weight: 25},
+		{Name: "c", URL: "http://example.com/c", Weight: 0},
+	}
+
+	n := make([]int, len(vv))
+	for ii := 0; ii < 10000; ii++ {
+		key := fmt.Sprintf("10001|10.0.%d.%d", ii/256, ii%256)
+		v := VariantByHash(vv, key)
+		if v != VariantByHash(vv, key) {
+			t.Fatalf("Expected the same variant for the same key\n")
+		}
+		n[v]++
+	}
+	if n[2] != 0 {
+		t.Errorf("Expected no visitors on a variant with a weight of 0 got %d\n", n[2])
+	}
+	if n[0] < 7000 || n[0] > 8000 {
+		t.Errorf("Expected about 7500 on variant a got %d\n", n[0])
+	}
+
+	if err := ValidateSplit([]SplitVariant{{Name: "a", URL: "x"}}); err == nil {
+		t.Errorf("Expected error when no variant has a weight\n")
+	}
+}
+
+func TestClientIP(t *testing.T) {
+	defer func(s string) { gCfg.TrustedProxies = s }(gCfg.TrustedProxies)
+
+	tests := []struct {
+		trusted  string
+		remote   string
+		xff      []string
+		expected string
+	}{
+		{"", "203.0.113.7:4000", nil, "203.0.113.7"},
+		{"", "203.0.113.7:4000", []string{"1.2.3.4"}, "203.0.113.7"}, // not from a proxy, X-Forwarded-For is ignored
+		{"10.0.0.1", "10.0.0.1:4000", []string{"1.2.3.4"}, "1.2.3.4"},
+		{"10.0.0.0/8", "10.0.0.1:4000", []string{"6.6.6.6, 1.2.3.4, 10.0.0.2"}, "1.2.3.4"}, // 6.6.6.6 was sent by the client
+		{"10.0.0.0/8", "10.0.0.1:4000", []string{"6.6.6.6", "1.2.3.4"}, "1.2.3.4"},
+		{"10.0.0.0/8", "10.0.0.1:4000", []string{"10.0.0.3"}, "10.0.0.3"},
+		{"10.0.0.0/8", "10.0.0.1:4000", nil, "10.0.0.1"},
+		{"10.0.0.0/8, ::1", "[::1]:4000", []string{"2001:db8::1"}, "2001:db8::1"},
+		{"10.0.0.1", "10.0.0.9:4000", []string{"1.2.3.4"}, "10.0.0.9"},
+	}
+
+	for ii, test := range tests {
+		gCfg.TrustedProxies = test.trusted
+		req := httptest.NewRequest("GET", "/q/10001", nil)
+		req.RemoteAddr = test.remote
+		for _, x := range test.xff {
+			req.Header.Add("X-Forwarded-For", x)
+		}
+		if got := ClientIP(req); got != test.expected {
+			t.Errorf("Test %d, expected %s got %s\n", ii, test.expected, got)
+		}
+	}
+}
+
+func TestVariantCookie(t *testing.T) {
+	vv := []SplitVariant{{Name: "a", Weight: 1}, {Name: "b", Weight: 1}, {Name: "c", Weight: 0}}
+	tests := []struct {
+		id      string
+		variant string
+	}{
+		{id: "10001", variant: "a"},
+		{id: "10001", variant: "b"},
+		{id: "promo", variant: "b"},
+		{id: "promo@brand-b.link", variant: "a"},
+		{id: "promo@brand-b.link", variant: "b"},
+	}
+
+	for ii, test := range tests {
+		rec := httptest.NewRecorder()
+		SetVariantCookie(rec, test.id, test.variant)
+		cookies := rec.Result().Cookies()
+		if len(cookies) != 1 {
+			t.Errorf("Test %d, expected a cookie got %s\n", ii, rec.Header().Get("Set-Cookie"))
+			continue
+		}
+		req := httptest.NewRequest("GET", "/q/"+test.id, nil)
+		req.AddCookie(cookies[0])
+		if got := ChooseVariant(vv, test.id, req); vv[got].Name != test.variant {
+			t.Errorf("Test %d, expected variant %s got %s\n", ii, test.variant, vv[got].Name)
+		}
+	}
+}
+
+func TestDelVariantCounts(t *testing.T) {
+	_, done := testRedis(t)
+	defer done()
+
+	SaveSplit("10001", []SplitVariant{{Name: "a", Weight: 1}})
+	for _, k := range []string{"qr-count:10001:a", "qr-count:10001:old", "qr-conv:10001:old", "qr-count:10001", "qr-count:100011:a", "qr-count:10002:a"} {
+		redisClient.Cmd("SET", k, 1)
+	}
+	for ii := 0; ii < 250; ii++ { // more than one SCAN
+		redisClient.Cmd("SET", fmt.Sprintf("qr-count:10001:v%d", ii), 1)
+	}
+	DelVariantCounts("10001")
+
+	tests := []struct {
+		key    string
+		exists int
+	}{
+		{"qr-count:10001:a", 0},
+		{"qr-count:10001:old", 0},
+		{"qr-conv:10001:old", 0},
+		{"qr-count:10001:v249", 0},
+		{"qr-count:10001", 1},
+		{"qr-count:100011:a", 1},
+		{"qr-count:10002:a", 1},
+	}
+	for ii, test := range tests {
+		if n, _ := redisClient.Cmd("EXISTS", test.key).Int(); n != test.exists {
+			t.Errorf("Test %d, expected %s exists %d got %d\n", ii, test.key, test.exists, n)
+		}
+	}
+}
+
+/* vim: set noai ts=4 sw=4: */
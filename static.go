@@ -0,0 +1,80 @@
+package main
+
+// MIT Licensed - see LICENSE
+
+import (
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+const alphanumericChars = "0123456789ABCDEFGHIJKLMNOPQRSTUVWXYZ $%*+-./:"
+
+// CheckEncoding returns an error if content can not be encoded in the mode asked for.  Content that passes
+// for numeric or alphanumeric is all of one class, so the encoder puts it in a single segment of that mode.
+// byte and auto take any content, encoded as UTF-8.  The encoder can not be made to use byte mode for
+// content that fits a compact mode, it picks the smallest mode for each run, which decodes to the same text.
+func CheckEncoding(content, encoding string) error {
+	switch encoding {
+	case "", "auto", "byte":
+		return nil
+	case "numeric":
+		for _, c := range content {
+			if c < '0' || c > '9' {
+				return fmt.Errorf("Numeric mode can only encode 0-9, found %q", c)
+			}
+		}
+	case "alphanumeric":
+		for _, c := range content {
+			if !strings.ContainsRune(alphanumericChars, c) {
+				return fmt.Errorf("Alphanumeric mode can only encode 0-9, A-Z, space and $%%*+-./:, found %q", c)
+			}
+		}
+	default:
+		return fmt.Errorf("Invalid encoding %q", encoding)
+	}
+	return nil
+}
+
+/*
+/api/static-qr?content=TEXT[&level=L|M|Q|H&size=N&format=png|svg&encoding=auto|numeric|alphanumeric|byte]
+Returns a QR code for TEXT as an image, with no ID and nothing stored, so it does not depend on this
+server.  level and size default to the config.  Use a POST for long content.  encoding=numeric or
+alphanumeric gives a 406 if TEXT does not fit the mode, see CheckEncoding.
+*/
+func respHandlerStaticQR(www http.ResponseWriter, req *http.Request) {
+	if !CheckAuth(www, req) {
+		return
+	}
+
+	content := GetParam(www, req, "content", "")
+	if content == "" {
+		AnError(www, req, 406, "Missing Parameter")
+		return
+	}
+	level := GetParam(www, req, "level", gCfg.Level)
+	format := strings.ToLower(GetParam(www, req, "format", "png"))
+	size, err := strconv.Atoi(GetParam(www, req, "size", fmt.Sprintf("%d", gCfg.QRSize)))
+	if err != nil || size < 21 || size > 4096 {
+		AnError(www, req, 406, "Invalid size, must be 21 to 4096")
+		return
+	}
+	if err = CheckEncoding(content, strings.ToLower(GetParam(www, req, "encoding", "auto"))); err != nil {
+		AnError(www, req, 406, err.Error())
+		return
+	}
+
+	body, contentType, err := RenderQRFormat(content, level, size, format)
+	if err != nil {
+		AnError(www, req, 406, err.Error())
+		return
+	}
+
+	www.Header().Set("Content-Type", contentType)
+	www.Header().Set("Content-Disposition", fmt.Sprintf(`inline; filename="qr.%s"`, format))
+	www.Header().Set("Cache-Control", "no-store")
+	www.Write(body)
+}
+
+/* vim: set noai ts=4 sw=4: */
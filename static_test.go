@@ -0,0 +1,116 @@
+package main
+
+// MIT Licensed - see LICENSE
+
+import (
+	"bytes"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestRenderQRFormat(t *testing.T) {
+	tests := []struct {
+		content string
+		level   string
+		format  string
+		ctype   string
+		isErr   bool
+	}{
+		{"0123456789", "L", "png", "image/png", false},
+		{"HELLO WORLD $%*+-./:", "m", "png", "image/png", false},
+		{"https://example.com/?a=1", "Q", "svg", "image/svg+xml", false},
+		{"WIFI:T:WPA;S:Guest;P:password;;", "H", "png", "image/png", false},
+		{"x", "X", "png", "", true},
+		{"x", "H", "gif", "", true},
+		{strings.Repeat("x", 5000), "H", "png", "", true},
+	}
+
+	for ii, test := range tests {
+		body, ct, err := RenderQRFormat(test.content, test.level, 256, test.format)
+		if test.isErr {
+			if err == nil {
+				t.Errorf("Test %d, expected an error\n", ii)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("Test %d, error %s\n", ii, err)
+			continue
+		}
+		if ct != test.ctype {
+			t.Errorf("Test %d, expected %s got %s\n", ii, test.ctype, ct)
+		}
+		if test.format == "png" && !bytes.HasPrefix(body, []byte("\x89PNG")) {
+			t.Errorf("Test %d, not a png\n", ii)
+		}
+		if test.format == "svg" && !bytes.Contains(body, []byte(`width="256"`)) {
+			t.Errorf("Test %d, bad svg %s\n", ii, body)
+		}
+	}
+}
+
+func TestQRSVG(t *testing.T) {
+	bitmap := [][]bool{
+		{false, true, true, false},
+		{true, false, false, true},
+	}
+	got := string(QRSVG(bitmap, 100))
+	if !strings.Contains(got, `d="M1 0h2v1h-2zM0 1h1v1h-1zM3 1h1v1h-1z"`) {
+		t.Errorf("Unexpected path in %s\n", got)
+	}
+}
+
+func TestCheckEncoding(t *testing.T) {
+	tests := []struct {
+		content  string
+		encoding string
+		isErr    bool
+	}{
+		{"12345", "numeric", false},
+		{"12a45", "numeric", true},
+		{"ABC 123", "alphanumeric", false},
+		{"HTTP://EXAMPLE.COM/Q/10001", "alphanumeric", false},
+		{"abc", "alphanumeric", true},
+		{"anything at all", "byte", false},
+		{"caf\u00e9", "auto", false},
+		{"anything", "kanji", true},
+	}
+	for ii, test := range tests {
+		if err := CheckEncoding(test.content, test.encoding); (err != nil) != test.isErr {
+			t.Errorf("Test %d, expected error %v got %v\n", ii, test.isErr, err)
+		}
+	}
+}
+
+func TestStaticQREncoding(t *testing.T) {
+	_, done := testRedis(t)
+	defer done()
+	defer func(level string, size int) { gCfg.Level, gCfg.QRSize = level, size }(gCfg.Level, gCfg.QRSize)
+	gCfg.Level, gCfg.QRSize = "M", 128
+
+	redisClient.Cmd("SET", "qr-token:tok", "bob")
+	tests := []struct {
+		query string
+		code  int
+	}{
+		{query: "content=12345&encoding=numeric", code: 200},
+		{query: "content=12345x&encoding=numeric", code: 406},
+		{query: "content=ABC&encoding=ALPHANUMERIC", code: 200},
+		{query: "content=abc&encoding=alphanumeric", code: 406},
+		{query: "content=abc&encoding=byte", code: 200},
+		{query: "content=abc", code: 200},
+		{query: "content=abc&encoding=kanji", code: 406},
+	}
+	for ii, test := range tests {
+		req := httptest.NewRequest("GET", "/api/static-qr?"+test.query, nil)
+		req.Header.Set("X-Auth", "tok")
+		rec := httptest.NewRecorder()
+		respHandlerStaticQR(rec, req)
+		if rec.Code != test.code {
+			t.Errorf("Test %d, expected %d got %d %s\n", ii, test.code, rec.Code, rec.Body.String())
+		}
+	}
+}
+
+/* vim: set noai ts=4 sw=4: */
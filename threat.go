@@ -0,0 +1,403 @@
+package main
+
+// MIT Licensed - see LICENSE
+
+import (
+	"crypto/sha256"
+	"encoding/csv"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pschlump/json"
+)
+
+// Offline threat lists.
+//
+// Two kinds of list can be used, both are files on local disk that are read again when they change (they
+// are looked at no more than once every threatCheckInterval):
+//
+//	gCfg.ThreatHashFile - hex SHA-256 hash prefixes (4 to 32 bytes), one per line, of host/path expressions
+//	                      as used by Safe Browsing.
+//	gCfg.ThreatURLFile  - a URLhaus CSV dump (the url is the 3rd column) or a plain list of URLs, one per line.
+//	                      It can be refreshed from gCfg.ThreatURLSource with --refresh-threats from cron.
+//
+// A target that matches is quarantined: it is recorded in the hash qr-quarantine:{id} (field is the URL)
+// and the redirect will not send anyone to it until an admin releases it.  The IDs with quarantined
+// targets are kept in the set qr-quarantine-ids.  A release is remembered in the hash
+// qr-quarantine-released:{id} (field is the URL) so that the check at scan time does not put the same
+// target back in quarantine.
+
+// ThreatHit is a target URL that matched a threat list.
+type ThreatHit struct {
+	Field string `json:"field,omitempty"`
+	URL   string `json:"url"`
+	List  string `json:"list"` // "hash" or "url"
+	User  string `json:"user,omitempty"`
+	Time  int64  `json:"time"`
+}
+
+// ThreatList is a threat list file loaded into memory.
+type ThreatList struct {
+	fn       string
+	modTime  time.Time
+	checked  time.Time               // last time the file was looked at
+	prefixes map[int]map[string]bool // hash prefixes by length in bytes
+	urls     map[string]bool
+	lock     sync.Mutex
+}
+
+var hashThreats, urlThreats ThreatList
+
+// threatCheckInterval is how often the threat list files are looked at for changes.
+var threatCheckInterval = 10 * time.Second
+
+func (tl *ThreatList) reload(fn string, read func(fn string, tl *ThreatList) error) bool {
+	if fn == "" {
+		return false
+	}
+	if fn == tl.fn && time.Since(tl.checked) < threatCheckInterval {
+		return true
+	}
+	tl.checked = time.Now()
+	if fi, err := os.Stat(fn); err == nil && (fn != tl.fn || !fi.ModTime().Equal(tl.modTime)) {
+		if err := read(fn, tl); err == nil {
+			tl.fn, tl.modTime = fn, fi.ModTime()
+		} else {
+			logger.Error("unable to read threat list", "file", fn, "error", err)
+		}
+	}
+	return tl.fn == fn
+}
+
+func readHashList(fn string, tl *ThreatList) error {
+	buf, err := ioutil.ReadFile(fn)
+	if err != nil {
+		return err
+	}
+	prefixes := make(map[int]map[string]bool)
+	for _, line := range strings.Split(string(buf), "\n") {
+		line = strings.ToLower(strings.TrimSpace(line))
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		b, err := hex.DecodeString(line)
+		if err != nil || len(b) < 4 || len(b) > 32 {
+			continue
+		}
+		if prefixes[len(b)] == nil {
+			prefixes[len(b)] = make(map[string]bool)
+		}
+		prefixes[len(b)][string(b)] = true
+	}
+	tl.prefixes = prefixes
+	return nil
+}
+
+func readURLList(fn string, tl *ThreatList) error {
+	fh, err := os.Open(fn)
+	if err != nil {
+		return err
+	}
+	defer fh.Close()
+	rdr := csv.NewReader(fh)
+	rdr.Comment = '#'
+	rdr.FieldsPerRecord = -1
+	rdr.LazyQuotes = true
+	urls := make(map[string]bool)
+	for {
+		rec, err := rdr.Read()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			continue
+		}
+		var s string
+		if len(rec) >= 3 {
+			s = rec[2]
+		} else if len(rec) == 1 {
+			s = rec[0]
+		}
+		if c := canonicalThreatURL(s); c != "" {
+			urls[c] = true
+		}
+	}
+	tl.urls = urls
+	return nil
+}
+
+// canonicalThreatURL puts a URL in the form used to compare against the URL list: lower case scheme
+// and host, no default port, no fragment and a path of at least "/".
+func canonicalThreatURL(s string) string {
+	u, err := url.Parse(strings.TrimSpace(s))
+	if err != nil || u.Host == "" {
+		return ""
+	}
+	u.Scheme = strings.ToLower(u.Scheme)
+	host := strings.ToLower(u.Hostname())
+	port := u.Port()
+	if (u.Scheme == "http" && port == "80") || (u.Scheme == "https" && port == "443") {
+		port = ""
+	}
+	if port != "" {
+		host = net.JoinHostPort(host, port)
+	}
+	u.Host = host
+	u.Fragment = ""
+	u.User = nil
+	if u.Path == "" {
+		u.Path = "/"
+	}
+	return u.String()
+}
+
+// ThreatExpressions returns the host suffix / path prefix expressions that are hashed for a Safe Browsing
+// style lookup of u: the exact host and up to 4 of its parent domains, each with the full path and query,
+// the full path and up to 4 leading directories of the path.
+func ThreatExpressions(u *url.URL) (rv []string) {
+	host := strings.ToLower(u.Hostname())
+	hosts := []string{host}
+	if net.ParseIP(host) == nil {
+		parts := strings.Split(host, ".")
+		start := len(parts) - 5
+		if start < 1 {
+			start = 1
+		}
+		for ii := start; ii <= len(parts)-2; ii++ {
+			hosts = append(hosts, strings.Join(parts[ii:], "."))
+		}
+	}
+
+	p := u.EscapedPath()
+	if p == "" {
+		p = "/"
+	}
+	var paths []string
+	if u.RawQuery != "" {
+		paths = append(paths, p+"?"+u.RawQuery)
+	}
+	paths = append(paths, p)
+	dirs := strings.Split(strings.TrimPrefix(p, "/"), "/")
+	prefix := "/"
+	for ii := 0; ii < len(dirs) && ii < 4; ii++ {
+		if prefix != p {
+			paths = append(paths, prefix)
+		}
+		if ii == len(dirs)-1 {
+			break
+		}
+		prefix += dirs[ii] + "/"
+	}
+
+	seen := make(map[string]bool)
+	for _, h := range hosts {
+		for _, pp := range paths {
+			e := h + pp
+			if !seen[e] {
+				seen[e] = true
+				rv = append(rv, e)
+			}
+		}
+	}
+	return
+}
+
+// CheckThreat returns the list that raw matches, or "" if it is clean.  Only http and https URLs are checked.
+func CheckThreat(raw string) string {
+	u, err := url.Parse(raw)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") {
+		return ""
+	}
+
+	urlThreats.lock.Lock()
+	if urlThreats.reload(gCfg.ThreatURLFile, readURLList) && urlThreats.urls[canonicalThreatURL(raw)] {
+		urlThreats.lock.Unlock()
+		return "url"
+	}
+	urlThreats.lock.Unlock()
+
+	hashThreats.lock.Lock()
+	defer hashThreats.lock.Unlock()
+	if !hashThreats.reload(gCfg.ThreatHashFile, readHashList) || len(hashThreats.prefixes) == 0 {
+		return ""
+	}
+	for _, e := range ThreatExpressions(u) {
+		sum := sha256.Sum256([]byte(e))
+		for n, set := range hashThreats.prefixes {
+			if set[string(sum[:n])] {
+				return "hash"
+			}
+		}
+	}
+	return ""
+}
+
+// Quarantine records the hits, made by user, against id and tells the admins about them.
+func Quarantine(id, user string, hits []ThreatHit) {
+	if len(hits) == 0 {
+		return
+	}
+	key := fmt.Sprintf("qr-quarantine:%s", id)
+	for _, hit := range hits {
+		hit.User = user
+		logger.Warn("quarantined", "qr_id", id, "url", hit.URL, "list", hit.List, "user", hit.User)
+		redisClient.Cmd("HSET", key, hit.URL, SVar(hit))
+	}
+	redisClient.Cmd("SADD", "qr-quarantine-ids", id)
+	EmitEvent(HookEvent{Event: "qr.quarantined", ID: id, URL: hits[0].URL}) // quarantines are rare, no need for a goroutine
+}
+
+// IsQuarantined is true if "to" may not be used as a target for id.  A target that was let through
+// before a list was updated is caught and quarantined here, unless an admin has released it for id.
+func IsQuarantined(id, to string) bool {
+	if n, err := redisClient.Cmd("HEXISTS", fmt.Sprintf("qr-quarantine:%s", id), to).Int(); err == nil && n == 1 {
+		return true
+	}
+	if n, err := redisClient.Cmd("HEXISTS", fmt.Sprintf("qr-quarantine-released:%s", id), to).Int(); err == nil && n == 1 {
+		return false
+	}
+	if list := CheckThreat(to); list != "" {
+		Quarantine(id, "", []ThreatHit{{URL: to, List: list, Time: time.Now().Unix()}})
+		return true
+	}
+	return false
+}
+
+// ServeQuarantined sends the response for a scan whose target has been quarantined.
+func ServeQuarantined(www http.ResponseWriter, req *http.Request) {
+	http.Error(www, "This QR code has been disabled while it is reviewed for safety\n", http.StatusForbidden)
+}
+
+// IsAdmin is true if the logged in user is in gCfg.AdminUsers.  If no admins are configured then nobody
+// is an admin.
+func IsAdmin(req *http.Request) bool {
+	un := AuthUser(req)
+	for _, a := range strings.Split(gCfg.AdminUsers, ",") {
+		if un != "" && strings.TrimSpace(a) == un {
+			return true
+		}
+	}
+	return false
+}
+
+// RefreshThreatList downloads gCfg.ThreatURLSource into gCfg.ThreatURLFile.  The file is replaced in one
+// step so the server never reads a partial list.
+func RefreshThreatList() error {
+	if gCfg.ThreatURLSource == "" || gCfg.ThreatURLFile == "" {
+		return fmt.Errorf("threat_url_source and threat_url_file must both be set")
+	}
+	resp, err := (&http.Client{Timeout: 5 * time.Minute}).Get(gCfg.ThreatURLSource)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != 200 {
+		return fmt.Errorf("Download of %s failed with status %d", gCfg.ThreatURLSource, resp.StatusCode)
+	}
+	tmp, err := ioutil.TempFile(filepath.Dir(gCfg.ThreatURLFile), ".threat-*")
+	if err != nil {
+		return err
+	}
+	if _, err = io.Copy(tmp, resp.Body); err != nil {
+		tmp.Close()
+		os.Remove(tmp.Name())
+		return err
+	}
+	tmp.Close()
+	return os.Rename(tmp.Name(), gCfg.ThreatURLFile)
+}
+
+/*
+/api/quarantine-list - the quarantined targets of all QRs.  Admin only.
+*/
+func respHandlerQuarantineList(www http.ResponseWriter, req *http.Request) {
+	if !CheckAuth(www, req) {
+		return
+	}
+	if !IsAdmin(req) {
+		AnError(www, req, 403, "Admin only")
+		return
+	}
+
+	ids, err := redisClient.Cmd("SMEMBERS", "qr-quarantine-ids").List()
+	if err != nil {
+		AnError(www, req, 500, "Config Error 26")
+		return
+	}
+	rv := make(map[string][]ThreatHit)
+	for _, id := range ids {
+		mm, err := redisClient.Cmd("HGETALL", fmt.Sprintf("qr-quarantine:%s", id)).Map()
+		if err != nil || len(mm) == 0 {
+			redisClient.Cmd("SREM", "qr-quarantine-ids", id)
+			continue
+		}
+		for _, s := range mm {
+			var hit ThreatHit
+			if json.Unmarshal([]byte(s), &hit) == nil {
+				rv[id] = append(rv[id], hit)
+			}
+		}
+	}
+
+	www.Header().Set("Content-Type", "application/json; charset=utf-8")
+	fmt.Fprintf(www, `{"status":"success","quarantine":%s}`+"\n", SVar(rv))
+}
+
+/*
+/api/quarantine-release?id=ID[&url=URL] - releases one quarantined target of a QR, or all of them if url
+is left out.  Admin only.  The released targets are not quarantined again by the scan time check even if
+they are still on a threat list.
+*/
+func respHandlerQuarantineRelease(www http.ResponseWriter, req *http.Request) {
+	if !CheckAuth(www, req) {
+		return
+	}
+	if !IsAdmin(req) {
+		AnError(www, req, 403, "Admin only")
+		return
+	}
+
+	id := GetParam(www, req, "id", "")
+	if id == "" {
+		AnError(www, req, 406, "Missing Parameter")
+		return
+	}
+
+	key := fmt.Sprintf("qr-quarantine:%s", id)
+	urls, err := redisClient.Cmd("HKEYS", key).List()
+	if err != nil {
+		AnError(www, req, 500, "Config Error 38")
+		return
+	}
+	if xurl := GetParam(www, req, "url", ""); xurl != "" {
+		urls = []string{xurl}
+	}
+	released := ThreatHit{User: AuthUser(req), Time: time.Now().Unix()}
+	for _, xurl := range urls {
+		n, err := redisClient.Cmd("HDEL", key, xurl).Int()
+		if err != nil || n == 0 {
+			AnError(www, req, 404, "Not Found")
+			return
+		}
+		released.URL = xurl
+		redisClient.Cmd("HSET", fmt.Sprintf("qr-quarantine-released:%s", id), xurl, SVar(released))
+	}
+	if n, _ := redisClient.Cmd("HLEN", key).Int(); n == 0 {
+		redisClient.Cmd("SREM", "qr-quarantine-ids", id)
+	}
+
+	www.Header().Set("Content-Type", "application/json; charset=utf-8")
+	fmt.Fprintf(www, `{"status":"success"}`)
+}
+
+/* vim: set noai ts=4 sw=4: */
@@ -0,0 +1,174 @@
+package main
+
+// MIT Licensed - see LICENSE
+
+import (
+	"io/ioutil"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestThreatExpressions(t *testing.T) {
+	tests := []struct {
+		raw      string
+		expected []string
+	}{
+		{"http://a.b.c/1/2.html?param=1", []string{
+			"a.b.c/1/2.html?param=1", "a.b.c/1/2.html", "a.b.c/", "a.b.c/1/",
+			"b.c/1/2.html?param=1", "b.c/1/2.html", "b.c/", "b.c/1/",
+		}},
+		{"http://1.2.3.4/1/", []string{"1.2.3.4/1/", "1.2.3.4/"}},
+		{"http://a.b.c.d.e.f.g/1.html", []string{
+			"a.b.c.d.e.f.g/1.html", "a.b.c.d.e.f.g/",
+			"c.d.e.f.g/1.html", "c.d.e.f.g/",
+			"d.e.f.g/1.html", "d.e.f.g/",
+			"e.f.g/1.html", "e.f.g/",
+			"f.g/1.html", "f.g/",
+		}},
+	}
+
+	for ii, test := range tests {
+		u, _ := url.Parse(test.raw)
+		got := ThreatExpressions(u)
+		if !reflect.DeepEqual(got, test.expected) {
+			t.Errorf("Test %d, expected %s got %s\n", ii, SVar(test.expected), SVar(got))
+		}
+	}
+}
+
+func TestCheckThreat(t *testing.T) {
+	gCfg.ThreatURLFile = "./testdata/urlhaus.csv"
+	gCfg.ThreatHashFile = "./testdata/threat-hash.txt"
+	defer func() { gCfg.ThreatURLFile, gCfg.ThreatHashFile = "", "" }()
+
+	tests := []struct {
+		raw      string
+		expected string
+	}{
+		{"http://malware.test/payload.exe", "url"},
+		{"http://phish.test/", "url"},
+		{"http://malware.test/other.exe", ""},
+		{"https://www.bad.example.org/any/path?x=1", "hash"},
+		{"https://example.net/login/form.php", "hash"},
+		{"https://example.net/logout/", ""},
+		{"https://example.com/", ""},
+		{"tel:+1-555-0100", ""},
+	}
+
+	for ii, test := range tests {
+		got := CheckThreat(test.raw)
+		if got != test.expected {
+			t.Errorf("Test %d, %s expected %q got %q\n", ii, test.raw, test.expected, got)
+		}
+	}
+}
+
+func TestThreatListReload(t *testing.T) {
+	defer func(fn string, interval time.Duration) {
+		gCfg.ThreatURLFile, threatCheckInterval = fn, interval
+	}(gCfg.ThreatURLFile, threatCheckInterval)
+
+	fh, err := ioutil.TempFile("", "threat-*.txt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	fn := fh.Name()
+	fh.Close()
+	defer os.Remove(fn)
+	gCfg.ThreatURLFile = fn
+
+	tests := []struct {
+		list     string
+		interval time.Duration
+		expected string
+	}{
+		{list: "http://one.test/\n", interval: time.Hour, expected: "url"},
+		{list: "http://two.test/\n", interval: time.Hour, expected: "url"}, // not looked at again yet
+		{list: "http://two.test/\n", interval: 0, expected: ""},
+	}
+	for ii, test := range tests {
+		ioutil.WriteFile(fn, []byte(test.list), 0644)
+		mt := time.Now().Add(time.Duration(ii) * time.Minute)
+		os.Chtimes(fn, mt, mt)
+		threatCheckInterval = test.interval
+		if got := CheckThreat("http://one.test/"); got != test.expected {
+			t.Errorf("Test %d, expected %q got %q\n", ii, test.expected, got)
+		}
+	}
+}
+
+func TestQuarantineRelease(t *testing.T) {
+	_, done := testRedis(t)
+	defer done()
+	defer func(fn, admins string) { gCfg.ThreatURLFile, gCfg.AdminUsers = fn, admins }(gCfg.ThreatURLFile, gCfg.AdminUsers)
+	gCfg.ThreatURLFile, gCfg.AdminUsers = "./testdata/urlhaus.csv", "root"
+
+	bad := "http://malware.test/payload.exe"
+	redisClient.Cmd("MSET", "qr-token:bob", "bob", "qr-token:root", "root")
+
+	tests := []struct {
+		token       string
+		query       string
+		code        int
+		quarantined bool // IsQuarantined after
+	}{
+		{token: "", query: "", code: 0, quarantined: true},
+		{token: "bob", query: "id=10001", code: 403, quarantined: true},
+		{token: "root", query: "id=10001&url=http://other.test/", code: 404, quarantined: true},
+		{token: "root", query: "id=10001", code: 200, quarantined: false},
+		{token: "", query: "", code: 0, quarantined: false}, // still on the list, but released
+	}
+	for ii, test := range tests {
+		if test.token != "" {
+			req := httptest.NewRequest("GET", "/api/quarantine-release?"+test.query, nil)
+			req.Header.Set("X-Auth", test.token)
+			rec := httptest.NewRecorder()
+			respHandlerQuarantineRelease(rec, req)
+			if rec.Code != test.code {
+				t.Errorf("Test %d, expected %d got %d %s\n", ii, test.code, rec.Code, rec.Body.String())
+			}
+		}
+		if got := IsQuarantined("10001", bad); got != test.quarantined {
+			t.Errorf("Test %d, expected quarantined %v got %v\n", ii, test.quarantined, got)
+		}
+	}
+	if IsQuarantined("10002", bad) != true {
+		t.Errorf("Expected the release to be for 10001 only\n")
+	}
+}
+
+func TestIsAdmin(t *testing.T) {
+	_, done := testRedis(t)
+	defer done()
+	defer func(admins string) { gCfg.AdminUsers = admins }(gCfg.AdminUsers)
+
+	redisClient.Cmd("MSET", "qr-token:bob", "bob", "qr-token:root", "root")
+	tests := []struct {
+		admins   string
+		token    string
+		expected bool
+	}{
+		{admins: "", token: "bob", expected: false},
+		{admins: "", token: "", expected: false},
+		{admins: "root", token: "root", expected: true},
+		{admins: "alice, root", token: "root", expected: true},
+		{admins: "root", token: "bob", expected: false},
+		{admins: "root", token: "", expected: false},
+	}
+	for ii, test := range tests {
+		gCfg.AdminUsers = test.admins
+		req := httptest.NewRequest("GET", "/api/quarantine-list", nil)
+		if test.token != "" {
+			req.Header.Set("X-Auth", test.token)
+		}
+		if got := IsAdmin(req); got != test.expected {
+			t.Errorf("Test %d, expected %v got %v\n", ii, test.expected, got)
+		}
+	}
+}
+
+/* vim: set noai ts=4 sw=4: */
@@ -0,0 +1,175 @@
+package main
+
+// MIT Licensed - see LICENSE
+
+import (
+	"crypto/tls"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"os/signal"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// Native TLS.
+//
+// If tls_cert and tls_key are set the server listens with TLS.  The certificate is loaded again on SIGHUP
+// and when either file changes, checked every tls_reload seconds, so a renewal does not need a restart.
+// A bad pair of files is logged and the old certificate is kept.  redirect_http is an optional plain
+// listener that only sends clients on to HTTPS, at the public_base_url if that is https.
+
+// CertLoader holds the current certificate.
+type CertLoader struct {
+	certFile, keyFile string
+	lock              sync.RWMutex
+	cert              *tls.Certificate
+	certMod, keyMod   time.Time
+}
+
+// NewCertLoader loads the certificate and key, it is an error if they can not be loaded.
+func NewCertLoader(certFile, keyFile string) (*CertLoader, error) {
+	cl := &CertLoader{certFile: certFile, keyFile: keyFile}
+	if err := cl.Reload(); err != nil {
+		return nil, err
+	}
+	return cl, nil
+}
+
+func modTime(fn string) time.Time {
+	if fi, err := os.Stat(fn); err == nil {
+		return fi.ModTime()
+	}
+	return time.Time{}
+}
+
+// Reload reads the files again.
+func (cl *CertLoader) Reload() error {
+	certMod, keyMod := modTime(cl.certFile), modTime(cl.keyFile)
+	cert, err := tls.LoadX509KeyPair(cl.certFile, cl.keyFile)
+	if err != nil {
+		return fmt.Errorf("Unable to load certificate %s, key %s: %s", cl.certFile, cl.keyFile, err)
+	}
+	cl.lock.Lock()
+	cl.cert, cl.certMod, cl.keyMod = &cert, certMod, keyMod
+	cl.lock.Unlock()
+	return nil
+}
+
+// Changed is true if either file has been changed since it was loaded.
+func (cl *CertLoader) Changed() bool {
+	cl.lock.RLock()
+	defer cl.lock.RUnlock()
+	return !modTime(cl.certFile).Equal(cl.certMod) || !modTime(cl.keyFile).Equal(cl.keyMod)
+}
+
+// GetCertificate is the tls.Config callback.
+func (cl *CertLoader) GetCertificate(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+	cl.lock.RLock()
+	defer cl.lock.RUnlock()
+	return cl.cert, nil
+}
+
+// Watch reloads the certificate on SIGHUP and, if interval is not 0, when the files change.  It does not
+// return.
+func (cl *CertLoader) Watch(interval time.Duration) {
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+	var tick <-chan time.Time
+	if interval > 0 {
+		tick = time.NewTicker(interval).C
+	}
+	for {
+		select {
+		case <-hup:
+		case <-tick:
+			if !cl.Changed() {
+				continue
+			}
+		}
+		if err := cl.Reload(); err != nil {
+			logger.Error("unable to reload certificate, keeping the old one", "error", err)
+		} else {
+			logger.Info("loaded certificate", "file", cl.certFile)
+		}
+	}
+}
+
+// TLSConfig is TLS 1.2 and up with forward secret AEAD ciphers only, certificates come from cl.
+func TLSConfig(cl *CertLoader) *tls.Config {
+	return &tls.Config{
+		MinVersion:       tls.VersionTLS12,
+		GetCertificate:   cl.GetCertificate,
+		CurvePreferences: []tls.CurveID{tls.X25519, tls.CurveP256},
+		CipherSuites: []uint16{ // TLS 1.2, 1.3 suites are not configurable
+			tls.TLS_ECDHE_ECDSA_WITH_AES_128_GCM_SHA256,
+			tls.TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256,
+			tls.TLS_ECDHE_ECDSA_WITH_AES_256_GCM_SHA384,
+			tls.TLS_ECDHE_RSA_WITH_AES_256_GCM_SHA384,
+			tls.TLS_ECDHE_ECDSA_WITH_CHACHA20_POLY1305,
+			tls.TLS_ECDHE_RSA_WITH_CHACHA20_POLY1305,
+		},
+		NextProtos: []string{"h2", "http/1.1"},
+	}
+}
+
+// HSTS adds a Strict-Transport-Security header to responses sent over TLS.  subDomains adds
+// includeSubDomains, which stops browsers using plain HTTP on every host under ours.
+func HSTS(maxAge int, subDomains bool, h http.Handler) http.Handler {
+	if maxAge <= 0 {
+		return h
+	}
+	value := fmt.Sprintf("max-age=%d", maxAge)
+	if subDomains {
+		value += "; includeSubDomains"
+	}
+	return http.HandlerFunc(func(www http.ResponseWriter, req *http.Request) {
+		if req.TLS != nil {
+			www.Header().Set("Strict-Transport-Security", value)
+		}
+		h.ServeHTTP(www, req)
+	})
+}
+
+// httpsHost is the host and port of base if it is an https URL.
+func httpsHost(base string) (string, bool) {
+	u, err := url.Parse(base)
+	if err != nil || u.Scheme != "https" || u.Host == "" {
+		return "", false
+	}
+	return u.Host, true
+}
+
+// RedirectHTTPS sends every request on to the same URL over HTTPS.  The host and port are those of the
+// base URL for the request's host, the custom domain or public_base_url, when it is https.  Otherwise the
+// request's host is kept with the port of tlsAddr.  GET and HEAD get a 301, anything else a 308 so the
+// method and body are kept.
+func RedirectHTTPS(tlsAddr string) http.Handler {
+	_, port, _ := net.SplitHostPort(tlsAddr)
+	return http.HandlerFunc(func(www http.ResponseWriter, req *http.Request) {
+		host := hostName(req.Host)
+		if host == "" {
+			AnError(www, req, 400, "Missing Host")
+			return
+		}
+		base := BaseURL()
+		if !ScansDefault(host) {
+			base, _ = CustomBaseURL(host)
+		}
+		if h, ok := httpsHost(base); ok {
+			host = h
+		} else if port != "" && port != "443" {
+			host = net.JoinHostPort(host, port)
+		}
+		code := http.StatusMovedPermanently
+		if req.Method != "GET" && req.Method != "HEAD" {
+			code = http.StatusPermanentRedirect
+		}
+		http.Redirect(www, req, "https://"+host+req.URL.RequestURI(), code)
+	})
+}
+
+/* vim: set noai ts=4 sw=4: */
@@ -0,0 +1,189 @@
+package main
+
+// MIT Licensed - see LICENSE
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"io/ioutil"
+	"math/big"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// writeSelfSigned writes a self-signed certificate for 127.0.0.1 with the serial number and returns it
+// for the client to trust.
+func writeSelfSigned(t *testing.T, certFile, keyFile string, serial int64) *x509.Certificate {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatalf("GenerateKey: %s\n", err)
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(serial),
+		Subject:      pkix.Name{CommonName: "qr-svr test"},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+		IPAddresses:  []net.IP{net.ParseIP("127.0.0.1")},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	if err != nil {
+		t.Fatalf("CreateCertificate: %s\n", err)
+	}
+	kder, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatalf("MarshalECPrivateKey: %s\n", err)
+	}
+	ioutil.WriteFile(certFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0600)
+	ioutil.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: kder}), 0600)
+	cert, _ := x509.ParseCertificate(der)
+	return cert
+}
+
+func TestCertLoader(t *testing.T) {
+	dir, err := ioutil.TempDir("", "qr-tls")
+	if err != nil {
+		t.Fatalf("TempDir: %s\n", err)
+	}
+	defer os.RemoveAll(dir)
+	certFile, keyFile := filepath.Join(dir, "cert.pem"), filepath.Join(dir, "key.pem")
+
+	if _, err := NewCertLoader(certFile, keyFile); err == nil {
+		t.Errorf("Expected an error with no files\n")
+	}
+
+	first := writeSelfSigned(t, certFile, keyFile, 1)
+	cl, err := NewCertLoader(certFile, keyFile)
+	if err != nil {
+		t.Fatalf("NewCertLoader: %s\n", err)
+	}
+
+	ts := httptest.NewUnstartedServer(HSTS(300, false, http.HandlerFunc(func(www http.ResponseWriter, req *http.Request) {
+		www.Write([]byte("ok"))
+	})))
+	ts.Listener = tls.NewListener(ts.Listener, TLSConfig(cl)) // httptest's StartTLS would add its own certificate
+	ts.Start()
+	defer ts.Close()
+	url := "https://" + ts.Listener.Addr().String()
+
+	get := func(trust *x509.Certificate) (*http.Response, error) {
+		pool := x509.NewCertPool()
+		pool.AddCert(trust)
+		client := &http.Client{Transport: &http.Transport{TLSClientConfig: &tls.Config{RootCAs: pool}}}
+		return client.Get(url)
+	}
+
+	resp, err := get(first)
+	if err != nil {
+		t.Fatalf("GET: %s\n", err)
+	}
+	resp.Body.Close()
+	if h := resp.Header.Get("Strict-Transport-Security"); h != "max-age=300" {
+		t.Errorf("Expected an HSTS header, got %q\n", h)
+	}
+	if resp.TLS.Version < tls.VersionTLS12 {
+		t.Errorf("Expected TLS 1.2 or later, got %x\n", resp.TLS.Version)
+	}
+
+	// Replace the files, the new certificate is used once it is reloaded.
+	second := writeSelfSigned(t, certFile, keyFile, 2)
+	os.Chtimes(certFile, time.Now().Add(time.Minute), time.Now().Add(time.Minute)) // in case the clock has not moved on
+	if !cl.Changed() {
+		t.Errorf("Expected the change to be seen\n")
+	}
+	if err := cl.Reload(); err != nil {
+		t.Fatalf("Reload: %s\n", err)
+	}
+	if cl.Changed() {
+		t.Errorf("Expected no change after the reload\n")
+	}
+	resp, err = get(second)
+	if err != nil {
+		t.Fatalf("GET after reload: %s\n", err)
+	}
+	resp.Body.Close()
+	if sn := resp.TLS.PeerCertificates[0].SerialNumber.Int64(); sn != 2 {
+		t.Errorf("Expected the new certificate, got serial %d\n", sn)
+	}
+
+	// A bad file keeps the old certificate.
+	ioutil.WriteFile(keyFile, []byte("junk"), 0600)
+	if err := cl.Reload(); err == nil {
+		t.Errorf("Expected an error with a bad key\n")
+	}
+	if c, _ := cl.GetCertificate(nil); c == nil {
+		t.Errorf("Expected the old certificate to be kept\n")
+	}
+}
+
+func TestHSTSSubDomains(t *testing.T) {
+	tests := []struct {
+		subDomains bool
+		expected   string
+	}{
+		{false, "max-age=300"},
+		{true, "max-age=300; includeSubDomains"},
+	}
+	for ii, test := range tests {
+		req := httptest.NewRequest("GET", "/", nil)
+		req.TLS = &tls.ConnectionState{}
+		rec := httptest.NewRecorder()
+		HSTS(300, test.subDomains, http.NotFoundHandler()).ServeHTTP(rec, req)
+		if h := rec.Header().Get("Strict-Transport-Security"); h != test.expected {
+			t.Errorf("Test %d, expected %q got %q\n", ii, test.expected, h)
+		}
+	}
+}
+
+func TestRedirectHTTPS(t *testing.T) {
+	defer func() { gCfg.PublicBaseURL = ""; SetDomains(nil, nil) }()
+
+	tests := []struct {
+		base     string // public_base_url
+		domains  bool   // go.brand-a.com is registered
+		tlsAddr  string
+		method   string
+		url      string
+		host     string
+		code     int
+		location string
+	}{
+		{"", false, ":443", "GET", "/Q/10001?a=1", "qr.example.com", 301, "https://qr.example.com/Q/10001?a=1"},
+		{"", false, ":8443", "GET", "/Q/10001", "qr.example.com:8080", 301, "https://qr.example.com:8443/Q/10001"},
+		{"", false, ":443", "POST", "/api/gen-qr", "qr.example.com", 308, "https://qr.example.com/api/gen-qr"},
+		{"", false, "", "HEAD", "/", "qr.example.com", 301, "https://qr.example.com/"},
+		{"https://qr.example.com", false, ":8443", "GET", "/Q/10001", "backend:8080", 301, "https://qr.example.com/Q/10001"},
+		{"https://qr.example.com:4443", false, ":8443", "GET", "/Q/10001", "qr.example.com", 301, "https://qr.example.com:4443/Q/10001"},
+		{"http://qr.example.com", false, ":8443", "GET", "/Q/10001", "qr.example.com", 301, "https://qr.example.com:8443/Q/10001"},
+		{"https://qr.example.com", true, ":8443", "GET", "/Q/promo", "go.brand-a.com", 301, "https://go.brand-a.com/Q/promo"},
+		{"https://qr.example.com", true, ":8443", "GET", "/Q/10001", "qr.example.com", 301, "https://qr.example.com/Q/10001"},
+	}
+
+	for ii, test := range tests {
+		gCfg.PublicBaseURL = test.base
+		SetDomains(nil, nil)
+		if test.domains {
+			SetDomains(map[string]DomainType{"go.brand-a.com": {Host: "go.brand-a.com", BaseURL: "https://go.brand-a.com"}}, nil)
+		}
+		req := httptest.NewRequest(test.method, test.url, nil)
+		req.Host = test.host
+		rec := httptest.NewRecorder()
+		RedirectHTTPS(test.tlsAddr).ServeHTTP(rec, req)
+		if rec.Code != test.code || rec.Header().Get("Location") != test.location {
+			t.Errorf("Test %d, expected %d %s got %d %s\n", ii, test.code, test.location, rec.Code, rec.Header().Get("Location"))
+		}
+	}
+}
+
+/* vim: set noai ts=4 sw=4: */
@@ -0,0 +1,166 @@
+package main
+
+// MIT Licensed - see LICENSE
+
+import (
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+
+	"github.com/pschlump/json"
+)
+
+// UTMType is the set of UTM tags added to the target URL on redirect.  The per-QR tags are kept in
+// qr-utm:{id}, any tag that is not set there comes from the global config.  A "{id}" in a tag is replaced
+// with the QR ID.  Passthrough, if set, overrides gCfg.UTMPassthrough for the QR.
+type UTMType struct {
+	Source      string `json:"utm_source,omitempty"`
+	Medium      string `json:"utm_medium,omitempty"`
+	Campaign    string `json:"utm_campaign,omitempty"`
+	Term        string `json:"utm_term,omitempty"`
+	Content     string `json:"utm_content,omitempty"`
+	Passthrough *bool  `json:"passthrough,omitempty"`
+}
+
+// GetUTM returns the UTM tags for id merged over the global defaults.
+func GetUTM(id string) (utm UTMType) {
+	if s, err := redisClient.Cmd("GET", fmt.Sprintf("qr-utm:%s", id)).Str(); err == nil {
+		json.Unmarshal([]byte(s), &utm)
+	}
+	dflt := func(v *string, d string) {
+		if *v == "" {
+			*v = d
+		}
+	}
+	dflt(&utm.Source, gCfg.UTMSource)
+	dflt(&utm.Medium, gCfg.UTMMedium)
+	dflt(&utm.Campaign, gCfg.UTMCampaign)
+	if utm.Passthrough == nil {
+		pt := gCfg.UTMPassthrough
+		utm.Passthrough = &pt
+	}
+	return
+}
+
+// AddQueryParams adds the UTM tags and, if passthrough is on, the incoming query parameters to target.
+// Parameters already in target are never replaced, and passed through parameters take precedence over
+// the UTM tags.  The target's own query string is left as it is, the new parameters are appended
+// URL encoded.  Targets that are not http or https are returned unchanged.
+func AddQueryParams(target, id string, utm UTMType, incoming url.Values) string {
+	u, err := url.Parse(target)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") {
+		return target
+	}
+	have := u.Query()
+	extra := url.Values{}
+	add := func(name, value string) {
+		if value == "" {
+			return
+		}
+		if _, ok := have[name]; ok {
+			return
+		}
+		if _, ok := extra[name]; ok {
+			return
+		}
+		extra.Set(name, strings.Replace(value, "{id}", id, -1))
+	}
+	if utm.Passthrough != nil && *utm.Passthrough {
+		for name, vals := range incoming {
+			if _, ok := have[name]; ok || len(vals) == 0 {
+				continue
+			}
+			extra[name] = vals
+		}
+	}
+	add("utm_source", utm.Source)
+	add("utm_medium", utm.Medium)
+	add("utm_campaign", utm.Campaign)
+	add("utm_term", utm.Term)
+	add("utm_content", utm.Content)
+	if len(extra) == 0 {
+		return target
+	}
+	if u.RawQuery == "" {
+		u.RawQuery = extra.Encode()
+	} else {
+		u.RawQuery = u.RawQuery + "&" + extra.Encode()
+	}
+	return u.String()
+}
+
+/*
+/api/set-utm?id=ID&utm_source=S&utm_medium=M&utm_campaign=C&utm_term=T&utm_content=X&passthrough=true
+Replaces the UTM tags for the QR.  Tags that are left out use the global defaults.
+*/
+func respHandlerSetUTM(www http.ResponseWriter, req *http.Request) {
+	if !CheckAuth(www, req) {
+		return
+	}
+
+	id := GetParam(www, req, "id", "")
+	if id == "" {
+		AnError(www, req, 406, "Missing Parameter")
+		return
+	}
+
+	if _, err := redisClient.Cmd("GET", fmt.Sprintf("qrr:%s", id)).Str(); err != nil {
+		AnError(www, req, 404, "Not Found")
+		return
+	}
+
+	utm := UTMType{
+		Source:   GetParam(www, req, "utm_source", ""),
+		Medium:   GetParam(www, req, "utm_medium", ""),
+		Campaign: GetParam(www, req, "utm_campaign", ""),
+		Term:     GetParam(www, req, "utm_term", ""),
+		Content:  GetParam(www, req, "utm_content", ""),
+	}
+	switch GetParam(www, req, "passthrough", "") {
+	case "":
+	case "true", "yes", "1":
+		pt := true
+		utm.Passthrough = &pt
+	case "false", "no", "0":
+		pt := false
+		utm.Passthrough = &pt
+	default:
+		AnError(www, req, 406, "Invalid passthrough")
+		return
+	}
+
+	key := fmt.Sprintf("qr-utm:%s", id)
+	if utm == (UTMType{}) {
+		redisClient.Cmd("DEL", key)
+	} else {
+		err := redisClient.Cmd("SET", key, SVar(utm)).Err
+		if err != nil {
+			AnError(www, req, 500, "Config Error 24")
+			return
+		}
+	}
+
+	www.Header().Set("Content-Type", "application/json; charset=utf-8")
+	fmt.Fprintf(www, `{"status":"success","utm":%s}`+"\n", SVar(GetUTM(id)))
+}
+
+/*
+/api/get-utm?id=ID - the tags that will be used, after merging with the global defaults.
+*/
+func respHandlerGetUTM(www http.ResponseWriter, req *http.Request) {
+	if !CheckAuth(www, req) {
+		return
+	}
+
+	id := GetParam(www, req, "id", "")
+	if id == "" {
+		AnError(www, req, 406, "Missing Parameter")
+		return
+	}
+
+	www.Header().Set("Content-Type", "application/json; charset=utf-8")
+	fmt.Fprintf(www, `{"status":"success","utm":%s}`+"\n", SVar(GetUTM(id)))
+}
+
+/* vim: set noai ts=4 sw=4: */
@@ -0,0 +1,39 @@
+package main
+
+// MIT Licensed - see LICENSE
+
+import (
+	"net/url"
+	"testing"
+)
+
+func TestAddQueryParams(t *testing.T) {
+	yes := true
+	no := false
+	tags := UTMType{Source: "qr", Medium: "print", Campaign: "flyer-{id}", Passthrough: &no}
+	pass := UTMType{Source: "qr", Passthrough: &yes}
+
+	tests := []struct {
+		target   string
+		utm      UTMType
+		incoming string
+		expected string
+	}{
+		{"http://example.com/", tags, "", "http://example.com/?utm_campaign=flyer-10001&utm_medium=print&utm_source=qr"},
+		{"http://example.com/a?x=1&utm_source=mine#top", tags, "", "http://example.com/a?x=1&utm_source=mine&utm_campaign=flyer-10001&utm_medium=print#top"},
+		{"http://example.com/a", tags, "b=2", "http://example.com/a?utm_campaign=flyer-10001&utm_medium=print&utm_source=qr"},
+		{"http://example.com/a?b=1", pass, "b=2&c=a+b%26c&utm_source=poster", "http://example.com/a?b=1&c=a+b%26c&utm_source=poster"},
+		{"http://example.com/你好", pass, "", "http://example.com/%E4%BD%A0%E5%A5%BD?utm_source=qr"},
+		{"mailto:bob@example.com", tags, "", "mailto:bob@example.com"},
+	}
+
+	for ii, test := range tests {
+		incoming, _ := url.ParseQuery(test.incoming)
+		got := AddQueryParams(test.target, "10001", test.utm, incoming)
+		if got != test.expected {
+			t.Errorf("Test %d, expected %s got %s\n", ii, test.expected, got)
+		}
+	}
+}
+
+/* vim: set noai ts=4 sw=4: */
@@ -0,0 +1,231 @@
+package main
+
+// MIT Licensed - see LICENSE
+
+import (
+	"bufio"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// ValidationError is one problem with a parameter.  They are returned to the client as JSON so the
+// client can tell which field was wrong and why.
+type ValidationError struct {
+	Field string `json:"field"`
+	Code  string `json:"code"` // invalid_url, too_long, scheme_not_allowed, credentials_not_allowed, domain_blocked, domain_not_allowed
+	Value string `json:"value"`
+	Msg   string `json:"msg"`
+}
+
+func (ve *ValidationError) Error() string {
+	return fmt.Sprintf("%s: %s", ve.Field, ve.Msg)
+}
+
+// Validator collects the validation errors for a request, and the URLs that are on a threat list.
+// Those are not errors, the change is made and the URLs are quarantined.
+type Validator struct {
+	Errors  []*ValidationError
+	Threats []ThreatHit
+}
+
+// URL validates and normalizes the target URL in *p, replacing it with the normalized form.
+func (vv *Validator) URL(field string, p *string) {
+	n, ve := ValidateTargetURL(field, *p)
+	if ve != nil {
+		vv.Errors = append(vv.Errors, ve)
+		return
+	}
+	*p = n
+	if list := CheckThreat(n); list != "" {
+		vv.Threats = append(vv.Threats, ThreatHit{Field: field, URL: n, List: list, Time: time.Now().Unix()})
+	}
+}
+
+// Send reports the errors, if there are any, with a 406 and returns true.
+func (vv *Validator) Send(www http.ResponseWriter, req *http.Request) bool {
+	if len(vv.Errors) == 0 {
+		return false
+	}
+	LogReq(req, LevelWarn, "validation failed", "status", 406, "errors", vv.Errors)
+	www.Header().Set("Content-Type", "application/json; charset=utf-8")
+	www.WriteHeader(406)
+	fmt.Fprintf(www, `{"status":"error","errors":%s}`+"\n", SVar(vv.Errors))
+	return true
+}
+
+const maxURLLength = 2048
+
+// ValidateTargetURL checks that raw is an absolute URL with an allowed scheme that is not going to a
+// blocked domain, and returns it normalized: scheme and host lower case, default port removed and an
+// empty path set to "/".  A bare "example.com/x" is taken to be https.
+func ValidateTargetURL(field, raw string) (string, *ValidationError) {
+	bad := func(code, msg string) (string, *ValidationError) {
+		return "", &ValidationError{Field: field, Code: code, Value: raw, Msg: msg}
+	}
+
+	s := strings.TrimSpace(raw)
+	if s == "" {
+		return bad("invalid_url", "URL is empty")
+	}
+	if len(s) > maxURLLength {
+		return bad("too_long", fmt.Sprintf("URL is longer than %d characters", maxURLLength))
+	}
+	for _, c := range s {
+		if c < ' ' || c == 0x7f || c == ' ' {
+			return bad("invalid_url", "URL contains spaces or control characters")
+		}
+	}
+	if !strings.Contains(s, ":") && looksLikeHost(s) {
+		s = "https://" + s
+	}
+
+	u, err := url.Parse(s)
+	if err != nil {
+		return bad("invalid_url", "URL can not be parsed")
+	}
+	if u.Scheme == "" {
+		return bad("invalid_url", "URL must be absolute")
+	}
+	u.Scheme = strings.ToLower(u.Scheme)
+	if !schemeAllowed(u.Scheme) {
+		return bad("scheme_not_allowed", fmt.Sprintf("Scheme %q is not allowed", u.Scheme))
+	}
+
+	if u.Scheme != "http" && u.Scheme != "https" {
+		if u.Opaque == "" && u.Path == "" {
+			return bad("invalid_url", fmt.Sprintf("Missing value after %s:", u.Scheme))
+		}
+		return u.String(), nil
+	}
+
+	if u.User != nil {
+		return bad("credentials_not_allowed", "URL must not contain a username or password")
+	}
+	host := strings.ToLower(u.Hostname())
+	if host == "" || strings.Contains(host, "%") || strings.HasPrefix(host, ".") || strings.HasSuffix(host, ".") {
+		return bad("invalid_url", "URL has an invalid host")
+	}
+	if ip := net.ParseIP(host); ip == nil && !strings.Contains(host, ".") && host != "localhost" {
+		return bad("invalid_url", "URL has an invalid host")
+	}
+	port := u.Port()
+	if (u.Scheme == "http" && port == "80") || (u.Scheme == "https" && port == "443") {
+		port = ""
+	}
+	u.Host = host
+	if port != "" {
+		u.Host = net.JoinHostPort(host, port)
+	} else if strings.Contains(host, ":") {
+		u.Host = "[" + host + "]"
+	}
+	if u.Path == "" {
+		u.Path = "/"
+	}
+
+	if code, msg := CheckDomain(host); code != "" {
+		return bad(code, msg)
+	}
+	return u.String(), nil
+}
+
+func looksLikeHost(s string) bool {
+	h := s
+	if i := strings.IndexAny(h, "/?#"); i >= 0 {
+		h = h[:i]
+	}
+	return strings.Contains(h, ".") && !strings.HasPrefix(h, ".")
+}
+
+func schemeAllowed(scheme string) bool {
+	for _, s := range strings.Split(gCfg.URLSchemes, ",") {
+		if strings.TrimSpace(strings.ToLower(s)) == scheme {
+			return true
+		}
+	}
+	return false
+}
+
+// DomainList is a set of domains read from a file, one per line, # for comments.  A domain also matches
+// all of its sub-domains.  The file is read again if it changes.
+type DomainList struct {
+	fn      string
+	modTime time.Time
+	domains map[string]bool
+	lock    sync.Mutex
+}
+
+var allowDomains, blockDomains DomainList
+
+// Match is true if host or one of its parent domains is in the list.  ok is false if there is no list.
+func (dl *DomainList) Match(fn, host string) (match, ok bool) {
+	dl.lock.Lock()
+	defer dl.lock.Unlock()
+	if fn == "" {
+		return false, false
+	}
+	if fi, err := os.Stat(fn); err == nil && (fn != dl.fn || !fi.ModTime().Equal(dl.modTime)) {
+		if domains, err := readDomainList(fn); err == nil {
+			dl.fn, dl.modTime, dl.domains = fn, fi.ModTime(), domains
+		} else {
+			logger.Error("unable to read domain list", "file", fn, "error", err)
+		}
+	}
+	if dl.fn != fn {
+		return false, false
+	}
+	for h := host; h != ""; {
+		if dl.domains[h] {
+			return true, true
+		}
+		i := strings.Index(h, ".")
+		if i < 0 {
+			break
+		}
+		h = h[i+1:]
+	}
+	return false, true
+}
+
+func readDomainList(fn string) (map[string]bool, error) {
+	fh, err := os.Open(fn)
+	if err != nil {
+		return nil, err
+	}
+	defer fh.Close()
+	domains := make(map[string]bool)
+	scanner := bufio.NewScanner(fh)
+	for scanner.Scan() {
+		line := scanner.Text()
+		if i := strings.Index(line, "#"); i >= 0 {
+			line = line[:i]
+		}
+		line = strings.TrimPrefix(strings.ToLower(strings.TrimSpace(line)), "*.")
+		if line != "" {
+			domains[line] = true
+		}
+	}
+	return domains, scanner.Err()
+}
+
+// CheckDomain returns a validation code and message if host is on the block list or, when there is an
+// allow list, not on it.  Our own host is always allowed.
+func CheckDomain(host string) (code, msg string) {
+	if m, _ := blockDomains.Match(gCfg.DomainBlockFile, host); m {
+		return "domain_blocked", fmt.Sprintf("Domain %s is blocked", host)
+	}
+	if IsOwnHost(host) {
+		return "", ""
+	}
+	if m, ok := allowDomains.Match(gCfg.DomainAllowFile, host); ok && !m {
+		return "domain_not_allowed", fmt.Sprintf("Domain %s is not on the allow list", host)
+	}
+	return "", ""
+}
+
+/* vim: set noai ts=4 sw=4: */
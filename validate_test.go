@@ -0,0 +1,63 @@
+package main
+
+// MIT Licensed - see LICENSE
+
+import (
+	"testing"
+)
+
+func TestValidateTargetURL(t *testing.T) {
+	defer func(schemes, hostPort, block, allow string) {
+		gCfg.URLSchemes, gCfg.HostPort, gCfg.DomainBlockFile, gCfg.DomainAllowFile = schemes, hostPort, block, allow
+	}(gCfg.URLSchemes, gCfg.HostPort, gCfg.DomainBlockFile, gCfg.DomainAllowFile)
+	gCfg.URLSchemes = "http,https,tel,mailto"
+	gCfg.HostPort = "localhost:8333"
+	gCfg.DomainBlockFile = "./testdata/block.txt"
+	gCfg.DomainAllowFile = ""
+
+	tests := []struct {
+		raw      string
+		expected string
+		code     string
+	}{
+		{"http://Example.COM", "http://example.com/", ""},
+		{"HTTPS://example.com:443/a?b=1#c", "https://example.com/a?b=1#c", ""},
+		{"www.example.com/menu", "https://www.example.com/menu", ""},
+		{"http://example.com:8080/x", "http://example.com:8080/x", ""},
+		{"tel:+1-555-0100", "tel:+1-555-0100", ""},
+		{"mailto:bob@example.com", "mailto:bob@example.com", ""},
+		{"javascript:alert(1)", "", "scheme_not_allowed"},
+		{"/relative/junk", "", "invalid_url"},
+		{"not a url", "", "invalid_url"},
+		{"http://user:pw@example.com/", "", "credentials_not_allowed"},
+		{"http://bad.example.com/x", "", "domain_blocked"},
+		{"https://www.evil.test/", "", "domain_blocked"},
+		{"http://localhost:8333/404page.html", "http://localhost:8333/404page.html", ""},
+	}
+
+	for ii, test := range tests {
+		got, ve := ValidateTargetURL("url", test.raw)
+		if test.code != "" {
+			if ve == nil || ve.Code != test.code {
+				t.Errorf("Test %d, expected error %s got %v %s\n", ii, test.code, ve, got)
+			}
+			continue
+		}
+		if ve != nil || got != test.expected {
+			t.Errorf("Test %d, expected %s got %s error %v\n", ii, test.expected, got, ve)
+		}
+	}
+
+	gCfg.DomainAllowFile = "./testdata/allow.txt"
+	if _, ve := ValidateTargetURL("url", "https://shop.example.com/"); ve != nil {
+		t.Errorf("Expected sub-domain of an allowed domain to pass got %s\n", ve)
+	}
+	if _, ve := ValidateTargetURL("url", "https://example.org/"); ve == nil || ve.Code != "domain_not_allowed" {
+		t.Errorf("Expected domain_not_allowed got %v\n", ve)
+	}
+	if _, ve := ValidateTargetURL("url", "http://localhost:8333/404page.html"); ve != nil {
+		t.Errorf("Expected our own host to be allowed got %s\n", ve)
+	}
+}
+
+/* vim: set noai ts=4 sw=4: */
@@ -0,0 +1,50 @@
+package main
+
+// MIT Licensed - see LICENSE
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+var webhookClient = &http.Client{Timeout: 10 * time.Second}
+
+// SignWebhook returns the hex encoded HMAC-SHA256 of "timestamp.body" keyed with secret.  The receiver
+// recomputes this from the X-QR-Timestamp header and the raw body and compares it to X-QR-Signature.
+func SignWebhook(secret string, ts int64, body []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	fmt.Fprintf(mac, "%d.", ts)
+	mac.Write(body)
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// postWebhookOnce makes one attempt at sending a signed JSON body to url and returns the HTTP status.
+// Retries are left to the queue, see RunHookQueue.
+func postWebhookOnce(url, secret, event string, body []byte) (status int, err error) {
+	ts := time.Now().Unix()
+	req, err := http.NewRequest("POST", url, bytes.NewReader(body))
+	if err != nil {
+		return 0, err
+	}
+	req.Header.Set("Content-Type", "application/json; charset=utf-8")
+	req.Header.Set("X-QR-Event", event)
+	req.Header.Set("X-QR-Timestamp", strconv.FormatInt(ts, 10))
+	req.Header.Set("X-QR-Signature", "sha256="+SignWebhook(secret, ts, body))
+	resp, err := webhookClient.Do(req)
+	if err != nil {
+		return 0, err
+	}
+	io.Copy(ioutil.Discard, resp.Body)
+	resp.Body.Close()
+	return resp.StatusCode, nil
+}
+
+/* vim: set noai ts=4 sw=4: */